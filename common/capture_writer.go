@@ -0,0 +1,54 @@
+package common
+
+import (
+	"bytes"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CaptureWriter 在写给客户端的同时保留一份响应，响应超过 maxBytes 时不再保留并标记为溢出
+type CaptureWriter struct {
+	gin.ResponseWriter
+	body     bytes.Buffer
+	maxBytes int
+	overflow bool
+}
+
+// NewCaptureWriter maxBytes 不大于 0 时不限制保留的大小
+func NewCaptureWriter(writer gin.ResponseWriter, maxBytes int) *CaptureWriter {
+	return &CaptureWriter{
+		ResponseWriter: writer,
+		maxBytes:       maxBytes,
+	}
+}
+
+func (w *CaptureWriter) capture(data []byte) {
+	if w.overflow {
+		return
+	}
+	if w.maxBytes > 0 && w.body.Len()+len(data) > w.maxBytes {
+		w.overflow = true
+		w.body.Reset()
+		return
+	}
+	w.body.Write(data)
+}
+
+func (w *CaptureWriter) Write(data []byte) (int, error) {
+	w.capture(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *CaptureWriter) WriteString(s string) (int, error) {
+	w.capture([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Body 返回保留的响应，溢出时为空
+func (w *CaptureWriter) Body() []byte {
+	return w.body.Bytes()
+}
+
+func (w *CaptureWriter) Overflow() bool {
+	return w.overflow
+}
@@ -146,6 +146,11 @@ func initConstantEnv() {
 	constant.ErrorLogEnabled = GetEnvOrDefaultBool("ERROR_LOG_ENABLED", false)
 	// 任务轮询时查询的最大数量
 	constant.TaskQueryLimit = GetEnvOrDefault("TASK_QUERY_LIMIT", 1000)
+	// Prometheus 指标接口，METRICS_TOKEN 不为空时需要以 Bearer Token 访问
+	constant.MetricsEnabled = GetEnvOrDefaultBool("METRICS_ENABLED", false)
+	constant.MetricsToken = GetEnvOrDefaultString("METRICS_TOKEN", "")
+	// OpenTelemetry 链路追踪，导出地址等使用标准的 OTEL_EXPORTER_OTLP_* 环境变量
+	constant.TracingEnabled = GetEnvOrDefaultBool("TRACING_ENABLED", false)
 
 	soraPatchStr := GetEnvOrDefaultString("TASK_PRICE_PATCH", "")
 	if soraPatchStr != "" {
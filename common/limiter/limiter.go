@@ -5,6 +5,7 @@ import (
 	_ "embed"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/QuantumNous/new-api/common"
 	"github.com/go-redis/redis/v8"
@@ -13,9 +14,17 @@ import (
 //go:embed lua/rate_limit.lua
 var rateLimitScript string
 
+//go:embed lua/token_bucket.lua
+var tokenBucketScript string
+
+//go:embed lua/concurrency.lua
+var concurrencyScript string
+
 type RedisLimiter struct {
-	client         *redis.Client
-	limitScriptSHA string
+	client               *redis.Client
+	limitScriptSHA       string
+	tokenBucketScriptSHA string
+	concurrencyScriptSHA string
 }
 
 var (
@@ -30,9 +39,19 @@ func New(ctx context.Context, r *redis.Client) *RedisLimiter {
 		if err != nil {
 			common.SysLog(fmt.Sprintf("Failed to load rate limit script: %v", err))
 		}
+		tokenBucketSHA, err := r.ScriptLoad(ctx, tokenBucketScript).Result()
+		if err != nil {
+			common.SysLog(fmt.Sprintf("Failed to load token bucket script: %v", err))
+		}
+		concurrencySHA, err := r.ScriptLoad(ctx, concurrencyScript).Result()
+		if err != nil {
+			common.SysLog(fmt.Sprintf("Failed to load concurrency script: %v", err))
+		}
 		instance = &RedisLimiter{
-			client:         r,
-			limitScriptSHA: limitSHA,
+			client:               r,
+			limitScriptSHA:       limitSHA,
+			tokenBucketScriptSHA: tokenBucketSHA,
+			concurrencyScriptSHA: concurrencySHA,
 		}
 	})
 
@@ -68,6 +87,62 @@ func (rl *RedisLimiter) Allow(ctx context.Context, key string, opts ...Option) (
 	return result == 1, nil
 }
 
+// Take 与 Allow 相同，同时返回扣除后桶内剩余的令牌数，用于返回限流响应头
+func (rl *RedisLimiter) Take(ctx context.Context, key string, opts ...Option) (bool, int64, error) {
+	config := &Config{
+		Capacity:  10,
+		Rate:      1,
+		Requested: 1,
+	}
+	for _, opt := range opts {
+		opt(config)
+	}
+
+	result, err := rl.client.EvalSha(
+		ctx,
+		rl.tokenBucketScriptSHA,
+		[]string{key},
+		config.Requested,
+		config.Rate,
+		config.Capacity,
+	).Int64Slice()
+	if err != nil {
+		return false, 0, fmt.Errorf("rate limit failed: %w", err)
+	}
+	return result[0] == 1, result[1], nil
+}
+
+// Acquire 占用一个并发名额，返回是否成功、当前并发数以及名额标识，成功后必须使用该标识调用 Release 释放
+func (rl *RedisLimiter) Acquire(ctx context.Context, key string, limit int64, ttl time.Duration) (bool, int64, string, error) {
+	member := common.GetUUID()
+	result, err := rl.client.EvalSha(
+		ctx,
+		rl.concurrencyScriptSHA,
+		[]string{key},
+		limit,
+		int64(ttl.Seconds()),
+		member,
+	).Int64Slice()
+	if err != nil {
+		return false, 0, "", fmt.Errorf("concurrency limit failed: %w", err)
+	}
+	return result[0] == 1, result[1], member, nil
+}
+
+// Refresh 延长 Acquire 占用的名额的过期时间，用于运行时间超过 ttl 的请求，名额已过期或已释放时不做任何操作
+func (rl *RedisLimiter) Refresh(ctx context.Context, key string, member string, ttl time.Duration) error {
+	pipe := rl.client.TxPipeline()
+	pipe.ZAddXX(ctx, key, &redis.Z{Score: float64(time.Now().Add(ttl).Unix()), Member: member})
+	pipe.Expire(ctx, key, ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Release 释放 Acquire 占用的名额，名额已过期时不做任何操作
+func (rl *RedisLimiter) Release(ctx context.Context, key string, member string) error {
+	return rl.client.ZRem(ctx, key, member).Err()
+}
+
 // Config 配置选项模式
 type Config struct {
 	Capacity  int64
@@ -0,0 +1,22 @@
+-- 并发数限制器，每个请求在有序集合中占用一个成员，分数为该名额的过期时间。
+-- 进程异常退出未释放的名额到期后即被清理，不会因为后续请求而续期
+-- KEYS[1]: 限制器唯一标识
+-- ARGV[1]: 最大并发数
+-- ARGV[2]: 名额过期时间 (秒)
+-- ARGV[3]: 本次请求的唯一标识，释放时使用
+
+local key = KEYS[1]
+local limit = tonumber(ARGV[1])
+local ttl = tonumber(ARGV[2])
+local member = ARGV[3]
+
+local now = tonumber(redis.call('TIME')[1])
+redis.call('ZREMRANGEBYSCORE', key, '-inf', now)
+local current = redis.call('ZCARD', key)
+if current >= limit then
+    return {0, current}
+end
+redis.call('ZADD', key, now + ttl, member)
+-- 最晚加入的名额过期后集合为空，整个 key 随之过期
+redis.call('EXPIRE', key, ttl)
+return {1, current + 1}
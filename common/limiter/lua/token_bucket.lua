@@ -0,0 +1,36 @@
+-- 令牌桶限流器，返回是否允许以及剩余令牌数
+-- KEYS[1]: 限流器唯一标识
+-- ARGV[1]: 请求令牌数
+-- ARGV[2]: 令牌生成速率 (每秒)
+-- ARGV[3]: 桶容量
+
+local key = KEYS[1]
+local requested = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local capacity = tonumber(ARGV[3])
+
+local now = redis.call('TIME')
+local nowInSeconds = tonumber(now[1])
+
+local bucket = redis.call('HMGET', key, 'tokens', 'last_time')
+local tokens = tonumber(bucket[1])
+local last_time = tonumber(bucket[2])
+
+if not tokens or not last_time then
+    tokens = capacity
+else
+    local elapsed = nowInSeconds - last_time
+    tokens = math.min(capacity, tokens + elapsed * rate)
+end
+
+local allowed = 0
+if tokens >= requested then
+    tokens = tokens - requested
+    allowed = 1
+end
+
+redis.call('HMSET', key, 'tokens', tokens, 'last_time', nowInSeconds)
+-- 桶回满后状态与新建时一致，可以直接过期
+redis.call('EXPIRE', key, math.ceil(capacity / rate) + 60)
+
+return {allowed, tokens}
@@ -0,0 +1,97 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+)
+
+const memoryLimiterSweepInterval = time.Minute
+
+// MemoryLimiter 未启用 Redis 时使用的内存限流器，令牌桶算法与 Redis 脚本一致
+type MemoryLimiter struct {
+	mu          sync.Mutex
+	buckets     map[string]*memoryBucket
+	concurrency map[string]int64
+	lastSweep   int64
+}
+
+type memoryBucket struct {
+	tokens   int64
+	lastTime int64
+	expireAt int64
+}
+
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{
+		buckets:     make(map[string]*memoryBucket),
+		concurrency: make(map[string]int64),
+	}
+}
+
+// sweep 清理已经回满的桶，调用方需持有锁
+func (l *MemoryLimiter) sweep(now int64) {
+	if now-l.lastSweep < int64(memoryLimiterSweepInterval.Seconds()) {
+		return
+	}
+	l.lastSweep = now
+	for key, bucket := range l.buckets {
+		if bucket.expireAt <= now {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Take 从令牌桶中扣除令牌，返回是否允许以及剩余令牌数
+func (l *MemoryLimiter) Take(key string, opts ...Option) (bool, int64) {
+	config := &Config{
+		Capacity:  10,
+		Rate:      1,
+		Requested: 1,
+	}
+	for _, opt := range opts {
+		opt(config)
+	}
+
+	now := time.Now().Unix()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &memoryBucket{tokens: config.Capacity, lastTime: now}
+		l.buckets[key] = bucket
+	} else {
+		bucket.tokens = min(config.Capacity, bucket.tokens+(now-bucket.lastTime)*config.Rate)
+		bucket.lastTime = now
+	}
+	allowed := false
+	if bucket.tokens >= config.Requested {
+		bucket.tokens -= config.Requested
+		allowed = true
+	}
+	bucket.expireAt = now + (config.Capacity-bucket.tokens)/max(config.Rate, 1) + 1
+	return allowed, bucket.tokens
+}
+
+// Acquire 占用一个并发名额，返回是否成功以及当前并发数，成功后必须调用 Release 释放
+func (l *MemoryLimiter) Acquire(key string, limit int64) (bool, int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	current := l.concurrency[key]
+	if current >= limit {
+		return false, current
+	}
+	l.concurrency[key] = current + 1
+	return true, current + 1
+}
+
+func (l *MemoryLimiter) Release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.concurrency[key] <= 1 {
+		delete(l.concurrency, key)
+		return
+	}
+	l.concurrency[key]--
+}
@@ -19,6 +19,11 @@ const (
 	ContextKeyTokenModelLimitEnabled ContextKey = "token_model_limit_enabled"
 	ContextKeyTokenModelLimit        ContextKey = "token_model_limit"
 	ContextKeyTokenCrossGroupRetry   ContextKey = "token_cross_group_retry"
+	ContextKeyTokenHedging           ContextKey = "token_hedging"
+	ContextKeyTokenRpmLimit          ContextKey = "token_rpm_limit"
+	ContextKeyTokenTpmLimit          ContextKey = "token_tpm_limit"
+	ContextKeyTokenConcurrencyLimit  ContextKey = "token_concurrency_limit"
+	ContextKeyTokenMiddleOut         ContextKey = "token_middle_out"
 
 	/* channel related keys */
 	ContextKeyChannelId                ContextKey = "channel_id"
@@ -37,11 +42,21 @@ const (
 	ContextKeyChannelIsMultiKey        ContextKey = "channel_is_multi_key"
 	ContextKeyChannelMultiKeyIndex     ContextKey = "channel_multi_key_index"
 	ContextKeyChannelKey               ContextKey = "channel_key"
+	// 请求引用的 Gemini 上下文缓存所在的 key 索引
+	ContextKeyGeminiCachedContentKeyIndex ContextKey = "gemini_cached_content_key_index"
 
 	ContextKeyAutoGroup           ContextKey = "auto_group"
 	ContextKeyAutoGroupIndex      ContextKey = "auto_group_index"
 	ContextKeyAutoGroupRetryIndex ContextKey = "auto_group_retry_index"
 
+	// 请求的虚拟模型名称、当前使用的模型在链中的位置，以及请求本身的分组
+	ContextKeyVirtualModel      ContextKey = "virtual_model"
+	ContextKeyVirtualModelIndex ContextKey = "virtual_model_index"
+	ContextKeyVirtualModelGroup ContextKey = "virtual_model_group"
+
+	// 请求需要的上下文（model.ContextRequirement），选择渠道时跳过上下文长度不足的渠道
+	ContextKeyContextRequirement ContextKey = "context_requirement"
+
 	/* user related keys */
 	ContextKeyUserId      ContextKey = "id"
 	ContextKeyUserSetting ContextKey = "user_setting"
@@ -59,4 +74,20 @@ const (
 	// ContextKeyAdminRejectReason stores an admin-only reject/block reason extracted from upstream responses.
 	// It is not returned to end users, but can be persisted into consume/error logs for debugging.
 	ContextKeyAdminRejectReason ContextKey = "admin_reject_reason"
+
+	// ContextKeyHedgeInfo stores the shared *relaycommon.HedgeInfo of a hedged request, written into consume logs.
+	ContextKeyHedgeInfo ContextKey = "hedge_info"
+
+	// ContextKeyRelayFailed marks a relay that ended with an error, even if a 200 stream was already sent.
+	ContextKeyRelayFailed ContextKey = "relay_failed"
+	// ContextKeyStreamErrorSent marks that an error event has already been written into the stream.
+	ContextKeyStreamErrorSent ContextKey = "stream_error_sent"
+
+	// ContextKeyNativeBatch marks a request executed in-process by a gateway batch, billed with the batch ratio.
+	ContextKeyNativeBatch ContextKey = "native_batch"
+
+	// ContextKeyResponseCacheKey is the response cache key computed before channel selection; empty when the request is not cacheable.
+	ContextKeyResponseCacheKey ContextKey = "response_cache_key"
+	// ContextKeyResponseCacheEntry stores the *service.ResponseCacheEntry hit before channel selection; no channel is selected for it.
+	ContextKeyResponseCacheEntry ContextKey = "response_cache_entry"
 )
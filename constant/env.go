@@ -17,6 +17,9 @@ var NotificationLimitDurationMinute int
 var GenerateDefaultToken bool
 var ErrorLogEnabled bool
 var TaskQueryLimit int
+var MetricsEnabled bool
+var MetricsToken string
+var TracingEnabled bool
 
 // temporary variable for sora patch, will be removed in future
 var TaskPricePatches []string
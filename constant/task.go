@@ -3,8 +3,10 @@ package constant
 type TaskPlatform string
 
 const (
-	TaskPlatformSuno       TaskPlatform = "suno"
-	TaskPlatformMidjourney              = "mj"
+	TaskPlatformSuno        TaskPlatform = "suno"
+	TaskPlatformMidjourney               = "mj"
+	TaskPlatformOpenAIBatch TaskPlatform = "openai_batch"
+	TaskPlatformFineTuning  TaskPlatform = "openai_fine_tuning"
 )
 
 const (
@@ -16,6 +18,10 @@ const (
 	TaskActionFirstTailGenerate = "firstTailGenerate"
 	TaskActionReferenceGenerate = "referenceGenerate"
 	TaskActionRemix             = "remixGenerate"
+
+	TaskActionBatch       = "batch"       // 上游原生 batch 接口
+	TaskActionNativeBatch = "nativeBatch" // 网关逐行转发执行的 batch
+	TaskActionFineTuning  = "fineTuning"
 )
 
 var SunoModel2Action = map[string]string{
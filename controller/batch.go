@@ -0,0 +1,277 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/middleware"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/relay"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+const batchListMaxLimit = 100
+
+// getUserBatchTask 查询当前用户的 batch，不存在或不属于该用户时直接返回 404
+func getUserBatchTask(c *gin.Context) (*model.Task, bool) {
+	batchId := c.Param("id")
+	userId := common.GetContextKeyInt(c, constant.ContextKeyUserId)
+	task, exist, err := model.GetByTaskId(userId, batchId)
+	if err != nil {
+		respondPlatformError(c, types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry()))
+		return nil, false
+	}
+	if !exist || task.Platform != constant.TaskPlatformOpenAIBatch {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": types.OpenAIError{
+				Message: fmt.Sprintf("No batch found with id '%s'.", batchId),
+				Type:    "invalid_request_error",
+				Param:   "id",
+			},
+		})
+		return nil, false
+	}
+	return task, true
+}
+
+func RelayBatchCreate(c *gin.Context) {
+	if newAPIError := relay.BatchCreateHelper(c); newAPIError != nil {
+		respondPlatformError(c, newAPIError)
+	}
+}
+
+func RelayBatchRetrieve(c *gin.Context) {
+	task, ok := getUserBatchTask(c)
+	if !ok {
+		return
+	}
+	if newAPIError := relay.BatchRetrieveHelper(c, task); newAPIError != nil {
+		respondPlatformError(c, newAPIError)
+	}
+}
+
+func RelayBatchCancel(c *gin.Context) {
+	task, ok := getUserBatchTask(c)
+	if !ok {
+		return
+	}
+	if newAPIError := relay.BatchCancelHelper(c, task); newAPIError != nil {
+		respondPlatformError(c, newAPIError)
+	}
+}
+
+// RelayBatchList batch 列表由本地任务表提供，状态以最近一次同步为准
+func RelayBatchList(c *gin.Context) {
+	userId := common.GetContextKeyInt(c, constant.ContextKeyUserId)
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit <= 0 {
+		limit = 20
+	}
+	if limit > batchListMaxLimit {
+		limit = batchListMaxLimit
+	}
+	tasks, err := model.GetUserTasksByPlatform(userId, constant.TaskPlatformOpenAIBatch, c.Query("after"), limit+1)
+	if err != nil {
+		respondPlatformError(c, types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry()))
+		return
+	}
+	hasMore := len(tasks) > limit
+	if hasMore {
+		tasks = tasks[:limit]
+	}
+	response := dto.OpenAIBatchList{
+		Object:  "list",
+		Data:    make([]dto.OpenAIBatch, 0, len(tasks)),
+		HasMore: hasMore,
+	}
+	for _, task := range tasks {
+		var batch dto.OpenAIBatch
+		if err := task.GetData(&batch); err != nil {
+			continue
+		}
+		response.Data = append(response.Data, batch)
+	}
+	if len(response.Data) > 0 {
+		response.FirstId = response.Data[0].Id
+		response.LastId = response.Data[len(response.Data)-1].Id
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// UpdateBatchTaskAll 同步上游 batch 状态并在结束时结算；网关执行的 batch 由本节点启动
+func UpdateBatchTaskAll(ctx context.Context, taskChannelM map[int][]string, taskM map[string]*model.Task) error {
+	for channelId, taskIds := range taskChannelM {
+		channel, err := model.GetChannelById(channelId, true)
+		if err != nil {
+			logger.LogError(ctx, fmt.Sprintf("渠道 #%d 获取失败，跳过 batch 同步: %s", channelId, err.Error()))
+			continue
+		}
+		for _, taskId := range taskIds {
+			task := taskM[taskId]
+			if task.Action == constant.TaskActionNativeBatch {
+				if service.IsNativeBatchRunning(task.TaskID) {
+					continue
+				}
+				if task.Status == model.TaskStatusInProgress {
+					service.FailInterruptedNativeBatch(task)
+					continue
+				}
+				service.StartNativeBatch(task, relayNativeBatchLine)
+				continue
+			}
+			if err := updateUpstreamBatchTask(ctx, channel, task); err != nil {
+				logger.LogError(ctx, fmt.Sprintf("batch %s 同步失败: %s", task.TaskID, err.Error()))
+			}
+		}
+	}
+	return nil
+}
+
+type nativeBatchTokenKey struct{}
+
+// nativeBatchRouter 网关执行 batch 时在进程内转发每一行请求，只经过令牌校验与渠道选择，不经过幂等、限流与排队
+var nativeBatchRouter = sync.OnceValue(func() *gin.Engine {
+	router := gin.New()
+	relayRouter := router.Group("/v1", middleware.RequestId(), middleware.BodyStorageCleanup(), nativeBatchAuth, middleware.Distribute())
+	relayRouter.POST("/chat/completions", func(c *gin.Context) {
+		Relay(c, types.RelayFormatOpenAI)
+	})
+	relayRouter.POST("/completions", func(c *gin.Context) {
+		Relay(c, types.RelayFormatOpenAI)
+	})
+	relayRouter.POST("/embeddings", func(c *gin.Context) {
+		Relay(c, types.RelayFormatEmbedding)
+	})
+	relayRouter.POST("/responses", func(c *gin.Context) {
+		Relay(c, types.RelayFormatOpenAIResponses)
+	})
+	return router
+})
+
+// nativeBatchAuth 按 batch 所属令牌校验并标记为 batch 请求，按 batch 倍率计费
+func nativeBatchAuth(c *gin.Context) {
+	tokenKey, _ := c.Request.Context().Value(nativeBatchTokenKey{}).(string)
+	if !middleware.NativeBatchAuth(c, tokenKey) {
+		return
+	}
+	common.SetContextKey(c, constant.ContextKeyNativeBatch, true)
+	c.Next()
+}
+
+func relayNativeBatchLine(ctx context.Context, tokenKey string, method string, path string, body []byte) (int, string, []byte) {
+	req, err := http.NewRequestWithContext(context.WithValue(ctx, nativeBatchTokenKey{}, tokenKey), method, path, bytes.NewReader(body))
+	if err != nil {
+		responseBody, _ := common.Marshal(gin.H{"error": types.OpenAIError{Message: err.Error(), Type: "invalid_request_error"}})
+		return http.StatusBadRequest, "", responseBody
+	}
+	req.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	nativeBatchRouter().ServeHTTP(recorder, req)
+	return recorder.Code, recorder.Header().Get(common.RequestIdKey), recorder.Body.Bytes()
+}
+
+func updateUpstreamBatchTask(ctx context.Context, channel *model.Channel, task *model.Task) error {
+	key := task.PrivateData.Key
+	if key == "" {
+		var newAPIError *types.NewAPIError
+		key, _, newAPIError = channel.GetNextEnabledKey()
+		if newAPIError != nil {
+			return newAPIError
+		}
+	}
+	resp, err := service.DoPlatformRequest(ctx, channel, key, http.MethodGet, "/v1/batches/"+task.TaskID, nil, "")
+	if err != nil {
+		return err
+	}
+	responseBody, err := io.ReadAll(resp.Body)
+	service.CloseResponseBodyGracefully(resp)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status code %d: %s", resp.StatusCode, string(responseBody))
+	}
+	var batch dto.OpenAIBatch
+	if err := common.Unmarshal(responseBody, &batch); err != nil {
+		return err
+	}
+	task.Data = responseBody
+	if batch.RequestCounts.Total > 0 {
+		done := batch.RequestCounts.Completed + batch.RequestCounts.Failed
+		task.Progress = fmt.Sprintf("%d%%", done*99/batch.RequestCounts.Total)
+	}
+	if !batch.IsFinished() {
+		if batch.Status != dto.BatchStatusValidating {
+			task.Status = model.TaskStatusInProgress
+			if task.StartTime == 0 {
+				task.StartTime = common.GetTimestamp()
+			}
+		}
+		return task.Update()
+	}
+
+	fromStatus := task.Status
+	var usages map[string]*service.BatchModelUsage
+	// 输出文件登记到文件映射表，用户才能下载
+	if _, err := service.RegisterUpstreamFile(ctx, channel, key, batch.OutputFileId, task.UserId, task.PrivateData.TokenId, task.Group); err != nil {
+		return fmt.Errorf("register output file failed: %w", err)
+	}
+	if _, err := service.RegisterUpstreamFile(ctx, channel, key, batch.ErrorFileId, task.UserId, task.PrivateData.TokenId, task.Group); err != nil {
+		return fmt.Errorf("register error file failed: %w", err)
+	}
+	if batch.OutputFileId != "" {
+		resp, err := service.DoPlatformRequest(ctx, channel, key, http.MethodGet, "/v1/files/"+batch.OutputFileId+"/content", nil, "")
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			service.CloseResponseBodyGracefully(resp)
+			return fmt.Errorf("download output file failed, status code %d", resp.StatusCode)
+		}
+		// 逐行读取输出文件计算用量，不在内存中保存整个文件
+		usages, err = service.CalcBatchOutputQuota(resp.Body, task.Group)
+		service.CloseResponseBodyGracefully(resp)
+		if err != nil {
+			return err
+		}
+		task.Quota = service.SumBatchQuota(usages)
+	}
+
+	if batch.Status == dto.BatchStatusCompleted {
+		task.Status = model.TaskStatusSuccess
+	} else {
+		task.Status = model.TaskStatusFailure
+		task.FailReason = batch.Status
+		if batch.Errors != nil && len(batch.Errors.Data) > 0 {
+			task.FailReason = batch.Errors.Data[0].Message
+		}
+	}
+	task.Progress = "100%"
+	task.FinishTime = common.GetTimestamp()
+	// 先保存结束状态再扣费，状态已被其他轮询改变时说明已经结算过
+	updated, err := task.UpdateWithStatus(fromStatus)
+	if err != nil {
+		return err
+	}
+	if !updated {
+		return nil
+	}
+	if len(usages) > 0 {
+		service.SettleBatchQuota(task, batch.Id, usages)
+		logger.LogInfo(ctx, fmt.Sprintf("batch %s 结算完成，扣除 %s", batch.Id, logger.LogQuota(task.Quota)))
+	}
+	return nil
+}
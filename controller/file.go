@@ -0,0 +1,146 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/relay"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+const fileListMaxLimit = 10000
+
+// respondPlatformError 以 OpenAI 格式返回 files / batches 等平台接口的错误
+func respondPlatformError(c *gin.Context, newAPIError *types.NewAPIError) {
+	requestId := c.GetString(common.RequestIdKey)
+	logger.LogError(c, fmt.Sprintf("relay error: %s", newAPIError.Error()))
+	newAPIError.SetMessage(common.MessageWithRequestId(newAPIError.Error(), requestId))
+	c.JSON(newAPIError.StatusCode, gin.H{
+		"error": newAPIError.ToOpenAIError(),
+	})
+}
+
+// getUserFile 查询当前用户的文件，不存在或不属于该用户时直接返回 404
+func getUserFile(c *gin.Context) (*model.File, bool) {
+	fileId := c.Param("id")
+	userId := common.GetContextKeyInt(c, constant.ContextKeyUserId)
+	file, exist, err := model.GetUserFileByFileId(userId, fileId)
+	if err != nil {
+		respondPlatformError(c, types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry()))
+		return nil, false
+	}
+	if !exist {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": types.OpenAIError{
+				Message: fmt.Sprintf("No such File object: %s", fileId),
+				Type:    "invalid_request_error",
+				Param:   "id",
+			},
+		})
+		return nil, false
+	}
+	return file, true
+}
+
+func toOpenAIFile(file *model.File) dto.OpenAIFile {
+	return dto.OpenAIFile{
+		Id:        file.FileId,
+		Object:    "file",
+		Bytes:     file.Bytes,
+		CreatedAt: file.CreatedAt,
+		ExpiresAt: file.ExpiresAt,
+		Filename:  file.Filename,
+		Purpose:   file.Purpose,
+	}
+}
+
+func RelayFileUpload(c *gin.Context) {
+	if newAPIError := relay.FileUploadHelper(c); newAPIError != nil {
+		respondPlatformError(c, newAPIError)
+	}
+}
+
+// RelayFileList 文件列表直接由本地映射表提供，只返回当前用户上传的文件
+func RelayFileList(c *gin.Context) {
+	userId := common.GetContextKeyInt(c, constant.ContextKeyUserId)
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit <= 0 || limit > fileListMaxLimit {
+		limit = fileListMaxLimit
+	}
+	files, err := model.GetUserFiles(userId, c.Query("purpose"), c.Query("after"), limit+1, c.Query("order"))
+	if err != nil {
+		respondPlatformError(c, types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry()))
+		return
+	}
+	hasMore := len(files) > limit
+	if hasMore {
+		files = files[:limit]
+	}
+	response := dto.OpenAIFileList{
+		Object:  "list",
+		Data:    make([]dto.OpenAIFile, 0, len(files)),
+		HasMore: hasMore,
+	}
+	for _, file := range files {
+		response.Data = append(response.Data, toOpenAIFile(file))
+	}
+	if len(response.Data) > 0 {
+		response.FirstId = response.Data[0].Id
+		response.LastId = response.Data[len(response.Data)-1].Id
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func RelayFileRetrieve(c *gin.Context) {
+	file, ok := getUserFile(c)
+	if !ok {
+		return
+	}
+	if newAPIError := relay.FileRetrieveHelper(c, file); newAPIError != nil {
+		respondPlatformError(c, newAPIError)
+	}
+}
+
+func RelayFileContent(c *gin.Context) {
+	file, ok := getUserFile(c)
+	if !ok {
+		return
+	}
+	if newAPIError := relay.FileContentHelper(c, file); newAPIError != nil {
+		respondPlatformError(c, newAPIError)
+	}
+}
+
+func RelayFileDelete(c *gin.Context) {
+	file, ok := getUserFile(c)
+	if !ok {
+		return
+	}
+	if newAPIError := relay.FileDeleteHelper(c, file); newAPIError != nil {
+		respondPlatformError(c, newAPIError)
+	}
+}
+
+// UpdateFileStorageBilling 定期结算文件存储费用
+func UpdateFileStorageBilling() {
+	for {
+		interval := operation_setting.GetFileSetting().StorageBillingInterval
+		if interval <= 0 {
+			interval = 60
+		}
+		time.Sleep(time.Duration(interval) * time.Minute)
+		common.SysLog("文件存储计费开始")
+		service.SettleAllFileStorage()
+	}
+}
@@ -0,0 +1,217 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/relay"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+const fineTuningListMaxLimit = 100
+
+// getUserFineTuningTask 查询当前用户的微调任务，不存在或不属于该用户时直接返回 404
+func getUserFineTuningTask(c *gin.Context) (*model.Task, bool) {
+	jobId := c.Param("id")
+	userId := common.GetContextKeyInt(c, constant.ContextKeyUserId)
+	task, exist, err := model.GetByTaskId(userId, jobId)
+	if err != nil {
+		respondPlatformError(c, types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry()))
+		return nil, false
+	}
+	if !exist || task.Platform != constant.TaskPlatformFineTuning {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": types.OpenAIError{
+				Message: fmt.Sprintf("Could not find fine tune: %s", jobId),
+				Type:    "invalid_request_error",
+				Param:   "fine_tune_id",
+			},
+		})
+		return nil, false
+	}
+	return task, true
+}
+
+func RelayFineTuningCreate(c *gin.Context) {
+	if newAPIError := relay.FineTuningCreateHelper(c); newAPIError != nil {
+		respondPlatformError(c, newAPIError)
+	}
+}
+
+func RelayFineTuningRetrieve(c *gin.Context) {
+	task, ok := getUserFineTuningTask(c)
+	if !ok {
+		return
+	}
+	if newAPIError := relay.FineTuningRetrieveHelper(c, task); newAPIError != nil {
+		respondPlatformError(c, newAPIError)
+	}
+}
+
+func RelayFineTuningCancel(c *gin.Context) {
+	task, ok := getUserFineTuningTask(c)
+	if !ok {
+		return
+	}
+	if newAPIError := relay.FineTuningCancelHelper(c, task); newAPIError != nil {
+		respondPlatformError(c, newAPIError)
+	}
+}
+
+func RelayFineTuningEvents(c *gin.Context) {
+	task, ok := getUserFineTuningTask(c)
+	if !ok {
+		return
+	}
+	if newAPIError := relay.FineTuningSubResourceHelper(c, task, "events"); newAPIError != nil {
+		respondPlatformError(c, newAPIError)
+	}
+}
+
+func RelayFineTuningCheckpoints(c *gin.Context) {
+	task, ok := getUserFineTuningTask(c)
+	if !ok {
+		return
+	}
+	if newAPIError := relay.FineTuningSubResourceHelper(c, task, "checkpoints"); newAPIError != nil {
+		respondPlatformError(c, newAPIError)
+	}
+}
+
+// RelayFineTuningList 微调任务列表由本地任务表提供，状态以最近一次同步为准
+func RelayFineTuningList(c *gin.Context) {
+	userId := common.GetContextKeyInt(c, constant.ContextKeyUserId)
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit <= 0 {
+		limit = 20
+	}
+	if limit > fineTuningListMaxLimit {
+		limit = fineTuningListMaxLimit
+	}
+	tasks, err := model.GetUserTasksByPlatform(userId, constant.TaskPlatformFineTuning, c.Query("after"), limit+1)
+	if err != nil {
+		respondPlatformError(c, types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry()))
+		return
+	}
+	hasMore := len(tasks) > limit
+	if hasMore {
+		tasks = tasks[:limit]
+	}
+	response := dto.FineTuningJobList{
+		Object:  "list",
+		Data:    make([]dto.FineTuningJob, 0, len(tasks)),
+		HasMore: hasMore,
+	}
+	for _, task := range tasks {
+		var job dto.FineTuningJob
+		if err := task.GetData(&job); err != nil {
+			continue
+		}
+		response.Data = append(response.Data, job)
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// UpdateFineTuningTaskAll 同步上游微调任务状态，成功后登记微调模型并结算训练费用
+func UpdateFineTuningTaskAll(ctx context.Context, taskChannelM map[int][]string, taskM map[string]*model.Task) error {
+	for channelId, taskIds := range taskChannelM {
+		channel, err := model.GetChannelById(channelId, true)
+		if err != nil {
+			logger.LogError(ctx, fmt.Sprintf("渠道 #%d 获取失败，跳过微调任务同步: %s", channelId, err.Error()))
+			continue
+		}
+		for _, taskId := range taskIds {
+			if err := updateFineTuningTask(ctx, channel, taskM[taskId]); err != nil {
+				logger.LogError(ctx, fmt.Sprintf("微调任务 %s 同步失败: %s", taskId, err.Error()))
+			}
+		}
+	}
+	return nil
+}
+
+func updateFineTuningTask(ctx context.Context, channel *model.Channel, task *model.Task) error {
+	key := task.PrivateData.Key
+	if key == "" {
+		var newAPIError *types.NewAPIError
+		key, _, newAPIError = channel.GetNextEnabledKey()
+		if newAPIError != nil {
+			return newAPIError
+		}
+	}
+	resp, err := service.DoPlatformRequest(ctx, channel, key, http.MethodGet, "/v1/fine_tuning/jobs/"+task.TaskID, nil, "")
+	if err != nil {
+		return err
+	}
+	responseBody, err := io.ReadAll(resp.Body)
+	service.CloseResponseBodyGracefully(resp)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status code %d: %s", resp.StatusCode, string(responseBody))
+	}
+	var job dto.FineTuningJob
+	if err := common.Unmarshal(responseBody, &job); err != nil {
+		return err
+	}
+	task.Data = responseBody
+	if !job.IsFinished() {
+		if job.Status == dto.FineTuningStatusRunning {
+			task.Status = model.TaskStatusInProgress
+			if task.StartTime == 0 {
+				task.StartTime = common.GetTimestamp()
+			}
+		} else {
+			task.Status = model.TaskStatusQueued
+		}
+		return task.Update()
+	}
+
+	fromStatus := task.Status
+	// 训练结果文件登记到文件映射表，用户才能下载
+	for _, fileId := range job.ResultFiles {
+		if _, err := service.RegisterUpstreamFile(ctx, channel, key, fileId, task.UserId, task.PrivateData.TokenId, task.Group); err != nil {
+			return fmt.Errorf("register result file failed: %w", err)
+		}
+	}
+	if job.Status == dto.FineTuningStatusSucceeded {
+		if err := service.RegisterFineTunedModel(task, &job); err != nil {
+			return fmt.Errorf("register fine-tuned model failed: %w", err)
+		}
+		task.Status = model.TaskStatusSuccess
+	} else {
+		task.Status = model.TaskStatusFailure
+		task.FailReason = job.Status
+		if job.Error != nil && job.Error.Message != "" {
+			task.FailReason = job.Error.Message
+		}
+	}
+	// 失败或取消的任务上游同样会对已训练的 token 计费
+	task.Quota, _ = service.CalcFineTuningQuota(job.Model, job.TrainedTokens, task.Group)
+	task.Progress = "100%"
+	task.FinishTime = common.GetTimestamp()
+	// 先保存结束状态再扣费，状态已被其他轮询改变时说明已经结算过
+	updated, err := task.UpdateWithStatus(fromStatus)
+	if err != nil {
+		return err
+	}
+	if !updated {
+		return nil
+	}
+	if task.Quota > 0 {
+		service.SettleFineTuningQuota(task, &job)
+		logger.LogInfo(ctx, fmt.Sprintf("微调任务 %s 结算完成，扣除 %s", job.Id, logger.LogQuota(task.Quota)))
+	}
+	return nil
+}
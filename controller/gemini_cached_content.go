@@ -0,0 +1,138 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/relay"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+const geminiCachedContentListMaxPageSize = 1000
+
+// getUserGeminiCachedContent 查询当前用户创建的上下文缓存，不存在或不属于该用户时直接返回 404
+func getUserGeminiCachedContent(c *gin.Context) (*model.GeminiCachedContent, bool) {
+	name := "cachedContents/" + c.Param("id")
+	userId := common.GetContextKeyInt(c, constant.ContextKeyUserId)
+	cachedContent, exist, err := model.GetUserGeminiCachedContentByName(userId, name)
+	if err != nil {
+		respondPlatformError(c, types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry()))
+		return nil, false
+	}
+	if !exist {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": types.OpenAIError{
+				Message: fmt.Sprintf("CachedContent not found: %s", name),
+				Type:    "invalid_request_error",
+				Param:   "name",
+			},
+		})
+		return nil, false
+	}
+	return cachedContent, true
+}
+
+func toGeminiCachedContent(cachedContent *model.GeminiCachedContent) dto.GeminiCachedContent {
+	return dto.GeminiCachedContent{
+		Name:        cachedContent.Name,
+		Model:       "models/" + cachedContent.Model,
+		DisplayName: cachedContent.DisplayName,
+		CreateTime:  time.Unix(cachedContent.CreatedAt, 0).UTC().Format(time.RFC3339),
+		UpdateTime:  time.Unix(cachedContent.UpdatedAt, 0).UTC().Format(time.RFC3339),
+		ExpireTime:  time.Unix(cachedContent.ExpiresAt, 0).UTC().Format(time.RFC3339),
+		UsageMetadata: &dto.GeminiCachedContentUsageMetadata{
+			TotalTokenCount: cachedContent.TotalTokens,
+		},
+	}
+}
+
+func RelayGeminiCachedContentCreate(c *gin.Context) {
+	if newAPIError := relay.GeminiCachedContentCreateHelper(c); newAPIError != nil {
+		respondPlatformError(c, newAPIError)
+	}
+}
+
+// RelayGeminiCachedContentList 缓存列表直接由本地映射表提供，只返回当前用户创建的未过期缓存，pageToken 为上一页最后一条记录的 id
+func RelayGeminiCachedContentList(c *gin.Context) {
+	userId := common.GetContextKeyInt(c, constant.ContextKeyUserId)
+	pageSize, _ := strconv.Atoi(c.Query("pageSize"))
+	if pageSize <= 0 {
+		pageSize = 50
+	}
+	if pageSize > geminiCachedContentListMaxPageSize {
+		pageSize = geminiCachedContentListMaxPageSize
+	}
+	afterId, _ := strconv.Atoi(c.Query("pageToken"))
+	cachedContents, err := model.GetUserGeminiCachedContents(userId, afterId, pageSize+1)
+	if err != nil {
+		respondPlatformError(c, types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry()))
+		return
+	}
+	hasMore := len(cachedContents) > pageSize
+	if hasMore {
+		cachedContents = cachedContents[:pageSize]
+	}
+	response := dto.GeminiCachedContentList{
+		CachedContents: make([]dto.GeminiCachedContent, 0, len(cachedContents)),
+	}
+	for _, cachedContent := range cachedContents {
+		response.CachedContents = append(response.CachedContents, toGeminiCachedContent(cachedContent))
+	}
+	if hasMore {
+		response.NextPageToken = strconv.Itoa(cachedContents[len(cachedContents)-1].Id)
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func RelayGeminiCachedContentRetrieve(c *gin.Context) {
+	cachedContent, ok := getUserGeminiCachedContent(c)
+	if !ok {
+		return
+	}
+	if newAPIError := relay.GeminiCachedContentRetrieveHelper(c, cachedContent); newAPIError != nil {
+		respondPlatformError(c, newAPIError)
+	}
+}
+
+func RelayGeminiCachedContentUpdate(c *gin.Context) {
+	cachedContent, ok := getUserGeminiCachedContent(c)
+	if !ok {
+		return
+	}
+	if newAPIError := relay.GeminiCachedContentUpdateHelper(c, cachedContent); newAPIError != nil {
+		respondPlatformError(c, newAPIError)
+	}
+}
+
+func RelayGeminiCachedContentDelete(c *gin.Context) {
+	cachedContent, ok := getUserGeminiCachedContent(c)
+	if !ok {
+		return
+	}
+	if newAPIError := relay.GeminiCachedContentDeleteHelper(c, cachedContent); newAPIError != nil {
+		respondPlatformError(c, newAPIError)
+	}
+}
+
+// UpdateGeminiCacheStorageBilling 定期结算 Gemini 上下文缓存的存储费用
+func UpdateGeminiCacheStorageBilling() {
+	for {
+		interval := operation_setting.GetGeminiCacheSetting().StorageBillingInterval
+		if interval <= 0 {
+			interval = 60
+		}
+		time.Sleep(time.Duration(interval) * time.Minute)
+		common.SysLog("Gemini 上下文缓存存储计费开始")
+		service.SettleAllGeminiCacheStorage()
+	}
+}
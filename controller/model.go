@@ -133,7 +133,8 @@ func ListModels(c *gin.Context, modelType int) {
 			tokenModelLimit = map[string]bool{}
 		}
 		for allowModel, _ := range tokenModelLimit {
-			if !acceptUnsetRatioModel {
+			_, isVirtual := operation_setting.GetVirtualModelChain(allowModel)
+			if !acceptUnsetRatioModel && !isVirtual {
 				_, _, exist := ratio_setting.GetModelRatioOrPrice(allowModel)
 				if !exist {
 					continue
@@ -200,7 +201,25 @@ func ListModels(c *gin.Context, modelType int) {
 				})
 			}
 		}
+		// 虚拟模型按链中实际使用的模型计费，因此不检查倍率
+		for _, virtualModel := range operation_setting.GetVirtualModelNames() {
+			chain, _ := operation_setting.GetVirtualModelChain(virtualModel)
+			if len(chain) == 0 || common.StringsContains(models, virtualModel) {
+				continue
+			}
+			userOpenAiModels = append(userOpenAiModels, dto.OpenAIModels{
+				Id:                     virtualModel,
+				Object:                 "model",
+				Created:                1626777600,
+				OwnedBy:                "custom",
+				SupportedEndpointTypes: model.GetModelSupportEndpointTypes(chain[0].Model),
+			})
+		}
 	}
+	// 其他用户训练的微调模型不对外展示
+	userOpenAiModels = lo.Filter(userOpenAiModels, func(m dto.OpenAIModels, _ int) bool {
+		return service.CanUseFineTunedModel(c, m.Id)
+	})
 
 	switch modelType {
 	case constant.ChannelTypeAnthropic:
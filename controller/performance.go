@@ -7,6 +7,7 @@ import (
 	"runtime"
 
 	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/service"
 	"github.com/gin-gonic/gin"
 )
 
@@ -22,6 +23,8 @@ type PerformanceStats struct {
 	DiskSpaceInfo DiskSpaceInfo `json:"disk_space_info"`
 	// 配置信息
 	Config PerformanceConfig `json:"config"`
+	// 渠道限流时的排队统计
+	RelayQueueStats []service.RelayQueueStat `json:"relay_queue_stats"`
 }
 
 // MemoryStats 内存统计
@@ -110,9 +113,10 @@ func GetPerformanceStats(c *gin.Context) {
 			NumGC:        memStats.NumGC,
 			NumGoroutine: runtime.NumGoroutine(),
 		},
-		DiskCacheInfo: diskCacheInfo,
-		DiskSpaceInfo: diskSpaceInfo,
-		Config:        config,
+		DiskCacheInfo:   diskCacheInfo,
+		DiskSpaceInfo:   diskSpaceInfo,
+		Config:          config,
+		RelayQueueStats: service.GetRelayQueueStats(),
 	}
 
 	c.JSON(http.StatusOK, gin.H{
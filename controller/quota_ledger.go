@@ -0,0 +1,38 @@
+package controller
+
+import (
+	"strconv"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/model"
+
+	"github.com/bytedance/gopkg/util/gopool"
+	"github.com/gin-gonic/gin"
+)
+
+// GetQuotaLedgers 按账户、主体、来源或关联单号查询额度账本分录
+func GetQuotaLedgers(c *gin.Context) {
+	pageInfo := common.GetPageQuery(c)
+	subjectId, _ := strconv.Atoi(c.Query("subject_id"))
+	ledgers, total, err := model.GetQuotaLedgers(c.Query("account"), subjectId, c.Query("source"), c.Query("ref_id"), pageInfo)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	pageInfo.SetTotal(int(total))
+	pageInfo.SetItems(ledgers)
+	common.ApiSuccess(c, pageInfo)
+}
+
+// GetQuotaLedgerReconciliation 获取本节点最近一次对账报告
+func GetQuotaLedgerReconciliation(c *gin.Context) {
+	common.ApiSuccess(c, model.GetQuotaLedgerReconcileReport())
+}
+
+// ReconcileQuotaLedger 立即在后台对账，结果通过 GetQuotaLedgerReconciliation 查询
+func ReconcileQuotaLedger(c *gin.Context) {
+	gopool.Go(func() {
+		model.ReconcileQuotaLedger()
+	})
+	common.ApiSuccess(c, nil)
+}
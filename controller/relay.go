@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/QuantumNous/new-api/common"
 	"github.com/QuantumNous/new-api/constant"
@@ -15,6 +16,7 @@ import (
 	"github.com/QuantumNous/new-api/logger"
 	"github.com/QuantumNous/new-api/middleware"
 	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/pkg/metrics"
 	"github.com/QuantumNous/new-api/relay"
 	relaycommon "github.com/QuantumNous/new-api/relay/common"
 	relayconstant "github.com/QuantumNous/new-api/relay/constant"
@@ -87,7 +89,16 @@ func Relay(c *gin.Context, relayFormat types.RelayFormat) {
 	defer func() {
 		if newAPIError != nil {
 			logger.LogError(c, fmt.Sprintf("relay error: %s", newAPIError.Error()))
+			common.SetContextKey(c, constant.ContextKeyRelayFailed, true)
+			if helper.IsStreamErrorSent(c) {
+				return
+			}
 			newAPIError.SetMessage(common.MessageWithRequestId(newAPIError.Error(), requestId))
+			// 已经开始发送流式响应（如排队时的 SSE ping）时只能以错误事件的形式返回
+			if relayFormat != types.RelayFormatOpenAIRealtime && helper.IsStreamStarted(c) {
+				helper.StreamErrorData(c, relayFormat, newAPIError)
+				return
+			}
 			switch relayFormat {
 			case types.RelayFormatOpenAIRealtime:
 				helper.WssError(c, ws, newAPIError.ToOpenAIError())
@@ -121,6 +132,11 @@ func Relay(c *gin.Context, relayFormat types.RelayFormat) {
 		return
 	}
 
+	// previous_response_id 在估算 token 之前展开，预扣费与渠道筛选按完整的输入计算
+	if newAPIError = relay.ExpandPreviousResponse(relayInfo); newAPIError != nil {
+		return
+	}
+
 	needSensitiveCheck := setting.ShouldCheckPromptSensitive()
 	needCountToken := constant.CountToken
 	// Avoid building huge CombineText (strings.Join) when token counting and sensitive check are both disabled.
@@ -146,7 +162,18 @@ func Relay(c *gin.Context, relayFormat types.RelayFormat) {
 		return
 	}
 
+	if tokens, meta, newAPIError = service.ApplyMiddleOut(c, relayInfo, request, tokens, meta); newAPIError != nil {
+		return
+	}
 	relayInfo.SetEstimatePromptTokens(tokens)
+	if tokens > 0 && model.HasModelContextLimits() {
+		// 重试时按转发时的估算跳过上下文长度不足的渠道
+		common.SetContextKey(c, constant.ContextKeyContextRequirement, model.ContextRequirement{PromptTokens: tokens, MaxTokens: meta.MaxTokens})
+	}
+
+	if newAPIError = service.CheckTokenTpmLimit(c, tokens); newAPIError != nil {
+		return
+	}
 
 	priceData, err := helper.ModelPriceHelper(c, relayInfo, tokens, meta)
 	if err != nil {
@@ -163,6 +190,7 @@ func Relay(c *gin.Context, relayFormat types.RelayFormat) {
 		if newAPIError != nil {
 			return
 		}
+		relayInfo.StreamQuotaGuard = service.NewStreamQuotaGuard(c, relayInfo)
 	}
 
 	defer func() {
@@ -176,18 +204,49 @@ func Relay(c *gin.Context, relayFormat types.RelayFormat) {
 		}
 	}()
 
+	// 响应缓存在选择渠道之前由 Distribute 查询
+	if entry, ok := common.GetContextKeyType[*service.ResponseCacheEntry](c, constant.ContextKeyResponseCacheEntry); ok {
+		newAPIError = relay.ResponseCacheHelper(c, relayInfo, entry)
+		return
+	}
+	if responseCacheKey := common.GetContextKeyString(c, constant.ContextKeyResponseCacheKey); responseCacheKey != "" {
+		cacheWriter := common.NewCaptureWriter(c.Writer, operation_setting.GetResponseCacheSetting().MaxBodyBytes)
+		c.Writer = cacheWriter
+		defer func() {
+			if newAPIError == nil {
+				storeResponseCache(c, relayInfo, responseCacheKey, cacheWriter)
+			}
+		}()
+	}
+
 	retryParam := &service.RetryParam{
 		Ctx:        c,
 		TokenGroup: relayInfo.TokenGroup,
 		ModelName:  relayInfo.OriginModelName,
 		Retry:      common.GetPointer(0),
 	}
+	if relayInfo.VirtualModelName != "" {
+		// 虚拟模型链中的每个模型使用各自的分组
+		retryParam.TokenGroup = relayInfo.UsingGroup
+	}
 
-	for ; retryParam.GetRetry() <= common.RetryTimes; retryParam.IncreaseRetry() {
+	for attempts := 0; retryParam.GetRetry() <= common.RetryTimes; retryParam.IncreaseRetry() {
+		if attempts > 0 {
+			metrics.RecordRelayRetry(relayInfo.OriginModelName, relayInfo.UsingGroup, string(relayFormat))
+		}
+		attempts++
+		if newAPIError = waitRelayQueue(c, relayInfo); newAPIError != nil {
+			break
+		}
 		channel, channelErr := getChannel(c, relayInfo, retryParam)
 		if channelErr != nil {
 			logger.LogError(c, channelErr.Error())
 			newAPIError = channelErr
+			if advanced, advanceErr := advanceVirtualModel(c, relayInfo, retryParam, tokens, meta); advanced {
+				continue
+			} else if advanceErr != nil {
+				newAPIError = advanceErr
+			}
 			break
 		}
 
@@ -204,15 +263,10 @@ func Relay(c *gin.Context, relayFormat types.RelayFormat) {
 		}
 		c.Request.Body = io.NopCloser(bytes.NewBuffer(requestBody))
 
-		switch relayFormat {
-		case types.RelayFormatOpenAIRealtime:
-			newAPIError = relay.WssHelper(c, relayInfo)
-		case types.RelayFormatClaude:
-			newAPIError = relay.ClaudeHelper(c, relayInfo)
-		case types.RelayFormatGemini:
-			newAPIError = geminiRelayHandler(c, relayInfo)
-		default:
-			newAPIError = relayHandler(c, relayInfo)
+		if shouldHedge(c, relayFormat, relayInfo, retryParam) {
+			newAPIError, channel = relayWithHedge(c, relayFormat, relayInfo, retryParam, channel, requestBody)
+		} else {
+			newAPIError = relayWithChannelStats(c, relayFormat, relayInfo, channel.Id)
 		}
 
 		if newAPIError == nil {
@@ -221,9 +275,19 @@ func Relay(c *gin.Context, relayFormat types.RelayFormat) {
 
 		newAPIError = service.NormalizeViolationFeeError(newAPIError)
 
-		processChannelError(c, *types.NewChannelError(channel.Id, channel.Type, channel.Name, channel.ChannelInfo.IsMultiKey, common.GetContextKeyString(c, constant.ContextKeyChannelKey), channel.GetAutoBan()), newAPIError)
+		processChannelError(c, newChannelErrorFromContext(c, channel), newAPIError)
 
-		if !shouldRetry(c, newAPIError, common.RetryTimes-retryParam.GetRetry()) {
+		if retryParam.GetRetry() < common.RetryTimes && shouldRetry(c, newAPIError, common.RetryTimes-retryParam.GetRetry()) {
+			continue
+		}
+		// 当前模型的重试次数已用完，虚拟模型继续尝试链中的下一个模型
+		if !shouldRetry(c, newAPIError, 1) {
+			break
+		}
+		if advanced, advanceErr := advanceVirtualModel(c, relayInfo, retryParam, tokens, meta); !advanced {
+			if advanceErr != nil {
+				newAPIError = advanceErr
+			}
 			break
 		}
 	}
@@ -235,6 +299,77 @@ func Relay(c *gin.Context, relayFormat types.RelayFormat) {
 	}
 }
 
+// relayWithChannelStats 执行一次转发，并把在途数、延迟与结果反馈给渠道选择策略与熔断器
+func relayWithChannelStats(c *gin.Context, relayFormat types.RelayFormat, relayInfo *relaycommon.RelayInfo, channelId int) (newAPIError *types.NewAPIError) {
+	attemptStart := time.Now()
+	model.IncreaseChannelInflight(channelId)
+	defer model.DecreaseChannelInflight(channelId)
+	keyIndex := -1
+	if common.GetContextKeyBool(c, constant.ContextKeyChannelIsMultiKey) {
+		keyIndex = common.GetContextKeyInt(c, constant.ContextKeyChannelMultiKeyIndex)
+	}
+	breakerAttempt := model.BeginChannelBreakerAttempt(channelId, keyIndex)
+
+	switch relayFormat {
+	case types.RelayFormatOpenAIRealtime:
+		newAPIError = relay.WssHelper(c, relayInfo)
+	case types.RelayFormatClaude:
+		newAPIError = relay.ClaudeHelper(c, relayInfo)
+	case types.RelayFormatGemini:
+		newAPIError = geminiRelayHandler(c, relayInfo)
+	default:
+		newAPIError = relayHandler(c, relayInfo)
+	}
+
+	// 输掉对冲的请求是被主动取消的，不计入渠道统计
+	if relayInfo.IsHedgeLost() {
+		breakerAttempt.Cancel()
+		return newAPIError
+	}
+
+	// 流式请求以首字延迟衡量渠道速度，避免输出长度影响判断
+	duration := time.Since(attemptStart)
+	latency := duration
+	var firstToken time.Duration
+	if relayInfo.FirstResponseTime.After(attemptStart) {
+		latency = relayInfo.FirstResponseTime.Sub(attemptStart)
+		if relayInfo.IsStream {
+			firstToken = latency
+		}
+	}
+	statusCode := http.StatusOK
+	if newAPIError != nil {
+		statusCode = newAPIError.StatusCode
+	}
+	metrics.RecordRelayAttempt(metrics.RelayAttempt{
+		ChannelId:   channelId,
+		ChannelType: common.GetContextKeyInt(c, constant.ContextKeyChannelType),
+		Model:       relayInfo.OriginModelName,
+		Group:       relayInfo.UsingGroup,
+		RelayFormat: string(relayFormat),
+		StatusCode:  statusCode,
+		Duration:    duration,
+		FirstToken:  firstToken,
+	})
+	success := !isChannelFailure(newAPIError)
+	model.RecordChannelOutcome(channelId, relayInfo.OriginModelName, latency, success)
+	breakerAttempt.Finish(success)
+	return newAPIError
+}
+
+// isChannelFailure 只有渠道自身的问题才计入错误率，请求参数错误等不影响渠道选择
+func isChannelFailure(err *types.NewAPIError) bool {
+	if err == nil {
+		return false
+	}
+	if types.IsChannelError(err) {
+		return true
+	}
+	return err.StatusCode == http.StatusTooManyRequests ||
+		err.StatusCode == http.StatusRequestTimeout ||
+		err.StatusCode >= http.StatusInternalServerError
+}
+
 var upgrader = websocket.Upgrader{
 	Subprotocols: []string{"realtime"}, // WS 握手支持的协议，如果有使用 Sec-WebSocket-Protocol，则必须在此声明对应的 Protocol TODO add other protocol
 	CheckOrigin: func(r *http.Request) bool {
@@ -307,6 +442,81 @@ func getChannel(c *gin.Context, info *relaycommon.RelayInfo, retryParam *service
 	return channel, nil
 }
 
+// advanceVirtualModel 虚拟模型当前使用的模型无法完成请求时切换到链中的下一个模型，并按新模型重新计算价格。
+// 价格未配置的模型会被跳过；此前未预扣费（如免费模型）时按新模型预扣费，新模型更贵时追加预扣差额，预扣费失败时返回错误。
+// 切换后重试计数重新开始，链中每个模型都有完整的重试次数
+func advanceVirtualModel(c *gin.Context, relayInfo *relaycommon.RelayInfo, retryParam *service.RetryParam, tokens int, meta *types.TokenCountMeta) (bool, *types.NewAPIError) {
+	if relayInfo.VirtualModelName == "" {
+		return false, nil
+	}
+	if _, ok := c.Get("specific_channel_id"); ok {
+		return false, nil
+	}
+	previousModel, previousGroup := relayInfo.OriginModelName, relayInfo.UsingGroup
+	for index := common.GetContextKeyInt(c, constant.ContextKeyVirtualModelIndex) + 1; ; index++ {
+		target, group, ok := service.UseVirtualModelTarget(c, index)
+		if !ok {
+			relayInfo.OriginModelName, relayInfo.UsingGroup = previousModel, previousGroup
+			return false, nil
+		}
+		relayInfo.OriginModelName = target.Model
+		relayInfo.UsingGroup = group
+		priceData, err := helper.ModelPriceHelper(c, relayInfo, tokens, meta)
+		if err != nil {
+			logger.LogWarn(c, fmt.Sprintf("虚拟模型 %s 跳过模型 %s: %s", relayInfo.VirtualModelName, target.Model, err.Error()))
+			continue
+		}
+		if !priceData.FreeModel {
+			var newAPIError *types.NewAPIError
+			if relayInfo.FinalPreConsumedQuota == 0 {
+				newAPIError = service.PreConsumeQuota(c, priceData.QuotaToPreConsume, relayInfo)
+			} else {
+				newAPIError = service.TopUpPreConsumedQuota(c, priceData.QuotaToPreConsume, relayInfo)
+			}
+			if newAPIError != nil {
+				return false, newAPIError
+			}
+		}
+		relayInfo.StreamQuotaGuard = nil
+		if !priceData.FreeModel {
+			relayInfo.StreamQuotaGuard = service.NewStreamQuotaGuard(c, relayInfo)
+		}
+		retryParam.ModelName = target.Model
+		retryParam.TokenGroup = group
+		// 调用方随后执行循环的 IncreaseRetry，计数从 -1 回到 0
+		retryParam.RestartRetry()
+		logger.LogInfo(c, fmt.Sprintf("虚拟模型 %s 从模型 %s 切换到分组 %s 下的模型 %s", relayInfo.VirtualModelName, previousModel, group, target.Model))
+		return true, nil
+	}
+}
+
+// waitRelayQueue 渠道全部被上游限流时排队等待，流式请求在等待期间发送 SSE ping 保活
+func waitRelayQueue(c *gin.Context, relayInfo *relaycommon.RelayInfo) *types.NewAPIError {
+	if _, ok := c.Get("specific_channel_id"); ok {
+		return nil
+	}
+	// 虚拟模型直接切换到链中的下一个模型，不排队等待
+	if service.HasNextVirtualModelTarget(c) {
+		return nil
+	}
+	var keepAlive func() error
+	if relayInfo.IsStream && relayInfo.RelayFormat != types.RelayFormatOpenAIRealtime {
+		keepAlive = func() error {
+			helper.SetEventStreamHeaders(c)
+			return helper.PingData(c)
+		}
+	}
+	pingInterval := helper.DefaultPingInterval
+	if generalSettings := operation_setting.GetGeneralSetting(); generalSettings.PingIntervalEnabled && generalSettings.PingIntervalSeconds > 0 {
+		pingInterval = time.Duration(generalSettings.PingIntervalSeconds) * time.Second
+	}
+	group := relayInfo.UsingGroup
+	if autoGroup := common.GetContextKeyString(c, constant.ContextKeyAutoGroup); autoGroup != "" {
+		group = autoGroup
+	}
+	return service.WaitRelayQueue(c, group, relayInfo.OriginModelName, pingInterval, keepAlive)
+}
+
 func shouldRetry(c *gin.Context, openaiErr *types.NewAPIError, retryTimes int) bool {
 	if openaiErr == nil {
 		return false
@@ -418,6 +628,62 @@ func RelayMidjourney(c *gin.Context) {
 	}
 }
 
+// RelayClaudeCountTokens 处理 /v1/messages/count_tokens，只计数不调用模型，因此不预扣费也不重试
+func RelayClaudeCountTokens(c *gin.Context) {
+	requestId := c.GetString(common.RequestIdKey)
+
+	var newAPIError *types.NewAPIError
+	defer func() {
+		if newAPIError != nil {
+			logger.LogError(c, fmt.Sprintf("relay error: %s", newAPIError.Error()))
+			newAPIError.SetMessage(common.MessageWithRequestId(newAPIError.Error(), requestId))
+			c.JSON(newAPIError.StatusCode, gin.H{
+				"type":  "error",
+				"error": newAPIError.ToClaudeError(),
+			})
+		}
+	}()
+
+	request, err := helper.GetAndValidateClaudeRequest(c)
+	if err != nil {
+		newAPIError = types.NewErrorWithStatusCode(err, types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+		return
+	}
+
+	relayInfo := relaycommon.GenRelayInfoClaude(c, request)
+	newAPIError = relay.ClaudeCountTokensHelper(c, relayInfo)
+}
+
+// RelayGeminiCountTokens 处理 Gemini countTokens，只计数不调用模型，因此不预扣费也不重试
+func RelayGeminiCountTokens(c *gin.Context) {
+	requestId := c.GetString(common.RequestIdKey)
+
+	var newAPIError *types.NewAPIError
+	defer func() {
+		if newAPIError != nil {
+			logger.LogError(c, fmt.Sprintf("relay error: %s", newAPIError.Error()))
+			newAPIError.SetMessage(common.MessageWithRequestId(newAPIError.Error(), requestId))
+			c.JSON(newAPIError.StatusCode, gin.H{
+				"error": newAPIError.ToOpenAIError(),
+			})
+		}
+	}()
+
+	countRequest := &dto.GeminiCountTokensRequest{}
+	if err := common.UnmarshalBodyReusable(c, countRequest); err != nil {
+		newAPIError = types.NewErrorWithStatusCode(err, types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+		return
+	}
+	request := countRequest.ToChatRequest()
+	if len(request.Contents) == 0 {
+		newAPIError = types.NewErrorWithStatusCode(errors.New("field contents is required"), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+		return
+	}
+
+	relayInfo := relaycommon.GenRelayInfoGemini(c, request)
+	newAPIError = relay.GeminiCountTokensHelper(c, relayInfo)
+}
+
 func RelayNotImplemented(c *gin.Context) {
 	err := types.OpenAIError{
 		Message: "API not implemented",
@@ -0,0 +1,379 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/middleware"
+	"github.com/QuantumNous/new-api/model"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	relayconstant "github.com/QuantumNous/new-api/relay/constant"
+	"github.com/QuantumNous/new-api/relay/helper"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/bytedance/gopkg/util/gopool"
+	"github.com/gin-gonic/gin"
+)
+
+// hedgeChannelSelectTimes 选择对冲渠道时，最多尝试多少次以避开首个渠道
+const hedgeChannelSelectTimes = 3
+
+var errHedgeLost = errors.New("hedged request lost the race")
+
+// hedgeRace 对冲请求中先向客户端写入数据的一方胜出，另一方会被取消
+type hedgeRace struct {
+	mu      sync.Mutex
+	winner  int // -1 表示还未决出
+	cancels []context.CancelFunc
+	decided chan struct{}
+	info    *relaycommon.HedgeInfo
+}
+
+func newHedgeRace(info *relaycommon.HedgeInfo) *hedgeRace {
+	return &hedgeRace{winner: -1, decided: make(chan struct{}), info: info}
+}
+
+// join 加入一次转发，已决出胜者时返回 false
+func (r *hedgeRace) join(channelId int, cancel context.CancelFunc) (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.winner != -1 {
+		return -1, false
+	}
+	r.cancels = append(r.cancels, cancel)
+	return r.info.AddAttempt(channelId), true
+}
+
+func (r *hedgeRace) claim(index int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.winner == -1 {
+		r.winner = index
+		close(r.decided)
+		r.info.SetStatus(index, relaycommon.HedgeStatusWon, "")
+		for i, cancel := range r.cancels {
+			if i != index {
+				cancel()
+				r.info.SetStatus(i, relaycommon.HedgeStatusCancelled, "")
+			}
+		}
+	}
+	return r.winner == index
+}
+
+func (r *hedgeRace) getWinner() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.winner
+}
+
+func (r *hedgeRace) lost(index int) bool {
+	winner := r.getWinner()
+	return winner != -1 && winner != index
+}
+
+// hedgeWriter 在决出胜者前缓存响应头，第一次写入响应体时参与竞争，输掉的一方无法写入
+type hedgeWriter struct {
+	gin.ResponseWriter
+	race   *hedgeRace
+	index  int
+	won    bool
+	header http.Header
+	status int
+}
+
+func newHedgeWriter(writer gin.ResponseWriter, race *hedgeRace, index int) *hedgeWriter {
+	return &hedgeWriter{
+		ResponseWriter: writer,
+		race:           race,
+		index:          index,
+		header:         writer.Header().Clone(),
+	}
+}
+
+func (w *hedgeWriter) acquire() bool {
+	if w.won {
+		return true
+	}
+	if !w.race.claim(w.index) {
+		return false
+	}
+	w.won = true
+	header := w.ResponseWriter.Header()
+	for key, values := range w.header {
+		header[key] = values
+	}
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	return true
+}
+
+func (w *hedgeWriter) Header() http.Header {
+	if w.won {
+		return w.ResponseWriter.Header()
+	}
+	return w.header
+}
+
+func (w *hedgeWriter) WriteHeader(code int) {
+	if w.won {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.status = code
+}
+
+func (w *hedgeWriter) WriteHeaderNow() {
+	if w.acquire() {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (w *hedgeWriter) Write(data []byte) (int, error) {
+	if !w.acquire() {
+		return 0, errHedgeLost
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *hedgeWriter) WriteString(s string) (int, error) {
+	if !w.acquire() {
+		return 0, errHedgeLost
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *hedgeWriter) Flush() {
+	if w.won {
+		w.ResponseWriter.Flush()
+	}
+}
+
+func (w *hedgeWriter) Status() int {
+	if w.won {
+		return w.ResponseWriter.Status()
+	}
+	if w.status != 0 {
+		return w.status
+	}
+	return http.StatusOK
+}
+
+func (w *hedgeWriter) Written() bool {
+	return w.won && w.ResponseWriter.Written()
+}
+
+func (w *hedgeWriter) Size() int {
+	if w.won {
+		return w.ResponseWriter.Size()
+	}
+	return -1
+}
+
+type hedgeResult struct {
+	err  *types.NewAPIError
+	lost bool // 结束时已输掉对冲，错误是被取消导致的
+}
+
+// shouldHedge 只对首次转发的交互式对话请求启用对冲
+func shouldHedge(c *gin.Context, relayFormat types.RelayFormat, relayInfo *relaycommon.RelayInfo, retryParam *service.RetryParam) bool {
+	if retryParam.GetRetry() != 0 {
+		return false
+	}
+	if _, ok := c.Get("specific_channel_id"); ok {
+		return false
+	}
+	switch relayFormat {
+	case types.RelayFormatOpenAI:
+		if relayInfo.RelayMode != relayconstant.RelayModeChatCompletions && relayInfo.RelayMode != relayconstant.RelayModeCompletions {
+			return false
+		}
+	case types.RelayFormatOpenAIResponses:
+		if relayInfo.RelayMode != relayconstant.RelayModeResponses {
+			return false
+		}
+	case types.RelayFormatGemini:
+		if strings.Contains(c.Request.URL.Path, "embed") {
+			return false
+		}
+	case types.RelayFormatClaude:
+	default:
+		return false
+	}
+	return operation_setting.ShouldHedge(common.GetContextKeyBool(c, constant.ContextKeyTokenHedging), relayInfo.OriginModelName)
+}
+
+// relayWithHedge 首个渠道在 DelayMs 内没有向客户端写入数据时，向另一个渠道发送相同请求，
+// 先写入数据的一方胜出并继续输出，另一方被取消且不计费。返回胜出方（或首个渠道）的结果与渠道
+func relayWithHedge(c *gin.Context, relayFormat types.RelayFormat, relayInfo *relaycommon.RelayInfo, retryParam *service.RetryParam, channel *model.Channel, requestBody []byte) (*types.NewAPIError, *model.Channel) {
+	hedgeSetting := operation_setting.GetHedgeSetting()
+	// 对冲请求使用的上下文与 RelayInfo 必须在首个请求开始前复制，避免两次转发并发读写
+	hedgeRelayInfo, err := relayInfo.CloneForHedge()
+	if err != nil {
+		logger.LogWarn(c, fmt.Sprintf("clone relay info for hedge failed: %s", err.Error()))
+		return relayWithChannelStats(c, relayFormat, relayInfo, channel.Id), channel
+	}
+	hc := c.Copy()
+	// BodyStorage 的读取位置不能并发使用，对冲请求改用缓存的请求体
+	hc.Set(common.KeyBodyStorage, nil)
+	hc.Set(common.KeyRequestBody, requestBody)
+	if relayInfo.StreamQuotaGuard != nil {
+		hedgeRelayInfo.StreamQuotaGuard = service.NewStreamQuotaGuard(hc, hedgeRelayInfo)
+	}
+
+	hedgeInfo := relaycommon.NewHedgeInfo(hedgeSetting.DelayMs)
+	race := newHedgeRace(hedgeInfo)
+	realWriter := c.Writer
+	disablePing := relayInfo.DisablePing
+	defer func() {
+		c.Writer = realWriter
+		relayInfo.Hedge = nil
+		relayInfo.DisablePing = disablePing
+	}()
+
+	primaryCtx, primaryCancel := context.WithCancel(c.Request.Context())
+	defer primaryCancel()
+	primaryIndex, _ := race.join(channel.Id, primaryCancel)
+	// ping 也会写入响应，决出胜者前不能发送
+	relayInfo.DisablePing = true
+	relayInfo.Hedge = &relaycommon.HedgeAttempt{
+		Ctx:  primaryCtx,
+		Lost: func() bool { return race.lost(primaryIndex) },
+	}
+	c.Writer = newHedgeWriter(realWriter, race, primaryIndex)
+	primaryDone := runHedgeAttempt(c, relayFormat, relayInfo, channel.Id, race, primaryIndex)
+
+	timer := time.NewTimer(time.Duration(hedgeSetting.DelayMs) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case primary := <-primaryDone:
+		return primary.err, channel
+	case <-race.decided:
+		return (<-primaryDone).err, channel
+	case <-timer.C:
+	}
+
+	hedgeChannel, err := selectHedgeChannel(hc, hedgeRelayInfo, retryParam, channel.Id)
+	if err != nil || hedgeChannel == nil {
+		if err != nil {
+			logger.LogWarn(c, fmt.Sprintf("select hedge channel failed: %s", err.Error()))
+		}
+		return (<-primaryDone).err, channel
+	}
+	hedgeCtx, hedgeCancel := context.WithCancel(c.Request.Context())
+	defer hedgeCancel()
+	hedgeIndex, ok := race.join(hedgeChannel.Id, hedgeCancel)
+	if !ok {
+		return (<-primaryDone).err, channel
+	}
+	hc.Request = c.Request.Clone(hedgeCtx)
+	hc.Request.Body = io.NopCloser(bytes.NewBuffer(requestBody))
+	hc.Writer = newHedgeWriter(realWriter, race, hedgeIndex)
+	hedgeRelayInfo.DisablePing = true
+	hedgeRelayInfo.Hedge = &relaycommon.HedgeAttempt{
+		Ctx:  hedgeCtx,
+		Lost: func() bool { return race.lost(hedgeIndex) },
+	}
+	common.SetContextKey(c, constant.ContextKeyHedgeInfo, hedgeInfo)
+	common.SetContextKey(hc, constant.ContextKeyHedgeInfo, hedgeInfo)
+	addUsedChannel(c, hedgeChannel.Id)
+	hc.Set("use_channel", c.GetStringSlice("use_channel"))
+	logger.LogInfo(c, fmt.Sprintf("渠道 #%d 在 %dms 内未响应，发起对冲请求，渠道 #%d", channel.Id, hedgeSetting.DelayMs, hedgeChannel.Id))
+
+	hedgeDone := runHedgeAttempt(hc, relayFormat, hedgeRelayInfo, hedgeChannel.Id, race, hedgeIndex)
+	primary := <-primaryDone
+	hedge := <-hedgeDone
+
+	switch race.getWinner() {
+	case primaryIndex:
+		return primary.err, channel
+	case hedgeIndex:
+		if primary.err != nil && !primary.lost {
+			processChannelError(c, newChannelErrorFromContext(c, channel), primary.err)
+		}
+		syncHedgeContext(c, hc)
+		// 对冲请求在流式输出中追加的预扣费记录在副本上，出错退款时按副本的预扣额度退还
+		relayInfo.FinalPreConsumedQuota = hedgeRelayInfo.FinalPreConsumedQuota
+		return hedge.err, hedgeChannel
+	default:
+		// 两个渠道都没有返回数据，对冲渠道的错误在这里处理，首个渠道的错误交给重试流程
+		if hedge.err != nil {
+			processChannelError(hc, newChannelErrorFromContext(hc, hedgeChannel), hedge.err)
+		}
+		return primary.err, channel
+	}
+}
+
+func runHedgeAttempt(c *gin.Context, relayFormat types.RelayFormat, relayInfo *relaycommon.RelayInfo, channelId int, race *hedgeRace, index int) <-chan hedgeResult {
+	done := make(chan hedgeResult, 1)
+	gopool.Go(func() {
+		var newAPIError *types.NewAPIError
+		defer func() {
+			if r := recover(); r != nil {
+				newAPIError = types.NewError(fmt.Errorf("hedged relay panic: %v", r), types.ErrorCodeDoRequestFailed)
+			}
+			lost := race.lost(index)
+			if newAPIError != nil && !lost {
+				race.info.SetStatus(index, relaycommon.HedgeStatusFailed, newAPIError.Error())
+			}
+			done <- hedgeResult{err: newAPIError, lost: lost}
+		}()
+		newAPIError = relayWithChannelStats(c, relayFormat, relayInfo, channelId)
+	})
+	return done
+}
+
+// selectHedgeChannel 为对冲请求选择一个与首个渠道不同的渠道，并设置到对冲请求的上下文中
+func selectHedgeChannel(hc *gin.Context, info *relaycommon.RelayInfo, retryParam *service.RetryParam, excludeChannelId int) (*model.Channel, error) {
+	param := &service.RetryParam{
+		Ctx:        hc,
+		TokenGroup: retryParam.TokenGroup,
+		ModelName:  retryParam.ModelName,
+		Retry:      common.GetPointer(0),
+	}
+	for i := 0; i < hedgeChannelSelectTimes; i++ {
+		channel, _, err := service.CacheGetRandomSatisfiedChannel(param)
+		if err != nil {
+			return nil, err
+		}
+		if channel == nil {
+			return nil, nil
+		}
+		if channel.Id == excludeChannelId {
+			continue
+		}
+		info.PriceData.GroupRatioInfo = helper.HandleGroupRatio(hc, info)
+		if newAPIError := middleware.SetupContextForSelectedChannel(hc, channel, info.OriginModelName); newAPIError != nil {
+			return nil, newAPIError
+		}
+		return channel, nil
+	}
+	return nil, nil
+}
+
+// syncHedgeContext 对冲请求胜出时，把它使用的渠道等信息同步回原请求上下文，供后续错误处理与重试使用
+func syncHedgeContext(c *gin.Context, hc *gin.Context) {
+	for key, value := range hc.Keys {
+		if key == common.KeyBodyStorage || key == common.KeyRequestBody {
+			continue
+		}
+		c.Set(key, value)
+	}
+}
+
+func newChannelErrorFromContext(c *gin.Context, channel *model.Channel) types.ChannelError {
+	return *types.NewChannelError(channel.Id, channel.Type, channel.Name, channel.ChannelInfo.IsMultiKey, common.GetContextKeyString(c, constant.ContextKeyChannelKey), channel.GetAutoBan())
+}
@@ -0,0 +1,22 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/logger"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+func storeResponseCache(c *gin.Context, relayInfo *relaycommon.RelayInfo, key string, writer *common.CaptureWriter) {
+	if writer.Overflow() || writer.Status() != http.StatusOK || len(writer.Body()) == 0 {
+		return
+	}
+	if err := service.StoreResponseCache(key, relayInfo, writer.Body()); err != nil {
+		logger.LogDebug(c, fmt.Sprintf("response cache not stored: %s", err.Error()))
+	}
+}
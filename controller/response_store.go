@@ -0,0 +1,153 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+const responseInputItemsMaxLimit = 100
+
+// getUserStoredResponse 查询当前用户保存的响应，不存在或不属于该用户时直接返回 404
+func getUserStoredResponse(c *gin.Context) (*model.StoredResponse, bool) {
+	responseId := c.Param("id")
+	userId := common.GetContextKeyInt(c, constant.ContextKeyUserId)
+	stored, exist, err := model.GetStoredResponse(userId, responseId)
+	if err != nil {
+		respondPlatformError(c, types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry()))
+		return nil, false
+	}
+	if !exist {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": types.OpenAIError{
+				Message: fmt.Sprintf("Response with id '%s' not found.", responseId),
+				Type:    "invalid_request_error",
+				Param:   "id",
+			},
+		})
+		return nil, false
+	}
+	if stored.Oversized {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": types.OpenAIError{
+				Message: fmt.Sprintf("Response with id '%s' exceeds the response store size limit and was not stored.", responseId),
+				Type:    "invalid_request_error",
+				Param:   "id",
+			},
+		})
+		return nil, false
+	}
+	return stored, true
+}
+
+// RelayResponseRetrieve 由本地响应存储提供，只能查询经对话接口转换并保存的响应
+func RelayResponseRetrieve(c *gin.Context) {
+	stored, ok := getUserStoredResponse(c)
+	if !ok {
+		return
+	}
+	c.Data(http.StatusOK, "application/json", []byte(stored.Response))
+}
+
+func RelayResponseDelete(c *gin.Context) {
+	stored, ok := getUserStoredResponse(c)
+	if !ok {
+		return
+	}
+	if err := model.DeleteStoredResponse(stored); err != nil {
+		respondPlatformError(c, types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry()))
+		return
+	}
+	c.JSON(http.StatusOK, dto.ResponsesDeleteResponse{
+		Id:      stored.ResponseId,
+		Object:  "response",
+		Deleted: true,
+	})
+}
+
+// RelayResponseInputItems 返回响应的完整输入条目（包含沿 previous_response_id 回溯的历史），默认按倒序返回
+func RelayResponseInputItems(c *gin.Context) {
+	stored, ok := getUserStoredResponse(c)
+	if !ok {
+		return
+	}
+	userId := common.GetContextKeyInt(c, constant.ContextKeyUserId)
+	inputItems, err := service.StoredResponseInputItems(userId, stored)
+	if errors.Is(err, service.ErrStoredResponseUnavailable) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": types.OpenAIError{
+				Message: err.Error(),
+				Type:    "invalid_request_error",
+				Param:   "id",
+			},
+		})
+		return
+	}
+	if err != nil {
+		respondPlatformError(c, types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry()))
+		return
+	}
+	items := make([]map[string]any, 0, len(inputItems))
+	for _, inputItem := range inputItems {
+		var item map[string]any
+		if err := common.Unmarshal(inputItem, &item); err != nil {
+			respondPlatformError(c, types.NewError(err, types.ErrorCodeBadResponseBody, types.ErrOptionWithSkipRetry()))
+			return
+		}
+		items = append(items, item)
+	}
+	for i, item := range items {
+		if common.Interface2String(item["id"]) == "" {
+			// 客户端传入的条目没有 id，按位置生成稳定的 id 以支持 after 分页
+			item["id"] = fmt.Sprintf("item_%s_%d", stored.ResponseId, i)
+		}
+		if common.Interface2String(item["type"]) == "" {
+			item["type"] = "message"
+		}
+	}
+	if c.Query("order") != "asc" {
+		slices.Reverse(items)
+	}
+	if after := c.Query("after"); after != "" {
+		index := slices.IndexFunc(items, func(item map[string]any) bool {
+			return common.Interface2String(item["id"]) == after
+		})
+		items = items[index+1:]
+	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit <= 0 {
+		limit = 20
+	}
+	if limit > responseInputItemsMaxLimit {
+		limit = responseInputItemsMaxLimit
+	}
+	hasMore := len(items) > limit
+	if hasMore {
+		items = items[:limit]
+	}
+
+	response := dto.ResponsesInputItemList{
+		Object:  "list",
+		Data:    items,
+		HasMore: hasMore,
+	}
+	if response.Data == nil {
+		response.Data = []map[string]any{}
+	}
+	if len(items) > 0 {
+		response.FirstId = common.Interface2String(items[0]["id"])
+		response.LastId = common.Interface2String(items[len(items)-1]["id"])
+	}
+	c.JSON(http.StatusOK, response)
+}
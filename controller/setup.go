@@ -8,6 +8,7 @@ import (
 	"github.com/QuantumNous/new-api/model"
 	"github.com/QuantumNous/new-api/setting/operation_setting"
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 type Setup struct {
@@ -119,7 +120,12 @@ func PostSetup(c *gin.Context) {
 			AccessToken: nil,
 			Quota:       100000000,
 		}
-		err = model.DB.Create(&rootUser).Error
+		err = model.DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&rootUser).Error; err != nil {
+				return err
+			}
+			return model.RecordQuotaLedger(tx, model.QuotaLedgerAccountUserQuota, rootUser.Id, rootUser.Quota, model.QuotaLedgerRef{Source: model.QuotaLedgerSourceRegister})
+		})
 		if err != nil {
 			c.JSON(200, gin.H{
 				"success": false,
@@ -77,6 +77,10 @@ func UpdateTaskByPlatform(platform constant.TaskPlatform, taskChannelM map[int][
 		//_ = UpdateMidjourneyTaskAll(context.Background(), tasks)
 	case constant.TaskPlatformSuno:
 		_ = UpdateSunoTaskAll(context.Background(), taskChannelM, taskM)
+	case constant.TaskPlatformOpenAIBatch:
+		_ = UpdateBatchTaskAll(context.Background(), taskChannelM, taskM)
+	case constant.TaskPlatformFineTuning:
+		_ = UpdateFineTuningTaskAll(context.Background(), taskChannelM, taskM)
 	default:
 		if err := UpdateVideoTaskAll(context.Background(), platform, taskChannelM, taskM); err != nil {
 			common.SysLog(fmt.Sprintf("UpdateVideoTaskAll fail: %s", err))
@@ -165,7 +169,7 @@ func updateSunoTaskAll(ctx context.Context, channelId int, taskIds []string, tas
 			} else {
 				quota := task.Quota
 				if quota != 0 {
-					err = model.IncreaseUserQuota(task.UserId, quota, false)
+					err = model.IncreaseUserQuota(task.UserId, quota, false, model.QuotaLedgerRef{Source: model.QuotaLedgerSourceRefund, RefId: task.TaskID})
 					if err != nil {
 						logger.LogError(ctx, "fail to increase user quota: "+err.Error())
 					}
@@ -191,6 +191,14 @@ func AddToken(c *gin.Context) {
 		AllowIps:           token.AllowIps,
 		Group:              token.Group,
 		CrossGroupRetry:    token.CrossGroupRetry,
+		Hedging:            token.Hedging,
+		MiddleOut:          token.MiddleOut,
+		DailyBudget:        token.DailyBudget,
+		MonthlyBudget:      token.MonthlyBudget,
+		BudgetWindow:       token.BudgetWindow,
+		RpmLimit:           token.RpmLimit,
+		TpmLimit:           token.TpmLimit,
+		ConcurrencyLimit:   token.ConcurrencyLimit,
 	}
 	err = cleanToken.Insert()
 	if err != nil {
@@ -286,6 +294,14 @@ func UpdateToken(c *gin.Context) {
 		cleanToken.AllowIps = token.AllowIps
 		cleanToken.Group = token.Group
 		cleanToken.CrossGroupRetry = token.CrossGroupRetry
+		cleanToken.Hedging = token.Hedging
+		cleanToken.MiddleOut = token.MiddleOut
+		cleanToken.DailyBudget = token.DailyBudget
+		cleanToken.MonthlyBudget = token.MonthlyBudget
+		cleanToken.BudgetWindow = token.BudgetWindow
+		cleanToken.RpmLimit = token.RpmLimit
+		cleanToken.TpmLimit = token.TpmLimit
+		cleanToken.ConcurrencyLimit = token.ConcurrencyLimit
 	}
 	err = cleanToken.Update()
 	if err != nil {
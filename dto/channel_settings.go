@@ -31,6 +31,12 @@ type ChannelOtherSettings struct {
 	DisableStore          bool          `json:"disable_store,omitempty"`           // 是否禁用 store 透传（默认允许透传，禁用后可能导致 Codex 无法使用）
 	AllowSafetyIdentifier bool          `json:"allow_safety_identifier,omitempty"` // 是否允许 safety_identifier 透传（默认过滤以保护用户隐私）
 	AwsKeyType            AwsKeyType    `json:"aws_key_type,omitempty"`
+	FileStoragePrice      float64       `json:"file_storage_price,omitempty"`    // 文件存储价格（美元 / GB / 天），为 0 时不计费
+	BatchNativeFallback   bool          `json:"batch_native_fallback,omitempty"` // 上游不支持 batch 接口，由网关逐行转发执行
+	// OpenAI 格式请求转换为 Claude 时自动插入 cache_control 断点
+	ClaudeAutoCacheControl bool `json:"claude_auto_cache_control,omitempty"`
+	// 本节点同时转发到该渠道的最大请求数，为 0 时不限制
+	MaxConcurrency int `json:"max_concurrency,omitempty"`
 }
 
 func (s *ChannelOtherSettings) IsOpenRouterEnterprise() bool {
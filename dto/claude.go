@@ -34,6 +34,7 @@ type ClaudeMediaMessage struct {
 	Input     any    `json:"input,omitempty"`
 	Content   any    `json:"content,omitempty"`
 	ToolUseId string `json:"tool_use_id,omitempty"`
+	IsError   *bool  `json:"is_error,omitempty"`
 }
 
 func (c *ClaudeMediaMessage) SetText(s string) {
@@ -157,9 +158,10 @@ func (c *ClaudeMessage) ParseContent() ([]ClaudeMediaMessage, error) {
 }
 
 type Tool struct {
-	Name        string                 `json:"name"`
-	Description string                 `json:"description,omitempty"`
-	InputSchema map[string]interface{} `json:"input_schema"`
+	Name         string                 `json:"name"`
+	Description  string                 `json:"description,omitempty"`
+	InputSchema  map[string]interface{} `json:"input_schema"`
+	CacheControl json.RawMessage        `json:"cache_control,omitempty"`
 }
 
 type InputSchema struct {
@@ -173,6 +175,7 @@ type ClaudeWebSearchTool struct {
 	Name         string                       `json:"name"`
 	MaxUses      int                          `json:"max_uses,omitempty"`
 	UserLocation *ClaudeWebSearchUserLocation `json:"user_location,omitempty"`
+	CacheControl json.RawMessage              `json:"cache_control,omitempty"`
 }
 
 type ClaudeWebSearchUserLocation struct {
@@ -556,3 +559,30 @@ func (u *ClaudeUsage) GetCacheCreationTotalTokens() int {
 type ClaudeServerToolUse struct {
 	WebSearchRequests int `json:"web_search_requests"`
 }
+
+// ClaudeCountTokensRequest /v1/messages/count_tokens 只接受以下字段，多余字段会被上游拒绝
+type ClaudeCountTokensRequest struct {
+	Model      string          `json:"model"`
+	System     any             `json:"system,omitempty"`
+	Messages   []ClaudeMessage `json:"messages"`
+	Tools      any             `json:"tools,omitempty"`
+	ToolChoice any             `json:"tool_choice,omitempty"`
+	Thinking   *Thinking       `json:"thinking,omitempty"`
+	McpServers json.RawMessage `json:"mcp_servers,omitempty"`
+}
+
+func NewClaudeCountTokensRequest(req *ClaudeRequest) *ClaudeCountTokensRequest {
+	return &ClaudeCountTokensRequest{
+		Model:      req.Model,
+		System:     req.System,
+		Messages:   req.Messages,
+		Tools:      req.Tools,
+		ToolChoice: req.ToolChoice,
+		Thinking:   req.Thinking,
+		McpServers: req.McpServers,
+	}
+}
+
+type ClaudeCountTokensResponse struct {
+	InputTokens int `json:"input_tokens"`
+}
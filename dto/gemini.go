@@ -231,6 +231,7 @@ func (g *GeminiInlineData) UnmarshalJSON(data []byte) error {
 }
 
 type FunctionCall struct {
+	ID           string `json:"id,omitempty"`
 	FunctionName string `json:"name"`
 	Arguments    any    `json:"args"`
 }
@@ -301,6 +302,18 @@ func (p *GeminiPart) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// GeminiRawString 取 ThoughtSignature、functionResponse.id 等按原始 JSON 保存的字段中的字符串，不是字符串时返回空
+func GeminiRawString(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var s string
+	if err := common.Unmarshal(raw, &s); err != nil {
+		return ""
+	}
+	return s
+}
+
 type GeminiChatContent struct {
 	Role  string       `json:"role,omitempty"`
 	Parts []GeminiPart `json:"parts"`
@@ -454,6 +467,8 @@ type GeminiUsageMetadata struct {
 	TotalTokenCount      int                         `json:"totalTokenCount"`
 	ThoughtsTokenCount   int                         `json:"thoughtsTokenCount"`
 	PromptTokensDetails  []GeminiPromptTokensDetails `json:"promptTokensDetails"`
+	// 命中上下文缓存的 token 数，已包含在 PromptTokenCount 中
+	CachedContentTokenCount int `json:"cachedContentTokenCount"`
 }
 
 type GeminiPromptTokensDetails struct {
@@ -564,3 +579,48 @@ type GeminiBatchEmbeddingResponse struct {
 type ContentEmbedding struct {
 	Values []float64 `json:"values"`
 }
+
+// GeminiCountTokensRequest countTokens 请求，Gemini API 使用 generateContentRequest 或 contents，
+// Vertex AI 使用 contents、systemInstruction 等字段
+type GeminiCountTokensRequest struct {
+	Contents               []GeminiChatContent `json:"contents,omitempty"`
+	SystemInstructions     *GeminiChatContent  `json:"systemInstruction,omitempty"`
+	Tools                  json.RawMessage     `json:"tools,omitempty"`
+	GenerateContentRequest *GeminiChatRequest  `json:"generateContentRequest,omitempty"`
+}
+
+// ToChatRequest 统一转换为 GeminiChatRequest，便于模型映射与本地估算
+func (r *GeminiCountTokensRequest) ToChatRequest() *GeminiChatRequest {
+	if r.GenerateContentRequest != nil {
+		return r.GenerateContentRequest
+	}
+	return &GeminiChatRequest{
+		Contents:           r.Contents,
+		SystemInstructions: r.SystemInstructions,
+		Tools:              r.Tools,
+	}
+}
+
+type GeminiCountTokensResponse struct {
+	TotalTokens int `json:"totalTokens"`
+}
+
+// GeminiCachedContent Gemini 上下文缓存（cachedContents）对象，只列出需要记录的字段
+type GeminiCachedContent struct {
+	Name          string                            `json:"name"`
+	Model         string                            `json:"model,omitempty"`
+	DisplayName   string                            `json:"displayName,omitempty"`
+	CreateTime    string                            `json:"createTime,omitempty"`
+	UpdateTime    string                            `json:"updateTime,omitempty"`
+	ExpireTime    string                            `json:"expireTime,omitempty"`
+	UsageMetadata *GeminiCachedContentUsageMetadata `json:"usageMetadata,omitempty"`
+}
+
+type GeminiCachedContentUsageMetadata struct {
+	TotalTokenCount int `json:"totalTokenCount"`
+}
+
+type GeminiCachedContentList struct {
+	CachedContents []GeminiCachedContent `json:"cachedContents"`
+	NextPageToken  string                `json:"nextPageToken,omitempty"`
+}
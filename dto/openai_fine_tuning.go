@@ -0,0 +1,57 @@
+package dto
+
+import "encoding/json"
+
+const (
+	FineTuningStatusValidatingFiles = "validating_files"
+	FineTuningStatusQueued          = "queued"
+	FineTuningStatusRunning         = "running"
+	FineTuningStatusSucceeded       = "succeeded"
+	FineTuningStatusFailed          = "failed"
+	FineTuningStatusCancelled       = "cancelled"
+)
+
+type FineTuningJobError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Param   string `json:"param,omitempty"`
+}
+
+// FineTuningJob https://platform.openai.com/docs/api-reference/fine-tuning/object
+type FineTuningJob struct {
+	Id              string              `json:"id"`
+	Object          string              `json:"object"`
+	CreatedAt       int64               `json:"created_at"`
+	Error           *FineTuningJobError `json:"error,omitempty"`
+	FineTunedModel  string              `json:"fine_tuned_model,omitempty"`
+	FinishedAt      int64               `json:"finished_at,omitempty"`
+	Hyperparameters json.RawMessage     `json:"hyperparameters,omitempty"`
+	Model           string              `json:"model"`
+	OrganizationId  string              `json:"organization_id,omitempty"`
+	ResultFiles     []string            `json:"result_files"`
+	Status          string              `json:"status"`
+	TrainedTokens   int                 `json:"trained_tokens,omitempty"`
+	TrainingFile    string              `json:"training_file"`
+	ValidationFile  string              `json:"validation_file,omitempty"`
+	Suffix          string              `json:"suffix,omitempty"`
+	Seed            int64               `json:"seed,omitempty"`
+	EstimatedFinish int64               `json:"estimated_finish,omitempty"`
+	Method          json.RawMessage     `json:"method,omitempty"`
+	Integrations    json.RawMessage     `json:"integrations,omitempty"`
+	Metadata        map[string]string   `json:"metadata,omitempty"`
+}
+
+// IsFinished 是否已处于终态
+func (j *FineTuningJob) IsFinished() bool {
+	switch j.Status {
+	case FineTuningStatusSucceeded, FineTuningStatusFailed, FineTuningStatusCancelled:
+		return true
+	}
+	return false
+}
+
+type FineTuningJobList struct {
+	Object  string          `json:"object"`
+	Data    []FineTuningJob `json:"data"`
+	HasMore bool            `json:"has_more"`
+}
@@ -329,6 +329,20 @@ func (o *OpenAIResponsesResponse) GetSize() string {
 	return ""
 }
 
+type ResponsesDeleteResponse struct {
+	Id      string `json:"id"`
+	Object  string `json:"object"`
+	Deleted bool   `json:"deleted"`
+}
+
+type ResponsesInputItemList struct {
+	Object  string           `json:"object"`
+	Data    []map[string]any `json:"data"`
+	FirstId string           `json:"first_id,omitempty"`
+	LastId  string           `json:"last_id,omitempty"`
+	HasMore bool             `json:"has_more"`
+}
+
 type IncompleteDetails struct {
 	Reasoning string `json:"reasoning"`
 }
@@ -344,6 +358,8 @@ type ResponsesOutput struct {
 	CallId    string                   `json:"call_id,omitempty"`
 	Name      string                   `json:"name,omitempty"`
 	Arguments string                   `json:"arguments,omitempty"`
+	// reasoning 条目的摘要
+	Summary []ResponsesOutputContent `json:"summary,omitempty"`
 }
 
 type ResponsesOutputContent struct {
@@ -376,6 +392,15 @@ type ResponsesStreamResponse struct {
 	// - response.function_call_arguments.done
 	OutputIndex *int   `json:"output_index,omitempty"`
 	ItemID      string `json:"item_id,omitempty"`
+	// - response.content_part.added / done
+	// - response.output_text.done
+	// - response.reasoning_summary_part.added / done
+	// - response.reasoning_summary_text.delta / done
+	ContentIndex *int                    `json:"content_index,omitempty"`
+	SummaryIndex *int                    `json:"summary_index,omitempty"`
+	Part         *ResponsesOutputContent `json:"part,omitempty"`
+	Text         string                  `json:"text,omitempty"`
+	Arguments    string                  `json:"arguments,omitempty"`
 }
 
 // GetOpenAIError 从动态错误类型中提取OpenAIError结构
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"embed"
 	"fmt"
 	"log"
@@ -17,6 +18,7 @@ import (
 	"github.com/QuantumNous/new-api/logger"
 	"github.com/QuantumNous/new-api/middleware"
 	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/pkg/tracing"
 	"github.com/QuantumNous/new-api/router"
 	"github.com/QuantumNous/new-api/service"
 	"github.com/QuantumNous/new-api/setting/ratio_setting"
@@ -93,6 +95,21 @@ func main() {
 	// 数据看板
 	go model.UpdateQuotaData()
 
+	// 清理过期的预算计数
+	if common.IsMasterNode {
+		go model.CleanExpiredBudgetSpends(3600)
+	}
+
+	// 清理过期的响应存储
+	if common.IsMasterNode {
+		go model.CleanExpiredStoredResponses(3600)
+	}
+
+	// 额度账本对账
+	if common.IsMasterNode {
+		go model.AutomaticallyReconcileQuotaLedger()
+	}
+
 	if os.Getenv("CHANNEL_UPDATE_FREQUENCY") != "" {
 		frequency, err := strconv.Atoi(os.Getenv("CHANNEL_UPDATE_FREQUENCY"))
 		if err != nil {
@@ -113,6 +130,12 @@ func main() {
 		gopool.Go(func() {
 			controller.UpdateTaskBulk()
 		})
+		gopool.Go(func() {
+			controller.UpdateFileStorageBilling()
+		})
+		gopool.Go(func() {
+			controller.UpdateGeminiCacheStorageBilling()
+		})
 	}
 	if os.Getenv("BATCH_UPDATE_ENABLED") == "true" {
 		common.BatchUpdateEnabled = true
@@ -133,6 +156,18 @@ func main() {
 		common.SysError(fmt.Sprintf("start pyroscope error : %v", err))
 	}
 
+	if constant.TracingEnabled {
+		shutdownTracing, err := tracing.Init(context.Background(), "new-api")
+		if err != nil {
+			common.SysError(fmt.Sprintf("init opentelemetry tracing error : %v", err))
+		} else {
+			common.SysLog("opentelemetry tracing enabled")
+			defer func() {
+				_ = shutdownTracing(context.Background())
+			}()
+		}
+	}
+
 	// Initialize HTTP server
 	server := gin.New()
 	server.Use(gin.CustomRecovery(func(c *gin.Context, err any) {
@@ -147,6 +182,7 @@ func main() {
 	// This will cause SSE not to work!!!
 	//server.Use(gzip.Gzip(gzip.DefaultCompression))
 	server.Use(middleware.RequestId())
+	server.Use(middleware.Tracing())
 	server.Use(middleware.PoweredBy())
 	middleware.SetUpLogger(server)
 	// Initialize session store
@@ -266,6 +302,14 @@ func InitResources() error {
 		return err
 	}
 
+	// 初始化额度账本，首次启用时写入期初余额
+	if err := model.InitQuotaLedger(); err != nil {
+		common.SysError("failed to initialize quota ledger: " + err.Error())
+	}
+
+	// 加载模型元数据中的上下文长度，选择渠道时跳过上下文长度不足的渠道
+	model.RefreshModelContextLimits()
+
 	// Initialize Redis
 	err = common.InitRedisClient()
 	if err != nil {
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"net"
 	"net/http"
@@ -263,44 +264,66 @@ func TokenAuth() func(c *gin.Context) {
 			logger.LogDebug(c, "Client IP %s passed the token IP restrictions check", clientIp)
 		}
 
-		userCache, err := model.GetUserCache(token.UserId)
-		if err != nil {
-			abortWithOpenAiMessage(c, http.StatusInternalServerError, err.Error())
+		if !setupTokenUserContext(c, token) {
 			return
 		}
-		userEnabled := userCache.Status == common.UserStatusEnabled
-		if !userEnabled {
-			abortWithOpenAiMessage(c, http.StatusForbidden, "用户已被封禁")
+
+		err = SetupContextForToken(c, token, parts...)
+		if err != nil {
 			return
 		}
+		c.Next()
+	}
+}
+
+// setupTokenUserContext 检查令牌所属用户的状态与分组并写入上下文，失败时已中止请求
+func setupTokenUserContext(c *gin.Context, token *model.Token) bool {
+	userCache, err := model.GetUserCache(token.UserId)
+	if err != nil {
+		abortWithOpenAiMessage(c, http.StatusInternalServerError, err.Error())
+		return false
+	}
+	userEnabled := userCache.Status == common.UserStatusEnabled
+	if !userEnabled {
+		abortWithOpenAiMessage(c, http.StatusForbidden, "用户已被封禁")
+		return false
+	}
 
-		userCache.WriteContext(c)
+	userCache.WriteContext(c)
 
-		userGroup := userCache.Group
-		tokenGroup := token.Group
-		if tokenGroup != "" {
-			// check common.UserUsableGroups[userGroup]
-			if _, ok := service.GetUserUsableGroups(userGroup)[tokenGroup]; !ok {
-				abortWithOpenAiMessage(c, http.StatusForbidden, fmt.Sprintf("无权访问 %s 分组", tokenGroup))
-				return
-			}
-			// check group in common.GroupRatio
-			if !ratio_setting.ContainsGroupRatio(tokenGroup) {
-				if tokenGroup != "auto" {
-					abortWithOpenAiMessage(c, http.StatusForbidden, fmt.Sprintf("分组 %s 已被弃用", tokenGroup))
-					return
-				}
+	userGroup := userCache.Group
+	tokenGroup := token.Group
+	if tokenGroup != "" {
+		// check common.UserUsableGroups[userGroup]
+		if _, ok := service.GetUserUsableGroups(userGroup)[tokenGroup]; !ok {
+			abortWithOpenAiMessage(c, http.StatusForbidden, fmt.Sprintf("无权访问 %s 分组", tokenGroup))
+			return false
+		}
+		// check group in common.GroupRatio
+		if !ratio_setting.ContainsGroupRatio(tokenGroup) {
+			if tokenGroup != "auto" {
+				abortWithOpenAiMessage(c, http.StatusForbidden, fmt.Sprintf("分组 %s 已被弃用", tokenGroup))
+				return false
 			}
-			userGroup = tokenGroup
 		}
-		common.SetContextKey(c, constant.ContextKeyUsingGroup, userGroup)
+		userGroup = tokenGroup
+	}
+	common.SetContextKey(c, constant.ContextKeyUsingGroup, userGroup)
+	return true
+}
 
-		err = SetupContextForToken(c, token, parts...)
-		if err != nil {
-			return
-		}
-		c.Next()
+// NativeBatchAuth 网关在进程内执行 batch 中的请求时校验令牌并写入上下文，不经过请求头与 IP 限制，失败时已中止请求
+func NativeBatchAuth(c *gin.Context, key string) bool {
+	token, err := model.ValidateUserToken(key)
+	if err != nil {
+		abortWithOpenAiMessage(c, http.StatusUnauthorized, err.Error())
+		return false
+	}
+	c.Set("id", token.UserId)
+	if !setupTokenUserContext(c, token) {
+		return false
 	}
+	return SetupContextForToken(c, token) == nil
 }
 
 func SetupContextForToken(c *gin.Context, token *model.Token, parts ...string) error {
@@ -323,6 +346,11 @@ func SetupContextForToken(c *gin.Context, token *model.Token, parts ...string) e
 	}
 	common.SetContextKey(c, constant.ContextKeyTokenGroup, token.Group)
 	common.SetContextKey(c, constant.ContextKeyTokenCrossGroupRetry, token.CrossGroupRetry)
+	common.SetContextKey(c, constant.ContextKeyTokenHedging, token.Hedging)
+	common.SetContextKey(c, constant.ContextKeyTokenMiddleOut, token.MiddleOut)
+	common.SetContextKey(c, constant.ContextKeyTokenRpmLimit, token.RpmLimit)
+	common.SetContextKey(c, constant.ContextKeyTokenTpmLimit, token.TpmLimit)
+	common.SetContextKey(c, constant.ContextKeyTokenConcurrencyLimit, token.ConcurrencyLimit)
 	if len(parts) > 1 {
 		if model.IsAdmin(token.UserId) {
 			c.Set("specific_channel_id", parts[1])
@@ -333,3 +361,19 @@ func SetupContextForToken(c *gin.Context, token *model.Token, parts ...string) e
 	}
 	return nil
 }
+
+// MetricsAuth 配置了 METRICS_TOKEN 时，/metrics 需要携带 Authorization: Bearer <token>
+func MetricsAuth() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if constant.MetricsToken == "" {
+			c.Next()
+			return
+		}
+		token := strings.TrimPrefix(c.Request.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(constant.MetricsToken)) != 1 {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
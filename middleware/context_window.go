@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/model"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	relayconstant "github.com/QuantumNous/new-api/relay/constant"
+	"github.com/QuantumNous/new-api/relay/helper"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// contextWindowRelayFormat 需要检查上下文长度的对话类请求对应的格式，其他请求返回空
+func contextWindowRelayFormat(path string) types.RelayFormat {
+	switch {
+	case strings.HasPrefix(path, "/v1/chat/completions"), strings.HasPrefix(path, "/pg/chat/completions"):
+		return types.RelayFormatOpenAI
+	case path == "/v1/messages":
+		return types.RelayFormatClaude
+	case path == "/v1/responses":
+		return types.RelayFormatOpenAIResponses
+	case strings.HasPrefix(path, "/v1beta/models/"), strings.HasPrefix(path, "/v1/models/"):
+		if strings.HasSuffix(path, ":generateContent") || strings.HasSuffix(path, ":streamGenerateContent") {
+			return types.RelayFormatGemini
+		}
+	}
+	return ""
+}
+
+// setupContextRequirement 有模型配置了上下文长度时，在选择渠道前估算请求需要的上下文，
+// 选择渠道时跳过上下文长度不足的渠道与模型。令牌开启 middle-out 时由转发时截断提示，这里不做限制
+func setupContextRequirement(c *gin.Context) {
+	if !model.HasModelContextLimits() || common.GetContextKeyBool(c, constant.ContextKeyTokenMiddleOut) {
+		return
+	}
+	format := contextWindowRelayFormat(c.Request.URL.Path)
+	if format == "" {
+		return
+	}
+	// 请求格式错误等问题留给转发时处理，这里估算失败时不做限制
+	request, err := helper.GetAndValidateRequest(c, format)
+	if err != nil {
+		return
+	}
+	meta := request.GetTokenCountMeta()
+	if meta == nil {
+		return
+	}
+	info := &relaycommon.RelayInfo{
+		RelayFormat: format,
+		RelayMode:   relayconstant.Path2RelayMode(c.Request.URL.Path),
+		IsStream:    request.IsStream(c),
+	}
+	tokens, err := service.EstimateRequestToken(c, meta, info)
+	if err != nil || tokens <= 0 {
+		return
+	}
+	common.SetContextKey(c, constant.ContextKeyContextRequirement, model.ContextRequirement{
+		PromptTokens: tokens,
+		MaxTokens:    meta.MaxTokens,
+	})
+}
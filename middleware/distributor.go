@@ -13,12 +13,15 @@ import (
 	"github.com/QuantumNous/new-api/constant"
 	"github.com/QuantumNous/new-api/dto"
 	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/pkg/tracing"
 	relayconstant "github.com/QuantumNous/new-api/relay/constant"
 	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
 	"github.com/QuantumNous/new-api/setting/ratio_setting"
 	"github.com/QuantumNous/new-api/types"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type ModelRequest struct {
@@ -28,6 +31,9 @@ type ModelRequest struct {
 
 func Distribute() func(c *gin.Context) {
 	return func(c *gin.Context) {
+		// 选择渠道结束后在 c.Next() 之前结束 span，提前返回时由 defer 结束，重复 End 不会有影响
+		_, span := tracing.Start(c.Request.Context(), "middleware.Distribute")
+		defer span.End()
 		var channel *model.Channel
 		channelId, ok := common.GetContextKey(c, constant.ContextKeyTokenSpecificChannelId)
 		modelRequest, shouldSelectChannel, err := getModelRequest(c)
@@ -35,6 +41,10 @@ func Distribute() func(c *gin.Context) {
 			abortWithOpenAiMessage(c, http.StatusBadRequest, "Invalid request, "+err.Error())
 			return
 		}
+		if !service.CanUseFineTunedModel(c, modelRequest.Model) {
+			abortWithOpenAiMessage(c, http.StatusForbidden, "无权访问微调模型 "+modelRequest.Model)
+			return
+		}
 		if ok {
 			id, err := strconv.Atoi(channelId.(string))
 			if err != nil {
@@ -98,9 +108,35 @@ func Distribute() func(c *gin.Context) {
 					}
 				}
 
-				if preferredChannelID, found := service.GetPreferredChannelByAffinity(c, modelRequest.Model, usingGroup); found {
+				if _, isVirtual := operation_setting.GetVirtualModelChain(modelRequest.Model); !isVirtual && service.LookupResponseCache(c, modelRequest.Model, usingGroup) {
+					// 命中响应缓存的请求不会转发到上游，不选择渠道
+					common.SetContextKey(c, constant.ContextKeyRequestStartTime, time.Now())
+					common.SetContextKey(c, constant.ContextKeyOriginalModel, modelRequest.Model)
+					span.End()
+					c.Next()
+					return
+				}
+
+				setupContextRequirement(c)
+				requirement, _ := common.GetContextKeyType[model.ContextRequirement](c, constant.ContextKeyContextRequirement)
+
+				if _, isVirtual := operation_setting.GetVirtualModelChain(modelRequest.Model); isVirtual {
+					var servingModel string
+					channel, servingModel, err = service.SelectVirtualModelChannel(c, modelRequest.Model, usingGroup)
+					if err != nil {
+						abortWithOpenAiMessage(c, http.StatusServiceUnavailable, err.Error()+"（distributor）", types.ErrorCodeModelNotFound)
+						return
+					}
+					// 之后按实际使用的模型转发，计费与日志也使用该模型
+					modelRequest.Model = servingModel
+				} else if pinned, ok := getGeminiCachedContentChannel(c, usingGroup); ok {
+					// 引用了上下文缓存的请求只能发往创建缓存的渠道，同时禁止重试到其他渠道
+					channel = pinned
+					c.Set("specific_channel_id", strconv.Itoa(pinned.Id))
+				} else if preferredChannelID, found := service.GetPreferredChannelByAffinity(c, modelRequest.Model, usingGroup); found {
 					preferred, err := model.CacheGetChannel(preferredChannelID)
-					if err == nil && preferred != nil && preferred.Status == common.ChannelStatusEnabled {
+					if err == nil && preferred != nil && preferred.Status == common.ChannelStatusEnabled && model.IsChannelBreakerAllowed(preferred) && !model.IsChannelRateLimited(preferred) &&
+						model.IsChannelFitContext(preferred, modelRequest.Model, requirement) {
 						if usingGroup == "auto" {
 							userGroup := common.GetContextKeyString(c, constant.ContextKeyUserGroup)
 							autoGroups := service.GetUserAutoGroup(userGroup)
@@ -134,6 +170,10 @@ func Distribute() func(c *gin.Context) {
 							showGroup = fmt.Sprintf("auto(%s)", selectGroup)
 						}
 						message := fmt.Sprintf("获取分组 %s 下模型 %s 的可用渠道失败（distributor）: %s", showGroup, modelRequest.Model, err.Error())
+						if errors.Is(err, model.ErrContextLengthExceeded) {
+							abortWithOpenAiMessage(c, http.StatusBadRequest, message, types.ErrorCodeContextLengthExceeded)
+							return
+						}
 						// 如果错误，但是渠道不为空，说明是数据库一致性问题
 						//if channel != nil {
 						//	common.SysError(fmt.Sprintf("渠道不存在：%d", channel.Id))
@@ -151,6 +191,25 @@ func Distribute() func(c *gin.Context) {
 		}
 		common.SetContextKey(c, constant.ContextKeyRequestStartTime, time.Now())
 		SetupContextForSelectedChannel(c, channel, modelRequest.Model)
+		if channel != nil && channel.ChannelInfo.IsMultiKey {
+			if keyIndex, ok := common.GetContextKey(c, constant.ContextKeyGeminiCachedContentKeyIndex); ok {
+				// 缓存只存在于创建它的 key 上
+				if key, index, newAPIError := service.GetChannelKeyByIndex(channel, keyIndex.(int)); newAPIError == nil {
+					common.SetContextKey(c, constant.ContextKeyChannelKey, key)
+					common.SetContextKey(c, constant.ContextKeyChannelMultiKeyIndex, index)
+				}
+			} else if keyIndex, ok := service.GetChannelAffinityKeyIndex(c, channel); ok {
+				// 上游的提示缓存按 key 隔离，亲和请求继续使用上次的 key
+				if key, index, newAPIError := service.GetChannelKeyByIndex(channel, keyIndex); newAPIError == nil {
+					common.SetContextKey(c, constant.ContextKeyChannelKey, key)
+					common.SetContextKey(c, constant.ContextKeyChannelMultiKeyIndex, index)
+				}
+			}
+		}
+		if channel != nil {
+			span.SetAttributes(attribute.Int("channel_id", channel.Id), attribute.String("model", modelRequest.Model))
+		}
+		span.End()
 		c.Next()
 		if channel != nil && c.Writer != nil && c.Writer.Status() < http.StatusBadRequest {
 			service.RecordChannelAffinity(c, channel.Id)
@@ -158,6 +217,30 @@ func Distribute() func(c *gin.Context) {
 	}
 }
 
+// getGeminiCachedContentChannel 查询请求引用的 Gemini 上下文缓存所在的渠道，缓存不属于当前用户或渠道不可用时按普通请求选择渠道
+func getGeminiCachedContentChannel(c *gin.Context, usingGroup string) (*model.Channel, bool) {
+	if !strings.HasPrefix(c.Request.URL.Path, "/v1beta/models/") && !strings.HasPrefix(c.Request.URL.Path, "/v1/models/") {
+		return nil, false
+	}
+	name := service.GetGeminiCachedContentName(c)
+	if name == "" {
+		return nil, false
+	}
+	route, found := service.GetGeminiCachedContentRoute(name)
+	if !found || route.UserId != common.GetContextKeyInt(c, constant.ContextKeyUserId) {
+		return nil, false
+	}
+	channel, err := model.CacheGetChannel(route.ChannelId)
+	if err != nil || channel == nil || channel.Status != common.ChannelStatusEnabled {
+		return nil, false
+	}
+	if usingGroup == "auto" && route.Group != "" {
+		common.SetContextKey(c, constant.ContextKeyAutoGroup, route.Group)
+	}
+	common.SetContextKey(c, constant.ContextKeyGeminiCachedContentKeyIndex, route.KeyIndex)
+	return channel, true
+}
+
 // getModelFromRequest 从请求中读取模型信息
 // 根据 Content-Type 自动处理：
 // - application/json
@@ -256,6 +339,22 @@ func getModelRequest(c *gin.Context) (*ModelRequest, bool, error) {
 		if _, ok := c.Get("relay_mode"); !ok {
 			c.Set("relay_mode", relayMode)
 		}
+	} else if strings.HasPrefix(c.Request.URL.Path, "/v1/files") {
+		// 文件上传按 model 字段选择渠道，未指定时使用默认模型
+		req, err := getModelFromRequest(c)
+		if err != nil {
+			return nil, false, err
+		}
+		modelRequest.Model = common.GetStringIfEmpty(req.Model, operation_setting.GetFileSetting().DefaultModel)
+		c.Set("relay_mode", relayconstant.RelayModeFiles)
+	} else if strings.HasPrefix(c.Request.URL.Path, "/v1beta/cachedContents") {
+		// 创建上下文缓存时按 model 字段选择渠道，格式为 models/gemini-2.5-flash
+		req, err := getModelFromRequest(c)
+		if err != nil {
+			return nil, false, err
+		}
+		modelRequest.Model = strings.TrimPrefix(req.Model, "models/")
+		c.Set("relay_mode", relayconstant.RelayModeGeminiCachedContents)
 	} else if strings.HasPrefix(c.Request.URL.Path, "/v1beta/models/") || strings.HasPrefix(c.Request.URL.Path, "/v1/models/") {
 		// Gemini API 路径处理: /v1beta/models/gemini-2.0-flash:generateContent
 		relayMode := relayconstant.RelayModeGemini
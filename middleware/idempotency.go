@@ -0,0 +1,127 @@
+package middleware
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+const idempotencyKeyMaxLength = 255
+
+// getIdempotencyRequestHash 用于识别复用同一 key 的不同请求。multipart 请求每次重试的 boundary 都不同，只比较请求路径
+func getIdempotencyRequestHash(c *gin.Context) (string, error) {
+	data := []byte(c.Request.Method + " " + c.Request.URL.Path + "\n")
+	if !strings.Contains(c.Request.Header.Get("Content-Type"), "multipart/form-data") {
+		body, err := common.GetRequestBody(c)
+		if err != nil {
+			return "", err
+		}
+		data = append(data, body...)
+	}
+	return hex.EncodeToString(common.Sha256Raw(data)), nil
+}
+
+// Idempotency 处理中继请求的 Idempotency-Key 请求头，key 按令牌隔离。
+// 处理中的重复请求等待原请求完成，已完成的重复请求直接返回保存的响应（流式请求重放完整的 SSE 数据），不会再次预扣与结算额度；
+// 响应过大未保存时返回 409。
+// 原请求失败时释放 key，客户端可以使用相同的 key 重试
+func Idempotency() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := strings.TrimSpace(c.GetHeader("Idempotency-Key"))
+		setting := operation_setting.GetIdempotencySetting()
+		if key == "" || c.Request.Method != http.MethodPost || !setting.Enabled {
+			c.Next()
+			return
+		}
+		if len(key) > idempotencyKeyMaxLength {
+			abortWithOpenAiMessage(c, http.StatusBadRequest, fmt.Sprintf("Idempotency-Key 长度不能超过 %d", idempotencyKeyMaxLength), types.ErrorCodeInvalidRequest)
+			return
+		}
+		requestHash, err := getIdempotencyRequestHash(c)
+		if err != nil {
+			// 请求体读取失败由后续处理返回错误
+			c.Next()
+			return
+		}
+
+		scope := service.GetIdempotencyScope(common.GetContextKeyInt(c, constant.ContextKeyTokenId), key)
+		entry, acquired, err := service.AcquireIdempotencyKey(c.Request.Context(), scope, requestHash)
+		if err != nil {
+			if errors.Is(err, service.ErrIdempotencyKeyInProgress) {
+				abortWithOpenAiMessage(c, http.StatusConflict, "相同 Idempotency-Key 的请求仍在处理中", types.ErrorCodeInvalidRequest)
+				return
+			}
+			if c.Request.Context().Err() != nil {
+				c.Abort()
+				return
+			}
+			logger.LogError(c, fmt.Sprintf("idempotency key acquire failed: %s", err.Error()))
+			c.Next()
+			return
+		}
+		if !acquired {
+			if entry.RequestHash != requestHash {
+				abortWithOpenAiMessage(c, http.StatusUnprocessableEntity, "Idempotency-Key 已被用于其他请求", types.ErrorCodeInvalidRequest)
+				return
+			}
+			if entry.BodyOmitted {
+				abortWithOpenAiMessage(c, http.StatusConflict, "相同 Idempotency-Key 的请求已完成，但响应过大未保存，无法重放", types.ErrorCodeInvalidRequest)
+				return
+			}
+			c.Header("Idempotent-Replayed", "true")
+			if strings.HasPrefix(entry.ContentType, "text/event-stream") {
+				c.Header("Cache-Control", "no-cache")
+				c.Header("X-Accel-Buffering", "no")
+			}
+			c.Data(entry.StatusCode, entry.ContentType, entry.Body)
+			c.Abort()
+			return
+		}
+
+		stopKeep := service.KeepIdempotencyKey(scope, requestHash)
+		writer := common.NewCaptureWriter(c.Writer, setting.MaxBodyBytes)
+		c.Writer = writer
+		defer func() {
+			if r := recover(); r != nil {
+				stopKeep()
+				service.ReleaseIdempotencyKey(scope)
+				panic(r)
+			}
+		}()
+		c.Next()
+		stopKeep()
+
+		if !writer.Written() || writer.Status() >= http.StatusBadRequest || common.GetContextKeyBool(c, constant.ContextKeyRelayFailed) {
+			service.ReleaseIdempotencyKey(scope)
+			return
+		}
+		completed := service.IdempotencyEntry{
+			RequestHash: requestHash,
+			StatusCode:  writer.Status(),
+			ContentType: writer.Header().Get("Content-Type"),
+			CreatedAt:   common.GetTimestamp(),
+		}
+		// 响应过大时只记录请求已完成，重复请求返回 409 而不是再次执行并计费
+		if writer.Overflow() {
+			completed.BodyOmitted = true
+		} else {
+			completed.Body = writer.Body()
+		}
+		err = service.CompleteIdempotencyKey(scope, completed)
+		if err != nil {
+			logger.LogError(c, fmt.Sprintf("idempotency response store failed: %s", err.Error()))
+			service.ReleaseIdempotencyKey(scope)
+		}
+	}
+}
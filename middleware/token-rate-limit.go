@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TokenRateLimit 令牌级别的每分钟请求数与并发数限制，每分钟 token 数在预估输入 token 后由 controller.Relay 检查
+func TokenRateLimit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		release, newAPIError := service.AcquireTokenConcurrency(c)
+		if newAPIError != nil {
+			abortWithOpenAiMessage(c, newAPIError.StatusCode, newAPIError.Error(), types.ErrorCodeRateLimitExceeded)
+			return
+		}
+		defer release()
+
+		if newAPIError := service.CheckTokenRpmLimit(c); newAPIError != nil {
+			abortWithOpenAiMessage(c, newAPIError.StatusCode, newAPIError.Error(), types.ErrorCodeRateLimitExceeded)
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/pkg/tracing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Tracing 为每个请求创建入口 span，并放入 c.Request 的 context 中，后续的 span 都挂在它下面
+func Tracing() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if !tracing.Enabled() {
+			c.Next()
+			return
+		}
+		ctx, span := tracing.StartServer(c.Request, c.Request.Method+" "+c.FullPath(),
+			attribute.String("request_id", c.GetString(common.RequestIdKey)),
+			attribute.String("http.method", c.Request.Method),
+			attribute.String("http.path", c.Request.URL.Path),
+		)
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+		span.SetAttributes(
+			attribute.Int("http.status_code", c.Writer.Status()),
+			attribute.Int("user_id", c.GetInt("id")),
+			attribute.Int("channel_id", c.GetInt("channel_id")),
+			attribute.String("model", c.GetString("original_model")),
+		)
+	}
+}
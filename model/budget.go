@@ -0,0 +1,192 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	BudgetWindowCalendar = "calendar" // 自然日 / 自然月
+	BudgetWindowRolling  = "rolling"  // 最近 24 小时 / 最近 30 天
+)
+
+const (
+	BudgetSubjectUser  = "user"
+	BudgetSubjectToken = "token"
+)
+
+const (
+	budgetBucketHour = "hour"
+	budgetBucketDay  = "day"
+
+	budgetRollingDays = 30
+)
+
+// BudgetSpend 预算窗口的消费计数，按小时与按天分桶累加。开启 Redis 时计数保存在 Redis 中
+type BudgetSpend struct {
+	Id          int    `json:"id"`
+	SubjectType string `json:"subject_type" gorm:"type:varchar(16);uniqueIndex:idx_budget_spend_bucket"`
+	SubjectId   int    `json:"subject_id" gorm:"uniqueIndex:idx_budget_spend_bucket"`
+	BucketType  string `json:"bucket_type" gorm:"type:varchar(8);uniqueIndex:idx_budget_spend_bucket"`
+	BucketStart int64  `json:"bucket_start" gorm:"bigint;uniqueIndex:idx_budget_spend_bucket;index"`
+	Quota       int    `json:"quota" gorm:"default:0"`
+}
+
+// BudgetUsage 预算窗口内已消费的额度
+type BudgetUsage struct {
+	Daily   int
+	Monthly int
+}
+
+func budgetHourStart(t time.Time) time.Time {
+	return t.Truncate(time.Hour)
+}
+
+func budgetDayStart(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
+
+func getBudgetSpendKey(subjectType string, subjectId int, bucketType string, bucketStart int64) string {
+	return fmt.Sprintf("budget:%s:%d:%s:%d", subjectType, subjectId, bucketType, bucketStart)
+}
+
+// IncreaseBudgetSpend 累加 at 所在分桶的预算计数，quota 为负数时表示返还。
+// 返还预扣费时 at 须为预扣费的时间，使返还与预扣计入同一分桶
+func IncreaseBudgetSpend(subjectType string, subjectId int, quota int, at time.Time) error {
+	if subjectId == 0 || quota == 0 {
+		return nil
+	}
+	hourStart := budgetHourStart(at).Unix()
+	dayStart := budgetDayStart(at).Unix()
+
+	if common.RedisEnabled {
+		ctx := context.Background()
+		pipe := common.RDB.TxPipeline()
+		hourKey := getBudgetSpendKey(subjectType, subjectId, budgetBucketHour, hourStart)
+		dayKey := getBudgetSpendKey(subjectType, subjectId, budgetBucketDay, dayStart)
+		pipe.IncrBy(ctx, hourKey, int64(quota))
+		pipe.Expire(ctx, hourKey, 25*time.Hour)
+		pipe.IncrBy(ctx, dayKey, int64(quota))
+		pipe.Expire(ctx, dayKey, 32*24*time.Hour)
+		_, err := pipe.Exec(ctx)
+		return err
+	}
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+		for _, bucket := range []struct {
+			bucketType string
+			start      int64
+		}{{budgetBucketHour, hourStart}, {budgetBucketDay, dayStart}} {
+			spend := &BudgetSpend{
+				SubjectType: subjectType,
+				SubjectId:   subjectId,
+				BucketType:  bucket.bucketType,
+				BucketStart: bucket.start,
+				Quota:       quota,
+			}
+			err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "subject_type"}, {Name: "subject_id"}, {Name: "bucket_type"}, {Name: "bucket_start"}},
+				DoUpdates: clause.Assignments(map[string]interface{}{"quota": gorm.Expr("quota + ?", quota)}),
+			}).Create(spend).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetBudgetUsage 统计预算窗口内的消费，自然日与最近 24 小时按小时分桶统计，自然月与最近 30 天按天分桶统计
+func GetBudgetUsage(subjectType string, subjectId int, window string) (BudgetUsage, error) {
+	now := time.Now()
+	var dailySince, monthlySince time.Time
+	if window == BudgetWindowRolling {
+		dailySince = budgetHourStart(now).Add(-23 * time.Hour)
+		monthlySince = budgetDayStart(now).AddDate(0, 0, -(budgetRollingDays - 1))
+	} else {
+		dailySince = budgetDayStart(now)
+		year, month, _ := now.Date()
+		monthlySince = time.Date(year, month, 1, 0, 0, 0, 0, now.Location())
+	}
+
+	var usage BudgetUsage
+	var err error
+	if common.RedisEnabled {
+		usage.Daily, err = sumBudgetSpendRedis(subjectType, subjectId, budgetBucketHour, dailySince, now, func(t time.Time) time.Time { return t.Add(time.Hour) })
+		if err != nil {
+			return usage, err
+		}
+		usage.Monthly, err = sumBudgetSpendRedis(subjectType, subjectId, budgetBucketDay, monthlySince, now, func(t time.Time) time.Time { return t.AddDate(0, 0, 1) })
+		return usage, err
+	}
+
+	usage.Daily, err = sumBudgetSpendDB(subjectType, subjectId, budgetBucketHour, dailySince)
+	if err != nil {
+		return usage, err
+	}
+	usage.Monthly, err = sumBudgetSpendDB(subjectType, subjectId, budgetBucketDay, monthlySince)
+	return usage, err
+}
+
+func sumBudgetSpendRedis(subjectType string, subjectId int, bucketType string, since time.Time, now time.Time, next func(time.Time) time.Time) (int, error) {
+	var keys []string
+	for t := since; !t.After(now); t = next(t) {
+		keys = append(keys, getBudgetSpendKey(subjectType, subjectId, bucketType, t.Unix()))
+	}
+	values, err := common.RDB.MGet(context.Background(), keys...).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return 0, err
+	}
+	total := 0
+	for _, value := range values {
+		str, ok := value.(string)
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(str)
+		if err != nil {
+			continue
+		}
+		total += n
+	}
+	return total, nil
+}
+
+func sumBudgetSpendDB(subjectType string, subjectId int, bucketType string, since time.Time) (int, error) {
+	var total int64
+	err := DB.Model(&BudgetSpend{}).
+		Where("subject_type = ? AND subject_id = ? AND bucket_type = ? AND bucket_start >= ?", subjectType, subjectId, bucketType, since.Unix()).
+		Select("COALESCE(SUM(quota), 0)").
+		Scan(&total).Error
+	return int(total), err
+}
+
+// CleanExpiredBudgetSpends 定期删除已经不在任何预算窗口内的计数，仅未开启 Redis 时需要
+func CleanExpiredBudgetSpends(frequency int) {
+	for {
+		time.Sleep(time.Duration(frequency) * time.Second)
+		if common.RedisEnabled {
+			continue
+		}
+		if err := cleanExpiredBudgetSpends(time.Now()); err != nil {
+			common.SysLog("failed to clean expired budget spends: " + err.Error())
+		}
+	}
+}
+
+func cleanExpiredBudgetSpends(now time.Time) error {
+	return DB.Where("(bucket_type = ? AND bucket_start < ?) OR (bucket_type = ? AND bucket_start < ?)",
+		budgetBucketHour, now.Add(-25*time.Hour).Unix(),
+		budgetBucketDay, now.AddDate(0, 0, -32).Unix()).
+		Delete(&BudgetSpend{}).Error
+}
@@ -0,0 +1,105 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func insertBudgetSpend(t *testing.T, bucketType string, start time.Time, quota int) {
+	t.Helper()
+	require.NoError(t, DB.Create(&BudgetSpend{
+		SubjectType: BudgetSubjectToken,
+		SubjectId:   1,
+		BucketType:  bucketType,
+		BucketStart: start.Unix(),
+		Quota:       quota,
+	}).Error)
+}
+
+func TestIncreaseBudgetSpend_AccumulatesAndRefunds(t *testing.T) {
+	setupTestDB(t, &BudgetSpend{})
+	now := time.Now()
+
+	require.NoError(t, IncreaseBudgetSpend(BudgetSubjectUser, 1, 100, now))
+	require.NoError(t, IncreaseBudgetSpend(BudgetSubjectUser, 1, 50, now))
+	require.NoError(t, IncreaseBudgetSpend(BudgetSubjectUser, 1, -30, now))
+	require.NoError(t, IncreaseBudgetSpend(BudgetSubjectUser, 2, 999, now))
+	require.NoError(t, IncreaseBudgetSpend(BudgetSubjectUser, 0, 999, now))
+
+	for _, window := range []string{BudgetWindowCalendar, BudgetWindowRolling} {
+		usage, err := GetBudgetUsage(BudgetSubjectUser, 1, window)
+		require.NoError(t, err)
+		require.Equal(t, BudgetUsage{Daily: 120, Monthly: 120}, usage, window)
+	}
+
+	var count int64
+	require.NoError(t, DB.Model(&BudgetSpend{}).Where("subject_id = ?", 1).Count(&count).Error)
+	require.EqualValues(t, 2, count, "one hour bucket and one day bucket")
+}
+
+func TestIncreaseBudgetSpend_RefundsIntoPreConsumeBucket(t *testing.T) {
+	setupTestDB(t, &BudgetSpend{})
+	preConsumedAt := budgetHourStart(time.Now()).Add(-time.Minute)
+
+	require.NoError(t, IncreaseBudgetSpend(BudgetSubjectToken, 1, 100, preConsumedAt))
+	require.NoError(t, IncreaseBudgetSpend(BudgetSubjectToken, 1, -100, preConsumedAt))
+
+	var spends []BudgetSpend
+	require.NoError(t, DB.Where("bucket_type = ?", budgetBucketHour).Find(&spends).Error)
+	require.Len(t, spends, 1, "refund does not create a bucket of its own")
+	require.Equal(t, budgetHourStart(preConsumedAt).Unix(), spends[0].BucketStart)
+	require.Zero(t, spends[0].Quota)
+}
+
+func TestGetBudgetUsage_RollingWindow(t *testing.T) {
+	setupTestDB(t, &BudgetSpend{})
+	now := time.Now()
+
+	insertBudgetSpend(t, budgetBucketHour, budgetHourStart(now), 10)
+	insertBudgetSpend(t, budgetBucketHour, budgetHourStart(now).Add(-23*time.Hour), 20)
+	insertBudgetSpend(t, budgetBucketHour, budgetHourStart(now).Add(-24*time.Hour), 40)
+	insertBudgetSpend(t, budgetBucketDay, budgetDayStart(now), 100)
+	insertBudgetSpend(t, budgetBucketDay, budgetDayStart(now).AddDate(0, 0, -(budgetRollingDays-1)), 200)
+	insertBudgetSpend(t, budgetBucketDay, budgetDayStart(now).AddDate(0, 0, -budgetRollingDays), 400)
+
+	usage, err := GetBudgetUsage(BudgetSubjectToken, 1, BudgetWindowRolling)
+	require.NoError(t, err)
+	require.Equal(t, BudgetUsage{Daily: 30, Monthly: 300}, usage)
+}
+
+func TestGetBudgetUsage_CalendarWindow(t *testing.T) {
+	setupTestDB(t, &BudgetSpend{})
+	now := time.Now()
+	dayStart := budgetDayStart(now)
+	year, month, _ := now.Date()
+	monthStart := time.Date(year, month, 1, 0, 0, 0, 0, now.Location())
+
+	insertBudgetSpend(t, budgetBucketHour, dayStart, 10)
+	insertBudgetSpend(t, budgetBucketHour, dayStart.Add(-time.Hour), 20)
+	insertBudgetSpend(t, budgetBucketDay, monthStart, 100)
+	insertBudgetSpend(t, budgetBucketDay, monthStart.AddDate(0, 0, -1), 200)
+
+	usage, err := GetBudgetUsage(BudgetSubjectToken, 1, BudgetWindowCalendar)
+	require.NoError(t, err)
+	require.Equal(t, BudgetUsage{Daily: 10, Monthly: 100}, usage)
+}
+
+func TestCleanExpiredBudgetSpends(t *testing.T) {
+	setupTestDB(t, &BudgetSpend{})
+	now := time.Now()
+
+	insertBudgetSpend(t, budgetBucketHour, now.Add(-24*time.Hour), 1)
+	insertBudgetSpend(t, budgetBucketHour, now.Add(-26*time.Hour), 1)
+	insertBudgetSpend(t, budgetBucketDay, now.AddDate(0, 0, -31), 1)
+	insertBudgetSpend(t, budgetBucketDay, now.AddDate(0, 0, -33), 1)
+
+	require.NoError(t, cleanExpiredBudgetSpends(now))
+
+	var spends []BudgetSpend
+	require.NoError(t, DB.Order("bucket_start desc").Find(&spends).Error)
+	require.Len(t, spends, 2)
+	require.Equal(t, budgetBucketHour, spends[0].BucketType)
+	require.Equal(t, budgetBucketDay, spends[1].BucketType)
+}
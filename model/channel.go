@@ -102,6 +102,24 @@ func (channel *Channel) GetKeys() []string {
 	return keys
 }
 
+// IsKeyUsable 多 key 渠道中第 index 个 key 已启用，且未熔断、未被上游限流
+func (channel *Channel) IsKeyUsable(index int) bool {
+	if !channel.ChannelInfo.IsMultiKey {
+		return index == 0
+	}
+	if index < 0 || index >= len(channel.GetKeys()) {
+		return false
+	}
+	lock := GetChannelPollingLock(channel.Id)
+	lock.Lock()
+	status, ok := channel.ChannelInfo.MultiKeyStatusList[index]
+	lock.Unlock()
+	if ok && status != common.ChannelStatusEnabled {
+		return false
+	}
+	return len(filterBreakerAllowedKeys(channel.Id, []int{index})) > 0 && len(filterRateLimitedKeys(channel.Id, []int{index})) > 0
+}
+
 func (channel *Channel) GetNextEnabledKey() (string, int, *types.NewAPIError) {
 	// If not in multi-key mode, return the original key string directly.
 	if !channel.ChannelInfo.IsMultiKey {
@@ -144,6 +162,18 @@ func (channel *Channel) GetNextEnabledKey() (string, int, *types.NewAPIError) {
 	if len(enabledIdx) == 0 {
 		return "", 0, types.NewError(errors.New("no enabled keys"), types.ErrorCodeChannelNoAvailableKey)
 	}
+	// 熔断中的 key 暂不使用；全部熔断时仍从启用的 key 中选择，避免渠道因没有可用 key 被自动禁用
+	if allowedIdx := filterBreakerAllowedKeys(channel.Id, enabledIdx); len(allowedIdx) > 0 {
+		enabledIdx = allowedIdx
+	}
+	// 上游限流中的 key 暂停使用，接近限额的 key 仅在没有其他 key 时使用
+	if preferredIdx := filterRateLimitedKeys(channel.Id, enabledIdx); len(preferredIdx) > 0 {
+		enabledIdx = preferredIdx
+	}
+	candidates := make([]bool, len(keys))
+	for _, idx := range enabledIdx {
+		candidates[idx] = true
+	}
 
 	switch channel.ChannelInfo.MultiKeyMode {
 	case constant.MultiKeyModeRandom:
@@ -175,7 +205,7 @@ func (channel *Channel) GetNextEnabledKey() (string, int, *types.NewAPIError) {
 		}
 		for i := 0; i < len(keys); i++ {
 			idx := (start + i) % len(keys)
-			if getStatus(idx) == common.ChannelStatusEnabled {
+			if candidates[idx] {
 				// update polling index for next call (point to the next position)
 				channel.ChannelInfo.MultiKeyPollingIndex = (idx + 1) % len(keys)
 				return keys[idx], idx, nil
@@ -200,6 +230,23 @@ func (channel *Channel) GetModels() []string {
 	return strings.Split(strings.Trim(channel.Models, ","), ",")
 }
 
+// AppendModel 向渠道追加一个模型并补充对应的 abilities，模型已存在时不做任何修改
+func (channel *Channel) AppendModel(modelName string) error {
+	if lo.Contains(channel.GetModels(), modelName) {
+		return nil
+	}
+	if channel.Models == "" {
+		channel.Models = modelName
+	} else {
+		channel.Models = strings.Trim(channel.Models, ",") + "," + modelName
+	}
+	err := DB.Model(channel).Update("models", channel.Models).Error
+	if err != nil {
+		return err
+	}
+	return channel.AddAbilities(nil)
+}
+
 func (channel *Channel) GetGroups() []string {
 	if channel.Group == "" {
 		return []string{}
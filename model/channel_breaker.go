@@ -0,0 +1,268 @@
+package model
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+)
+
+const (
+	BreakerStateClosed   = "closed"
+	BreakerStateOpen     = "open"
+	BreakerStateHalfOpen = "half_open"
+)
+
+// channelBreakerKey keyIndex 为 -1 时表示整个渠道
+type channelBreakerKey struct {
+	channelId int
+	keyIndex  int
+}
+
+type channelBreaker struct {
+	mu                  sync.Mutex
+	state               string
+	consecutiveFailures int
+	halfOpenSuccesses   int
+	probes              int // 半开状态下在途的探测请求数
+	generation          int // 每次进入半开状态加一，用于忽略上一轮探测的结果
+	trips               int // 连续熔断次数，用于计算冷却时间
+	openedAt            time.Time
+}
+
+var channelBreakers sync.Map // channelBreakerKey -> *channelBreaker
+
+func getChannelBreaker(channelId int, keyIndex int) *channelBreaker {
+	key := channelBreakerKey{channelId: channelId, keyIndex: keyIndex}
+	if breaker, ok := channelBreakers.Load(key); ok {
+		return breaker.(*channelBreaker)
+	}
+	breaker, _ := channelBreakers.LoadOrStore(key, &channelBreaker{state: BreakerStateClosed})
+	return breaker.(*channelBreaker)
+}
+
+func (b *channelBreaker) cooldown(setting *operation_setting.ChannelBreakerSetting) time.Duration {
+	cooldown := time.Duration(setting.CooldownSeconds) * time.Second
+	for i := 1; i < b.trips; i++ {
+		cooldown *= 2
+		if setting.MaxCooldownSeconds > 0 && cooldown >= time.Duration(setting.MaxCooldownSeconds)*time.Second {
+			return time.Duration(setting.MaxCooldownSeconds) * time.Second
+		}
+	}
+	return cooldown
+}
+
+func halfOpenMaxProbes(setting *operation_setting.ChannelBreakerSetting) int {
+	if setting.HalfOpenMaxProbes <= 0 {
+		return 1
+	}
+	return setting.HalfOpenMaxProbes
+}
+
+// allow 只判断是否放行，不改变状态，选择渠道时可以多次调用
+func (b *channelBreaker) allow(setting *operation_setting.ChannelBreakerSetting) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerStateOpen:
+		return time.Since(b.openedAt) >= b.cooldown(setting)
+	case BreakerStateHalfOpen:
+		return b.probes < halfOpenMaxProbes(setting)
+	default:
+		return true
+	}
+}
+
+// begin 请求实际使用该渠道或 key 时调用，冷却结束后转为半开，半开状态下占用一个探测名额。
+// 返回探测所属的半开轮次，不是探测请求时返回 0
+func (b *channelBreaker) begin(setting *operation_setting.ChannelBreakerSetting) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerStateOpen && time.Since(b.openedAt) >= b.cooldown(setting) {
+		b.state = BreakerStateHalfOpen
+		b.halfOpenSuccesses = 0
+		b.probes = 0
+		b.generation++
+	}
+	if b.state != BreakerStateHalfOpen || b.probes >= halfOpenMaxProbes(setting) {
+		return 0
+	}
+	b.probes++
+	return b.generation
+}
+
+// record 返回状态是否发生变化，probe 为 begin 返回的半开轮次
+func (b *channelBreaker) record(setting *operation_setting.ChannelBreakerSetting, probe int, success bool) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerStateHalfOpen:
+		// 只有本轮的探测请求决定半开状态的去向，进入半开前在途的请求结果不影响状态
+		if probe == 0 || probe != b.generation {
+			return b.state, false
+		}
+		b.probes--
+		if !success {
+			b.trips++
+			b.state = BreakerStateOpen
+			b.openedAt = time.Now()
+			return b.state, true
+		}
+		b.halfOpenSuccesses++
+		if b.halfOpenSuccesses >= setting.HalfOpenSuccessThreshold {
+			b.state = BreakerStateClosed
+			b.consecutiveFailures = 0
+			b.trips = 0
+			return b.state, true
+		}
+	case BreakerStateClosed:
+		if success {
+			b.consecutiveFailures = 0
+			return b.state, false
+		}
+		b.consecutiveFailures++
+		if setting.FailureThreshold > 0 && b.consecutiveFailures >= setting.FailureThreshold {
+			b.trips = 1
+			b.state = BreakerStateOpen
+			b.openedAt = time.Now()
+			return b.state, true
+		}
+	}
+	// 熔断期间仍在途的请求结果不影响状态
+	return b.state, false
+}
+
+// release 释放探测名额，不记录结果
+func (b *channelBreaker) release(probe int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerStateHalfOpen && probe != 0 && probe == b.generation {
+		b.probes--
+	}
+}
+
+func (b *channelBreaker) getState() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// IsChannelBreakerAllowed 渠道熔断器是否放行请求，只读取状态；多 key 渠道在全部启用的 key 都熔断时不放行
+func IsChannelBreakerAllowed(channel *Channel) bool {
+	setting := operation_setting.GetChannelBreakerSetting()
+	if !setting.Enabled || channel == nil {
+		return true
+	}
+	if !channel.ChannelInfo.IsMultiKey {
+		return isBreakerAllowed(setting, channel.Id, -1)
+	}
+	lock := GetChannelPollingLock(channel.Id)
+	lock.Lock()
+	defer lock.Unlock()
+	for i := 0; i < channel.ChannelInfo.MultiKeySize; i++ {
+		if status, ok := channel.ChannelInfo.MultiKeyStatusList[i]; ok && status != common.ChannelStatusEnabled {
+			continue
+		}
+		if isBreakerAllowed(setting, channel.Id, i) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsChannelKeyBreakerAllowed 多 key 渠道中某个 key 的熔断器是否放行请求
+func IsChannelKeyBreakerAllowed(channelId int, keyIndex int) bool {
+	return isBreakerAllowed(operation_setting.GetChannelBreakerSetting(), channelId, keyIndex)
+}
+
+func isBreakerAllowed(setting *operation_setting.ChannelBreakerSetting, channelId int, keyIndex int) bool {
+	if !setting.Enabled {
+		return true
+	}
+	breaker, ok := channelBreakers.Load(channelBreakerKey{channelId: channelId, keyIndex: keyIndex})
+	if !ok {
+		return true
+	}
+	return breaker.(*channelBreaker).allow(setting)
+}
+
+// ChannelBreakerAttempt 一次实际转发在熔断器上的记录，多 key 渠道记录在所用的 key 上，否则记录在渠道上
+type ChannelBreakerAttempt struct {
+	channelId int
+	keyIndex  int
+	probe     int
+}
+
+// BeginChannelBreakerAttempt 请求实际使用渠道时调用，keyIndex 为 -1 表示非多 key 渠道。
+// 半开状态下的请求占用探测名额，名额已满时仍然转发，但结果不影响熔断状态
+func BeginChannelBreakerAttempt(channelId int, keyIndex int) *ChannelBreakerAttempt {
+	attempt := &ChannelBreakerAttempt{channelId: channelId, keyIndex: keyIndex}
+	setting := operation_setting.GetChannelBreakerSetting()
+	if setting.Enabled {
+		attempt.probe = getChannelBreaker(channelId, keyIndex).begin(setting)
+	}
+	return attempt
+}
+
+// Finish 记录转发结果并释放占用的探测名额
+func (a *ChannelBreakerAttempt) Finish(success bool) {
+	setting := operation_setting.GetChannelBreakerSetting()
+	if !setting.Enabled {
+		return
+	}
+	state, changed := getChannelBreaker(a.channelId, a.keyIndex).record(setting, a.probe, success)
+	if !changed {
+		return
+	}
+	if a.keyIndex >= 0 {
+		common.SysLog(fmt.Sprintf("渠道 #%d 的第 %d 个 key 熔断状态变为 %s", a.channelId, a.keyIndex, state))
+	} else {
+		common.SysLog(fmt.Sprintf("渠道 #%d 熔断状态变为 %s", a.channelId, state))
+	}
+}
+
+// Cancel 请求被主动取消时释放占用的探测名额，不记录结果
+func (a *ChannelBreakerAttempt) Cancel() {
+	if a.probe != 0 {
+		getChannelBreaker(a.channelId, a.keyIndex).release(a.probe)
+	}
+}
+
+// GetChannelBreakerState 获取渠道（keyIndex 为 -1）或多 key 渠道中某个 key 的熔断状态
+func GetChannelBreakerState(channelId int, keyIndex int) string {
+	breaker, ok := channelBreakers.Load(channelBreakerKey{channelId: channelId, keyIndex: keyIndex})
+	if !ok {
+		return BreakerStateClosed
+	}
+	return breaker.(*channelBreaker).getState()
+}
+
+// filterBreakerAllowedChannels 过滤掉熔断中的渠道，返回新的切片，不修改缓存中的数据，channelM 为候选渠道的详情
+func filterBreakerAllowedChannels(channelIds []int, channelM map[int]*Channel) []int {
+	if !operation_setting.GetChannelBreakerSetting().Enabled {
+		return channelIds
+	}
+	allowed := make([]int, 0, len(channelIds))
+	for _, channelId := range channelIds {
+		if IsChannelBreakerAllowed(channelM[channelId]) {
+			allowed = append(allowed, channelId)
+		}
+	}
+	return allowed
+}
+
+// filterBreakerAllowedKeys 过滤掉熔断中的 key
+func filterBreakerAllowedKeys(channelId int, keyIndexes []int) []int {
+	if !operation_setting.GetChannelBreakerSetting().Enabled {
+		return keyIndexes
+	}
+	allowed := make([]int, 0, len(keyIndexes))
+	for _, keyIndex := range keyIndexes {
+		if IsChannelKeyBreakerAllowed(channelId, keyIndex) {
+			allowed = append(allowed, keyIndex)
+		}
+	}
+	return allowed
+}
@@ -0,0 +1,71 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelBreaker_HalfOpenProbes(t *testing.T) {
+	setting := &operation_setting.ChannelBreakerSetting{
+		Enabled:                  true,
+		FailureThreshold:         1,
+		HalfOpenMaxProbes:        1,
+		HalfOpenSuccessThreshold: 2,
+	}
+	breaker := &channelBreaker{state: BreakerStateClosed}
+	_, changed := breaker.record(setting, breaker.begin(setting), false)
+	require.True(t, changed)
+	require.Equal(t, BreakerStateOpen, breaker.getState())
+
+	// 筛选渠道不改变状态，冷却结束后在实际使用时才转为半开
+	require.True(t, breaker.allow(setting))
+	require.True(t, breaker.allow(setting))
+	require.Equal(t, BreakerStateOpen, breaker.getState())
+
+	probe := breaker.begin(setting)
+	require.NotZero(t, probe)
+	require.Equal(t, BreakerStateHalfOpen, breaker.getState())
+	require.False(t, breaker.allow(setting), "probe slots are full")
+	require.Zero(t, breaker.begin(setting))
+
+	_, changed = breaker.record(setting, probe, true)
+	require.False(t, changed)
+	require.True(t, breaker.allow(setting))
+
+	// 超出名额的请求结果不影响状态
+	_, changed = breaker.record(setting, 0, false)
+	require.False(t, changed)
+
+	probe = breaker.begin(setting)
+	state, changed := breaker.record(setting, probe, true)
+	require.True(t, changed)
+	require.Equal(t, BreakerStateClosed, state)
+}
+
+func TestChannelBreaker_StaleProbeIgnored(t *testing.T) {
+	setting := &operation_setting.ChannelBreakerSetting{
+		Enabled:                  true,
+		FailureThreshold:         1,
+		HalfOpenMaxProbes:        2,
+		HalfOpenSuccessThreshold: 1,
+	}
+	breaker := &channelBreaker{state: BreakerStateOpen, trips: 1, openedAt: time.Now().Add(-time.Minute)}
+	first := breaker.begin(setting)
+	second := breaker.begin(setting)
+	_, changed := breaker.record(setting, first, false)
+	require.True(t, changed)
+
+	// 上一轮半开的探测在新一轮半开中返回，不占用也不释放新一轮的名额
+	breaker.openedAt = time.Now().Add(-time.Hour)
+	current := breaker.begin(setting)
+	require.NotEqual(t, second, current)
+	breaker.release(second)
+	require.Equal(t, 1, breaker.probes)
+	_, changed = breaker.record(setting, second, true)
+	require.False(t, changed)
+	require.Equal(t, BreakerStateHalfOpen, breaker.getState())
+}
@@ -3,7 +3,6 @@ package model
 import (
 	"errors"
 	"fmt"
-	"math/rand"
 	"sort"
 	"strings"
 	"sync"
@@ -82,6 +81,7 @@ func InitChannelCache() {
 	}
 	channelsIDM = newChannelId2channel
 	channelSyncLock.Unlock()
+	RefreshModelContextLimits()
 	common.SysLog("channels synced from database")
 }
 
@@ -93,10 +93,24 @@ func SyncChannelCache(frequency int) {
 	}
 }
 
-func GetRandomSatisfiedChannel(group string, model string, retry int) (*Channel, error) {
-	// if memory cache is disabled, get channel directly from database
+// GetRandomSatisfiedChannel 按优先级选择渠道，requirement 不为空时跳过上下文长度不足的渠道
+func GetRandomSatisfiedChannel(group string, model string, retry int, requirement ContextRequirement) (*Channel, error) {
+	// if memory cache is disabled, get channels directly from database
 	if !common.MemoryCacheEnabled {
-		return GetChannel(group, model, retry)
+		channels, err := GetModelChannels(group, model)
+		if err == nil && len(channels) == 0 {
+			channels, err = GetModelChannels(group, ratio_setting.FormatMatchingModelName(model))
+		}
+		if err != nil {
+			return nil, err
+		}
+		channelIds := make([]int, 0, len(channels))
+		channelM := make(map[int]*Channel, len(channels))
+		for _, channel := range channels {
+			channelIds = append(channelIds, channel.Id)
+			channelM[channel.Id] = channel
+		}
+		return selectSatisfiedChannel(group, model, retry, requirement, channelIds, channelM)
 	}
 
 	channelSyncLock.RLock()
@@ -110,13 +124,36 @@ func GetRandomSatisfiedChannel(group string, model string, retry int) (*Channel,
 		normalizedModel := ratio_setting.FormatMatchingModelName(model)
 		channels = group2model2channels[group][normalizedModel]
 	}
+	return selectSatisfiedChannel(group, model, retry, requirement, channels, channelsIDM)
+}
 
+// selectSatisfiedChannel 从候选渠道中过滤熔断、上下文长度不足、上游限流的渠道，再按优先级与策略选择，
+// channelM 为候选渠道的详情，开启内存缓存时调用方需持有 channelSyncLock
+func selectSatisfiedChannel(group string, model string, retry int, requirement ContextRequirement, channels []int, channelM map[int]*Channel) (*Channel, error) {
 	if len(channels) == 0 {
 		return nil, nil
 	}
 
+	// 熔断中的渠道不参与选择
+	channels = filterBreakerAllowedChannels(channels, channelM)
+	if len(channels) == 0 {
+		return nil, fmt.Errorf("分组 %s 下模型 %s 的渠道均处于熔断状态", group, model)
+	}
+	channels = filterContextFitChannels(channels, channelM, model, requirement)
+	if len(channels) == 0 {
+		return nil, fmt.Errorf("分组 %s 下模型 %s 的渠道上下文长度均不足以容纳 %d 个提示 token: %w", group, model, requirement.PromptTokens, ErrContextLengthExceeded)
+	}
+	// 上游限流中的渠道暂停使用，接近限额的渠道仅在没有其他渠道时使用；全部限流时仍从原渠道中选择
+	if preferred := filterRateLimitedChannels(channels, channelM); len(preferred) > 0 {
+		channels = preferred
+	}
+	// 在途请求数达到最大并发数的渠道优先让给其他渠道，全部达到上限时仍从原渠道中选择
+	if preferred := filterConcurrencyCappedChannels(channels, channelM); len(preferred) > 0 {
+		channels = preferred
+	}
+
 	if len(channels) == 1 {
-		if channel, ok := channelsIDM[channels[0]]; ok {
+		if channel, ok := channelM[channels[0]]; ok {
 			return channel, nil
 		}
 		return nil, fmt.Errorf("数据库一致性错误，渠道# %d 不存在，请联系管理员修复", channels[0])
@@ -124,7 +161,7 @@ func GetRandomSatisfiedChannel(group string, model string, retry int) (*Channel,
 
 	uniquePriorities := make(map[int]bool)
 	for _, channelId := range channels {
-		if channel, ok := channelsIDM[channelId]; ok {
+		if channel, ok := channelM[channelId]; ok {
 			uniquePriorities[int(channel.GetPriority())] = true
 		} else {
 			return nil, fmt.Errorf("数据库一致性错误，渠道# %d 不存在，请联系管理员修复", channelId)
@@ -142,12 +179,10 @@ func GetRandomSatisfiedChannel(group string, model string, retry int) (*Channel,
 	targetPriority := int64(sortedUniquePriorities[retry])
 
 	// get the priority for the given retry number
-	var sumWeight = 0
 	var targetChannels []*Channel
 	for _, channelId := range channels {
-		if channel, ok := channelsIDM[channelId]; ok {
+		if channel, ok := channelM[channelId]; ok {
 			if channel.GetPriority() == targetPriority {
-				sumWeight += channel.GetWeight()
 				targetChannels = append(targetChannels, channel)
 			}
 		} else {
@@ -159,32 +194,9 @@ func GetRandomSatisfiedChannel(group string, model string, retry int) (*Channel,
 		return nil, errors.New(fmt.Sprintf("no channel found, group: %s, model: %s, priority: %d", group, model, targetPriority))
 	}
 
-	// smoothing factor and adjustment
-	smoothingFactor := 1
-	smoothingAdjustment := 0
-
-	if sumWeight == 0 {
-		// when all channels have weight 0, set sumWeight to the number of channels and set smoothing adjustment to 100
-		// each channel's effective weight = 100
-		sumWeight = len(targetChannels) * 100
-		smoothingAdjustment = 100
-	} else if sumWeight/len(targetChannels) < 10 {
-		// when the average weight is less than 10, set smoothing factor to 100
-		smoothingFactor = 100
-	}
-
-	// Calculate the total weight of all channels up to endIdx
-	totalWeight := sumWeight * smoothingFactor
-
-	// Generate a random value in the range [0, totalWeight)
-	randomWeight := rand.Intn(totalWeight)
-
-	// Find a channel based on its weight
-	for _, channel := range targetChannels {
-		randomWeight -= channel.GetWeight()*smoothingFactor + smoothingAdjustment
-		if randomWeight < 0 {
-			return channel, nil
-		}
+	// 同一优先级内按分组 / 模型配置的策略选择渠道
+	if channel := selectChannelByStrategy(group, model, targetChannels); channel != nil {
+		return channel, nil
 	}
 	// return null if no channel is not found
 	return nil, errors.New("channel not found")
@@ -0,0 +1,64 @@
+package model
+
+import (
+	"github.com/QuantumNous/new-api/common"
+)
+
+// MultiKeyChannelState 多 key 渠道中各状态 key 的数量，用于监控
+type MultiKeyChannelState struct {
+	ChannelId   int
+	ChannelType int
+	Enabled     int
+	Disabled    int
+	BreakerOpen int // 熔断中的 key，同时计入 Enabled
+}
+
+// GetMultiKeyChannelStates 统计所有多 key 渠道的 key 状态，开启内存缓存时不查询数据库
+func GetMultiKeyChannelStates() ([]MultiKeyChannelState, error) {
+	var channels []*Channel
+	if common.MemoryCacheEnabled {
+		channelSyncLock.RLock()
+		for _, channel := range channelsIDM {
+			if channel.ChannelInfo.IsMultiKey {
+				channels = append(channels, channel)
+			}
+		}
+		channelSyncLock.RUnlock()
+	} else {
+		if err := DB.Select("id", "type", "channel_info").Find(&channels).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	states := make([]MultiKeyChannelState, 0, len(channels))
+	for _, channel := range channels {
+		if !channel.ChannelInfo.IsMultiKey {
+			continue
+		}
+		// 与 GetNextEnabledKey 使用同一把锁，避免并发读写 MultiKeyStatusList
+		lock := GetChannelPollingLock(channel.Id)
+		lock.Lock()
+		size := channel.ChannelInfo.MultiKeySize
+		disabled := make(map[int]bool, len(channel.ChannelInfo.MultiKeyStatusList))
+		for idx, status := range channel.ChannelInfo.MultiKeyStatusList {
+			if status != common.ChannelStatusEnabled {
+				disabled[idx] = true
+			}
+		}
+		lock.Unlock()
+
+		state := MultiKeyChannelState{ChannelId: channel.Id, ChannelType: channel.Type}
+		for idx := 0; idx < size; idx++ {
+			if disabled[idx] {
+				state.Disabled++
+				continue
+			}
+			state.Enabled++
+			if GetChannelBreakerState(channel.Id, idx) != BreakerStateClosed {
+				state.BreakerOpen++
+			}
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
@@ -0,0 +1,335 @@
+package model
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+	"github.com/QuantumNous/new-api/setting/ratio_setting"
+)
+
+const (
+	rateLimitStatusAvailable = iota
+	rateLimitStatusNearExhaustion
+	rateLimitStatusBenched
+)
+
+// 上游没有返回重置时间时，限流窗口按一分钟计算
+const defaultRateLimitWindow = time.Minute
+
+type rateLimitWindow struct {
+	limit     int64
+	remaining int64
+	resetAt   time.Time
+}
+
+func (w *rateLimitWindow) nearExhaustion(now time.Time, ratio float64) bool {
+	if w == nil || w.limit <= 0 || !now.Before(w.resetAt) {
+		return false
+	}
+	return w.remaining <= 0 || float64(w.remaining) <= float64(w.limit)*ratio
+}
+
+// channelRateLimit 从上游响应头中学习到的限流状态，keyIndex 为 -1 时表示非多 key 渠道
+type channelRateLimit struct {
+	mu           sync.Mutex
+	requests     *rateLimitWindow
+	tokens       *rateLimitWindow
+	benchedUntil time.Time
+}
+
+var channelRateLimits sync.Map // channelBreakerKey -> *channelRateLimit
+
+func getChannelRateLimit(channelId int, keyIndex int) *channelRateLimit {
+	key := channelBreakerKey{channelId: channelId, keyIndex: keyIndex}
+	if state, ok := channelRateLimits.Load(key); ok {
+		return state.(*channelRateLimit)
+	}
+	state, _ := channelRateLimits.LoadOrStore(key, &channelRateLimit{})
+	return state.(*channelRateLimit)
+}
+
+func (s *channelRateLimit) status(setting *operation_setting.ChannelRateLimitSetting, now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Before(s.benchedUntil) {
+		return rateLimitStatusBenched
+	}
+	if s.requests.nearExhaustion(now, setting.NearExhaustionRatio) || s.tokens.nearExhaustion(now, setting.NearExhaustionRatio) {
+		return rateLimitStatusNearExhaustion
+	}
+	return rateLimitStatusAvailable
+}
+
+// parseRateLimitReset 解析限流窗口的重置时间，OpenAI 使用 "6m0s"、"20ms" 这样的时长，Anthropic 使用 RFC3339 时间
+func parseRateLimitReset(value string, now time.Time) time.Time {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return now.Add(defaultRateLimitWindow)
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(d)
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return now.Add(time.Duration(seconds * float64(time.Second)))
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t
+	}
+	return now.Add(defaultRateLimitWindow)
+}
+
+func parseRateLimitWindow(header http.Header, limitKey string, remainingKey string, resetKey string, now time.Time) *rateLimitWindow {
+	remaining, err := strconv.ParseInt(strings.TrimSpace(header.Get(remainingKey)), 10, 64)
+	if err != nil {
+		return nil
+	}
+	limit, _ := strconv.ParseInt(strings.TrimSpace(header.Get(limitKey)), 10, 64)
+	return &rateLimitWindow{
+		limit:     limit,
+		remaining: remaining,
+		resetAt:   parseRateLimitReset(header.Get(resetKey), now),
+	}
+}
+
+// tighterRateLimitWindow 返回剩余比例更低的窗口
+func tighterRateLimitWindow(a *rateLimitWindow, b *rateLimitWindow) *rateLimitWindow {
+	if a == nil || a.limit <= 0 {
+		return b
+	}
+	if b == nil || b.limit <= 0 {
+		return a
+	}
+	if float64(b.remaining)/float64(b.limit) < float64(a.remaining)/float64(a.limit) {
+		return b
+	}
+	return a
+}
+
+func parseRequestsRateLimitWindow(header http.Header, now time.Time) *rateLimitWindow {
+	if window := parseRateLimitWindow(header, "x-ratelimit-limit-requests", "x-ratelimit-remaining-requests", "x-ratelimit-reset-requests", now); window != nil {
+		return window
+	}
+	return parseRateLimitWindow(header, "anthropic-ratelimit-requests-limit", "anthropic-ratelimit-requests-remaining", "anthropic-ratelimit-requests-reset", now)
+}
+
+func parseTokensRateLimitWindow(header http.Header, now time.Time) *rateLimitWindow {
+	if window := parseRateLimitWindow(header, "x-ratelimit-limit-tokens", "x-ratelimit-remaining-tokens", "x-ratelimit-reset-tokens", now); window != nil {
+		return window
+	}
+	// Anthropic 同时返回总 token 与输入、输出 token 的限额，取剩余比例最低的一项
+	var window *rateLimitWindow
+	for _, prefix := range []string{"anthropic-ratelimit-tokens", "anthropic-ratelimit-input-tokens", "anthropic-ratelimit-output-tokens"} {
+		window = tighterRateLimitWindow(window, parseRateLimitWindow(header, prefix+"-limit", prefix+"-remaining", prefix+"-reset", now))
+	}
+	return window
+}
+
+// parseRetryAfter 解析 retry-after-ms 或 retry-after（秒数或 HTTP 日期）
+func parseRetryAfter(header http.Header, now time.Time) (time.Duration, bool) {
+	if value := strings.TrimSpace(header.Get("retry-after-ms")); value != "" {
+		if ms, err := strconv.ParseFloat(value, 64); err == nil && ms >= 0 {
+			return time.Duration(ms * float64(time.Millisecond)), true
+		}
+	}
+	value := strings.TrimSpace(header.Get("retry-after"))
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds >= 0 {
+		return time.Duration(seconds * float64(time.Second)), true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return t.Sub(now), true
+	}
+	return 0, false
+}
+
+// RecordChannelRateLimitHeaders 根据上游响应头更新渠道或 key 的限流状态，返回 429 的 key 在 retry-after 之前不再使用。
+// keyIndex 为 -1 表示非多 key 渠道
+func RecordChannelRateLimitHeaders(channelId int, keyIndex int, statusCode int, header http.Header) {
+	setting := operation_setting.GetChannelRateLimitSetting()
+	if !setting.Enabled || header == nil {
+		return
+	}
+	now := time.Now()
+	requests := parseRequestsRateLimitWindow(header, now)
+	tokens := parseTokensRateLimitWindow(header, now)
+	retryAfter, hasRetryAfter := parseRetryAfter(header, now)
+	if requests == nil && tokens == nil && statusCode != http.StatusTooManyRequests {
+		return
+	}
+
+	state := getChannelRateLimit(channelId, keyIndex)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if requests != nil {
+		state.requests = requests
+	}
+	if tokens != nil {
+		state.tokens = tokens
+	}
+	if statusCode != http.StatusTooManyRequests {
+		if statusCode >= 200 && statusCode < 300 {
+			state.benchedUntil = time.Time{}
+		}
+		return
+	}
+
+	if !hasRetryAfter {
+		// 没有 retry-after 时优先使用已耗尽窗口的重置时间
+		retryAfter = time.Duration(setting.DefaultRetryAfterSeconds) * time.Second
+		for _, window := range []*rateLimitWindow{state.requests, state.tokens} {
+			if window != nil && window.remaining <= 0 && window.resetAt.After(now) {
+				retryAfter = window.resetAt.Sub(now)
+			}
+		}
+	}
+	if setting.MaxRetryAfterSeconds > 0 && retryAfter > time.Duration(setting.MaxRetryAfterSeconds)*time.Second {
+		retryAfter = time.Duration(setting.MaxRetryAfterSeconds) * time.Second
+	}
+	if retryAfter <= 0 {
+		return
+	}
+	benched := now.Before(state.benchedUntil)
+	state.benchedUntil = now.Add(retryAfter)
+	if !benched {
+		if keyIndex >= 0 {
+			common.SysLog(fmt.Sprintf("渠道 #%d 的第 %d 个 key 被上游限流，%s 内暂停使用", channelId, keyIndex, retryAfter.Round(time.Millisecond)))
+		} else {
+			common.SysLog(fmt.Sprintf("渠道 #%d 被上游限流，%s 内暂停使用", channelId, retryAfter.Round(time.Millisecond)))
+		}
+	}
+}
+
+func getRateLimitStatus(channelId int, keyIndex int, setting *operation_setting.ChannelRateLimitSetting, now time.Time) int {
+	state, ok := channelRateLimits.Load(channelBreakerKey{channelId: channelId, keyIndex: keyIndex})
+	if !ok {
+		return rateLimitStatusAvailable
+	}
+	return state.(*channelRateLimit).status(setting, now)
+}
+
+// getChannelRateLimitStatus 多 key 渠道的状态取决于其中状态最好的 key
+func getChannelRateLimitStatus(channel *Channel, setting *operation_setting.ChannelRateLimitSetting, now time.Time) int {
+	if !channel.ChannelInfo.IsMultiKey {
+		return getRateLimitStatus(channel.Id, -1, setting, now)
+	}
+	status := rateLimitStatusBenched
+	for keyIndex := 0; keyIndex < channel.ChannelInfo.MultiKeySize; keyIndex++ {
+		if keyStatus := getRateLimitStatus(channel.Id, keyIndex, setting, now); keyStatus < status {
+			status = keyStatus
+			if status == rateLimitStatusAvailable {
+				break
+			}
+		}
+	}
+	return status
+}
+
+// IsChannelRateLimited 渠道（多 key 渠道为全部 key）是否因上游返回 429 暂停使用
+func IsChannelRateLimited(channel *Channel) bool {
+	setting := operation_setting.GetChannelRateLimitSetting()
+	if !setting.Enabled || channel == nil {
+		return false
+	}
+	return getChannelRateLimitStatus(channel, setting, time.Now()) == rateLimitStatusBenched
+}
+
+// preferLeastRateLimited 优先返回未限流的候选，其次返回接近限额的候选，全部暂停使用时返回空切片
+func preferLeastRateLimited(ids []int, status func(id int) int) []int {
+	available := make([]int, 0, len(ids))
+	nearExhaustion := make([]int, 0)
+	for _, id := range ids {
+		switch status(id) {
+		case rateLimitStatusAvailable:
+			available = append(available, id)
+		case rateLimitStatusNearExhaustion:
+			nearExhaustion = append(nearExhaustion, id)
+		}
+	}
+	if len(available) > 0 {
+		return available
+	}
+	return nearExhaustion
+}
+
+// filterRateLimitedChannels 过滤掉上游限流中的渠道，channelM 为候选渠道的详情
+func filterRateLimitedChannels(channelIds []int, channelM map[int]*Channel) []int {
+	setting := operation_setting.GetChannelRateLimitSetting()
+	if !setting.Enabled {
+		return channelIds
+	}
+	now := time.Now()
+	return preferLeastRateLimited(channelIds, func(channelId int) int {
+		channel, ok := channelM[channelId]
+		if !ok {
+			return rateLimitStatusAvailable
+		}
+		return getChannelRateLimitStatus(channel, setting, now)
+	})
+}
+
+// filterRateLimitedKeys 过滤掉上游限流中的 key
+func filterRateLimitedKeys(channelId int, keyIndexes []int) []int {
+	setting := operation_setting.GetChannelRateLimitSetting()
+	if !setting.Enabled {
+		return keyIndexes
+	}
+	now := time.Now()
+	return preferLeastRateLimited(keyIndexes, func(keyIndex int) int {
+		return getRateLimitStatus(channelId, keyIndex, setting, now)
+	})
+}
+
+// GetModelChannels 获取分组下该模型的全部启用渠道，开启内存缓存时从缓存读取，否则查询数据库
+func GetModelChannels(group string, model string) ([]*Channel, error) {
+	if !common.MemoryCacheEnabled {
+		var channelIds []int
+		err := DB.Model(&Ability{}).Where(commonGroupCol+" = ? and model = ? and enabled = ?", group, model, true).
+			Distinct("channel_id").Pluck("channel_id", &channelIds).Error
+		if err != nil || len(channelIds) == 0 {
+			return nil, err
+		}
+		var channels []*Channel
+		err = DB.Where("id in ?", channelIds).Find(&channels).Error
+		return channels, err
+	}
+	channelSyncLock.RLock()
+	defer channelSyncLock.RUnlock()
+	channelIds := group2model2channels[group][model]
+	if len(channelIds) == 0 {
+		channelIds = group2model2channels[group][ratio_setting.FormatMatchingModelName(model)]
+	}
+	channels := make([]*Channel, 0, len(channelIds))
+	for _, channelId := range channelIds {
+		if channel, ok := channelsIDM[channelId]; ok {
+			channels = append(channels, channel)
+		}
+	}
+	return channels, nil
+}
+
+// IsModelChannelsSaturated 渠道是否全部无法立即使用：因上游返回 429 暂停使用，或本节点在途请求数已达到最大并发数
+func IsModelChannelsSaturated(channels []*Channel) bool {
+	if len(channels) == 0 {
+		return false
+	}
+	setting := operation_setting.GetChannelRateLimitSetting()
+	now := time.Now()
+	for _, channel := range channels {
+		if setting.Enabled && getChannelRateLimitStatus(channel, setting, now) == rateLimitStatusBenched {
+			continue
+		}
+		if IsChannelAtConcurrencyCap(channel) {
+			continue
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,250 @@
+package model
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+)
+
+// 渠道实时转发统计，仅保存在本节点内存中，用于同一优先级内的渠道选择
+type channelStatsKey struct {
+	channelId int
+	model     string
+}
+
+type channelStats struct {
+	mu          sync.Mutex
+	latencyEWMA float64 // 毫秒，流式请求为首字延迟
+	errorEWMA   float64 // 0~1
+	updatedAt   int64
+}
+
+var channelStatsMap sync.Map    // channelStatsKey -> *channelStats
+var channelInflightMap sync.Map // channelId -> *atomic.Int64
+
+func getChannelInflightCounter(channelId int) *atomic.Int64 {
+	if counter, ok := channelInflightMap.Load(channelId); ok {
+		return counter.(*atomic.Int64)
+	}
+	counter, _ := channelInflightMap.LoadOrStore(channelId, &atomic.Int64{})
+	return counter.(*atomic.Int64)
+}
+
+// IncreaseChannelInflight 渠道开始处理一个请求
+func IncreaseChannelInflight(channelId int) {
+	getChannelInflightCounter(channelId).Add(1)
+}
+
+// DecreaseChannelInflight 渠道处理完一个请求
+func DecreaseChannelInflight(channelId int) {
+	getChannelInflightCounter(channelId).Add(-1)
+}
+
+func GetChannelInflight(channelId int) int64 {
+	return getChannelInflightCounter(channelId).Load()
+}
+
+// IsChannelAtConcurrencyCap 本节点在途请求数是否已达到渠道设置的最大并发数
+func IsChannelAtConcurrencyCap(channel *Channel) bool {
+	if channel == nil {
+		return false
+	}
+	maxConcurrency := channel.GetOtherSettings().MaxConcurrency
+	return maxConcurrency > 0 && GetChannelInflight(channel.Id) >= int64(maxConcurrency)
+}
+
+// filterConcurrencyCappedChannels 过滤掉在途请求数已达上限的渠道，channelM 为候选渠道的详情
+func filterConcurrencyCappedChannels(channelIds []int, channelM map[int]*Channel) []int {
+	available := make([]int, 0, len(channelIds))
+	for _, channelId := range channelIds {
+		if !IsChannelAtConcurrencyCap(channelM[channelId]) {
+			available = append(available, channelId)
+		}
+	}
+	return available
+}
+
+// RecordChannelOutcome 记录一次真实转发的结果，latency 为首字延迟或整体耗时
+func RecordChannelOutcome(channelId int, modelName string, latency time.Duration, success bool) {
+	key := channelStatsKey{channelId: channelId, model: modelName}
+	value, _ := channelStatsMap.LoadOrStore(key, &channelStats{})
+	stats := value.(*channelStats)
+
+	setting := operation_setting.GetChannelSelectSetting()
+	alpha := setting.EWMAAlpha
+	if alpha <= 0 || alpha > 1 {
+		alpha = 0.2
+	}
+	errorValue := 0.0
+	if !success {
+		errorValue = 1
+	}
+	latencyMs := float64(latency.Milliseconds())
+	now := time.Now().Unix()
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	if stats.updatedAt == 0 || isChannelStatsExpired(stats.updatedAt, now) {
+		stats.latencyEWMA = latencyMs
+		stats.errorEWMA = errorValue
+	} else {
+		// 失败请求的耗时不代表渠道的正常延迟，只更新错误率
+		if success {
+			stats.latencyEWMA = alpha*latencyMs + (1-alpha)*stats.latencyEWMA
+		}
+		stats.errorEWMA = alpha*errorValue + (1-alpha)*stats.errorEWMA
+	}
+	stats.updatedAt = now
+}
+
+func isChannelStatsExpired(updatedAt int64, now int64) bool {
+	ttl := operation_setting.GetChannelSelectSetting().StatsTTLSeconds
+	return ttl > 0 && now-updatedAt > int64(ttl)
+}
+
+// getChannelStats 返回渠道在该模型上的延迟与错误率，没有数据或数据过期时 ok 为 false
+func getChannelStats(channelId int, modelName string) (latency float64, errorRate float64, ok bool) {
+	value, exist := channelStatsMap.Load(channelStatsKey{channelId: channelId, model: modelName})
+	if !exist {
+		return 0, 0, false
+	}
+	stats := value.(*channelStats)
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	if stats.updatedAt == 0 || isChannelStatsExpired(stats.updatedAt, time.Now().Unix()) {
+		return 0, 0, false
+	}
+	return stats.latencyEWMA, stats.errorEWMA, true
+}
+
+// selectChannelByStrategy 在同一优先级的渠道中按策略选择一个渠道
+func selectChannelByStrategy(group string, modelName string, channels []*Channel) *Channel {
+	switch operation_setting.GetChannelSelectStrategy(group, modelName) {
+	case operation_setting.ChannelSelectStrategyLeastLatency:
+		return selectLeastLatencyChannel(modelName, channels)
+	case operation_setting.ChannelSelectStrategyLeastInflight:
+		return selectLeastInflightChannel(channels)
+	case operation_setting.ChannelSelectStrategyErrorAware:
+		return selectErrorAwareChannel(modelName, channels)
+	default:
+		return selectWeightedRandomChannel(channels)
+	}
+}
+
+// selectWeightedRandomChannel 按渠道权重随机选择
+func selectWeightedRandomChannel(channels []*Channel) *Channel {
+	sumWeight := 0
+	for _, channel := range channels {
+		sumWeight += channel.GetWeight()
+	}
+
+	// smoothing factor and adjustment
+	smoothingFactor := 1
+	smoothingAdjustment := 0
+
+	if sumWeight == 0 {
+		// when all channels have weight 0, set sumWeight to the number of channels and set smoothing adjustment to 100
+		// each channel's effective weight = 100
+		sumWeight = len(channels) * 100
+		smoothingAdjustment = 100
+	} else if sumWeight/len(channels) < 10 {
+		// when the average weight is less than 10, set smoothing factor to 100
+		smoothingFactor = 100
+	}
+
+	// Calculate the total weight of all channels up to endIdx
+	totalWeight := sumWeight * smoothingFactor
+
+	// Generate a random value in the range [0, totalWeight)
+	randomWeight := rand.Intn(totalWeight)
+
+	// Find a channel based on its weight
+	for _, channel := range channels {
+		randomWeight -= channel.GetWeight()*smoothingFactor + smoothingAdjustment
+		if randomWeight < 0 {
+			return channel
+		}
+	}
+	return nil
+}
+
+// selectLeastLatencyChannel 优先尝试还没有统计数据的渠道，其余情况选择延迟最低的渠道，
+// 并按 ExploreRatio 保留少量随机流量，让变快的渠道有机会被重新发现
+func selectLeastLatencyChannel(modelName string, channels []*Channel) *Channel {
+	if rand.Float64() < operation_setting.GetChannelSelectSetting().ExploreRatio {
+		return selectWeightedRandomChannel(channels)
+	}
+	var unknown []*Channel
+	var best *Channel
+	bestLatency := math.MaxFloat64
+	for _, channel := range channels {
+		latency, _, ok := getChannelStats(channel.Id, modelName)
+		if !ok {
+			unknown = append(unknown, channel)
+			continue
+		}
+		if latency < bestLatency {
+			bestLatency = latency
+			best = channel
+		}
+	}
+	if len(unknown) > 0 {
+		return selectWeightedRandomChannel(unknown)
+	}
+	return best
+}
+
+// selectLeastInflightChannel 选择在途请求最少的渠道，数量相同时按权重随机
+func selectLeastInflightChannel(channels []*Channel) *Channel {
+	var candidates []*Channel
+	minInflight := int64(math.MaxInt64)
+	for _, channel := range channels {
+		inflight := GetChannelInflight(channel.Id)
+		if inflight < minInflight {
+			minInflight = inflight
+			candidates = candidates[:0]
+		}
+		if inflight == minInflight {
+			candidates = append(candidates, channel)
+		}
+	}
+	return selectWeightedRandomChannel(candidates)
+}
+
+// selectErrorAwareChannel 按 (1 - 错误率)^2 降低渠道权重后随机选择，权重最低保留 MinWeightRatio
+func selectErrorAwareChannel(modelName string, channels []*Channel) *Channel {
+	minWeightRatio := operation_setting.GetChannelSelectSetting().MinWeightRatio
+	sumBaseWeight := 0
+	for _, channel := range channels {
+		sumBaseWeight += channel.GetWeight()
+	}
+	weights := make([]float64, len(channels))
+	totalWeight := 0.0
+	for i, channel := range channels {
+		baseWeight := float64(channel.GetWeight())
+		if sumBaseWeight == 0 {
+			baseWeight = 1
+		}
+		factor := 1.0
+		if _, errorRate, ok := getChannelStats(channel.Id, modelName); ok {
+			factor = math.Max((1-errorRate)*(1-errorRate), minWeightRatio)
+		}
+		weights[i] = baseWeight * factor
+		totalWeight += weights[i]
+	}
+	if totalWeight <= 0 {
+		return selectWeightedRandomChannel(channels)
+	}
+	randomWeight := rand.Float64() * totalWeight
+	for i, channel := range channels {
+		randomWeight -= weights[i]
+		if randomWeight < 0 {
+			return channel
+		}
+	}
+	return channels[len(channels)-1]
+}
@@ -0,0 +1,121 @@
+package model
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+const (
+	FileStatusActive  = "active"
+	FileStatusDeleted = "deleted"
+)
+
+// File 记录上游文件 ID 与渠道的映射关系，后续的查询、下载、删除都会被路由回上传时使用的渠道
+type File struct {
+	Id        int    `json:"id"`
+	FileId    string `json:"file_id" gorm:"type:varchar(191);uniqueIndex"` // 上游返回的文件 ID
+	UserId    int    `json:"user_id" gorm:"index"`
+	TokenId   int    `json:"token_id"`
+	ChannelId int    `json:"channel_id" gorm:"index"`
+	Group     string `json:"group" gorm:"type:varchar(50)"`
+	Purpose   string `json:"purpose" gorm:"type:varchar(64);index"`
+	Filename  string `json:"filename"`
+	Bytes     int64  `json:"bytes"`
+	Status    string `json:"status" gorm:"type:varchar(20);index"`
+	CreatedAt int64  `json:"created_at" gorm:"bigint;index"`
+	ExpiresAt int64  `json:"expires_at" gorm:"bigint"`
+	BilledAt  int64  `json:"billed_at" gorm:"bigint"` // 存储费用已结算到的时间点
+	Quota     int    `json:"quota"`                   // 累计存储费用
+	// 禁止返回给用户，多 key 渠道下记录上传时使用的 key
+	PrivateData TaskPrivateData `json:"-" gorm:"column:private_data;type:json"`
+}
+
+func (file *File) Insert() error {
+	return DB.Create(file).Error
+}
+
+func (file *File) Update() error {
+	return DB.Save(file).Error
+}
+
+// GetUserFileByFileId 只返回属于该用户且未删除的文件，不属于该用户时视为不存在
+func GetUserFileByFileId(userId int, fileId string) (*File, bool, error) {
+	if fileId == "" {
+		return nil, false, nil
+	}
+	var file *File
+	err := DB.Where("file_id = ? and user_id = ? and status = ?", fileId, userId, FileStatusActive).First(&file).Error
+	exist, err := RecordExist(err)
+	if err != nil {
+		return nil, false, err
+	}
+	return file, exist, nil
+}
+
+func GetFileByFileId(fileId string) (*File, bool, error) {
+	if fileId == "" {
+		return nil, false, nil
+	}
+	var file *File
+	err := DB.Where("file_id = ?", fileId).First(&file).Error
+	exist, err := RecordExist(err)
+	if err != nil {
+		return nil, false, err
+	}
+	return file, exist, nil
+}
+
+func GetUserFiles(userId int, purpose string, after string, limit int, order string) ([]*File, error) {
+	var files []*File
+	query := DB.Where("user_id = ? and status = ?", userId, FileStatusActive)
+	if purpose != "" {
+		query = query.Where("purpose = ?", purpose)
+	}
+	desc := order != "asc"
+	if after != "" {
+		var cursor File
+		err := DB.Select("id").Where("file_id = ? and user_id = ?", after, userId).First(&cursor).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return files, nil
+			}
+			return nil, err
+		}
+		if desc {
+			query = query.Where("id < ?", cursor.Id)
+		} else {
+			query = query.Where("id > ?", cursor.Id)
+		}
+	}
+	if desc {
+		query = query.Order("id desc")
+	} else {
+		query = query.Order("id asc")
+	}
+	err := query.Limit(limit).Find(&files).Error
+	return files, err
+}
+
+// GetActiveFilesAfterId 按 id 分批遍历所有未删除的文件，用于存储计费
+func GetActiveFilesAfterId(lastId int, limit int) ([]*File, error) {
+	var files []*File
+	err := DB.Where("id > ? and status = ?", lastId, FileStatusActive).Order("id asc").Limit(limit).Find(&files).Error
+	return files, err
+}
+
+func MarkFileDeleted(id int) error {
+	return DB.Model(&File{}).Where("id = ?", id).Update("status", FileStatusDeleted).Error
+}
+
+// UpdateFileBilling 原子地推进存储计费时间点，防止多次结算同一时间段
+func UpdateFileBilling(id int, oldBilledAt int64, newBilledAt int64, quota int) (bool, error) {
+	result := DB.Model(&File{}).Where("id = ? and billed_at = ?", id, oldBilledAt).Updates(map[string]any{
+		"billed_at": newBilledAt,
+		"quota":     gorm.Expr("quota + ?", quota),
+	})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
@@ -0,0 +1,39 @@
+package model
+
+import (
+	"strings"
+
+	"gorm.io/gorm/clause"
+)
+
+// FineTunedModel 记录微调任务产出的模型归属，模型只允许训练它的用户（或同分组用户）使用
+type FineTunedModel struct {
+	Id        int    `json:"id"`
+	ModelName string `json:"model_name" gorm:"type:varchar(191);uniqueIndex"`
+	BaseModel string `json:"base_model" gorm:"type:varchar(191)"`
+	UserId    int    `json:"user_id" gorm:"index"`
+	Group     string `json:"group" gorm:"type:varchar(50)"`
+	ChannelId int    `json:"channel_id" gorm:"index"`
+	JobId     string `json:"job_id" gorm:"type:varchar(191)"`
+	CreatedAt int64  `json:"created_at" gorm:"bigint"`
+}
+
+// IsFineTunedModelName 是否为 OpenAI 微调模型名，如 ft:gpt-4o-mini-2024-07-18:org::abc123
+func IsFineTunedModelName(modelName string) bool {
+	return strings.HasPrefix(modelName, "ft:")
+}
+
+// Insert 同一个模型只记录一次，重复同步时直接忽略
+func (m *FineTunedModel) Insert() error {
+	return DB.Clauses(clause.OnConflict{DoNothing: true}).Create(m).Error
+}
+
+func GetFineTunedModel(modelName string) (*FineTunedModel, bool, error) {
+	var m *FineTunedModel
+	err := DB.Where("model_name = ?", modelName).First(&m).Error
+	exist, err := RecordExist(err)
+	if err != nil {
+		return nil, false, err
+	}
+	return m, exist, nil
+}
@@ -0,0 +1,105 @@
+package model
+
+import (
+	"github.com/QuantumNous/new-api/common"
+
+	"gorm.io/gorm"
+)
+
+const (
+	GeminiCachedContentStatusActive  = "active"
+	GeminiCachedContentStatusDeleted = "deleted"
+)
+
+// GeminiCachedContent 记录 Gemini 上下文缓存与渠道的映射关系，缓存只存在于创建它的渠道与 key 上，
+// 引用缓存的请求以及查询、更新、删除都会被路由回创建时使用的渠道
+type GeminiCachedContent struct {
+	Id          int    `json:"id"`
+	Name        string `json:"name" gorm:"type:varchar(191);uniqueIndex"` // 上游返回的缓存名称，形如 cachedContents/xxx
+	UserId      int    `json:"user_id" gorm:"index"`
+	TokenId     int    `json:"token_id"`
+	ChannelId   int    `json:"channel_id" gorm:"index"`
+	KeyIndex    int    `json:"-"` // 多 key 渠道下创建缓存时使用的 key
+	Group       string `json:"group" gorm:"type:varchar(50)"`
+	Model       string `json:"model" gorm:"type:varchar(255)"`
+	DisplayName string `json:"display_name"`
+	TotalTokens int    `json:"total_tokens"`
+	Status      string `json:"status" gorm:"type:varchar(20);index"`
+	CreatedAt   int64  `json:"created_at" gorm:"bigint;index"`
+	UpdatedAt   int64  `json:"updated_at" gorm:"bigint"`
+	ExpiresAt   int64  `json:"expires_at" gorm:"bigint"`
+	BilledAt    int64  `json:"billed_at" gorm:"bigint"` // 存储费用已结算到的时间点
+	Quota       int    `json:"quota"`                   // 累计存储费用
+}
+
+func (cachedContent *GeminiCachedContent) Insert() error {
+	return DB.Create(cachedContent).Error
+}
+
+// GetUserGeminiCachedContentByName 只返回属于该用户且未删除的缓存，不属于该用户时视为不存在
+func GetUserGeminiCachedContentByName(userId int, name string) (*GeminiCachedContent, bool, error) {
+	if name == "" {
+		return nil, false, nil
+	}
+	var cachedContent *GeminiCachedContent
+	err := DB.Where("name = ? and user_id = ? and status = ?", name, userId, GeminiCachedContentStatusActive).First(&cachedContent).Error
+	exist, err := RecordExist(err)
+	if err != nil {
+		return nil, false, err
+	}
+	return cachedContent, exist, nil
+}
+
+func GetActiveGeminiCachedContentByName(name string) (*GeminiCachedContent, bool, error) {
+	if name == "" {
+		return nil, false, nil
+	}
+	var cachedContent *GeminiCachedContent
+	err := DB.Where("name = ? and status = ?", name, GeminiCachedContentStatusActive).First(&cachedContent).Error
+	exist, err := RecordExist(err)
+	if err != nil {
+		return nil, false, err
+	}
+	return cachedContent, exist, nil
+}
+
+// GetUserGeminiCachedContents 按 id 倒序分页，afterId 为上一页最后一条记录的 id
+func GetUserGeminiCachedContents(userId int, afterId int, limit int) ([]*GeminiCachedContent, error) {
+	var cachedContents []*GeminiCachedContent
+	query := DB.Where("user_id = ? and status = ? and expires_at > ?", userId, GeminiCachedContentStatusActive, common.GetTimestamp())
+	if afterId > 0 {
+		query = query.Where("id < ?", afterId)
+	}
+	err := query.Order("id desc").Limit(limit).Find(&cachedContents).Error
+	return cachedContents, err
+}
+
+// GetActiveGeminiCachedContentsAfterId 按 id 分批遍历所有未删除的缓存，用于存储计费
+func GetActiveGeminiCachedContentsAfterId(lastId int, limit int) ([]*GeminiCachedContent, error) {
+	var cachedContents []*GeminiCachedContent
+	err := DB.Where("id > ? and status = ?", lastId, GeminiCachedContentStatusActive).Order("id asc").Limit(limit).Find(&cachedContents).Error
+	return cachedContents, err
+}
+
+func UpdateGeminiCachedContentExpiresAt(id int, expiresAt int64, updatedAt int64) error {
+	return DB.Model(&GeminiCachedContent{}).Where("id = ?", id).Updates(map[string]any{
+		"expires_at": expiresAt,
+		"updated_at": updatedAt,
+	}).Error
+}
+
+func MarkGeminiCachedContentDeleted(id int) error {
+	return DB.Model(&GeminiCachedContent{}).Where("id = ?", id).Update("status", GeminiCachedContentStatusDeleted).Error
+}
+
+// UpdateGeminiCachedContentBilling 原子地推进存储计费时间点，防止多次结算同一时间段
+func UpdateGeminiCachedContentBilling(id int, oldBilledAt int64, newBilledAt int64, quota int) (bool, error) {
+	result := DB.Model(&GeminiCachedContent{}).Where("id = ? and billed_at = ?", id, oldBilledAt).Updates(map[string]any{
+		"billed_at": newBilledAt,
+		"quota":     gorm.Expr("quota + ?", quota),
+	})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
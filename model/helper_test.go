@@ -0,0 +1,24 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"github.com/glebarez/sqlite"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// setupTestDB 使用内存 SQLite 替换数据库并关闭 Redis，测试结束后恢复
+func setupTestDB(t *testing.T, models ...any) {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(models...))
+	origDB, origRedis := DB, common.RedisEnabled
+	DB, common.RedisEnabled = db, false
+	t.Cleanup(func() {
+		DB, common.RedisEnabled = origDB, origRedis
+	})
+}
@@ -268,6 +268,12 @@ func migrateDB() error {
 		&TwoFA{},
 		&TwoFABackupCode{},
 		&Checkin{},
+		&File{},
+		&FineTunedModel{},
+		&BudgetSpend{},
+		&StoredResponse{},
+		&GeminiCachedContent{},
+		&QuotaLedger{},
 	)
 	if err != nil {
 		return err
@@ -302,6 +308,12 @@ func migrateDBFast() error {
 		{&TwoFA{}, "TwoFA"},
 		{&TwoFABackupCode{}, "TwoFABackupCode"},
 		{&Checkin{}, "Checkin"},
+		{&File{}, "File"},
+		{&FineTunedModel{}, "FineTunedModel"},
+		{&BudgetSpend{}, "BudgetSpend"},
+		{&StoredResponse{}, "StoredResponse"},
+		{&GeminiCachedContent{}, "GeminiCachedContent"},
+		{&QuotaLedger{}, "QuotaLedger"},
 	}
 	// 动态计算migration数量，确保errChan缓冲区足够大
 	errChan := make(chan error, len(migrations))
@@ -0,0 +1,157 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/QuantumNous/new-api/common"
+)
+
+// ModelContextLimit 模型的上下文长度与最大输出 token 数，来自模型元数据，0 表示未知
+type ModelContextLimit struct {
+	ContextWindow   int
+	MaxOutputTokens int
+}
+
+// ContextRequirement 请求需要的上下文：预估的提示 token 数与请求的最大输出 token 数
+type ContextRequirement struct {
+	PromptTokens int
+	MaxTokens    int
+}
+
+// Fits 模型能否容纳该请求，上下文长度未知时视为可以
+func (l ModelContextLimit) Fits(requirement ContextRequirement) bool {
+	if l.ContextWindow <= 0 || requirement.PromptTokens <= 0 {
+		return true
+	}
+	return requirement.PromptTokens+l.OutputReserve(requirement.MaxTokens) <= l.ContextWindow
+}
+
+// OutputReserve 需要为输出预留的 token 数，超出模型最大输出的部分上游不会生成，按最大输出计算
+func (l ModelContextLimit) OutputReserve(maxTokens int) int {
+	if l.MaxOutputTokens > 0 && maxTokens > l.MaxOutputTokens {
+		return l.MaxOutputTokens
+	}
+	return maxTokens
+}
+
+// ErrContextLengthExceeded 分组下该模型的渠道上下文长度均不足以容纳请求
+var ErrContextLengthExceeded = errors.New("context length exceeded")
+
+var (
+	modelContextLimitLock  sync.RWMutex
+	modelContextLimitExact = make(map[string]ModelContextLimit)
+	modelContextLimitRules []*Model // 非精确匹配的模型，依次按前缀、后缀、包含规则匹配
+)
+
+// RefreshModelContextLimits 从模型元数据重新加载上下文长度
+func RefreshModelContextLimits() {
+	var metas []*Model
+	err := DB.Select("model_name", "name_rule", "context_window", "max_output_tokens").
+		Where("context_window > 0 OR max_output_tokens > 0").Find(&metas).Error
+	if err != nil {
+		common.SysLog(fmt.Sprintf("failed to load model context limits: %s", err.Error()))
+		return
+	}
+	exact := make(map[string]ModelContextLimit)
+	rules := make([]*Model, 0)
+	for _, nameRule := range []int{NameRulePrefix, NameRuleSuffix, NameRuleContains} {
+		for _, meta := range metas {
+			if meta.NameRule == nameRule {
+				rules = append(rules, meta)
+			}
+		}
+	}
+	for _, meta := range metas {
+		if meta.NameRule == NameRuleExact {
+			exact[meta.ModelName] = ModelContextLimit{ContextWindow: meta.ContextWindow, MaxOutputTokens: meta.MaxOutputTokens}
+		}
+	}
+	modelContextLimitLock.Lock()
+	modelContextLimitExact = exact
+	modelContextLimitRules = rules
+	modelContextLimitLock.Unlock()
+}
+
+// HasModelContextLimits 是否有模型配置了上下文长度，没有时无需估算请求的上下文
+func HasModelContextLimits() bool {
+	modelContextLimitLock.RLock()
+	defer modelContextLimitLock.RUnlock()
+	return len(modelContextLimitExact) > 0 || len(modelContextLimitRules) > 0
+}
+
+// GetModelContextLimit 查询模型的上下文长度，先精确匹配，再依次按前缀、后缀、包含规则匹配
+func GetModelContextLimit(modelName string) (ModelContextLimit, bool) {
+	modelContextLimitLock.RLock()
+	defer modelContextLimitLock.RUnlock()
+	if limit, ok := modelContextLimitExact[modelName]; ok {
+		return limit, true
+	}
+	for _, meta := range modelContextLimitRules {
+		var matched bool
+		switch meta.NameRule {
+		case NameRulePrefix:
+			matched = strings.HasPrefix(modelName, meta.ModelName)
+		case NameRuleSuffix:
+			matched = strings.HasSuffix(modelName, meta.ModelName)
+		case NameRuleContains:
+			matched = strings.Contains(modelName, meta.ModelName)
+		}
+		if matched {
+			return ModelContextLimit{ContextWindow: meta.ContextWindow, MaxOutputTokens: meta.MaxOutputTokens}, true
+		}
+	}
+	return ModelContextLimit{}, false
+}
+
+// GetChannelContextLimit 查询渠道实际请求的模型（按渠道的模型重定向）的上下文长度，重定向后的模型未配置时使用请求的模型
+func GetChannelContextLimit(channel *Channel, modelName string) (ModelContextLimit, bool) {
+	if channel != nil {
+		if mapping := channel.GetModelMapping(); mapping != "" && mapping != "{}" {
+			modelMap := make(map[string]string)
+			if err := common.Unmarshal([]byte(mapping), &modelMap); err == nil {
+				current := modelName
+				visited := map[string]bool{current: true}
+				for {
+					mapped, ok := modelMap[current]
+					if !ok || mapped == "" || visited[mapped] {
+						break
+					}
+					visited[mapped] = true
+					current = mapped
+				}
+				if current != modelName {
+					if limit, ok := GetModelContextLimit(current); ok {
+						return limit, true
+					}
+				}
+			}
+		}
+	}
+	return GetModelContextLimit(modelName)
+}
+
+// IsChannelFitContext 渠道能否容纳该请求，上下文长度未知时视为可以
+func IsChannelFitContext(channel *Channel, modelName string, requirement ContextRequirement) bool {
+	if requirement.PromptTokens <= 0 {
+		return true
+	}
+	limit, ok := GetChannelContextLimit(channel, modelName)
+	return !ok || limit.Fits(requirement)
+}
+
+// filterContextFitChannels 过滤掉上下文长度不足以容纳该请求的渠道，channelM 为候选渠道的详情
+func filterContextFitChannels(channelIds []int, channelM map[int]*Channel, modelName string, requirement ContextRequirement) []int {
+	if requirement.PromptTokens <= 0 || !HasModelContextLimits() {
+		return channelIds
+	}
+	fit := make([]int, 0, len(channelIds))
+	for _, channelId := range channelIds {
+		if IsChannelFitContext(channelM[channelId], modelName, requirement) {
+			fit = append(fit, channelId)
+		}
+	}
+	return fit
+}
@@ -39,6 +39,9 @@ type Model struct {
 	QuotaTypes    []int          `json:"quota_types,omitempty" gorm:"-"`
 	NameRule      int            `json:"name_rule" gorm:"default:0"`
 
+	ContextWindow   int `json:"context_window" gorm:"default:0"`    // 上下文长度（输入 + 输出 token 数），0 表示未知
+	MaxOutputTokens int `json:"max_output_tokens" gorm:"default:0"` // 最大输出 token 数，0 表示未知
+
 	MatchedModels []string `json:"matched_models,omitempty" gorm:"-"`
 	MatchedCount  int      `json:"matched_count,omitempty" gorm:"-"`
 }
@@ -0,0 +1,293 @@
+package model
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"gorm.io/gorm"
+)
+
+// 账本中的账户，对应数据库中被记账的字段
+const (
+	QuotaLedgerAccountUserQuota      = "user_quota"       // User.Quota
+	QuotaLedgerAccountUserUsedQuota  = "user_used_quota"  // User.UsedQuota
+	QuotaLedgerAccountUserAffQuota   = "user_aff_quota"   // User.AffQuota
+	QuotaLedgerAccountTokenUsedQuota = "token_used_quota" // Token.UsedQuota
+	// QuotaLedgerAccountSystem 平台侧的对方账户，充值、消费等额度的流入流出都记在这里，不参与对账
+	QuotaLedgerAccountSystem = "system"
+)
+
+// 额度变动来源
+const (
+	QuotaLedgerSourceOpening     = "opening" // 启用账本时的期初余额
+	QuotaLedgerSourceRegister    = "register"
+	QuotaLedgerSourceConsume     = "consume"
+	QuotaLedgerSourceRefund      = "refund"
+	QuotaLedgerSourceTopUp       = "topup"
+	QuotaLedgerSourceRedemption  = "redemption"
+	QuotaLedgerSourceCheckin     = "checkin"
+	QuotaLedgerSourceInvite      = "invite"
+	QuotaLedgerSourceAffTransfer = "aff_transfer"
+	QuotaLedgerSourceAdmin       = "admin"
+)
+
+const quotaLedgerBatchSize = 500
+
+// QuotaLedger 额度账本分录，只追加不修改。每条分录同时记录借贷双方：
+// Account 变动 Delta，CounterAccount 变动 -Delta，所有分录的借贷合计恒为 0
+type QuotaLedger struct {
+	Id                  int    `json:"id"`
+	CreatedAt           int64  `json:"created_at" gorm:"bigint;index"`
+	Account             string `json:"account" gorm:"type:varchar(32);index:idx_quota_ledger_account,priority:1"`
+	SubjectId           int    `json:"subject_id" gorm:"index:idx_quota_ledger_account,priority:2"` // 用户 ID 或令牌 ID
+	CounterAccount      string `json:"counter_account" gorm:"type:varchar(32);index:idx_quota_ledger_counter,priority:1"`
+	CounterSubjectId    int    `json:"counter_subject_id" gorm:"index:idx_quota_ledger_counter,priority:2"`
+	Delta               int    `json:"delta"`
+	BalanceAfter        int    `json:"balance_after"`         // 变动后 Account 在数据库中的余额
+	CounterBalanceAfter int    `json:"counter_balance_after"` // CounterAccount 为系统账户时不记录
+	Source              string `json:"source" gorm:"type:varchar(32);index"`
+	RefId               string `json:"ref_id" gorm:"type:varchar(128);index;default:''"` // 请求 ID、订单号、兑换码 ID 等
+}
+
+// QuotaLedgerRef 额度变动的来源及关联单号，由发起变动的调用方提供
+type QuotaLedgerRef struct {
+	Source string
+	RefId  string
+}
+
+type quotaLedgerAccountKey struct {
+	account   string
+	subjectId int
+}
+
+var quotaLedgerReady atomic.Bool
+
+func newQuotaLedger(account string, subjectId int, delta int, ref QuotaLedgerRef) *QuotaLedger {
+	return newQuotaLedgerTransfer(account, subjectId, QuotaLedgerAccountSystem, 0, delta, ref)
+}
+
+func newQuotaLedgerTransfer(account string, subjectId int, counterAccount string, counterSubjectId int, delta int, ref QuotaLedgerRef) *QuotaLedger {
+	return &QuotaLedger{
+		CreatedAt:        common.GetTimestamp(),
+		Account:          account,
+		SubjectId:        subjectId,
+		CounterAccount:   counterAccount,
+		CounterSubjectId: counterSubjectId,
+		Delta:            delta,
+		Source:           ref.Source,
+		RefId:            ref.RefId,
+	}
+}
+
+// RecordQuotaLedger 记录一笔额度变动，需在更新余额的同一事务中、余额更新之后调用
+func RecordQuotaLedger(tx *gorm.DB, account string, subjectId int, delta int, ref QuotaLedgerRef) error {
+	return writeQuotaLedger(tx, newQuotaLedger(account, subjectId, delta, ref))
+}
+
+// updateWithQuotaLedger 在同一事务中更新余额并写入分录，没有需要记录的变动时直接更新
+func updateWithQuotaLedger(entries []*QuotaLedger, update func(tx *gorm.DB) error) error {
+	for _, entry := range entries {
+		if entry != nil && entry.Delta != 0 {
+			return DB.Transaction(func(tx *gorm.DB) error {
+				if err := update(tx); err != nil {
+					return err
+				}
+				return writeQuotaLedger(tx, entries...)
+			})
+		}
+	}
+	return update(DB)
+}
+
+// writeQuotaLedger 写入分录，需与余额更新在同一事务中调用。BalanceAfter 取更新后数据库中的余额，
+// 同一账户有多条分录时（批量更新）按顺序倒推每条分录变动后的余额
+func writeQuotaLedger(tx *gorm.DB, entries ...*QuotaLedger) error {
+	records := make([]*QuotaLedger, 0, len(entries))
+	for _, entry := range entries {
+		if entry != nil && entry.Delta != 0 {
+			records = append(records, entry)
+		}
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	if started, err := isQuotaLedgerStarted(tx); err != nil || !started {
+		return err
+	}
+
+	balances := make(map[quotaLedgerAccountKey]int)
+	// balanceAfter 返回账户在本条分录变动后的余额，并倒推出变动前的余额供更早的分录使用
+	balanceAfter := func(key quotaLedgerAccountKey, delta int) (int, error) {
+		balance, ok := balances[key]
+		if !ok {
+			var err error
+			if balance, err = getQuotaLedgerBalance(tx, key); err != nil {
+				return 0, err
+			}
+		}
+		balances[key] = balance - delta
+		return balance, nil
+	}
+	var err error
+	for i := len(records) - 1; i >= 0; i-- {
+		record := records[i]
+		record.BalanceAfter, err = balanceAfter(quotaLedgerAccountKey{record.Account, record.SubjectId}, record.Delta)
+		if err != nil {
+			return err
+		}
+		if record.CounterAccount != QuotaLedgerAccountSystem {
+			record.CounterBalanceAfter, err = balanceAfter(quotaLedgerAccountKey{record.CounterAccount, record.CounterSubjectId}, -record.Delta)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tx.CreateInBatches(records, quotaLedgerBatchSize).Error
+}
+
+// getQuotaLedgerBalance 查询账户在数据库中的当前余额，在余额更新之后查询时行锁保证读到的是本次更新后的值
+func getQuotaLedgerBalance(tx *gorm.DB, key quotaLedgerAccountKey) (int, error) {
+	var model any
+	var column string
+	switch key.account {
+	case QuotaLedgerAccountUserQuota:
+		model, column = &User{}, "quota"
+	case QuotaLedgerAccountUserUsedQuota:
+		model, column = &User{}, "used_quota"
+	case QuotaLedgerAccountUserAffQuota:
+		model, column = &User{}, "aff_quota"
+	case QuotaLedgerAccountTokenUsedQuota:
+		model, column = &Token{}, "used_quota"
+	default:
+		return 0, fmt.Errorf("unknown quota ledger account: %s", key.account)
+	}
+	var balance int
+	err := tx.Model(model).Select(column).Where("id = ?", key.subjectId).Scan(&balance).Error
+	return balance, err
+}
+
+// isQuotaLedgerStarted 期初余额写入后才开始记账，避免期初余额写入前的分录被重复计算。
+// 从节点在发现标记分录前每次记账时检查一次，发现后不再查询
+func isQuotaLedgerStarted(tx *gorm.DB) (bool, error) {
+	if quotaLedgerReady.Load() {
+		return true, nil
+	}
+	opened, err := isQuotaLedgerOpened(tx)
+	if err != nil || !opened {
+		return false, err
+	}
+	if quotaLedgerReady.CompareAndSwap(false, true) {
+		common.SysLog("quota ledger opening balances found, start recording")
+	}
+	return true, nil
+}
+
+// InitQuotaLedger 首次启用时由主节点写入所有账户的期初余额，之后开始记账
+func InitQuotaLedger() error {
+	if !common.IsMasterNode {
+		return nil
+	}
+	if err := createQuotaLedgerOpening(); err != nil {
+		return err
+	}
+	quotaLedgerReady.Store(true)
+	return nil
+}
+
+// isQuotaLedgerOpened 期初余额与标记分录（借贷双方均为系统账户）在同一事务中写入，存在标记分录说明期初余额已经写入
+func isQuotaLedgerOpened(db *gorm.DB) (bool, error) {
+	var marker QuotaLedger
+	err := db.Select("id").
+		Where("account = ? AND counter_account = ? AND source = ?", QuotaLedgerAccountSystem, QuotaLedgerAccountSystem, QuotaLedgerSourceOpening).
+		Limit(1).Find(&marker).Error
+	return marker.Id != 0, err
+}
+
+func createQuotaLedgerOpening() error {
+	now := common.GetTimestamp()
+	return DB.Transaction(func(tx *gorm.DB) error {
+		opened, err := isQuotaLedgerOpened(tx)
+		if err != nil || opened {
+			return err
+		}
+		if err := createQuotaLedgerOpeningEntries(tx, now); err != nil {
+			return err
+		}
+		common.SysLog("quota ledger opening balances created")
+		return tx.Create(&QuotaLedger{
+			CreatedAt:      now,
+			Account:        QuotaLedgerAccountSystem,
+			CounterAccount: QuotaLedgerAccountSystem,
+			Source:         QuotaLedgerSourceOpening,
+		}).Error
+	})
+}
+
+func createQuotaLedgerOpeningEntries(tx *gorm.DB, now int64) error {
+	// 余额为 0 的账户不写期初分录，对账时没有分录的账户按 0 计
+	appendOpening := func(entries []*QuotaLedger, account string, subjectId int, balance int) []*QuotaLedger {
+		if balance == 0 {
+			return entries
+		}
+		return append(entries, &QuotaLedger{
+			CreatedAt:      now,
+			Account:        account,
+			SubjectId:      subjectId,
+			CounterAccount: QuotaLedgerAccountSystem,
+			Delta:          balance,
+			BalanceAfter:   balance,
+			Source:         QuotaLedgerSourceOpening,
+		})
+	}
+	var users []*User
+	err := tx.Select("id", "quota", "used_quota", "aff_quota").FindInBatches(&users, quotaLedgerBatchSize, func(_ *gorm.DB, _ int) error {
+		entries := make([]*QuotaLedger, 0, len(users)*3)
+		for _, user := range users {
+			entries = appendOpening(entries, QuotaLedgerAccountUserQuota, user.Id, user.Quota)
+			entries = appendOpening(entries, QuotaLedgerAccountUserUsedQuota, user.Id, user.UsedQuota)
+			entries = appendOpening(entries, QuotaLedgerAccountUserAffQuota, user.Id, user.AffQuota)
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+		return tx.Create(&entries).Error
+	}).Error
+	if err != nil {
+		return err
+	}
+	var tokens []*Token
+	return tx.Select("id", "used_quota").FindInBatches(&tokens, quotaLedgerBatchSize, func(_ *gorm.DB, _ int) error {
+		entries := make([]*QuotaLedger, 0, len(tokens))
+		for _, token := range tokens {
+			entries = appendOpening(entries, QuotaLedgerAccountTokenUsedQuota, token.Id, token.UsedQuota)
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+		return tx.Create(&entries).Error
+	}).Error
+}
+
+// GetQuotaLedgers 分页查询账本分录，account 为空时查询该主体的所有账户
+func GetQuotaLedgers(account string, subjectId int, source string, refId string, pageInfo *common.PageInfo) (ledgers []*QuotaLedger, total int64, err error) {
+	tx := DB.Model(&QuotaLedger{})
+	if account != "" {
+		tx = tx.Where("account = ?", account)
+	}
+	if subjectId != 0 {
+		tx = tx.Where("subject_id = ?", subjectId)
+	}
+	if source != "" {
+		tx = tx.Where("source = ?", source)
+	}
+	if refId != "" {
+		tx = tx.Where("ref_id = ?", refId)
+	}
+	if err = tx.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err = tx.Order("id desc").Limit(pageInfo.GetPageSize()).Offset(pageInfo.GetStartIdx()).Find(&ledgers).Error
+	return ledgers, total, err
+}
@@ -0,0 +1,200 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+
+	"gorm.io/gorm"
+)
+
+// 报告中最多保留的差异条数，同时也是写入系统日志的条数
+const quotaLedgerMaxReportedDrifts = 200
+
+// QuotaLedgerDrift 账户实际余额与账本合计不一致
+type QuotaLedgerDrift struct {
+	Account   string `json:"account"`
+	SubjectId int    `json:"subject_id"`
+	Ledger    int    `json:"ledger"` // 账本中 Delta 的合计
+	Actual    int    `json:"actual"` // 数据库中的实际值
+	Drift     int    `json:"drift"`  // Actual - Ledger
+}
+
+type QuotaLedgerReconcileReport struct {
+	StartedAt  int64              `json:"started_at"`
+	FinishedAt int64              `json:"finished_at"`
+	Checked    int                `json:"checked"`     // 检查的账户数
+	DriftCount int                `json:"drift_count"` // 存在差异的账户数
+	Drifts     []QuotaLedgerDrift `json:"drifts"`
+	Error      string             `json:"error,omitempty"`
+	Running    bool               `json:"running"` // 是否有对账正在进行
+}
+
+var (
+	quotaLedgerReportLock  sync.RWMutex
+	quotaLedgerLastReport  *QuotaLedgerReconcileReport
+	quotaLedgerReconciling atomic.Bool
+)
+
+// quotaLedgerSettleDelay 两次快照之间的等待时间
+const quotaLedgerSettleDelay = 5 * time.Second
+
+// snapshotQuotaLedgerDrifts 对比数据库中的实际值与账本合计，返回检查的账户数与存在差异的账户
+func snapshotQuotaLedgerDrifts() (int, map[quotaLedgerAccountKey]QuotaLedgerDrift, error) {
+	type ledgerSum struct {
+		Account   string
+		SubjectId int
+		Total     int
+	}
+	ledger := make(map[quotaLedgerAccountKey]int)
+	var sums []ledgerSum
+	err := DB.Model(&QuotaLedger{}).Select("account, subject_id, SUM(delta) AS total").
+		Where("account <> ?", QuotaLedgerAccountSystem).
+		Group("account, subject_id").Scan(&sums).Error
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, sum := range sums {
+		ledger[quotaLedgerAccountKey{sum.Account, sum.SubjectId}] += sum.Total
+	}
+	sums = nil
+	err = DB.Model(&QuotaLedger{}).Select("counter_account AS account, counter_subject_id AS subject_id, SUM(delta) AS total").
+		Where("counter_account <> ?", QuotaLedgerAccountSystem).
+		Group("counter_account, counter_subject_id").Scan(&sums).Error
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, sum := range sums {
+		ledger[quotaLedgerAccountKey{sum.Account, sum.SubjectId}] -= sum.Total
+	}
+
+	checked := 0
+	drifts := make(map[quotaLedgerAccountKey]QuotaLedgerDrift)
+	compare := func(account string, subjectId int, actual int) {
+		checked++
+		key := quotaLedgerAccountKey{account, subjectId}
+		if expected := ledger[key]; expected != actual {
+			drifts[key] = QuotaLedgerDrift{
+				Account:   account,
+				SubjectId: subjectId,
+				Ledger:    expected,
+				Actual:    actual,
+				Drift:     actual - expected,
+			}
+		}
+	}
+	var users []*User
+	err = DB.Select("id", "quota", "used_quota", "aff_quota").FindInBatches(&users, quotaLedgerBatchSize, func(_ *gorm.DB, _ int) error {
+		for _, user := range users {
+			compare(QuotaLedgerAccountUserQuota, user.Id, user.Quota)
+			compare(QuotaLedgerAccountUserUsedQuota, user.Id, user.UsedQuota)
+			compare(QuotaLedgerAccountUserAffQuota, user.Id, user.AffQuota)
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return 0, nil, err
+	}
+	var tokens []*Token
+	err = DB.Select("id", "used_quota").FindInBatches(&tokens, quotaLedgerBatchSize, func(_ *gorm.DB, _ int) error {
+		for _, token := range tokens {
+			compare(QuotaLedgerAccountTokenUsedQuota, token.Id, token.UsedQuota)
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return 0, nil, err
+	}
+	return checked, drifts, nil
+}
+
+// ReconcileQuotaLedger 对比 User.Quota、User.UsedQuota、User.AffQuota、Token.UsedQuota 与账本合计。
+// 账本合计与余额分别查询，期间并发的额度变动会造成短暂的差异，因此间隔一段时间对比两次，只报告两次差异相同的账户
+func ReconcileQuotaLedger() *QuotaLedgerReconcileReport {
+	if !quotaLedgerReconciling.CompareAndSwap(false, true) {
+		return GetQuotaLedgerReconcileReport()
+	}
+	defer quotaLedgerReconciling.Store(false)
+
+	report := &QuotaLedgerReconcileReport{StartedAt: common.GetTimestamp(), Drifts: []QuotaLedgerDrift{}}
+	finish := func(err error) *QuotaLedgerReconcileReport {
+		report.FinishedAt = common.GetTimestamp()
+		if err != nil {
+			report.Error = err.Error()
+			common.SysLog("quota ledger reconciliation failed: " + err.Error())
+		}
+		quotaLedgerReportLock.Lock()
+		quotaLedgerLastReport = report
+		quotaLedgerReportLock.Unlock()
+		return report
+	}
+
+	_, first, err := snapshotQuotaLedgerDrifts()
+	if err != nil {
+		return finish(err)
+	}
+	if len(first) > 0 {
+		time.Sleep(quotaLedgerSettleDelay)
+	}
+	checked, second, err := snapshotQuotaLedgerDrifts()
+	if err != nil {
+		return finish(err)
+	}
+	report.Checked = checked
+	for key, drift := range second {
+		if previous, ok := first[key]; ok && previous.Drift == drift.Drift {
+			report.Drifts = append(report.Drifts, drift)
+		}
+	}
+	sort.Slice(report.Drifts, func(i, j int) bool {
+		if report.Drifts[i].Account != report.Drifts[j].Account {
+			return report.Drifts[i].Account < report.Drifts[j].Account
+		}
+		return report.Drifts[i].SubjectId < report.Drifts[j].SubjectId
+	})
+	report.DriftCount = len(report.Drifts)
+	if len(report.Drifts) > quotaLedgerMaxReportedDrifts {
+		report.Drifts = report.Drifts[:quotaLedgerMaxReportedDrifts]
+	}
+	for _, drift := range report.Drifts {
+		common.SysLog(fmt.Sprintf("quota ledger drift: %s %d actual %d, ledger %d, drift %d", drift.Account, drift.SubjectId, drift.Actual, drift.Ledger, drift.Drift))
+	}
+	common.SysLog(fmt.Sprintf("quota ledger reconciliation finished: %d accounts checked, %d drifted", report.Checked, report.DriftCount))
+	return finish(nil)
+}
+
+// GetQuotaLedgerReconcileReport 获取本节点最近一次对账报告，从未对账时返回 nil
+func GetQuotaLedgerReconcileReport() *QuotaLedgerReconcileReport {
+	quotaLedgerReportLock.RLock()
+	defer quotaLedgerReportLock.RUnlock()
+	if quotaLedgerLastReport == nil {
+		if quotaLedgerReconciling.Load() {
+			return &QuotaLedgerReconcileReport{Running: true, Drifts: []QuotaLedgerDrift{}}
+		}
+		return nil
+	}
+	report := *quotaLedgerLastReport
+	report.Running = quotaLedgerReconciling.Load()
+	return &report
+}
+
+// AutomaticallyReconcileQuotaLedger 按设置的间隔定期对账，由主节点运行
+func AutomaticallyReconcileQuotaLedger() {
+	for {
+		setting := operation_setting.GetQuotaLedgerSetting()
+		interval := time.Duration(setting.ReconcileIntervalMinutes) * time.Minute
+		if interval <= 0 {
+			interval = time.Hour
+		}
+		time.Sleep(interval)
+		if !setting.ReconcileEnabled || !quotaLedgerReady.Load() {
+			continue
+		}
+		ReconcileQuotaLedger()
+	}
+}
@@ -0,0 +1,172 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func setupQuotaLedgerTestDB(t *testing.T) {
+	t.Helper()
+	setupTestDB(t, &User{}, &Token{}, &QuotaLedger{})
+	origReady := quotaLedgerReady.Load()
+	quotaLedgerReady.Store(true)
+	t.Cleanup(func() {
+		quotaLedgerReady.Store(origReady)
+	})
+}
+
+func insertQuotaLedgerTestData(t *testing.T) {
+	t.Helper()
+	require.NoError(t, DB.Create(&[]User{
+		{Id: 1, Username: "a", Quota: 1000, UsedQuota: 200, AffQuota: 10, AffCode: "a"},
+		{Id: 2, Username: "b", Quota: 500, AffCode: "b"},
+	}).Error)
+	require.NoError(t, DB.Create(&[]Token{
+		{Id: 1, UserId: 1, Key: "k1", UsedQuota: 200},
+		{Id: 2, UserId: 2, Key: "k2"},
+	}).Error)
+}
+
+func countQuotaLedgers(t *testing.T, query string, args ...any) int64 {
+	t.Helper()
+	var count int64
+	require.NoError(t, DB.Model(&QuotaLedger{}).Where(query, args...).Count(&count).Error)
+	return count
+}
+
+func TestCreateQuotaLedgerOpening(t *testing.T) {
+	tests := []struct {
+		name        string
+		existing    []QuotaLedger
+		wantOpening int64 // 不含标记分录的期初分录数
+	}{
+		{
+			name:        "empty ledger",
+			wantOpening: 5,
+		},
+		{
+			name: "opened ledger is left untouched",
+			existing: []QuotaLedger{
+				{Account: QuotaLedgerAccountSystem, CounterAccount: QuotaLedgerAccountSystem, Source: QuotaLedgerSourceOpening},
+			},
+			wantOpening: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupQuotaLedgerTestDB(t)
+			insertQuotaLedgerTestData(t)
+			if len(tt.existing) > 0 {
+				require.NoError(t, DB.Create(&tt.existing).Error)
+			}
+
+			require.NoError(t, createQuotaLedgerOpening())
+			// 重复调用不会再次写入
+			require.NoError(t, createQuotaLedgerOpening())
+
+			opened, err := isQuotaLedgerOpened(DB)
+			require.NoError(t, err)
+			require.True(t, opened)
+			require.EqualValues(t, 1, countQuotaLedgers(t, "account = ? AND counter_account = ?", QuotaLedgerAccountSystem, QuotaLedgerAccountSystem))
+			require.Equal(t, tt.wantOpening, countQuotaLedgers(t, "source = ? AND account <> ?", QuotaLedgerSourceOpening, QuotaLedgerAccountSystem))
+		})
+	}
+}
+
+func TestSnapshotQuotaLedgerDrifts(t *testing.T) {
+	tests := []struct {
+		name       string
+		mutate     func(t *testing.T)
+		wantDrifts map[quotaLedgerAccountKey]int
+	}{
+		{
+			name:       "balanced after opening",
+			mutate:     func(t *testing.T) {},
+			wantDrifts: map[quotaLedgerAccountKey]int{},
+		},
+		{
+			name: "recorded consumption stays balanced",
+			mutate: func(t *testing.T) {
+				ref := QuotaLedgerRef{Source: QuotaLedgerSourceConsume, RefId: "req"}
+				require.NoError(t, decreaseUserQuota(1, 100, newQuotaLedger(QuotaLedgerAccountUserQuota, 1, -100, ref)))
+				require.NoError(t, decreaseTokenQuota(1, 100, newQuotaLedger(QuotaLedgerAccountTokenUsedQuota, 1, 100, ref)))
+				updateUserUsedQuotaAndRequestCount(1, 100, 1, newQuotaLedger(QuotaLedgerAccountUserUsedQuota, 1, 100, ref))
+			},
+			wantDrifts: map[quotaLedgerAccountKey]int{},
+		},
+		{
+			name: "transfer between accounts stays balanced",
+			mutate: func(t *testing.T) {
+				ledger := newQuotaLedgerTransfer(QuotaLedgerAccountUserQuota, 1, QuotaLedgerAccountUserAffQuota, 1, 10, QuotaLedgerRef{Source: QuotaLedgerSourceAffTransfer})
+				require.NoError(t, updateWithQuotaLedger([]*QuotaLedger{ledger}, func(tx *gorm.DB) error {
+					return tx.Model(&User{}).Where("id = ?", 1).Updates(map[string]any{"quota": 1010, "aff_quota": 0}).Error
+				}))
+				require.Equal(t, 1010, ledger.BalanceAfter)
+				require.Equal(t, 0, ledger.CounterBalanceAfter)
+			},
+			wantDrifts: map[quotaLedgerAccountKey]int{},
+		},
+		{
+			name: "unrecorded change drifts",
+			mutate: func(t *testing.T) {
+				require.NoError(t, DB.Model(&User{}).Where("id = ?", 2).Update("quota", 800).Error)
+			},
+			wantDrifts: map[quotaLedgerAccountKey]int{{QuotaLedgerAccountUserQuota, 2}: 300},
+		},
+		{
+			name: "new account without opening entry drifts",
+			mutate: func(t *testing.T) {
+				require.NoError(t, DB.Create(&Token{Id: 3, UserId: 2, Key: "k3", UsedQuota: 7}).Error)
+			},
+			wantDrifts: map[quotaLedgerAccountKey]int{{QuotaLedgerAccountTokenUsedQuota, 3}: 7},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupQuotaLedgerTestDB(t)
+			insertQuotaLedgerTestData(t)
+			require.NoError(t, createQuotaLedgerOpening())
+			tt.mutate(t)
+
+			checked, drifts, err := snapshotQuotaLedgerDrifts()
+			require.NoError(t, err)
+			require.Greater(t, checked, 0)
+			got := make(map[quotaLedgerAccountKey]int, len(drifts))
+			for key, drift := range drifts {
+				got[key] = drift.Drift
+			}
+			require.Equal(t, tt.wantDrifts, got)
+		})
+	}
+}
+
+func TestQuotaLedgerWrittenWithBalance(t *testing.T) {
+	setupQuotaLedgerTestDB(t)
+	insertQuotaLedgerTestData(t)
+	require.NoError(t, createQuotaLedgerOpening())
+
+	// 账本写入失败时余额更新一起回滚
+	require.NoError(t, DB.Migrator().RenameTable(&QuotaLedger{}, "quota_ledgers_moved"))
+	require.Error(t, increaseUserQuota(2, 300, newQuotaLedger(QuotaLedgerAccountUserQuota, 2, 300, QuotaLedgerRef{Source: QuotaLedgerSourceTopUp})))
+	require.NoError(t, DB.Migrator().RenameTable("quota_ledgers_moved", &QuotaLedger{}))
+	var user User
+	require.NoError(t, DB.First(&user, 2).Error)
+	require.Equal(t, 500, user.Quota)
+
+	// 批量更新时分录随余额一起写入，按顺序倒推每条分录变动后的余额
+	addNewRecord(BatchUpdateTypeUserQuota, 2, 300, newQuotaLedger(QuotaLedgerAccountUserQuota, 2, 300, QuotaLedgerRef{Source: QuotaLedgerSourceTopUp}))
+	addNewRecord(BatchUpdateTypeUserQuota, 2, -100, newQuotaLedger(QuotaLedgerAccountUserQuota, 2, -100, QuotaLedgerRef{Source: QuotaLedgerSourceConsume}))
+	require.EqualValues(t, 0, countQuotaLedgers(t, "source <> ?", QuotaLedgerSourceOpening))
+	batchUpdate()
+
+	var entries []QuotaLedger
+	require.NoError(t, DB.Where("account = ? AND subject_id = ? AND source <> ?", QuotaLedgerAccountUserQuota, 2, QuotaLedgerSourceOpening).Order("id").Find(&entries).Error)
+	require.Len(t, entries, 2)
+	require.Equal(t, 300, entries[0].Delta)
+	require.Equal(t, 800, entries[0].BalanceAfter)
+	require.Equal(t, 700, entries[1].BalanceAfter)
+	require.NoError(t, DB.First(&user, 2).Error)
+	require.Equal(t, 700, user.Quota)
+}
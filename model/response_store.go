@@ -0,0 +1,95 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// StoredResponse 保存在本地的 /v1/responses 响应，每轮只保存本轮新增的输入条目与输出条目，
+// 通过 PreviousResponseId 指向上一轮，沿链回溯即可得到完整上下文。开启 Redis 时记录保存在 Redis 中
+type StoredResponse struct {
+	Id                 int    `json:"id"`
+	ResponseId         string `json:"response_id" gorm:"type:varchar(191);uniqueIndex"`
+	PreviousResponseId string `json:"previous_response_id" gorm:"type:varchar(191)"`
+	UserId             int    `json:"user_id" gorm:"index"`
+	Model              string `json:"model" gorm:"type:varchar(255)"`
+	Input              string `json:"input"`     // JSON 数组，本轮的输入条目
+	Output             string `json:"output"`    // JSON 数组
+	Response           string `json:"response"`  // 完整的响应对象
+	Oversized          bool   `json:"oversized"` // 超过大小限制，只保存了元数据，引用时返回错误
+	CreatedAt          int64  `json:"created_at" gorm:"bigint"`
+	ExpiresAt          int64  `json:"expires_at" gorm:"bigint;index"`
+}
+
+func getStoredResponseKey(responseId string) string {
+	return fmt.Sprintf("response_store:%s", responseId)
+}
+
+func SaveStoredResponse(stored *StoredResponse, ttl time.Duration) error {
+	stored.CreatedAt = common.GetTimestamp()
+	stored.ExpiresAt = stored.CreatedAt + int64(ttl.Seconds())
+	if common.RedisEnabled {
+		data, err := common.Marshal(stored)
+		if err != nil {
+			return err
+		}
+		return common.RedisSet(getStoredResponseKey(stored.ResponseId), string(data), ttl)
+	}
+	return DB.Create(stored).Error
+}
+
+// GetStoredResponse 只返回属于该用户且未过期的记录，不属于该用户时视为不存在
+func GetStoredResponse(userId int, responseId string) (*StoredResponse, bool, error) {
+	if responseId == "" {
+		return nil, false, nil
+	}
+	var stored *StoredResponse
+	if common.RedisEnabled {
+		data, err := common.RedisGet(getStoredResponseKey(responseId))
+		if err != nil {
+			if errors.Is(err, redis.Nil) {
+				return nil, false, nil
+			}
+			return nil, false, err
+		}
+		if err := common.UnmarshalJsonStr(data, &stored); err != nil {
+			return nil, false, err
+		}
+		if stored.UserId != userId {
+			return nil, false, nil
+		}
+		return stored, true, nil
+	}
+	err := DB.Where("response_id = ? and user_id = ? and expires_at > ?", responseId, userId, common.GetTimestamp()).First(&stored).Error
+	exist, err := RecordExist(err)
+	if err != nil {
+		return nil, false, err
+	}
+	return stored, exist, nil
+}
+
+func DeleteStoredResponse(stored *StoredResponse) error {
+	if common.RedisEnabled {
+		return common.RedisDel(getStoredResponseKey(stored.ResponseId))
+	}
+	return DB.Where("response_id = ?", stored.ResponseId).Delete(&StoredResponse{}).Error
+}
+
+// CleanExpiredStoredResponses 定期删除过期的响应记录，仅未开启 Redis 时需要，只在主节点运行
+func CleanExpiredStoredResponses(frequency int) {
+	for {
+		time.Sleep(time.Duration(frequency) * time.Second)
+		if common.RedisEnabled {
+			continue
+		}
+		err := DB.Where("expires_at <= ?", common.GetTimestamp()).Delete(&StoredResponse{}).Error
+		if err != nil {
+			common.SysLog("failed to clean expired stored responses: " + err.Error())
+		}
+	}
+}
@@ -95,7 +95,8 @@ func (m Properties) Value() (driver.Value, error) {
 }
 
 type TaskPrivateData struct {
-	Key string `json:"key,omitempty"`
+	Key     string `json:"key,omitempty"`
+	TokenId int    `json:"token_id,omitempty"` // 网关执行 batch 时以该令牌身份转发请求
 }
 
 func (p *TaskPrivateData) Scan(val interface{}) error {
@@ -290,6 +291,26 @@ func GetByTaskIds(userId int, taskIds []any) ([]*Task, error) {
 	return task, nil
 }
 
+// GetUserTasksByPlatform 按 id 倒序分页查询用户指定平台的任务，after 为上一页最后一个任务的 task_id
+func GetUserTasksByPlatform(userId int, platform constant.TaskPlatform, after string, limit int) ([]*Task, error) {
+	var tasks []*Task
+	query := DB.Where("user_id = ? and platform = ?", userId, platform)
+	if after != "" {
+		var cursor Task
+		err := DB.Select("id").Where("user_id = ? and task_id = ?", userId, after).First(&cursor).Error
+		exist, err := RecordExist(err)
+		if err != nil {
+			return nil, err
+		}
+		if !exist {
+			return tasks, nil
+		}
+		query = query.Where("id < ?", cursor.ID)
+	}
+	err := query.Order("id desc").Limit(limit).Find(&tasks).Error
+	return tasks, err
+}
+
 func TaskUpdateProgress(id int64, progress string) error {
 	return DB.Model(&Task{}).Where("id = ?", id).Update("progress", progress).Error
 }
@@ -306,6 +327,31 @@ func (Task *Task) Update() error {
 	return err
 }
 
+// UpdateWithStatus 仅当数据库中任务的状态仍为 fromStatus 时保存任务，返回是否保存成功。
+// 结算前先以此抢占状态，多个轮询或上一次保存失败后的重试不会重复扣费
+func (t *Task) UpdateWithStatus(fromStatus TaskStatus) (bool, error) {
+	result := DB.Model(t).Where("status = ?", fromStatus).Select("*").Updates(t)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// UpdateProgressIfUnchanged 仅当任务的状态与更新时间仍与读取时一致时保存进度与数据，返回是否保存成功，
+// 避免覆盖期间并发写入的取消等修改
+func (t *Task) UpdateProgressIfUnchanged() (bool, error) {
+	result := DB.Model(&Task{}).
+		Where("id = ? and status = ? and updated_at = ?", t.ID, t.Status, t.UpdatedAt).
+		Updates(map[string]any{
+			"progress": t.Progress,
+			"data":     t.Data,
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
 func TaskBulkUpdate(TaskIds []string, params map[string]any) error {
 	if len(TaskIds) == 0 {
 		return nil
@@ -26,7 +26,15 @@ type Token struct {
 	AllowIps           *string        `json:"allow_ips" gorm:"default:''"`
 	UsedQuota          int            `json:"used_quota" gorm:"default:0"` // used quota
 	Group              string         `json:"group" gorm:"default:''"`
-	CrossGroupRetry    bool           `json:"cross_group_retry"` // 跨分组重试，仅auto分组有效
+	CrossGroupRetry    bool           `json:"cross_group_retry"`               // 跨分组重试，仅auto分组有效
+	Hedging            bool           `json:"hedging"`                         // 对冲请求，首个渠道响应慢时同时请求另一个渠道
+	MiddleOut          bool           `json:"middle_out"`                      // 提示超出模型上下文长度时从中间删除消息
+	DailyBudget        int            `json:"daily_budget" gorm:"default:0"`   // 每日预算，0 表示不限制
+	MonthlyBudget      int            `json:"monthly_budget" gorm:"default:0"` // 每月预算，0 表示不限制
+	BudgetWindow       string         `json:"budget_window" gorm:"type:varchar(16);default:'calendar'"`
+	RpmLimit           int            `json:"rpm_limit" gorm:"default:0"`         // 每分钟请求数限制，0 表示不限制
+	TpmLimit           int            `json:"tpm_limit" gorm:"default:0"`         // 每分钟预估 token 数限制，0 表示不限制
+	ConcurrencyLimit   int            `json:"concurrency_limit" gorm:"default:0"` // 最大并发请求数，0 表示不限制
 	DeletedAt          gorm.DeletedAt `gorm:"index"`
 }
 
@@ -190,7 +198,8 @@ func (token *Token) Update() (err error) {
 		}
 	}()
 	err = DB.Model(token).Select("name", "status", "expired_time", "remain_quota", "unlimited_quota",
-		"model_limits_enabled", "model_limits", "allow_ips", "group", "cross_group_retry").Updates(token).Error
+		"model_limits_enabled", "model_limits", "allow_ips", "group", "cross_group_retry", "hedging", "middle_out",
+		"daily_budget", "monthly_budget", "budget_window", "rpm_limit", "tpm_limit", "concurrency_limit").Updates(token).Error
 	return err
 }
 
@@ -267,7 +276,7 @@ func DeleteTokenById(id int, userId int) (err error) {
 	return token.Delete()
 }
 
-func IncreaseTokenQuota(id int, key string, quota int) (err error) {
+func IncreaseTokenQuota(id int, key string, quota int, ref QuotaLedgerRef) (err error) {
 	if quota < 0 {
 		return errors.New("quota 不能为负数！")
 	}
@@ -279,25 +288,27 @@ func IncreaseTokenQuota(id int, key string, quota int) (err error) {
 			}
 		})
 	}
+	ledger := newQuotaLedger(QuotaLedgerAccountTokenUsedQuota, id, -quota, ref)
 	if common.BatchUpdateEnabled {
-		addNewRecord(BatchUpdateTypeTokenQuota, id, quota)
+		addNewRecord(BatchUpdateTypeTokenQuota, id, quota, ledger)
 		return nil
 	}
-	return increaseTokenQuota(id, quota)
+	return increaseTokenQuota(id, quota, ledger)
 }
 
-func increaseTokenQuota(id int, quota int) (err error) {
-	err = DB.Model(&Token{}).Where("id = ?", id).Updates(
-		map[string]interface{}{
-			"remain_quota":  gorm.Expr("remain_quota + ?", quota),
-			"used_quota":    gorm.Expr("used_quota - ?", quota),
-			"accessed_time": common.GetTimestamp(),
-		},
-	).Error
-	return err
+func increaseTokenQuota(id int, quota int, ledgers ...*QuotaLedger) (err error) {
+	return updateWithQuotaLedger(ledgers, func(tx *gorm.DB) error {
+		return tx.Model(&Token{}).Where("id = ?", id).Updates(
+			map[string]interface{}{
+				"remain_quota":  gorm.Expr("remain_quota + ?", quota),
+				"used_quota":    gorm.Expr("used_quota - ?", quota),
+				"accessed_time": common.GetTimestamp(),
+			},
+		).Error
+	})
 }
 
-func DecreaseTokenQuota(id int, key string, quota int) (err error) {
+func DecreaseTokenQuota(id int, key string, quota int, ref QuotaLedgerRef) (err error) {
 	if quota < 0 {
 		return errors.New("quota 不能为负数！")
 	}
@@ -309,22 +320,24 @@ func DecreaseTokenQuota(id int, key string, quota int) (err error) {
 			}
 		})
 	}
+	ledger := newQuotaLedger(QuotaLedgerAccountTokenUsedQuota, id, quota, ref)
 	if common.BatchUpdateEnabled {
-		addNewRecord(BatchUpdateTypeTokenQuota, id, -quota)
+		addNewRecord(BatchUpdateTypeTokenQuota, id, -quota, ledger)
 		return nil
 	}
-	return decreaseTokenQuota(id, quota)
+	return decreaseTokenQuota(id, quota, ledger)
 }
 
-func decreaseTokenQuota(id int, quota int) (err error) {
-	err = DB.Model(&Token{}).Where("id = ?", id).Updates(
-		map[string]interface{}{
-			"remain_quota":  gorm.Expr("remain_quota - ?", quota),
-			"used_quota":    gorm.Expr("used_quota + ?", quota),
-			"accessed_time": common.GetTimestamp(),
-		},
-	).Error
-	return err
+func decreaseTokenQuota(id int, quota int, ledgers ...*QuotaLedger) (err error) {
+	return updateWithQuotaLedger(ledgers, func(tx *gorm.DB) error {
+		return tx.Model(&Token{}).Where("id = ?", id).Updates(
+			map[string]interface{}{
+				"remain_quota":  gorm.Expr("remain_quota - ?", quota),
+				"used_quota":    gorm.Expr("used_quota + ?", quota),
+				"accessed_time": common.GetTimestamp(),
+			},
+		).Error
+	})
 }
 
 // CountUserTokens returns total number of tokens for the given user, used for pagination
@@ -91,7 +91,7 @@ func Recharge(referenceId string, customerId string) (err error) {
 			return err
 		}
 
-		return nil
+		return RecordQuotaLedger(tx, QuotaLedgerAccountUserQuota, topUp.UserId, int(quota), QuotaLedgerRef{Source: QuotaLedgerSourceTopUp, RefId: topUp.TradeNo})
 	})
 
 	if err != nil {
@@ -291,6 +291,9 @@ func ManualCompleteTopUp(tradeNo string) error {
 		if err := tx.Model(&User{}).Where("id = ?", topUp.UserId).Update("quota", gorm.Expr("quota + ?", quotaToAdd)).Error; err != nil {
 			return err
 		}
+		if err := RecordQuotaLedger(tx, QuotaLedgerAccountUserQuota, topUp.UserId, quotaToAdd, QuotaLedgerRef{Source: QuotaLedgerSourceTopUp, RefId: tradeNo}); err != nil {
+			return err
+		}
 
 		userId = topUp.UserId
 		payMoney = topUp.Money
@@ -363,7 +366,7 @@ func RechargeCreem(referenceId string, customerEmail string, customerName string
 			return err
 		}
 
-		return nil
+		return RecordQuotaLedger(tx, QuotaLedgerAccountUserQuota, topUp.UserId, int(quota), QuotaLedgerRef{Source: QuotaLedgerSourceTopUp, RefId: topUp.TradeNo})
 	})
 
 	if err != nil {
@@ -47,17 +47,23 @@ type User struct {
 	Setting          string         `json:"setting" gorm:"type:text;column:setting"`
 	Remark           string         `json:"remark,omitempty" gorm:"type:varchar(255)" validate:"max=255"`
 	StripeCustomer   string         `json:"stripe_customer" gorm:"type:varchar(64);column:stripe_customer;index"`
+	DailyBudget      int            `json:"daily_budget" gorm:"type:int;default:0"`   // 每日预算，0 表示不限制
+	MonthlyBudget    int            `json:"monthly_budget" gorm:"type:int;default:0"` // 每月预算，0 表示不限制
+	BudgetWindow     string         `json:"budget_window" gorm:"type:varchar(16);default:'calendar'"`
 }
 
 func (user *User) ToBaseUser() *UserBase {
 	cache := &UserBase{
-		Id:       user.Id,
-		Group:    user.Group,
-		Quota:    user.Quota,
-		Status:   user.Status,
-		Username: user.Username,
-		Setting:  user.Setting,
-		Email:    user.Email,
+		Id:            user.Id,
+		Group:         user.Group,
+		Quota:         user.Quota,
+		Status:        user.Status,
+		Username:      user.Username,
+		Setting:       user.Setting,
+		Email:         user.Email,
+		DailyBudget:   user.DailyBudget,
+		MonthlyBudget: user.MonthlyBudget,
+		BudgetWindow:  user.BudgetWindow,
 	}
 	return cache
 }
@@ -325,7 +331,7 @@ func HardDeleteUserById(id int) error {
 	return err
 }
 
-func inviteUser(inviterId int) (err error) {
+func inviteUser(inviterId int, inviteeId int) (err error) {
 	user, err := GetUserById(inviterId, true)
 	if err != nil {
 		return err
@@ -333,7 +339,12 @@ func inviteUser(inviterId int) (err error) {
 	user.AffCount++
 	user.AffQuota += common.QuotaForInviter
 	user.AffHistoryQuota += common.QuotaForInviter
-	return DB.Save(user).Error
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(user).Error; err != nil {
+			return err
+		}
+		return RecordQuotaLedger(tx, QuotaLedgerAccountUserAffQuota, inviterId, common.QuotaForInviter, QuotaLedgerRef{Source: QuotaLedgerSourceInvite, RefId: strconv.Itoa(inviteeId)})
+	})
 }
 
 func (user *User) TransferAffQuotaToQuota(quota int) error {
@@ -368,6 +379,10 @@ func (user *User) TransferAffQuotaToQuota(quota int) error {
 	if err := tx.Save(user).Error; err != nil {
 		return err
 	}
+	ledger := newQuotaLedgerTransfer(QuotaLedgerAccountUserQuota, user.Id, QuotaLedgerAccountUserAffQuota, user.Id, quota, QuotaLedgerRef{Source: QuotaLedgerSourceAffTransfer})
+	if err := writeQuotaLedger(tx, ledger); err != nil {
+		return err
+	}
 
 	// 提交事务
 	return tx.Commit().Error
@@ -392,9 +407,14 @@ func (user *User) Insert(inviterId int) error {
 		user.SetSetting(defaultSetting)
 	}
 
-	result := DB.Create(user)
-	if result.Error != nil {
-		return result.Error
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+		return RecordQuotaLedger(tx, QuotaLedgerAccountUserQuota, user.Id, user.Quota, QuotaLedgerRef{Source: QuotaLedgerSourceRegister})
+	})
+	if err != nil {
+		return err
 	}
 
 	// 用户创建成功后，根据角色初始化边栏配置
@@ -417,13 +437,13 @@ func (user *User) Insert(inviterId int) error {
 	}
 	if inviterId != 0 {
 		if common.QuotaForInvitee > 0 {
-			_ = IncreaseUserQuota(user.Id, common.QuotaForInvitee, true)
+			_ = IncreaseUserQuota(user.Id, common.QuotaForInvitee, true, QuotaLedgerRef{Source: QuotaLedgerSourceInvite, RefId: strconv.Itoa(inviterId)})
 			RecordLog(user.Id, LogTypeSystem, fmt.Sprintf("使用邀请码赠送 %s", logger.LogQuota(common.QuotaForInvitee)))
 		}
 		if common.QuotaForInviter > 0 {
 			//_ = IncreaseUserQuota(inviterId, common.QuotaForInviter)
 			RecordLog(inviterId, LogTypeSystem, fmt.Sprintf("邀请用户赠送 %s", logger.LogQuota(common.QuotaForInviter)))
-			_ = inviteUser(inviterId)
+			_ = inviteUser(inviterId, user.Id)
 		}
 	}
 	return nil
@@ -458,18 +478,28 @@ func (user *User) Edit(updatePassword bool) error {
 
 	newUser := *user
 	updates := map[string]interface{}{
-		"username":     newUser.Username,
-		"display_name": newUser.DisplayName,
-		"group":        newUser.Group,
-		"quota":        newUser.Quota,
-		"remark":       newUser.Remark,
+		"username":       newUser.Username,
+		"display_name":   newUser.DisplayName,
+		"group":          newUser.Group,
+		"quota":          newUser.Quota,
+		"remark":         newUser.Remark,
+		"daily_budget":   newUser.DailyBudget,
+		"monthly_budget": newUser.MonthlyBudget,
+		"budget_window":  newUser.BudgetWindow,
 	}
 	if updatePassword {
 		updates["password"] = newUser.Password
 	}
 
-	DB.First(&user, user.Id)
-	if err = DB.Model(user).Updates(updates).Error; err != nil {
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		tx.Set("gorm:query_option", "FOR UPDATE").First(&user, user.Id)
+		oldQuota := user.Quota
+		if err := tx.Model(user).Updates(updates).Error; err != nil {
+			return err
+		}
+		return RecordQuotaLedger(tx, QuotaLedgerAccountUserQuota, user.Id, newUser.Quota-oldQuota, QuotaLedgerRef{Source: QuotaLedgerSourceAdmin})
+	})
+	if err != nil {
 		return err
 	}
 
@@ -763,7 +793,7 @@ func GetUserSetting(id int, fromDB bool) (settingMap dto.UserSetting, err error)
 	return userBase.GetSetting(), nil
 }
 
-func IncreaseUserQuota(id int, quota int, db bool) (err error) {
+func IncreaseUserQuota(id int, quota int, db bool, ref QuotaLedgerRef) (err error) {
 	if quota < 0 {
 		return errors.New("quota 不能为负数！")
 	}
@@ -773,22 +803,21 @@ func IncreaseUserQuota(id int, quota int, db bool) (err error) {
 			common.SysLog("failed to increase user quota: " + err.Error())
 		}
 	})
+	ledger := newQuotaLedger(QuotaLedgerAccountUserQuota, id, quota, ref)
 	if !db && common.BatchUpdateEnabled {
-		addNewRecord(BatchUpdateTypeUserQuota, id, quota)
+		addNewRecord(BatchUpdateTypeUserQuota, id, quota, ledger)
 		return nil
 	}
-	return increaseUserQuota(id, quota)
+	return increaseUserQuota(id, quota, ledger)
 }
 
-func increaseUserQuota(id int, quota int) (err error) {
-	err = DB.Model(&User{}).Where("id = ?", id).Update("quota", gorm.Expr("quota + ?", quota)).Error
-	if err != nil {
-		return err
-	}
-	return err
+func increaseUserQuota(id int, quota int, ledgers ...*QuotaLedger) (err error) {
+	return updateWithQuotaLedger(ledgers, func(tx *gorm.DB) error {
+		return tx.Model(&User{}).Where("id = ?", id).Update("quota", gorm.Expr("quota + ?", quota)).Error
+	})
 }
 
-func DecreaseUserQuota(id int, quota int) (err error) {
+func DecreaseUserQuota(id int, quota int, ref QuotaLedgerRef) (err error) {
 	if quota < 0 {
 		return errors.New("quota 不能为负数！")
 	}
@@ -798,29 +827,28 @@ func DecreaseUserQuota(id int, quota int) (err error) {
 			common.SysLog("failed to decrease user quota: " + err.Error())
 		}
 	})
+	ledger := newQuotaLedger(QuotaLedgerAccountUserQuota, id, -quota, ref)
 	if common.BatchUpdateEnabled {
-		addNewRecord(BatchUpdateTypeUserQuota, id, -quota)
+		addNewRecord(BatchUpdateTypeUserQuota, id, -quota, ledger)
 		return nil
 	}
-	return decreaseUserQuota(id, quota)
+	return decreaseUserQuota(id, quota, ledger)
 }
 
-func decreaseUserQuota(id int, quota int) (err error) {
-	err = DB.Model(&User{}).Where("id = ?", id).Update("quota", gorm.Expr("quota - ?", quota)).Error
-	if err != nil {
-		return err
-	}
-	return err
+func decreaseUserQuota(id int, quota int, ledgers ...*QuotaLedger) (err error) {
+	return updateWithQuotaLedger(ledgers, func(tx *gorm.DB) error {
+		return tx.Model(&User{}).Where("id = ?", id).Update("quota", gorm.Expr("quota - ?", quota)).Error
+	})
 }
 
-func DeltaUpdateUserQuota(id int, delta int) (err error) {
+func DeltaUpdateUserQuota(id int, delta int, ref QuotaLedgerRef) (err error) {
 	if delta == 0 {
 		return nil
 	}
 	if delta > 0 {
-		return IncreaseUserQuota(id, delta, false)
+		return IncreaseUserQuota(id, delta, false, ref)
 	} else {
-		return DecreaseUserQuota(id, -delta)
+		return DecreaseUserQuota(id, -delta, ref)
 	}
 }
 
@@ -834,22 +862,35 @@ func GetRootUser() (user *User) {
 	return user
 }
 
-func UpdateUserUsedQuotaAndRequestCount(id int, quota int) {
+func UpdateUserUsedQuotaAndRequestCount(id int, quota int, ref QuotaLedgerRef) {
+	ledger := newQuotaLedger(QuotaLedgerAccountUserUsedQuota, id, quota, ref)
 	if common.BatchUpdateEnabled {
-		addNewRecord(BatchUpdateTypeUsedQuota, id, quota)
+		addNewRecord(BatchUpdateTypeUsedQuota, id, quota, ledger)
 		addNewRecord(BatchUpdateTypeRequestCount, id, 1)
 		return
 	}
-	updateUserUsedQuotaAndRequestCount(id, quota, 1)
+	updateUserUsedQuotaAndRequestCount(id, quota, 1, ledger)
+}
+
+// UpdateUserUsedQuota 只累加已用额度，不增加请求次数，用于存储费用等非请求的消费
+func UpdateUserUsedQuota(id int, quota int, ref QuotaLedgerRef) {
+	ledger := newQuotaLedger(QuotaLedgerAccountUserUsedQuota, id, quota, ref)
+	if common.BatchUpdateEnabled {
+		addNewRecord(BatchUpdateTypeUsedQuota, id, quota, ledger)
+		return
+	}
+	updateUserUsedQuota(id, quota, ledger)
 }
 
-func updateUserUsedQuotaAndRequestCount(id int, quota int, count int) {
-	err := DB.Model(&User{}).Where("id = ?", id).Updates(
-		map[string]interface{}{
-			"used_quota":    gorm.Expr("used_quota + ?", quota),
-			"request_count": gorm.Expr("request_count + ?", count),
-		},
-	).Error
+func updateUserUsedQuotaAndRequestCount(id int, quota int, count int, ledgers ...*QuotaLedger) {
+	err := updateWithQuotaLedger(ledgers, func(tx *gorm.DB) error {
+		return tx.Model(&User{}).Where("id = ?", id).Updates(
+			map[string]interface{}{
+				"used_quota":    gorm.Expr("used_quota + ?", quota),
+				"request_count": gorm.Expr("request_count + ?", count),
+			},
+		).Error
+	})
 	if err != nil {
 		common.SysLog("failed to update user used quota and request count: " + err.Error())
 		return
@@ -861,12 +902,14 @@ func updateUserUsedQuotaAndRequestCount(id int, quota int, count int) {
 	//}
 }
 
-func updateUserUsedQuota(id int, quota int) {
-	err := DB.Model(&User{}).Where("id = ?", id).Updates(
-		map[string]interface{}{
-			"used_quota": gorm.Expr("used_quota + ?", quota),
-		},
-	).Error
+func updateUserUsedQuota(id int, quota int, ledgers ...*QuotaLedger) {
+	err := updateWithQuotaLedger(ledgers, func(tx *gorm.DB) error {
+		return tx.Model(&User{}).Where("id = ?", id).Updates(
+			map[string]interface{}{
+				"used_quota": gorm.Expr("used_quota + ?", quota),
+			},
+		).Error
+	})
 	if err != nil {
 		common.SysLog("failed to update user used quota: " + err.Error())
 	}
@@ -23,10 +23,14 @@ const (
 var batchUpdateStores []map[int]int
 var batchUpdateLocks []sync.Mutex
 
+// 与额度变动一起暂存的账本分录，批量更新时与余额在同一事务中写入
+var batchUpdateLedgers []map[int][]*QuotaLedger
+
 func init() {
 	for i := 0; i < BatchUpdateTypeCount; i++ {
 		batchUpdateStores = append(batchUpdateStores, make(map[int]int))
 		batchUpdateLocks = append(batchUpdateLocks, sync.Mutex{})
+		batchUpdateLedgers = append(batchUpdateLedgers, make(map[int][]*QuotaLedger))
 	}
 }
 
@@ -39,7 +43,7 @@ func InitBatchUpdater() {
 	})
 }
 
-func addNewRecord(type_ int, id int, value int) {
+func addNewRecord(type_ int, id int, value int, ledgers ...*QuotaLedger) {
 	batchUpdateLocks[type_].Lock()
 	defer batchUpdateLocks[type_].Unlock()
 	if _, ok := batchUpdateStores[type_][id]; !ok {
@@ -47,6 +51,9 @@ func addNewRecord(type_ int, id int, value int) {
 	} else {
 		batchUpdateStores[type_][id] += value
 	}
+	if len(ledgers) > 0 {
+		batchUpdateLedgers[type_][id] = append(batchUpdateLedgers[type_][id], ledgers...)
+	}
 }
 
 func batchUpdate() {
@@ -70,23 +77,25 @@ func batchUpdate() {
 	for i := 0; i < BatchUpdateTypeCount; i++ {
 		batchUpdateLocks[i].Lock()
 		store := batchUpdateStores[i]
+		ledgers := batchUpdateLedgers[i]
 		batchUpdateStores[i] = make(map[int]int)
+		batchUpdateLedgers[i] = make(map[int][]*QuotaLedger)
 		batchUpdateLocks[i].Unlock()
 		// TODO: maybe we can combine updates with same key?
 		for key, value := range store {
 			switch i {
 			case BatchUpdateTypeUserQuota:
-				err := increaseUserQuota(key, value)
+				err := increaseUserQuota(key, value, ledgers[key]...)
 				if err != nil {
 					common.SysLog("failed to batch update user quota: " + err.Error())
 				}
 			case BatchUpdateTypeTokenQuota:
-				err := increaseTokenQuota(key, value)
+				err := increaseTokenQuota(key, value, ledgers[key]...)
 				if err != nil {
 					common.SysLog("failed to batch update token quota: " + err.Error())
 				}
 			case BatchUpdateTypeUsedQuota:
-				updateUserUsedQuota(key, value)
+				updateUserUsedQuota(key, value, ledgers[key]...)
 			case BatchUpdateTypeRequestCount:
 				updateUserRequestCount(key, value)
 			case BatchUpdateTypeChannelUsedQuota:
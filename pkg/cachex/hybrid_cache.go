@@ -40,6 +40,7 @@ type HybridCache[V any] struct {
 	memOnce sync.Once
 	memInit func() *hot.HotCache[string, V]
 	mem     *hot.HotCache[string, V]
+	memMu   sync.Mutex // serializes SetNXWithTTL on the in-memory cache
 }
 
 func NewHybridCache[V any](cfg HybridCacheConfig[V]) *HybridCache[V] {
@@ -128,6 +129,33 @@ func (c *HybridCache[V]) SetWithTTL(key string, v V, ttl time.Duration) error {
 	return nil
 }
 
+// SetNXWithTTL stores the value only if the key does not exist yet and reports whether it was stored.
+func (c *HybridCache[V]) SetNXWithTTL(key string, v V, ttl time.Duration) (bool, error) {
+	full := c.ns.FullKey(key)
+	if full == "" {
+		return false, nil
+	}
+
+	if c.redisOn() {
+		raw, err := c.redisCodec.Encode(v)
+		if err != nil {
+			return false, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), defaultRedisOpTimeout)
+		defer cancel()
+		return c.redis.SetNX(ctx, full, raw, ttl).Result()
+	}
+
+	c.memMu.Lock()
+	defer c.memMu.Unlock()
+	mem := c.memCache()
+	if _, found, err := mem.Get(full); err != nil || found {
+		return false, err
+	}
+	mem.SetWithTTL(full, v, ttl)
+	return true, nil
+}
+
 // Keys returns keys with valid values. In Redis, it returns all matching keys.
 func (c *HybridCache[V]) Keys() ([]string, error) {
 	if c.redisOn() {
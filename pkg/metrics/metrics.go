@@ -0,0 +1,166 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "new_api"
+
+var relayLabels = []string{"channel_id", "channel_type", "model", "group", "relay_format"}
+var billingLabels = []string{"channel_id", "channel_type", "model", "group"}
+
+var (
+	relayRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "relay",
+		Name:      "requests_total",
+		Help:      "Relay attempts sent to upstream channels, by response status code.",
+	}, append(append([]string{}, relayLabels...), "status_code"))
+
+	relayDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "relay",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of relay attempts.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120, 300},
+	}, relayLabels)
+
+	relayFirstToken = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "relay",
+		Name:      "first_token_seconds",
+		Help:      "Time to first token of streaming relay attempts.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 3, 5, 10, 20, 30, 60},
+	}, relayLabels)
+
+	relayRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "relay",
+		Name:      "retries_total",
+		Help:      "Relay retries after a failed attempt.",
+	}, []string{"model", "group", "relay_format"})
+
+	promptTokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "billing",
+		Name:      "prompt_tokens_total",
+		Help:      "Billed prompt tokens.",
+	}, billingLabels)
+
+	completionTokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "billing",
+		Name:      "completion_tokens_total",
+		Help:      "Billed completion tokens.",
+	}, billingLabels)
+
+	quotaConsumed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "billing",
+		Name:      "quota_consumed_total",
+		Help:      "Consumed quota.",
+	}, billingLabels)
+
+	channelAutoDisabled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "channel",
+		Name:      "auto_disabled_total",
+		Help:      "Channels or multi-key channel keys disabled automatically.",
+	}, []string{"channel_id", "channel_type"})
+)
+
+var registry = prometheus.NewRegistry()
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		relayRequests,
+		relayDuration,
+		relayFirstToken,
+		relayRetries,
+		promptTokens,
+		completionTokens,
+		quotaConsumed,
+		channelAutoDisabled,
+	)
+}
+
+// Register 注册自定义指标，通常是在抓取时才读取数据的 Collector
+func Register(collector prometheus.Collector) {
+	registry.MustRegister(collector)
+}
+
+// RegisterGaugeFunc 注册一个在抓取时调用 fn 取值的 Gauge
+func RegisterGaugeFunc(subsystem string, name string, help string, fn func() float64) {
+	registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      name,
+		Help:      help,
+	}, fn))
+}
+
+// NewDesc 创建带有统一命名空间的指标描述，供自定义 Collector 使用
+func NewDesc(subsystem string, name string, help string, labels []string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, name), help, labels, nil)
+}
+
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// RelayAttempt 一次转发尝试的结果
+type RelayAttempt struct {
+	ChannelId   int
+	ChannelType int
+	Model       string
+	Group       string
+	RelayFormat string
+	StatusCode  int
+	Duration    time.Duration
+	FirstToken  time.Duration // 非流式请求为 0
+}
+
+func RecordRelayAttempt(attempt RelayAttempt) {
+	labels := prometheus.Labels{
+		"channel_id":   strconv.Itoa(attempt.ChannelId),
+		"channel_type": strconv.Itoa(attempt.ChannelType),
+		"model":        attempt.Model,
+		"group":        attempt.Group,
+		"relay_format": attempt.RelayFormat,
+	}
+	relayDuration.With(labels).Observe(attempt.Duration.Seconds())
+	if attempt.FirstToken > 0 {
+		relayFirstToken.With(labels).Observe(attempt.FirstToken.Seconds())
+	}
+	labels["status_code"] = strconv.Itoa(attempt.StatusCode)
+	relayRequests.With(labels).Inc()
+}
+
+func RecordRelayRetry(model string, group string, relayFormat string) {
+	relayRetries.WithLabelValues(model, group, relayFormat).Inc()
+}
+
+func RecordConsume(channelId int, channelType int, model string, group string, prompt int, completion int, quota int) {
+	labels := []string{strconv.Itoa(channelId), strconv.Itoa(channelType), model, group}
+	if prompt > 0 {
+		promptTokens.WithLabelValues(labels...).Add(float64(prompt))
+	}
+	if completion > 0 {
+		completionTokens.WithLabelValues(labels...).Add(float64(completion))
+	}
+	if quota > 0 {
+		quotaConsumed.WithLabelValues(labels...).Add(float64(quota))
+	}
+}
+
+func RecordChannelAutoDisabled(channelId int, channelType int) {
+	channelAutoDisabled.WithLabelValues(strconv.Itoa(channelId), strconv.Itoa(channelType)).Inc()
+}
@@ -0,0 +1,221 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BatchCreateHelper 创建 batch，batch 会在输入文件所在的渠道上执行
+func BatchCreateHelper(c *gin.Context) *types.NewAPIError {
+	var request dto.OpenAIBatchRequest
+	if err := common.UnmarshalBodyReusable(c, &request); err != nil {
+		return types.NewErrorWithStatusCode(err, types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+	if request.InputFileId == "" {
+		return types.NewErrorWithStatusCode(errors.New("input_file_id is required"), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+	if !slices.Contains(service.SupportedBatchEndpoints, request.Endpoint) {
+		return types.NewErrorWithStatusCode(fmt.Errorf("unsupported endpoint %s", request.Endpoint), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+	if request.CompletionWindow == "" {
+		request.CompletionWindow = "24h"
+	}
+
+	userId := common.GetContextKeyInt(c, constant.ContextKeyUserId)
+	inputFile, exist, err := model.GetUserFileByFileId(userId, request.InputFileId)
+	if err != nil {
+		return types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry())
+	}
+	if !exist {
+		return types.NewErrorWithStatusCode(fmt.Errorf("input file %s not found", request.InputFileId), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+	// batch 为延迟计费，创建时只校验用户余额
+	userQuota, err := model.GetUserQuota(userId, false)
+	if err != nil {
+		return types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry())
+	}
+	if userQuota <= 0 {
+		return types.NewErrorWithStatusCode(errors.New("user quota is not enough"), types.ErrorCodeInsufficientUserQuota, http.StatusForbidden, types.ErrOptionWithSkipRetry())
+	}
+	channel, key, newAPIError := service.GetFileChannelAndKey(inputFile)
+	if newAPIError != nil {
+		return newAPIError
+	}
+	if channel.Status != common.ChannelStatusEnabled {
+		return types.NewErrorWithStatusCode(fmt.Errorf("channel of input file %s is disabled", request.InputFileId), types.ErrorCodeGetChannelFailed, http.StatusServiceUnavailable, types.ErrOptionWithSkipRetry())
+	}
+
+	group := common.GetContextKeyString(c, constant.ContextKeyUsingGroup)
+	if group == "auto" {
+		group = inputFile.Group
+	}
+	now := time.Now().Unix()
+	task := &model.Task{
+		Platform:   constant.TaskPlatformOpenAIBatch,
+		UserId:     userId,
+		Group:      group,
+		ChannelId:  channel.Id,
+		SubmitTime: now,
+		Progress:   "0%",
+		PrivateData: model.TaskPrivateData{
+			Key:     inputFile.PrivateData.Key,
+			TokenId: common.GetContextKeyInt(c, constant.ContextKeyTokenId),
+		},
+	}
+
+	if service.IsNativeBatchChannel(channel) {
+		if !operation_setting.GetBatchSetting().NativeFallbackEnabled {
+			return types.NewErrorWithStatusCode(fmt.Errorf("channel of input file %s does not support batch api", request.InputFileId), types.ErrorCodeInvalidApiType, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+		}
+		batch := dto.OpenAIBatch{
+			Id:               "batch_" + common.GetRandomString(32),
+			Object:           "batch",
+			Endpoint:         request.Endpoint,
+			InputFileId:      request.InputFileId,
+			CompletionWindow: request.CompletionWindow,
+			Status:           dto.BatchStatusValidating,
+			CreatedAt:        now,
+			ExpiresAt:        now + 24*3600,
+			Metadata:         request.Metadata,
+		}
+		task.TaskID = batch.Id
+		task.Action = constant.TaskActionNativeBatch
+		task.Status = model.TaskStatusQueued
+		task.SetData(batch)
+		if err := task.Insert(); err != nil {
+			return types.NewError(err, types.ErrorCodeUpdateDataError, types.ErrOptionWithSkipRetry())
+		}
+		c.JSON(http.StatusOK, batch)
+		return nil
+	}
+
+	requestBody, err := common.GetRequestBody(c)
+	if err != nil {
+		return types.NewErrorWithStatusCode(err, types.ErrorCodeReadRequestBodyFailed, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+	resp, err := service.DoPlatformRequest(c.Request.Context(), channel, key, http.MethodPost, "/v1/batches", bytes.NewReader(requestBody), "application/json")
+	if err != nil {
+		return types.NewOpenAIError(err, types.ErrorCodeDoRequestFailed, http.StatusInternalServerError)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return service.RelayErrorHandler(c.Request.Context(), resp, false)
+	}
+	responseBody, err := io.ReadAll(resp.Body)
+	service.CloseResponseBodyGracefully(resp)
+	if err != nil {
+		return types.NewOpenAIError(err, types.ErrorCodeReadResponseBodyFailed, http.StatusInternalServerError)
+	}
+	var batch dto.OpenAIBatch
+	if err := common.Unmarshal(responseBody, &batch); err != nil || batch.Id == "" {
+		return types.NewOpenAIError(fmt.Errorf("invalid batch response: %s", string(responseBody)), types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
+	}
+	task.TaskID = batch.Id
+	task.Action = constant.TaskActionBatch
+	task.Status = model.TaskStatusSubmitted
+	task.Data = responseBody
+	if err := task.Insert(); err != nil {
+		logger.LogError(c, fmt.Sprintf("failed to save batch %s of channel #%d: %s", batch.Id, channel.Id, err.Error()))
+		return types.NewError(err, types.ErrorCodeUpdateDataError, types.ErrOptionWithSkipRetry())
+	}
+	service.IOCopyBytesGracefully(c, resp, responseBody)
+	return nil
+}
+
+func isTaskFinished(task *model.Task) bool {
+	return task.Status == model.TaskStatusSuccess || task.Status == model.TaskStatusFailure
+}
+
+// BatchRetrieveHelper 查询 batch，未结束的上游 batch 会实时查询上游状态
+func BatchRetrieveHelper(c *gin.Context, task *model.Task) *types.NewAPIError {
+	if task.Action == constant.TaskActionNativeBatch || isTaskFinished(task) {
+		c.Data(http.StatusOK, "application/json", task.Data)
+		return nil
+	}
+	return relayPlatformTask(c, task, http.MethodGet, "/v1/batches/"+task.TaskID, true)
+}
+
+// BatchCancelHelper 取消 batch
+func BatchCancelHelper(c *gin.Context, task *model.Task) *types.NewAPIError {
+	if task.Action != constant.TaskActionNativeBatch {
+		return relayPlatformTask(c, task, http.MethodPost, "/v1/batches/"+task.TaskID+"/cancel", true)
+	}
+	var batch dto.OpenAIBatch
+	if err := task.GetData(&batch); err != nil {
+		return types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry())
+	}
+	if batch.IsFinished() || batch.Status == dto.BatchStatusCancelling {
+		c.JSON(http.StatusOK, batch)
+		return nil
+	}
+	now := common.GetTimestamp()
+	batch.CancellingAt = now
+	if task.Status == model.TaskStatusQueued && !service.IsNativeBatchRunning(task.TaskID) {
+		// 尚未开始执行，直接取消
+		batch.Status = dto.BatchStatusCancelled
+		batch.CancelledAt = now
+		task.Status = model.TaskStatusFailure
+		task.Progress = "100%"
+		task.FailReason = "cancelled"
+		task.FinishTime = now
+	} else {
+		// 由执行中的任务在下次保存进度时停止
+		batch.Status = dto.BatchStatusCancelling
+	}
+	task.SetData(batch)
+	if err := task.Update(); err != nil {
+		return types.NewError(err, types.ErrorCodeUpdateDataError, types.ErrOptionWithSkipRetry())
+	}
+	c.JSON(http.StatusOK, batch)
+	return nil
+}
+
+// relayPlatformTask 将请求转发到任务所在渠道，saveData 为 true 时保存上游返回的最新任务对象；结算由后台轮询完成
+func relayPlatformTask(c *gin.Context, task *model.Task, method string, path string, saveData bool) *types.NewAPIError {
+	channel, err := model.GetChannelById(task.ChannelId, true)
+	if err != nil {
+		return types.NewError(fmt.Errorf("channel #%d of task %s not found", task.ChannelId, task.TaskID), types.ErrorCodeGetChannelFailed, types.ErrOptionWithSkipRetry())
+	}
+	key := task.PrivateData.Key
+	if key == "" {
+		var newAPIError *types.NewAPIError
+		key, _, newAPIError = channel.GetNextEnabledKey()
+		if newAPIError != nil {
+			return newAPIError
+		}
+	}
+	resp, err := service.DoPlatformRequest(c.Request.Context(), channel, key, method, path, nil, "")
+	if err != nil {
+		return types.NewOpenAIError(err, types.ErrorCodeDoRequestFailed, http.StatusInternalServerError)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return service.RelayErrorHandler(c.Request.Context(), resp, false)
+	}
+	responseBody, err := io.ReadAll(resp.Body)
+	service.CloseResponseBodyGracefully(resp)
+	if err != nil {
+		return types.NewOpenAIError(err, types.ErrorCodeReadResponseBodyFailed, http.StatusInternalServerError)
+	}
+	if saveData {
+		if err := model.TaskBulkUpdateByID([]int64{task.ID}, map[string]any{"data": responseBody}); err != nil {
+			logger.LogError(c, fmt.Sprintf("failed to save task %s: %s", task.TaskID, err.Error()))
+		}
+	}
+	service.IOCopyBytesGracefully(c, resp, responseBody)
+	return nil
+}
@@ -55,3 +55,15 @@ type TaskAdaptor interface {
 type OpenAIVideoConverter interface {
 	ConvertToOpenAIVideo(originTask *model.Task) ([]byte, error)
 }
+
+// ClaudeTokenCounter 渠道支持 /v1/messages/count_tokens 时实现，请求地址由 GetRequestURL 根据 RelayMode 返回，
+// 未实现或返回错误时由本地估算
+type ClaudeTokenCounter interface {
+	ConvertClaudeCountTokensRequest(c *gin.Context, info *relaycommon.RelayInfo, request *dto.ClaudeRequest) (any, error)
+}
+
+// GeminiTokenCounter 渠道支持 Gemini countTokens 时实现，请求地址由 GetRequestURL 根据 RelayMode 返回，
+// 未实现或返回错误时由本地估算
+type GeminiTokenCounter interface {
+	ConvertGeminiCountTokensRequest(c *gin.Context, info *relaycommon.RelayInfo, request *dto.GeminiChatRequest) (any, error)
+}
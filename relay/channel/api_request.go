@@ -12,6 +12,8 @@ import (
 
 	common2 "github.com/QuantumNous/new-api/common"
 	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/pkg/tracing"
 	"github.com/QuantumNous/new-api/relay/common"
 	"github.com/QuantumNous/new-api/relay/constant"
 	"github.com/QuantumNous/new-api/relay/helper"
@@ -22,6 +24,7 @@ import (
 	"github.com/bytedance/gopkg/util/gopool"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func SetupApiRequestHeader(info *common.RelayInfo, c *gin.Context, req *http.Header) {
@@ -310,6 +313,11 @@ func doRequest(c *gin.Context, req *http.Request, info *common.RelayInfo) (*http
 		client = service.GetHttpClient()
 	}
 
+	if info.Hedge != nil {
+		// 对冲请求输掉后需要中断上游请求
+		req = req.WithContext(info.Hedge.Ctx)
+	}
+
 	var stopPinger context.CancelFunc
 	if info.IsStream {
 		helper.SetEventStreamHeaders(c)
@@ -330,14 +338,31 @@ func doRequest(c *gin.Context, req *http.Request, info *common.RelayInfo) (*http
 		}
 	}
 
+	// 上游请求的 span，同时把 traceparent 传给上游
+	_, span := tracing.StartClient(c.Request.Context(), "DoRequest", req.Header,
+		attribute.Int("channel_id", info.ChannelId),
+		attribute.Int("channel_type", info.ChannelType),
+		attribute.String("upstream_model", info.UpstreamModelName),
+	)
 	resp, err := client.Do(req)
 	if err != nil {
+		tracing.End(span, err)
 		logger.LogError(c, "do request failed: "+err.Error())
 		return nil, types.NewError(err, types.ErrorCodeDoRequestFailed, types.ErrOptionWithHideErrMsg("upstream error: do request failed"))
 	}
 	if resp == nil {
+		tracing.End(span, errors.New("resp is nil"))
 		return nil, errors.New("resp is nil")
 	}
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	span.End()
+
+	// 记录上游返回的限流状态，用于后续请求的渠道与 key 选择
+	keyIndex := -1
+	if info.ChannelIsMultiKey {
+		keyIndex = info.ChannelMultiKeyIndex
+	}
+	model.RecordChannelRateLimitHeaders(info.ChannelId, keyIndex, resp.StatusCode, resp.Header)
 
 	_ = req.Body.Close()
 	_ = c.Request.Body.Close()
@@ -6,10 +6,12 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/QuantumNous/new-api/common"
 	"github.com/QuantumNous/new-api/dto"
 	"github.com/QuantumNous/new-api/relay/channel"
 	"github.com/QuantumNous/new-api/relay/channel/claude"
 	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	relayconstant "github.com/QuantumNous/new-api/relay/constant"
 	"github.com/QuantumNous/new-api/service"
 	"github.com/QuantumNous/new-api/types"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
@@ -33,9 +35,12 @@ type Adaptor struct {
 	IsNova     bool
 }
 
-func (a *Adaptor) ConvertGeminiRequest(*gin.Context, *relaycommon.RelayInfo, *dto.GeminiChatRequest) (any, error) {
-	//TODO implement me
-	return nil, errors.New("not implemented")
+func (a *Adaptor) ConvertGeminiRequest(c *gin.Context, info *relaycommon.RelayInfo, request *dto.GeminiChatRequest) (any, error) {
+	claudeReq, err := claude.RequestGemini2Claude(c, request, info)
+	if err != nil {
+		return nil, err
+	}
+	return a.ConvertClaudeRequest(c, info, claudeReq)
 }
 
 func (a *Adaptor) ConvertClaudeRequest(c *gin.Context, info *relaycommon.RelayInfo, request *dto.ClaudeRequest) (any, error) {
@@ -73,6 +78,44 @@ func (a *Adaptor) ConvertClaudeRequest(c *gin.Context, info *relaycommon.RelayIn
 	return request, nil
 }
 
+// ConvertClaudeCountTokensRequest Bedrock 的 CountTokens 接口以 InvokeModel 的请求体作为输入，只支持 Claude 模型
+func (a *Adaptor) ConvertClaudeCountTokensRequest(c *gin.Context, info *relaycommon.RelayInfo, request *dto.ClaudeRequest) (any, error) {
+	if isNovaModel(info.UpstreamModelName) {
+		return nil, errors.New("count tokens is only supported for claude models")
+	}
+	// InvokeModel 的请求体必须包含 max_tokens，开启思考时还需大于思考预算，计数时该值不影响结果
+	maxTokens := request.MaxTokens
+	if maxTokens == 0 {
+		maxTokens = 1
+	}
+	if request.Thinking != nil && uint(request.Thinking.GetBudgetTokens()) >= maxTokens {
+		maxTokens = uint(request.Thinking.GetBudgetTokens()) + 1
+	}
+	awsClaudeReq := &AwsClaudeRequest{
+		AnthropicVersion: "bedrock-2023-05-31",
+		System:           request.System,
+		Messages:         request.Messages,
+		MaxTokens:        maxTokens,
+		Tools:            request.Tools,
+		ToolChoice:       request.ToolChoice,
+		Thinking:         request.Thinking,
+	}
+	if anthropicBeta := c.Request.Header.Get("anthropic-beta"); anthropicBeta != "" {
+		betaJson, err := common.Marshal(strings.Split(anthropicBeta, ","))
+		if err != nil {
+			return nil, err
+		}
+		awsClaudeReq.AnthropicBeta = betaJson
+	}
+	body, err := common.Marshal(awsClaudeReq)
+	if err != nil {
+		return nil, err
+	}
+	countReq := &AwsCountTokensRequest{}
+	countReq.Input.InvokeModel.Body = body
+	return countReq, nil
+}
+
 func (a *Adaptor) ConvertAudioRequest(c *gin.Context, info *relaycommon.RelayInfo, request dto.AudioRequest) (io.Reader, error) {
 	//TODO implement me
 	return nil, errors.New("not implemented")
@@ -144,6 +187,9 @@ func (a *Adaptor) ConvertOpenAIResponsesRequest(c *gin.Context, info *relaycommo
 }
 
 func (a *Adaptor) DoRequest(c *gin.Context, info *relaycommon.RelayInfo, requestBody io.Reader) (any, error) {
+	if info.RelayMode == relayconstant.RelayModeClaudeCountTokens {
+		return doAwsCountTokensRequest(c, info, requestBody)
+	}
 	if a.ClientMode == ClientModeApiKey {
 		return channel.DoApiRequest(a, c, info, requestBody)
 	} else {
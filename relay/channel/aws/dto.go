@@ -28,6 +28,15 @@ type AwsClaudeRequest struct {
 	Thinking         *dto.Thinking       `json:"thinking,omitempty"`
 }
 
+// AwsCountTokensRequest Bedrock CountTokens 的请求体，Body 为 InvokeModel 的请求体，序列化时自动编码为 base64
+type AwsCountTokensRequest struct {
+	Input struct {
+		InvokeModel struct {
+			Body []byte `json:"body"`
+		} `json:"invokeModel"`
+	} `json:"input"`
+}
+
 func formatRequest(requestBody io.Reader, requestHeader http.Header) (*AwsClaudeRequest, error) {
 	var awsClaudeRequest AwsClaudeRequest
 	err := common.DecodeJson(requestBody, &awsClaudeRequest)
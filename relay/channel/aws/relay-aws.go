@@ -1,11 +1,15 @@
 package aws
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -22,6 +26,7 @@ import (
 
 	"github.com/QuantumNous/new-api/setting/model_setting"
 	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
 	bedrockruntimeTypes "github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
@@ -46,18 +51,21 @@ func newAwsInvokeContext() (context.Context, context.CancelFunc) {
 	return context.WithTimeout(context.Background(), time.Duration(common.RelayTimeout)*time.Second)
 }
 
-func newAwsClient(c *gin.Context, info *relaycommon.RelayInfo) (*bedrockruntime.Client, error) {
-	var (
-		httpClient *http.Client
-		err        error
-	)
+func getAwsHttpClient(info *relaycommon.RelayInfo) (*http.Client, error) {
 	if info.ChannelSetting.Proxy != "" {
-		httpClient, err = service.NewProxyHttpClient(info.ChannelSetting.Proxy)
+		httpClient, err := service.NewProxyHttpClient(info.ChannelSetting.Proxy)
 		if err != nil {
 			return nil, fmt.Errorf("new proxy http client failed: %w", err)
 		}
-	} else {
-		httpClient = service.GetHttpClient()
+		return httpClient, nil
+	}
+	return service.GetHttpClient(), nil
+}
+
+func newAwsClient(c *gin.Context, info *relaycommon.RelayInfo) (*bedrockruntime.Client, error) {
+	httpClient, err := getAwsHttpClient(info)
+	if err != nil {
+		return nil, err
 	}
 
 	awsSecret := strings.Split(info.ApiKey, "|")
@@ -162,6 +170,72 @@ func doAwsClientRequest(c *gin.Context, info *relaycommon.RelayInfo, a *Adaptor,
 	}
 }
 
+// doAwsCountTokensRequest 调用 Bedrock CountTokens 接口，当前使用的 SDK 版本未提供该接口，因此直接发送 HTTP 请求，
+// API Key 使用 Bearer 认证，AK/SK 使用 SigV4 签名。成功时响应转换为 Claude count_tokens 的格式
+func doAwsCountTokensRequest(c *gin.Context, info *relaycommon.RelayInfo, requestBody io.Reader) (*http.Response, error) {
+	body, err := io.ReadAll(requestBody)
+	if err != nil {
+		return nil, err
+	}
+	awsSecret := strings.Split(info.ApiKey, "|")
+	var region string
+	switch len(awsSecret) {
+	case 2:
+		region = awsSecret[1]
+	case 3:
+		region = awsSecret[2]
+	default:
+		return nil, errors.New("invalid aws secret key")
+	}
+
+	// CountTokens 只接受基础模型 id，不使用跨区域推理配置；模型 id 中的冒号需要编码后参与签名
+	awsModelId := strings.ReplaceAll(url.PathEscape(getAwsModelID(info.UpstreamModelName)), ":", "%3A")
+	requestURL := fmt.Sprintf("https://bedrock-runtime.%s.amazonaws.com/model/%s/count-tokens", region, awsModelId)
+	req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPost, requestURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if len(awsSecret) == 2 {
+		req.Header.Set("Authorization", "Bearer "+awsSecret[0])
+	} else {
+		payloadHash := sha256.Sum256(body)
+		credential := aws.Credentials{AccessKeyID: awsSecret[0], SecretAccessKey: awsSecret[1]}
+		err = v4.NewSigner().SignHTTP(c.Request.Context(), credential, req, hex.EncodeToString(payloadHash[:]), "bedrock", region, time.Now())
+		if err != nil {
+			return nil, errors.Wrap(err, "sign aws count tokens request fail")
+		}
+	}
+
+	httpClient, err := getAwsHttpClient(info)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp, nil
+	}
+	var countResp struct {
+		InputTokens int `json:"inputTokens"`
+	}
+	err = common.DecodeJson(resp.Body, &countResp)
+	service.CloseResponseBodyGracefully(resp)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode aws count tokens response fail")
+	}
+	data, err := common.Marshal(dto.ClaudeCountTokensResponse{InputTokens: countResp.InputTokens})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	resp.ContentLength = int64(len(data))
+	return resp, nil
+}
+
 // buildAwsRequestBody prepares the payload for AWS requests, applying passthrough rules when enabled.
 func buildAwsRequestBody(c *gin.Context, info *relaycommon.RelayInfo, awsClaudeReq any) ([]byte, error) {
 	if model_setting.GetGlobalSettings().PassThroughRequestEnabled || info.ChannelSetting.PassThroughBodyEnabled {
@@ -0,0 +1,86 @@
+package claude
+
+import (
+	"encoding/json"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Claude 单个请求最多允许 4 个 cache_control 断点
+const maxCacheBreakpoints = 4
+
+// 自动插入的断点使用默认的 5 分钟缓存
+var ephemeralCacheControl = json.RawMessage(`{"type":"ephemeral"}`)
+
+// shouldAutoCacheControl 渠道开启了自动插入 cache_control，或模型在 Claude 设置的自动插入列表中
+func shouldAutoCacheControl(c *gin.Context, modelName string) bool {
+	if settings, ok := common.GetContextKeyType[dto.ChannelOtherSettings](c, constant.ContextKeyChannelOtherSetting); ok && settings.ClaudeAutoCacheControl {
+		return true
+	}
+	return model_setting.GetClaudeSettings().IsAutoCacheControlModel(modelName)
+}
+
+// applyAutoCacheControl 在最后一个工具定义、最后一段 system 与最后一条 user 消息上插入缓存断点，
+// 还有剩余断点时再插入到上一条 user 消息，较长的工具调用链中上一轮请求写入的缓存也能命中。
+// Claude 按 tools、system、messages 的顺序计算缓存前缀，断点之前的内容不变时下一轮请求即可读取缓存
+func applyAutoCacheControl(request *dto.ClaudeRequest) {
+	breakpoints := 0
+	if tools, ok := request.Tools.([]any); ok && len(tools) > 0 {
+		switch tool := tools[len(tools)-1].(type) {
+		case *dto.Tool:
+			tool.CacheControl = ephemeralCacheControl
+			breakpoints++
+		case *dto.ClaudeWebSearchTool:
+			tool.CacheControl = ephemeralCacheControl
+			breakpoints++
+		}
+	}
+	if system, ok := request.System.([]dto.ClaudeMediaMessage); ok && len(system) > 0 && system[len(system)-1].GetText() != "" {
+		system[len(system)-1].CacheControl = ephemeralCacheControl
+		breakpoints++
+	}
+	userTurns := 0
+	for i := len(request.Messages) - 1; i >= 0 && userTurns < 2 && breakpoints < maxCacheBreakpoints; i-- {
+		if request.Messages[i].Role != "user" {
+			continue
+		}
+		userTurns++
+		if setMessageCacheControl(&request.Messages[i]) {
+			breakpoints++
+		}
+	}
+}
+
+// setMessageCacheControl 在消息的最后一段内容上插入缓存断点，字符串内容会转换为 text 段
+func setMessageCacheControl(message *dto.ClaudeMessage) bool {
+	switch content := message.Content.(type) {
+	case string:
+		if content == "" {
+			return false
+		}
+		message.Content = []dto.ClaudeMediaMessage{
+			{
+				Type:         "text",
+				Text:         common.GetPointer[string](content),
+				CacheControl: ephemeralCacheControl,
+			},
+		}
+		return true
+	case []dto.ClaudeMediaMessage:
+		if len(content) == 0 {
+			return false
+		}
+		last := &content[len(content)-1]
+		if last.Type == "text" && last.GetText() == "" {
+			return false
+		}
+		last.CacheControl = ephemeralCacheControl
+		return true
+	}
+	return false
+}
@@ -0,0 +1,542 @@
+package claude
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/relay/reasonmap"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestGemini2Claude 将 Gemini generateContent 请求直接转换为 Claude Messages 请求，不经过 OpenAI 格式，
+// 保留思考签名、函数调用 id、图片与文档。相邻的思考 part 合并为一个 thinking 段，没有签名的 thinking 段 Claude 无法校验，删除
+func RequestGemini2Claude(c *gin.Context, geminiRequest *dto.GeminiChatRequest, info *relaycommon.RelayInfo) (*dto.ClaudeRequest, error) {
+	generationConfig := geminiRequest.GenerationConfig
+	claudeRequest := dto.ClaudeRequest{
+		Model:         info.UpstreamModelName,
+		MaxTokens:     generationConfig.MaxOutputTokens,
+		StopSequences: generationConfig.StopSequences,
+		Temperature:   generationConfig.Temperature,
+		TopP:          generationConfig.TopP,
+		TopK:          int(generationConfig.TopK),
+		Stream:        info.IsStream,
+	}
+	if claudeRequest.MaxTokens == 0 {
+		claudeRequest.MaxTokens = uint(model_setting.GetClaudeSettings().GetDefaultMaxTokens(claudeRequest.Model))
+	}
+	geminiThinking2Claude(&claudeRequest, generationConfig.ThinkingConfig)
+
+	if geminiRequest.SystemInstructions != nil {
+		systemMessages := make([]dto.ClaudeMediaMessage, 0, len(geminiRequest.SystemInstructions.Parts))
+		for _, part := range geminiRequest.SystemInstructions.Parts {
+			if part.Text != "" {
+				systemMessages = append(systemMessages, dto.ClaudeMediaMessage{
+					Type: "text",
+					Text: common.GetPointer(part.Text),
+				})
+			}
+		}
+		if len(systemMessages) > 0 {
+			claudeRequest.System = systemMessages
+		}
+	}
+
+	if err := geminiTools2Claude(&claudeRequest, geminiRequest); err != nil {
+		return nil, err
+	}
+
+	// Gemini 客户端可能不传函数调用 id，按函数名依次对应尚未返回结果的调用
+	pendingToolUseIds := make(map[string][]string)
+	claudeMessages := make([]dto.ClaudeMessage, 0, len(geminiRequest.Contents))
+	for _, content := range geminiRequest.Contents {
+		blocks, err := geminiParts2ClaudeContent(content.Parts, pendingToolUseIds)
+		if err != nil {
+			return nil, err
+		}
+		if len(blocks) == 0 {
+			continue
+		}
+		role := "user"
+		if content.Role == "model" {
+			role = "assistant"
+		}
+		claudeMessages = append(claudeMessages, dto.ClaudeMessage{
+			Role:    role,
+			Content: blocks,
+		})
+	}
+	claudeRequest.Messages = claudeMessages
+
+	if shouldAutoCacheControl(c, claudeRequest.Model) {
+		applyAutoCacheControl(&claudeRequest)
+	}
+	return &claudeRequest, nil
+}
+
+// geminiThinking2Claude thinkingBudget 为 0 时不开启思考，动态预算与 thinkingLevel 按 max_tokens 的比例计算预算
+func geminiThinking2Claude(claudeRequest *dto.ClaudeRequest, thinkingConfig *dto.GeminiThinkingConfig) {
+	if thinkingConfig == nil {
+		return
+	}
+	budget := 0
+	if thinkingConfig.ThinkingBudget != nil {
+		budget = *thinkingConfig.ThinkingBudget
+		if budget == 0 {
+			return
+		}
+	}
+	if budget <= 0 {
+		if !thinkingConfig.IncludeThoughts && thinkingConfig.ThinkingLevel == "" && thinkingConfig.ThinkingBudget == nil {
+			return
+		}
+		switch strings.ToLower(thinkingConfig.ThinkingLevel) {
+		case "minimal", "low":
+			budget = 1280
+		case "medium":
+			budget = 2048
+		case "high":
+			budget = 4096
+		default:
+			if claudeRequest.MaxTokens < 1280 {
+				claudeRequest.MaxTokens = 1280
+			}
+			budget = int(float64(claudeRequest.MaxTokens) * model_setting.GetClaudeSettings().ThinkingAdapterBudgetTokensPercentage)
+		}
+	}
+	// 因为BudgetTokens 必须大于1024，且小于 max_tokens
+	if budget < 1024 {
+		budget = 1024
+	}
+	if claudeRequest.MaxTokens <= uint(budget) {
+		claudeRequest.MaxTokens = uint(budget) + 1024
+	}
+	claudeRequest.Thinking = &dto.Thinking{
+		Type:         "enabled",
+		BudgetTokens: common.GetPointer(budget),
+	}
+	// https://docs.anthropic.com/en/docs/build-with-claude/extended-thinking#important-considerations-when-using-extended-thinking
+	claudeRequest.TopP = 0
+	claudeRequest.TopK = 0
+	claudeRequest.Temperature = common.GetPointer[float64](1.0)
+}
+
+// geminiTools2Claude 函数声明转换为自定义工具，googleSearch 转换为 web_search
+func geminiTools2Claude(claudeRequest *dto.ClaudeRequest, geminiRequest *dto.GeminiChatRequest) error {
+	for _, tool := range geminiRequest.GetTools() {
+		if tool.GoogleSearch != nil || tool.GoogleSearchRetrieval != nil {
+			claudeRequest.AddTool(&dto.ClaudeWebSearchTool{
+				Type: "web_search_20250305",
+				Name: "web_search",
+			})
+		}
+		if tool.FunctionDeclarations == nil {
+			continue
+		}
+		functions, err := common.Any2Type[[]map[string]any](tool.FunctionDeclarations)
+		if err != nil {
+			return fmt.Errorf("invalid gemini function declarations: %w", err)
+		}
+		for _, function := range functions {
+			name, _ := function["name"].(string)
+			description, _ := function["description"].(string)
+			schema, ok := function["parametersJsonSchema"].(map[string]any)
+			if !ok {
+				schema, _ = normalizeGeminiSchema(function["parameters"]).(map[string]any)
+			}
+			if schema == nil {
+				schema = map[string]any{
+					"type":       "object",
+					"properties": map[string]any{},
+				}
+			}
+			claudeRequest.AddTool(&dto.Tool{
+				Name:        name,
+				Description: description,
+				InputSchema: schema,
+			})
+		}
+	}
+	if len(claudeRequest.GetTools()) == 0 || geminiRequest.ToolConfig == nil || geminiRequest.ToolConfig.FunctionCallingConfig == nil {
+		return nil
+	}
+	config := geminiRequest.ToolConfig.FunctionCallingConfig
+	switch strings.ToUpper(string(config.Mode)) {
+	case "AUTO":
+		claudeRequest.ToolChoice = &dto.ClaudeToolChoice{Type: "auto"}
+	case "ANY", "VALIDATED":
+		if len(config.AllowedFunctionNames) == 1 {
+			claudeRequest.ToolChoice = &dto.ClaudeToolChoice{Type: "tool", Name: config.AllowedFunctionNames[0]}
+		} else {
+			claudeRequest.ToolChoice = &dto.ClaudeToolChoice{Type: "any"}
+		}
+	case "NONE":
+		claudeRequest.ToolChoice = &dto.ClaudeToolChoice{Type: "none"}
+	}
+	return nil
+}
+
+// normalizeGeminiSchema Gemini Schema 的类型可以是大写（OBJECT、STRING），Claude 只接受 JSON Schema 的小写类型
+func normalizeGeminiSchema(schema any) any {
+	switch v := schema.(type) {
+	case map[string]any:
+		normalized := make(map[string]any, len(v))
+		for key, value := range v {
+			if typeName, ok := value.(string); ok && key == "type" {
+				normalized[key] = strings.ToLower(typeName)
+				continue
+			}
+			normalized[key] = normalizeGeminiSchema(value)
+		}
+		return normalized
+	case []any:
+		normalized := make([]any, len(v))
+		for i, value := range v {
+			normalized[i] = normalizeGeminiSchema(value)
+		}
+		return normalized
+	}
+	return schema
+}
+
+// geminiParts2ClaudeContent tool_result 段必须在 user 消息的最前面
+func geminiParts2ClaudeContent(parts []dto.GeminiPart, pendingToolUseIds map[string][]string) ([]dto.ClaudeMediaMessage, error) {
+	blocks := make([]dto.ClaudeMediaMessage, 0, len(parts))
+	toolResults := make([]dto.ClaudeMediaMessage, 0)
+	for _, part := range parts {
+		switch {
+		case part.Thought:
+			signature := dto.GeminiRawString(part.ThoughtSignature)
+			if n := len(blocks); n > 0 && blocks[n-1].Type == "thinking" && blocks[n-1].Signature == "" {
+				blocks[n-1].Thinking = common.GetPointer(*blocks[n-1].Thinking + part.Text)
+				blocks[n-1].Signature = signature
+			} else {
+				blocks = append(blocks, dto.ClaudeMediaMessage{
+					Type:      "thinking",
+					Thinking:  common.GetPointer(part.Text),
+					Signature: signature,
+				})
+			}
+		case part.FunctionCall != nil:
+			id := part.FunctionCall.ID
+			if id == "" {
+				id = "toolu_" + common.GetUUID()
+			}
+			name := part.FunctionCall.FunctionName
+			pendingToolUseIds[name] = append(pendingToolUseIds[name], id)
+			input := part.FunctionCall.Arguments
+			if input == nil {
+				input = map[string]any{}
+			}
+			blocks = append(blocks, dto.ClaudeMediaMessage{
+				Type:  "tool_use",
+				Id:    id,
+				Name:  name,
+				Input: input,
+			})
+		case part.FunctionResponse != nil:
+			toolResult, err := geminiFunctionResponse2Claude(part.FunctionResponse, pendingToolUseIds)
+			if err != nil {
+				return nil, err
+			}
+			toolResults = append(toolResults, toolResult)
+		case part.InlineData != nil:
+			block, err := geminiMedia2Claude(part.InlineData.MimeType, part.InlineData.Data, "")
+			if err != nil {
+				return nil, err
+			}
+			blocks = append(blocks, block)
+		case part.FileData != nil:
+			block, err := geminiMedia2Claude(part.FileData.MimeType, "", part.FileData.FileUri)
+			if err != nil {
+				return nil, err
+			}
+			blocks = append(blocks, block)
+		case part.ExecutableCode != nil:
+			blocks = append(blocks, dto.ClaudeMediaMessage{
+				Type: "text",
+				Text: common.GetPointer("```" + part.ExecutableCode.Language + "\n" + part.ExecutableCode.Code + "\n```"),
+			})
+		case part.CodeExecutionResult != nil:
+			blocks = append(blocks, dto.ClaudeMediaMessage{
+				Type: "text",
+				Text: common.GetPointer("```output\n" + part.CodeExecutionResult.Output + "\n```"),
+			})
+		case part.Text != "":
+			blocks = append(blocks, dto.ClaudeMediaMessage{
+				Type: "text",
+				Text: common.GetPointer(part.Text),
+			})
+		}
+	}
+	for _, block := range blocks {
+		if block.Type != "thinking" || block.Signature != "" {
+			toolResults = append(toolResults, block)
+		}
+	}
+	return toolResults, nil
+}
+
+// geminiFunctionResponse2Claude response 中只有 content 或 error 字段时还原为文本，其他内容转换为 JSON 文本，
+// functionResponse.parts 中的图片与文档一并放入结果中
+func geminiFunctionResponse2Claude(response *dto.GeminiFunctionResponse, pendingToolUseIds map[string][]string) (dto.ClaudeMediaMessage, error) {
+	id := dto.GeminiRawString(response.ID)
+	pending := pendingToolUseIds[response.Name]
+	if id == "" && len(pending) > 0 {
+		id = pending[0]
+	}
+	for i, pendingId := range pending {
+		if pendingId == id {
+			pendingToolUseIds[response.Name] = append(pending[:i:i], pending[i+1:]...)
+			break
+		}
+	}
+	toolResult := dto.ClaudeMediaMessage{
+		Type:      "tool_result",
+		ToolUseId: id,
+	}
+
+	var text string
+	if value, ok := response.Response["error"].(string); ok && len(response.Response) == 1 {
+		text = value
+		toolResult.IsError = common.GetPointer(true)
+	} else if value, ok := response.Response["content"].(string); ok && len(response.Response) == 1 {
+		text = value
+	} else if len(response.Response) > 0 {
+		data, err := common.Marshal(response.Response)
+		if err != nil {
+			return toolResult, err
+		}
+		text = string(data)
+	}
+
+	var mediaParts []dto.GeminiPart
+	if len(response.Parts) > 0 {
+		if err := common.Unmarshal(response.Parts, &mediaParts); err != nil {
+			return toolResult, fmt.Errorf("invalid gemini function response parts: %w", err)
+		}
+	}
+	if len(mediaParts) == 0 {
+		toolResult.Content = text
+		return toolResult, nil
+	}
+	content := make([]dto.ClaudeMediaMessage, 0, len(mediaParts)+1)
+	if text != "" {
+		content = append(content, dto.ClaudeMediaMessage{
+			Type: "text",
+			Text: common.GetPointer(text),
+		})
+	}
+	for _, part := range mediaParts {
+		var block dto.ClaudeMediaMessage
+		var err error
+		if part.InlineData != nil {
+			block, err = geminiMedia2Claude(part.InlineData.MimeType, part.InlineData.Data, "")
+		} else if part.FileData != nil {
+			block, err = geminiMedia2Claude(part.FileData.MimeType, "", part.FileData.FileUri)
+		} else {
+			continue
+		}
+		if err != nil {
+			return toolResult, err
+		}
+		content = append(content, block)
+	}
+	toolResult.Content = content
+	return toolResult, nil
+}
+
+// geminiMedia2Claude 图片转换为 image 段，PDF 与纯文本转换为 document 段。fileUri 只支持 http(s) 地址
+func geminiMedia2Claude(mimeType string, data string, fileUri string) (dto.ClaudeMediaMessage, error) {
+	mimeType = strings.ToLower(mimeType)
+	source := &dto.ClaudeMessageSource{
+		Type:      "base64",
+		MediaType: mimeType,
+		Data:      data,
+	}
+	if fileUri != "" {
+		if !strings.HasPrefix(fileUri, "http://") && !strings.HasPrefix(fileUri, "https://") {
+			return dto.ClaudeMediaMessage{}, fmt.Errorf("file uri '%s' is not supported in claude, only http(s) url is supported", fileUri)
+		}
+		if mimeType == "" && strings.HasSuffix(strings.ToLower(fileUri), ".pdf") {
+			mimeType = "application/pdf"
+		}
+		source = &dto.ClaudeMessageSource{
+			Type: "url",
+			Url:  fileUri,
+		}
+	}
+	switch {
+	case strings.HasPrefix(mimeType, "image/"), fileUri != "" && mimeType == "":
+		return dto.ClaudeMediaMessage{Type: "image", Source: source}, nil
+	case mimeType == "application/pdf":
+		return dto.ClaudeMediaMessage{Type: "document", Source: source}, nil
+	case mimeType == "text/plain" && fileUri == "":
+		text, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return dto.ClaudeMediaMessage{}, fmt.Errorf("decode base64 text data failed: %w", err)
+		}
+		return dto.ClaudeMediaMessage{
+			Type: "document",
+			Source: &dto.ClaudeMessageSource{
+				Type:      "text",
+				MediaType: "text/plain",
+				Data:      string(text),
+			},
+		}, nil
+	}
+	return dto.ClaudeMediaMessage{}, fmt.Errorf("mime type is not supported by Claude: '%s'", mimeType)
+}
+
+// claudeContent2GeminiPart thinking 段转换为携带签名的思考 part，tool_use 转换为带 id 的函数调用
+func claudeContent2GeminiPart(block dto.ClaudeMediaMessage) *dto.GeminiPart {
+	switch block.Type {
+	case "text":
+		if block.GetText() != "" {
+			return &dto.GeminiPart{Text: block.GetText()}
+		}
+	case "thinking":
+		part := &dto.GeminiPart{Thought: true}
+		if block.Thinking != nil {
+			part.Text = *block.Thinking
+		}
+		if block.Signature != "" {
+			part.ThoughtSignature = json.RawMessage(strconv.Quote(block.Signature))
+		}
+		if part.Text != "" || len(part.ThoughtSignature) > 0 {
+			return part
+		}
+	case "tool_use":
+		args := block.Input
+		if args == nil {
+			args = map[string]any{}
+		}
+		return &dto.GeminiPart{
+			FunctionCall: &dto.FunctionCall{
+				ID:           block.Id,
+				FunctionName: block.Name,
+				Arguments:    args,
+			},
+		}
+	}
+	return nil
+}
+
+// claudeUsage2Gemini Gemini 的 promptTokenCount 包含命中缓存与写入缓存的 token
+func claudeUsage2Gemini(usage *dto.Usage) dto.GeminiUsageMetadata {
+	promptTokens := usage.PromptTokens + usage.PromptTokensDetails.CachedTokens + usage.PromptTokensDetails.CachedCreationTokens
+	return dto.GeminiUsageMetadata{
+		PromptTokenCount:        promptTokens,
+		CandidatesTokenCount:    usage.CompletionTokens,
+		TotalTokenCount:         promptTokens + usage.CompletionTokens,
+		CachedContentTokenCount: usage.PromptTokensDetails.CachedTokens,
+	}
+}
+
+func claudeGeminiChunk(parts []dto.GeminiPart, finishReason *string, usage *dto.Usage) *dto.GeminiChatResponse {
+	return &dto.GeminiChatResponse{
+		Candidates: []dto.GeminiChatCandidate{
+			{
+				Content: dto.GeminiChatContent{
+					Role:  "model",
+					Parts: parts,
+				},
+				FinishReason:  finishReason,
+				SafetyRatings: []dto.GeminiChatSafetyRating{},
+			},
+		},
+		UsageMetadata: claudeUsage2Gemini(usage),
+	}
+}
+
+// ResponseClaude2Gemini 将 Claude Messages 响应直接转换为 Gemini generateContent 响应
+func ResponseClaude2Gemini(claudeResponse *dto.ClaudeResponse, usage *dto.Usage) *dto.GeminiChatResponse {
+	parts := make([]dto.GeminiPart, 0, len(claudeResponse.Content))
+	for _, block := range claudeResponse.Content {
+		if part := claudeContent2GeminiPart(block); part != nil {
+			parts = append(parts, *part)
+		}
+	}
+	finishReason := reasonmap.ClaudeStopReasonToGeminiFinishReason(claudeResponse.StopReason)
+	return claudeGeminiChunk(parts, &finishReason, usage)
+}
+
+// claudeGeminiBlock 流式转换中尚未结束的内容段，工具调用的参数与思考的签名在段结束时才完整
+type claudeGeminiBlock struct {
+	block dto.ClaudeMediaMessage
+	input strings.Builder
+}
+
+// StreamResponseClaude2Gemini 将 Claude 流式事件转换为 Gemini 流式响应，没有对应内容的事件返回 nil。
+// 文本与思考按增量发送，思考的签名在段结束时作为一个文本为空的思考 part 发送，工具调用在段结束时整体发送
+func StreamResponseClaude2Gemini(claudeResponse *dto.ClaudeResponse, claudeInfo *ClaudeResponseInfo) *dto.GeminiChatResponse {
+	if claudeInfo.geminiBlocks == nil {
+		claudeInfo.geminiBlocks = make(map[int]*claudeGeminiBlock)
+	}
+	var part *dto.GeminiPart
+	switch claudeResponse.Type {
+	case "content_block_start":
+		if claudeResponse.ContentBlock == nil {
+			return nil
+		}
+		claudeInfo.geminiBlocks[claudeResponse.GetIndex()] = &claudeGeminiBlock{block: *claudeResponse.ContentBlock}
+		if claudeResponse.ContentBlock.Type == "text" {
+			part = claudeContent2GeminiPart(*claudeResponse.ContentBlock)
+		}
+	case "content_block_delta":
+		current := claudeInfo.geminiBlocks[claudeResponse.GetIndex()]
+		if claudeResponse.Delta == nil || current == nil {
+			return nil
+		}
+		switch claudeResponse.Delta.Type {
+		case "text_delta":
+			part = claudeContent2GeminiPart(dto.ClaudeMediaMessage{Type: "text", Text: claudeResponse.Delta.Text})
+		case "thinking_delta":
+			part = claudeContent2GeminiPart(dto.ClaudeMediaMessage{Type: "thinking", Thinking: claudeResponse.Delta.Thinking})
+		case "signature_delta":
+			current.block.Signature += claudeResponse.Delta.Signature
+		case "input_json_delta":
+			if claudeResponse.Delta.PartialJson != nil {
+				current.input.WriteString(*claudeResponse.Delta.PartialJson)
+			}
+		}
+	case "content_block_stop":
+		current := claudeInfo.geminiBlocks[claudeResponse.GetIndex()]
+		if current == nil {
+			return nil
+		}
+		delete(claudeInfo.geminiBlocks, claudeResponse.GetIndex())
+		switch current.block.Type {
+		case "thinking":
+			part = claudeContent2GeminiPart(dto.ClaudeMediaMessage{Type: "thinking", Signature: current.block.Signature})
+		case "tool_use":
+			if current.input.Len() > 0 {
+				var input map[string]any
+				if err := common.UnmarshalJsonStr(current.input.String(), &input); err != nil {
+					common.SysLog("tool_use input is not a valid json object: " + current.input.String())
+				} else {
+					current.block.Input = input
+				}
+			}
+			part = claudeContent2GeminiPart(current.block)
+		}
+	case "message_delta":
+		stopReason := ""
+		if claudeResponse.Delta != nil && claudeResponse.Delta.StopReason != nil {
+			stopReason = *claudeResponse.Delta.StopReason
+		}
+		finishReason := reasonmap.ClaudeStopReasonToGeminiFinishReason(stopReason)
+		return claudeGeminiChunk([]dto.GeminiPart{}, &finishReason, claudeInfo.Usage)
+	}
+	if part == nil {
+		return nil
+	}
+	return claudeGeminiChunk([]dto.GeminiPart{*part}, nil, claudeInfo.Usage)
+}
@@ -0,0 +1,285 @@
+package claude
+
+import (
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+
+	"github.com/stretchr/testify/require"
+)
+
+func requireJSON(t *testing.T, want string, v any) {
+	t.Helper()
+	data, err := common.Marshal(v)
+	require.NoError(t, err)
+	require.JSONEq(t, want, string(data))
+}
+
+func TestGeminiParts2ClaudeContent(t *testing.T) {
+	tests := []struct {
+		name        string
+		parts       string
+		pending     map[string][]string
+		want        string
+		wantPending map[string][]string
+		wantErr     bool
+	}{
+		{
+			name:  "adjacent thoughts are merged with the trailing signature",
+			parts: `[{"text":"a","thought":true},{"text":"b","thought":true,"thoughtSignature":"s1"},{"text":"answer"}]`,
+			want:  `[{"type":"thinking","thinking":"ab","signature":"s1"},{"type":"text","text":"answer"}]`,
+		},
+		{
+			name:  "thinking without signature is dropped",
+			parts: `[{"text":"a","thought":true},{"text":"hi"}]`,
+			want:  `[{"type":"text","text":"hi"}]`,
+		},
+		{
+			name:        "function call keeps its id",
+			parts:       `[{"functionCall":{"id":"call_1","name":"get_weather","args":{"city":"Paris"}}}]`,
+			want:        `[{"type":"tool_use","id":"call_1","name":"get_weather","input":{"city":"Paris"}}]`,
+			wantPending: map[string][]string{"get_weather": {"call_1"}},
+		},
+		{
+			name:        "tool results come first",
+			parts:       `[{"text":"see"},{"functionResponse":{"id":"call_1","name":"get_weather","response":{"content":"sunny"}}}]`,
+			pending:     map[string][]string{"get_weather": {"call_1"}},
+			want:        `[{"type":"tool_result","tool_use_id":"call_1","content":"sunny"},{"type":"text","text":"see"}]`,
+			wantPending: map[string][]string{"get_weather": {}},
+		},
+		{
+			name:        "response without id matches the oldest pending call",
+			parts:       `[{"functionResponse":{"name":"get_weather","response":{"error":"boom"}}}]`,
+			pending:     map[string][]string{"get_weather": {"toolu_a", "toolu_b"}},
+			want:        `[{"type":"tool_result","tool_use_id":"toolu_a","content":"boom","is_error":true}]`,
+			wantPending: map[string][]string{"get_weather": {"toolu_b"}},
+		},
+		{
+			name:  "structured response and media parts",
+			parts: `[{"functionResponse":{"id":"call_1","name":"chart","response":{"rows":2},"parts":[{"inlineData":{"mimeType":"image/png","data":"AAAA"}}]}}]`,
+			want:  `[{"type":"tool_result","tool_use_id":"call_1","content":[{"type":"text","text":"{\"rows\":2}"},{"type":"image","source":{"type":"base64","media_type":"image/png","data":"AAAA"}}]}]`,
+		},
+		{
+			name:  "code execution becomes text",
+			parts: `[{"executableCode":{"language":"python","code":"print(1)"}},{"codeExecutionResult":{"outcome":"OUTCOME_OK","output":"1"}}]`,
+			want:  "[{\"type\":\"text\",\"text\":\"```python\\nprint(1)\\n```\"},{\"type\":\"text\",\"text\":\"```output\\n1\\n```\"}]",
+		},
+		{
+			name:    "unsupported file uri",
+			parts:   `[{"fileData":{"mimeType":"application/pdf","fileUri":"gs://bucket/a.pdf"}}]`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var parts []dto.GeminiPart
+			require.NoError(t, common.UnmarshalJsonStr(tt.parts, &parts))
+			pending := tt.pending
+			if pending == nil {
+				pending = map[string][]string{}
+			}
+			blocks, err := geminiParts2ClaudeContent(parts, pending)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			requireJSON(t, tt.want, blocks)
+			if tt.wantPending == nil {
+				tt.wantPending = map[string][]string{}
+			}
+			require.Equal(t, tt.wantPending, pending)
+		})
+	}
+}
+
+func TestGeminiMedia2Claude(t *testing.T) {
+	tests := []struct {
+		name     string
+		mimeType string
+		data     string
+		fileUri  string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "base64 image",
+			mimeType: "IMAGE/PNG",
+			data:     "AAAA",
+			want:     `{"type":"image","source":{"type":"base64","media_type":"image/png","data":"AAAA"}}`,
+		},
+		{
+			name:     "base64 pdf",
+			mimeType: "application/pdf",
+			data:     "JVBE",
+			want:     `{"type":"document","source":{"type":"base64","media_type":"application/pdf","data":"JVBE"}}`,
+		},
+		{
+			name:     "plain text is decoded",
+			mimeType: "text/plain",
+			data:     "aGVsbG8=",
+			want:     `{"type":"document","source":{"type":"text","media_type":"text/plain","data":"hello"}}`,
+		},
+		{
+			name:    "pdf url without mime type",
+			fileUri: "https://example.com/a.PDF",
+			want:    `{"type":"document","source":{"type":"url","url":"https://example.com/a.PDF"}}`,
+		},
+		{
+			name:    "url without mime type is an image",
+			fileUri: "https://example.com/a",
+			want:    `{"type":"image","source":{"type":"url","url":"https://example.com/a"}}`,
+		},
+		{
+			name:     "gcs uri",
+			mimeType: "image/png",
+			fileUri:  "gs://bucket/a.png",
+			wantErr:  true,
+		},
+		{
+			name:     "unsupported mime type",
+			mimeType: "audio/mp3",
+			data:     "AAAA",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			block, err := geminiMedia2Claude(tt.mimeType, tt.data, tt.fileUri)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			requireJSON(t, tt.want, block)
+		})
+	}
+}
+
+func TestGeminiThinking2Claude(t *testing.T) {
+	tests := []struct {
+		name          string
+		maxTokens     uint
+		config        *dto.GeminiThinkingConfig
+		wantBudget    int
+		wantMaxTokens uint
+	}{
+		{name: "no thinking config", maxTokens: 4096, wantMaxTokens: 4096},
+		{name: "zero budget disables thinking", maxTokens: 4096, config: &dto.GeminiThinkingConfig{ThinkingBudget: common.GetPointer(0)}, wantMaxTokens: 4096},
+		{name: "explicit budget", maxTokens: 8192, config: &dto.GeminiThinkingConfig{ThinkingBudget: common.GetPointer(2000)}, wantBudget: 2000, wantMaxTokens: 8192},
+		{name: "budget raised to the minimum", maxTokens: 8192, config: &dto.GeminiThinkingConfig{ThinkingBudget: common.GetPointer(500)}, wantBudget: 1024, wantMaxTokens: 8192},
+		{name: "max tokens raised above the budget", maxTokens: 1000, config: &dto.GeminiThinkingConfig{ThinkingBudget: common.GetPointer(2000)}, wantBudget: 2000, wantMaxTokens: 3024},
+		{name: "thinking level", maxTokens: 8192, config: &dto.GeminiThinkingConfig{ThinkingLevel: "HIGH"}, wantBudget: 4096, wantMaxTokens: 8192},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := &dto.ClaudeRequest{MaxTokens: tt.maxTokens, TopP: 0.5}
+			geminiThinking2Claude(request, tt.config)
+			require.Equal(t, tt.wantMaxTokens, request.MaxTokens)
+			if tt.wantBudget == 0 {
+				require.Nil(t, request.Thinking)
+				require.Equal(t, 0.5, request.TopP)
+				return
+			}
+			require.NotNil(t, request.Thinking)
+			require.Equal(t, "enabled", request.Thinking.Type)
+			require.Equal(t, tt.wantBudget, request.Thinking.GetBudgetTokens())
+			require.Zero(t, request.TopP)
+			require.Equal(t, 1.0, *request.Temperature)
+		})
+	}
+}
+
+func TestNormalizeGeminiSchema(t *testing.T) {
+	schema := map[string]any{
+		"type": "OBJECT",
+		"properties": map[string]any{
+			"tags": map[string]any{"type": "ARRAY", "items": map[string]any{"type": "STRING"}},
+		},
+		"required": []any{"tags"},
+	}
+	requireJSON(t, `{"type":"object","properties":{"tags":{"type":"array","items":{"type":"string"}}},"required":["tags"]}`, normalizeGeminiSchema(schema))
+}
+
+func TestClaudeContent2GeminiPart(t *testing.T) {
+	tests := []struct {
+		name  string
+		block dto.ClaudeMediaMessage
+		want  string
+	}{
+		{name: "text", block: dto.ClaudeMediaMessage{Type: "text", Text: common.GetPointer("hi")}, want: `{"text":"hi"}`},
+		{name: "empty text", block: dto.ClaudeMediaMessage{Type: "text", Text: common.GetPointer("")}, want: `null`},
+		{name: "thinking with signature", block: dto.ClaudeMediaMessage{Type: "thinking", Thinking: common.GetPointer("hmm"), Signature: "s1"}, want: `{"text":"hmm","thought":true,"thoughtSignature":"s1"}`},
+		{name: "signature only", block: dto.ClaudeMediaMessage{Type: "thinking", Signature: "s1"}, want: `{"thought":true,"thoughtSignature":"s1"}`},
+		{name: "empty thinking", block: dto.ClaudeMediaMessage{Type: "thinking"}, want: `null`},
+		{name: "tool_use", block: dto.ClaudeMediaMessage{Type: "tool_use", Id: "call_1", Name: "f"}, want: `{"functionCall":{"id":"call_1","name":"f","args":{}}}`},
+		{name: "unsupported block", block: dto.ClaudeMediaMessage{Type: "server_tool_use"}, want: `null`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requireJSON(t, tt.want, claudeContent2GeminiPart(tt.block))
+		})
+	}
+}
+
+func TestResponseClaude2Gemini(t *testing.T) {
+	usage := &dto.Usage{PromptTokens: 10, CompletionTokens: 3}
+	usage.PromptTokensDetails.CachedTokens = 5
+	usage.PromptTokensDetails.CachedCreationTokens = 2
+	response := ResponseClaude2Gemini(&dto.ClaudeResponse{
+		StopReason: "max_tokens",
+		Content: []dto.ClaudeMediaMessage{
+			{Type: "thinking", Thinking: common.GetPointer("hmm"), Signature: "s1"},
+			{Type: "text", Text: common.GetPointer("hi")},
+			{Type: "tool_use", Id: "call_1", Name: "f", Input: map[string]any{"x": 1}},
+		},
+	}, usage)
+	requireJSON(t, `{
+		"candidates":[{
+			"content":{"role":"model","parts":[
+				{"text":"hmm","thought":true,"thoughtSignature":"s1"},
+				{"text":"hi"},
+				{"functionCall":{"id":"call_1","name":"f","args":{"x":1}}}
+			]},
+			"finishReason":"MAX_TOKENS",
+			"index":0,
+			"safetyRatings":[]
+		}],
+		"usageMetadata":{"promptTokenCount":17,"candidatesTokenCount":3,"totalTokenCount":20,"cachedContentTokenCount":5,"thoughtsTokenCount":0,"promptTokensDetails":null}
+	}`, response)
+}
+
+func TestStreamResponseClaude2Gemini(t *testing.T) {
+	claudeInfo := &ClaudeResponseInfo{Usage: &dto.Usage{}}
+	steps := []struct {
+		event string
+		want  string // 期望的 parts，空字符串表示不输出
+	}{
+		{event: `{"type":"content_block_start","index":0,"content_block":{"type":"thinking","thinking":""}}`},
+		{event: `{"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"hmm"}}`, want: `[{"text":"hmm","thought":true}]`},
+		{event: `{"type":"content_block_delta","index":0,"delta":{"type":"signature_delta","signature":"s1"}}`},
+		{event: `{"type":"content_block_stop","index":0}`, want: `[{"thought":true,"thoughtSignature":"s1"}]`},
+		{event: `{"type":"content_block_start","index":1,"content_block":{"type":"text","text":""}}`},
+		{event: `{"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":"hi"}}`, want: `[{"text":"hi"}]`},
+		{event: `{"type":"content_block_stop","index":1}`},
+		{event: `{"type":"content_block_start","index":2,"content_block":{"type":"tool_use","id":"call_1","name":"f","input":{}}}`},
+		{event: `{"type":"content_block_delta","index":2,"delta":{"type":"input_json_delta","partial_json":"{\"x\":"}}`},
+		{event: `{"type":"content_block_delta","index":2,"delta":{"type":"input_json_delta","partial_json":"1}"}}`},
+		{event: `{"type":"content_block_stop","index":2}`, want: `[{"functionCall":{"id":"call_1","name":"f","args":{"x":1}}}]`},
+		{event: `{"type":"content_block_delta","index":5,"delta":{"type":"text_delta","text":"lost"}}`},
+		{event: `{"type":"message_delta","delta":{"stop_reason":"tool_use"}}`, want: `[]`},
+	}
+	for _, step := range steps {
+		var claudeResponse dto.ClaudeResponse
+		require.NoError(t, common.UnmarshalJsonStr(step.event, &claudeResponse))
+		response := StreamResponseClaude2Gemini(&claudeResponse, claudeInfo)
+		if step.want == "" {
+			require.Nil(t, response, step.event)
+			continue
+		}
+		require.NotNil(t, response, step.event)
+		requireJSON(t, step.want, response.Candidates[0].Content.Parts)
+	}
+	require.Empty(t, claudeInfo.geminiBlocks)
+}
@@ -0,0 +1,663 @@
+package gemini
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/relay/helper"
+	"github.com/QuantumNous/new-api/relay/reasonmap"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Claude 与 Gemini 直接互转，不经过 OpenAI 格式，保留思考签名、工具调用 id、图片与文档。
+// Gemini 的签名既可能在思考 part 上，也可能在其后的函数调用或文本 part 上，Claude 的签名只能在 thinking 段上：
+// 思考 part 的签名放在对应的 thinking 段上，非思考 part 的签名单独作为一个内容为空的 thinking 段放在该 part 之前，
+// 转换回 Gemini 时内容为空的 thinking 段的签名附加到其后的第一个 part 上
+
+// RequestClaude2Gemini 将 Claude Messages 请求转换为 Gemini generateContent 请求
+func RequestClaude2Gemini(c *gin.Context, claudeRequest *dto.ClaudeRequest, info *relaycommon.RelayInfo) (*dto.GeminiChatRequest, error) {
+	geminiRequest := dto.GeminiChatRequest{
+		Contents:       make([]dto.GeminiChatContent, 0, len(claudeRequest.Messages)),
+		SafetySettings: geminiSafetySettings(),
+		GenerationConfig: dto.GeminiChatGenerationConfig{
+			Temperature:     claudeRequest.Temperature,
+			TopP:            claudeRequest.TopP,
+			TopK:            float64(claudeRequest.TopK),
+			MaxOutputTokens: claudeRequest.MaxTokens,
+		},
+	}
+	if model_setting.IsGeminiModelSupportImagine(info.UpstreamModelName) {
+		geminiRequest.GenerationConfig.ResponseModalities = []string{
+			"TEXT",
+			"IMAGE",
+		}
+	}
+	if stopSequences := claudeRequest.StopSequences; len(stopSequences) > 0 {
+		// Gemini supports up to 5 stop sequences
+		if len(stopSequences) > 5 {
+			stopSequences = stopSequences[:5]
+		}
+		geminiRequest.GenerationConfig.StopSequences = stopSequences
+	}
+	claudeThinking2Gemini(&geminiRequest, claudeRequest.Thinking, info)
+
+	var systemParts []dto.GeminiPart
+	if claudeRequest.IsStringSystem() {
+		if system := claudeRequest.GetStringSystem(); system != "" {
+			systemParts = append(systemParts, dto.GeminiPart{Text: system})
+		}
+	} else {
+		for _, block := range claudeRequest.ParseSystem() {
+			if block.GetText() != "" {
+				systemParts = append(systemParts, dto.GeminiPart{Text: block.GetText()})
+			}
+		}
+	}
+	if len(systemParts) > 0 {
+		geminiRequest.SystemInstructions = &dto.GeminiChatContent{
+			Parts: systemParts,
+		}
+	}
+
+	if tools := claudeTools2Gemini(claudeRequest.Tools); len(tools) > 0 {
+		geminiRequest.SetTools(tools)
+		geminiRequest.ToolConfig = claudeToolChoice2Gemini(claudeRequest.ToolChoice)
+	}
+
+	attachThoughtSignature := (info.ChannelType == constant.ChannelTypeGemini ||
+		info.ChannelType == constant.ChannelTypeVertexAi) &&
+		model_setting.GetGeminiSettings().FunctionCallThoughtSignatureEnabled
+
+	// tool_result 只有 tool_use_id，按 id 查找对应的函数名
+	toolNames := make(map[string]string)
+	for _, message := range claudeRequest.Messages {
+		parts, err := claudeMessage2GeminiParts(c, message, toolNames)
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) == 0 {
+			continue
+		}
+		content := dto.GeminiChatContent{
+			Role:  "user",
+			Parts: parts,
+		}
+		if message.Role == "assistant" {
+			content.Role = "model"
+			if attachThoughtSignature {
+				attachFunctionCallThoughtSignature(content.Parts)
+			}
+		}
+		geminiRequest.Contents = append(geminiRequest.Contents, content)
+	}
+
+	return &geminiRequest, nil
+}
+
+// claudeThinking2Gemini 请求未指定 thinking 时按模型名后缀适配
+func claudeThinking2Gemini(geminiRequest *dto.GeminiChatRequest, thinking *dto.Thinking, info *relaycommon.RelayInfo) {
+	if thinking == nil {
+		ThinkingAdaptor(geminiRequest, info)
+		return
+	}
+	switch thinking.Type {
+	case "enabled":
+		thinkingConfig := &dto.GeminiThinkingConfig{
+			IncludeThoughts: true,
+		}
+		if budget := thinking.GetBudgetTokens(); budget > 0 {
+			thinkingConfig.ThinkingBudget = common.GetPointer(clampThinkingBudget(info.UpstreamModelName, budget))
+		}
+		geminiRequest.GenerationConfig.ThinkingConfig = thinkingConfig
+	case "adaptive":
+		geminiRequest.GenerationConfig.ThinkingConfig = &dto.GeminiThinkingConfig{
+			IncludeThoughts: true,
+		}
+	case "disabled":
+		// 2.5 Pro 不支持关闭思考
+		if !isNew25ProModel(info.UpstreamModelName) {
+			geminiRequest.GenerationConfig.ThinkingConfig = &dto.GeminiThinkingConfig{
+				ThinkingBudget: common.GetPointer(0),
+			}
+		}
+	}
+}
+
+// claudeTools2Gemini 自定义工具转换为函数声明，web_search 转换为 googleSearch，其他 Claude 内置工具 Gemini 不支持，忽略
+func claudeTools2Gemini(tools any) []dto.GeminiChatTool {
+	if tools == nil {
+		return nil
+	}
+	claudeTools, err := common.Any2Type[[]map[string]any](tools)
+	if err != nil {
+		common.SysError(fmt.Sprintf("failed to parse claude tools: %v", err))
+		return nil
+	}
+	functions := make([]dto.FunctionRequest, 0, len(claudeTools))
+	googleSearch := false
+	for _, tool := range claudeTools {
+		toolType, _ := tool["type"].(string)
+		if strings.HasPrefix(toolType, "web_search") {
+			googleSearch = true
+			continue
+		}
+		if toolType != "" && toolType != "custom" {
+			continue
+		}
+		name, _ := tool["name"].(string)
+		description, _ := tool["description"].(string)
+		function := dto.FunctionRequest{
+			Name:        name,
+			Description: description,
+		}
+		// Gemini 不接受没有属性的 object 参数
+		if schema, ok := tool["input_schema"].(map[string]any); ok {
+			if properties, _ := schema["properties"].(map[string]any); len(properties) > 0 {
+				function.Parameters = cleanFunctionParameters(schema)
+			}
+		}
+		functions = append(functions, function)
+	}
+	var geminiTools []dto.GeminiChatTool
+	if googleSearch {
+		geminiTools = append(geminiTools, dto.GeminiChatTool{
+			GoogleSearch: make(map[string]string),
+		})
+	}
+	if len(functions) > 0 {
+		geminiTools = append(geminiTools, dto.GeminiChatTool{
+			FunctionDeclarations: functions,
+		})
+	}
+	return geminiTools
+}
+
+// claudeToolChoice2Gemini auto -> AUTO, any -> ANY, tool -> ANY + allowedFunctionNames, none -> NONE
+func claudeToolChoice2Gemini(toolChoice any) *dto.ToolConfig {
+	if toolChoice == nil {
+		return nil
+	}
+	choice, err := common.Any2Type[dto.ClaudeToolChoice](toolChoice)
+	if err != nil {
+		return nil
+	}
+	config := &dto.ToolConfig{
+		FunctionCallingConfig: &dto.FunctionCallingConfig{
+			Mode: "AUTO",
+		},
+	}
+	switch choice.Type {
+	case "any":
+		config.FunctionCallingConfig.Mode = "ANY"
+	case "tool":
+		config.FunctionCallingConfig.Mode = "ANY"
+		if choice.Name != "" {
+			config.FunctionCallingConfig.AllowedFunctionNames = []string{choice.Name}
+		}
+	case "none":
+		config.FunctionCallingConfig.Mode = "NONE"
+	}
+	return config
+}
+
+// attachFunctionCallThoughtSignature 历史消息来自其他模型时没有签名，在第一个函数调用上附加跳过校验的签名
+func attachFunctionCallThoughtSignature(parts []dto.GeminiPart) {
+	for _, part := range parts {
+		if len(part.ThoughtSignature) > 0 {
+			return
+		}
+	}
+	for i := range parts {
+		if parts[i].FunctionCall != nil {
+			parts[i].ThoughtSignature = json.RawMessage(strconv.Quote(thoughtSignatureBypassValue))
+			return
+		}
+	}
+}
+
+func claudeMessage2GeminiParts(c *gin.Context, message dto.ClaudeMessage, toolNames map[string]string) ([]dto.GeminiPart, error) {
+	if message.IsStringContent() {
+		if text := message.GetStringContent(); text != "" {
+			return []dto.GeminiPart{{Text: text}}, nil
+		}
+		return nil, nil
+	}
+	blocks, err := message.ParseContent()
+	if err != nil {
+		return nil, fmt.Errorf("invalid claude message content: %w", err)
+	}
+	parts := make([]dto.GeminiPart, 0, len(blocks))
+	var pendingSignature json.RawMessage
+	appendPart := func(part dto.GeminiPart) {
+		if len(pendingSignature) > 0 {
+			part.ThoughtSignature = pendingSignature
+			pendingSignature = nil
+		}
+		parts = append(parts, part)
+	}
+	for _, block := range blocks {
+		switch block.Type {
+		case "text":
+			if block.GetText() != "" {
+				appendPart(dto.GeminiPart{Text: block.GetText()})
+			}
+		case "thinking":
+			if block.Thinking != nil && *block.Thinking != "" {
+				part := dto.GeminiPart{
+					Text:    *block.Thinking,
+					Thought: true,
+				}
+				if block.Signature != "" {
+					part.ThoughtSignature = json.RawMessage(strconv.Quote(block.Signature))
+				}
+				parts = append(parts, part)
+			} else if block.Signature != "" {
+				pendingSignature = json.RawMessage(strconv.Quote(block.Signature))
+			}
+		case "tool_use":
+			toolNames[block.Id] = block.Name
+			args := block.Input
+			if args == nil {
+				args = map[string]any{}
+			}
+			appendPart(dto.GeminiPart{
+				FunctionCall: &dto.FunctionCall{
+					ID:           block.Id,
+					FunctionName: block.Name,
+					Arguments:    args,
+				},
+			})
+		case "tool_result":
+			part, err := claudeToolResult2Gemini(c, block, toolNames[block.ToolUseId])
+			if err != nil {
+				return nil, err
+			}
+			appendPart(part)
+		case "image", "document":
+			part, err := claudeMedia2Gemini(c, block)
+			if err != nil {
+				return nil, err
+			}
+			if part != nil {
+				appendPart(*part)
+			}
+		}
+	}
+	return parts, nil
+}
+
+// claudeToolResult2Gemini 文本结果转换为 functionResponse.response，图片与文档放在 functionResponse.parts 中
+func claudeToolResult2Gemini(c *gin.Context, block dto.ClaudeMediaMessage, name string) (dto.GeminiPart, error) {
+	var texts []string
+	var mediaParts []dto.GeminiPart
+	if block.IsStringContent() {
+		texts = append(texts, block.GetStringContent())
+	} else {
+		for _, item := range block.ParseMediaContent() {
+			switch item.Type {
+			case "text":
+				texts = append(texts, item.GetText())
+			case "image", "document":
+				part, err := claudeMedia2Gemini(c, item)
+				if err != nil {
+					return dto.GeminiPart{}, err
+				}
+				if part != nil {
+					mediaParts = append(mediaParts, *part)
+				}
+			}
+		}
+	}
+	functionResponse := &dto.GeminiFunctionResponse{
+		Name:     name,
+		Response: toolResultResponse(strings.Join(texts, "\n"), block.IsError != nil && *block.IsError),
+		ID:       json.RawMessage(strconv.Quote(block.ToolUseId)),
+	}
+	if len(mediaParts) > 0 {
+		data, err := common.Marshal(mediaParts)
+		if err != nil {
+			return dto.GeminiPart{}, err
+		}
+		functionResponse.Parts = data
+	}
+	return dto.GeminiPart{FunctionResponse: functionResponse}, nil
+}
+
+// toolResultResponse JSON 对象原样作为 response，其他内容放在 content 字段中，执行出错时放在 error 字段中
+func toolResultResponse(text string, isError bool) map[string]interface{} {
+	if isError {
+		return map[string]interface{}{"error": text}
+	}
+	var response map[string]interface{}
+	if err := common.UnmarshalJsonStr(text, &response); err == nil && response != nil {
+		return response
+	}
+	return map[string]interface{}{"content": text}
+}
+
+// claudeMedia2Gemini base64 图片与文档转换为 inlineData，url 来源下载后内联，纯文本文档转换为文本
+func claudeMedia2Gemini(c *gin.Context, block dto.ClaudeMediaMessage) (*dto.GeminiPart, error) {
+	if block.Source == nil {
+		return nil, nil
+	}
+	switch block.Source.Type {
+	case "base64":
+		data, _ := block.Source.Data.(string)
+		return &dto.GeminiPart{
+			InlineData: &dto.GeminiInlineData{
+				MimeType: block.Source.MediaType,
+				Data:     data,
+			},
+		}, nil
+	case "url":
+		fileData, err := service.GetFileBase64FromUrl(c, block.Source.Url, "formatting file for Gemini")
+		if err != nil {
+			return nil, fmt.Errorf("get file base64 from url '%s' failed: %w", block.Source.Url, err)
+		}
+		return &dto.GeminiPart{
+			InlineData: &dto.GeminiInlineData{
+				MimeType: fileData.MimeType,
+				Data:     fileData.Base64Data,
+			},
+		}, nil
+	case "text":
+		if data, _ := block.Source.Data.(string); data != "" {
+			return &dto.GeminiPart{Text: data}, nil
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("%s source type '%s' is not supported in gemini", block.Type, block.Source.Type)
+}
+
+// geminiPartText 不能直接对应 Claude 内容段的 part 按 OpenAI 格式的转换方式转换为文本
+func geminiPartText(part dto.GeminiPart) string {
+	switch {
+	case part.InlineData != nil:
+		if strings.HasPrefix(part.InlineData.MimeType, "image") {
+			return "![image](data:" + part.InlineData.MimeType + ";base64," + part.InlineData.Data + ")"
+		}
+		return fmt.Sprintf("[media](data:%s;base64,%s)", part.InlineData.MimeType, part.InlineData.Data)
+	case part.ExecutableCode != nil:
+		return "```" + part.ExecutableCode.Language + "\n" + part.ExecutableCode.Code + "\n```"
+	case part.CodeExecutionResult != nil:
+		return "```output\n" + part.CodeExecutionResult.Output + "\n```"
+	}
+	return part.Text
+}
+
+// geminiFunctionCall2Claude Gemini 没有返回调用 id 时生成一个
+func geminiFunctionCall2Claude(call *dto.FunctionCall) dto.ClaudeMediaMessage {
+	id := call.ID
+	if id == "" {
+		id = "toolu_" + common.GetUUID()
+	}
+	input := call.Arguments
+	if input == nil {
+		input = map[string]any{}
+	}
+	return dto.ClaudeMediaMessage{
+		Type:  "tool_use",
+		Id:    id,
+		Name:  call.FunctionName,
+		Input: input,
+	}
+}
+
+func geminiUsage2Claude(usage *dto.Usage) *dto.ClaudeUsage {
+	return &dto.ClaudeUsage{
+		InputTokens:          usage.PromptTokens - usage.PromptTokensDetails.CachedTokens,
+		CacheReadInputTokens: usage.PromptTokensDetails.CachedTokens,
+		OutputTokens:         usage.CompletionTokens,
+	}
+}
+
+func geminiStopReason2Claude(finishReason string, hasToolUse bool) string {
+	stopReason := reasonmap.GeminiFinishReasonToClaudeStopReason(finishReason)
+	if hasToolUse && stopReason == "end_turn" {
+		return "tool_use"
+	}
+	return stopReason
+}
+
+// responseGeminiChat2Claude 只转换第一个候选，相邻的思考 part 合并为一个 thinking 段
+func responseGeminiChat2Claude(c *gin.Context, response *dto.GeminiChatResponse, usage *dto.Usage, info *relaycommon.RelayInfo) *dto.ClaudeResponse {
+	contents := make([]dto.ClaudeMediaMessage, 0)
+	finishReason := ""
+	hasToolUse := false
+	if len(response.Candidates) > 0 {
+		candidate := response.Candidates[0]
+		if candidate.FinishReason != nil {
+			finishReason = *candidate.FinishReason
+		}
+		for _, part := range candidate.Content.Parts {
+			signature := dto.GeminiRawString(part.ThoughtSignature)
+			if part.Thought {
+				if n := len(contents); n > 0 && contents[n-1].Type == "thinking" && contents[n-1].Signature == "" {
+					contents[n-1].Thinking = common.GetPointer(*contents[n-1].Thinking + part.Text)
+					contents[n-1].Signature = signature
+				} else {
+					contents = append(contents, dto.ClaudeMediaMessage{
+						Type:      "thinking",
+						Thinking:  common.GetPointer(part.Text),
+						Signature: signature,
+					})
+				}
+				continue
+			}
+			if signature != "" {
+				contents = append(contents, dto.ClaudeMediaMessage{
+					Type:      "thinking",
+					Thinking:  common.GetPointer(""),
+					Signature: signature,
+				})
+			}
+			if part.FunctionCall != nil {
+				hasToolUse = true
+				contents = append(contents, geminiFunctionCall2Claude(part.FunctionCall))
+				continue
+			}
+			text := geminiPartText(part)
+			if text == "" {
+				continue
+			}
+			if n := len(contents); n > 0 && contents[n-1].Type == "text" {
+				contents[n-1].SetText(contents[n-1].GetText() + text)
+			} else {
+				contents = append(contents, dto.ClaudeMediaMessage{
+					Type: "text",
+					Text: common.GetPointer(text),
+				})
+			}
+		}
+	}
+	return &dto.ClaudeResponse{
+		Id:         helper.GetResponseID(c),
+		Type:       "message",
+		Role:       "assistant",
+		Model:      info.UpstreamModelName,
+		Content:    contents,
+		StopReason: geminiStopReason2Claude(finishReason, hasToolUse),
+		Usage:      geminiUsage2Claude(usage),
+	}
+}
+
+// geminiClaudeStream 将 Gemini 流式响应转换为 Claude 事件，文本与思考按段合并，每个函数调用都是完整的一段
+type geminiClaudeStream struct {
+	c            *gin.Context
+	index        int
+	openType     string
+	hasToolUse   bool
+	finishReason string
+}
+
+func (s *geminiClaudeStream) send(resp dto.ClaudeResponse) {
+	_ = helper.ClaudeData(s.c, resp)
+}
+
+func (s *geminiClaudeStream) startMessage(info *relaycommon.RelayInfo) {
+	message := &dto.ClaudeMediaMessage{
+		Id:    helper.GetResponseID(s.c),
+		Model: info.UpstreamModelName,
+		Type:  "message",
+		Role:  "assistant",
+		Usage: &dto.ClaudeUsage{
+			InputTokens: info.GetEstimatePromptTokens(),
+		},
+	}
+	message.SetContent(make([]any, 0))
+	s.send(dto.ClaudeResponse{
+		Type:    "message_start",
+		Message: message,
+	})
+}
+
+func (s *geminiClaudeStream) startBlock(block dto.ClaudeMediaMessage) {
+	s.stopBlock()
+	s.send(dto.ClaudeResponse{
+		Type:         "content_block_start",
+		Index:        common.GetPointer(s.index),
+		ContentBlock: &block,
+	})
+	s.openType = block.Type
+}
+
+func (s *geminiClaudeStream) delta(delta dto.ClaudeMediaMessage) {
+	s.send(dto.ClaudeResponse{
+		Type:  "content_block_delta",
+		Index: common.GetPointer(s.index),
+		Delta: &delta,
+	})
+}
+
+func (s *geminiClaudeStream) stopBlock() {
+	if s.openType == "" {
+		return
+	}
+	s.send(dto.ClaudeResponse{
+		Type:  "content_block_stop",
+		Index: common.GetPointer(s.index),
+	})
+	s.index++
+	s.openType = ""
+}
+
+func (s *geminiClaudeStream) sendSignature(signature string) {
+	s.delta(dto.ClaudeMediaMessage{
+		Type:      "signature_delta",
+		Signature: signature,
+	})
+	s.stopBlock()
+}
+
+func (s *geminiClaudeStream) handlePart(part dto.GeminiPart) {
+	signature := dto.GeminiRawString(part.ThoughtSignature)
+	if part.Thought {
+		if s.openType != "thinking" {
+			s.startBlock(dto.ClaudeMediaMessage{
+				Type:     "thinking",
+				Thinking: common.GetPointer(""),
+			})
+		}
+		if part.Text != "" {
+			s.delta(dto.ClaudeMediaMessage{
+				Type:     "thinking_delta",
+				Thinking: common.GetPointer(part.Text),
+			})
+		}
+		if signature != "" {
+			s.sendSignature(signature)
+		}
+		return
+	}
+	if signature != "" {
+		s.startBlock(dto.ClaudeMediaMessage{
+			Type:     "thinking",
+			Thinking: common.GetPointer(""),
+		})
+		s.sendSignature(signature)
+	}
+	if part.FunctionCall != nil {
+		s.hasToolUse = true
+		block := geminiFunctionCall2Claude(part.FunctionCall)
+		input, err := common.Marshal(block.Input)
+		block.Input = map[string]any{}
+		s.startBlock(block)
+		if err == nil {
+			s.delta(dto.ClaudeMediaMessage{
+				Type:        "input_json_delta",
+				PartialJson: common.GetPointer(string(input)),
+			})
+		}
+		s.stopBlock()
+		return
+	}
+	text := geminiPartText(part)
+	if text == "" {
+		return
+	}
+	if s.openType != "text" {
+		s.startBlock(dto.ClaudeMediaMessage{
+			Type: "text",
+			Text: common.GetPointer(""),
+		})
+	}
+	s.delta(dto.ClaudeMediaMessage{
+		Type: "text_delta",
+		Text: common.GetPointer(text),
+	})
+}
+
+func (s *geminiClaudeStream) finish(usage *dto.Usage) {
+	s.stopBlock()
+	s.send(dto.ClaudeResponse{
+		Type:  "message_delta",
+		Usage: geminiUsage2Claude(usage),
+		Delta: &dto.ClaudeMediaMessage{
+			StopReason: common.GetPointer(geminiStopReason2Claude(s.finishReason, s.hasToolUse)),
+		},
+	})
+	s.send(dto.ClaudeResponse{
+		Type: "message_stop",
+	})
+}
+
+// geminiClaudeStreamHandler 用量在流结束后才能确定，message_delta 与 message_stop 在流结束后发送
+func geminiClaudeStreamHandler(c *gin.Context, info *relaycommon.RelayInfo, resp *http.Response) (*dto.Usage, *types.NewAPIError) {
+	stream := &geminiClaudeStream{c: c}
+	started := false
+	usage, err := geminiStreamHandler(c, info, resp, func(data string, geminiResponse *dto.GeminiChatResponse) bool {
+		if !started {
+			stream.startMessage(info)
+			started = true
+		}
+		if len(geminiResponse.Candidates) > 0 {
+			candidate := geminiResponse.Candidates[0]
+			for _, part := range candidate.Content.Parts {
+				stream.handlePart(part)
+			}
+			if candidate.FinishReason != nil {
+				stream.finishReason = *candidate.FinishReason
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return usage, err
+	}
+	if !started {
+		stream.startMessage(info)
+	}
+	stream.finish(usage)
+	return usage, nil
+}
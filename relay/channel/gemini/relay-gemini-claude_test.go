@@ -0,0 +1,268 @@
+package gemini
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func requireJSON(t *testing.T, want string, v any) {
+	t.Helper()
+	data, err := common.Marshal(v)
+	require.NoError(t, err)
+	require.JSONEq(t, want, string(data))
+}
+
+func TestClaudeMessage2GeminiParts(t *testing.T) {
+	tests := []struct {
+		name          string
+		message       string
+		toolNames     map[string]string
+		want          string
+		wantToolNames map[string]string
+	}{
+		{
+			name:    "string content",
+			message: `{"role":"user","content":"hi"}`,
+			want:    `[{"text":"hi"}]`,
+		},
+		{
+			name:    "empty string content",
+			message: `{"role":"user","content":""}`,
+			want:    `null`,
+		},
+		{
+			name:    "thinking keeps its signature",
+			message: `{"role":"assistant","content":[{"type":"thinking","thinking":"hmm","signature":"s1"},{"type":"text","text":"ok"}]}`,
+			want:    `[{"text":"hmm","thought":true,"thoughtSignature":"s1"},{"text":"ok"}]`,
+		},
+		{
+			name:          "empty thinking signature moves to the next part",
+			message:       `{"role":"assistant","content":[{"type":"thinking","thinking":"","signature":"s2"},{"type":"tool_use","id":"call_1","name":"get_weather","input":{"city":"Paris"}}]}`,
+			want:          `[{"functionCall":{"id":"call_1","name":"get_weather","args":{"city":"Paris"}},"thoughtSignature":"s2"}]`,
+			wantToolNames: map[string]string{"call_1": "get_weather"},
+		},
+		{
+			name:          "tool_use without input",
+			message:       `{"role":"assistant","content":[{"type":"tool_use","id":"call_1","name":"now"}]}`,
+			want:          `[{"functionCall":{"id":"call_1","name":"now","args":{}}}]`,
+			wantToolNames: map[string]string{"call_1": "now"},
+		},
+		{
+			name:          "json tool result is used as the response",
+			message:       `{"role":"user","content":[{"type":"tool_result","tool_use_id":"call_1","content":"{\"temp\":20}"}]}`,
+			toolNames:     map[string]string{"call_1": "get_weather"},
+			want:          `[{"functionResponse":{"name":"get_weather","response":{"temp":20},"id":"call_1"}}]`,
+			wantToolNames: map[string]string{"call_1": "get_weather"},
+		},
+		{
+			name:          "failed tool result",
+			message:       `{"role":"user","content":[{"type":"tool_result","tool_use_id":"call_1","is_error":true,"content":[{"type":"text","text":"boom"}]}]}`,
+			toolNames:     map[string]string{"call_1": "get_weather"},
+			want:          `[{"functionResponse":{"name":"get_weather","response":{"error":"boom"},"id":"call_1"}}]`,
+			wantToolNames: map[string]string{"call_1": "get_weather"},
+		},
+		{
+			name:    "base64 image and text document",
+			message: `{"role":"user","content":[{"type":"image","source":{"type":"base64","media_type":"image/png","data":"AAAA"}},{"type":"document","source":{"type":"text","media_type":"text/plain","data":"notes"}}]}`,
+			want:    `[{"inlineData":{"mimeType":"image/png","data":"AAAA"}},{"text":"notes"}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var message dto.ClaudeMessage
+			require.NoError(t, common.UnmarshalJsonStr(tt.message, &message))
+			toolNames := tt.toolNames
+			if toolNames == nil {
+				toolNames = map[string]string{}
+			}
+			parts, err := claudeMessage2GeminiParts(nil, message, toolNames)
+			require.NoError(t, err)
+			requireJSON(t, tt.want, parts)
+			if tt.wantToolNames == nil {
+				tt.wantToolNames = map[string]string{}
+			}
+			require.Equal(t, tt.wantToolNames, toolNames)
+		})
+	}
+}
+
+func TestClaudeTools2Gemini(t *testing.T) {
+	tools := []any{
+		map[string]any{"name": "get_weather", "description": "weather", "input_schema": map[string]any{
+			"type":       "object",
+			"properties": map[string]any{"city": map[string]any{"type": "string"}},
+		}},
+		map[string]any{"type": "custom", "name": "now", "input_schema": map[string]any{"type": "object", "properties": map[string]any{}}},
+		map[string]any{"type": "web_search_20250305", "name": "web_search"},
+		map[string]any{"type": "bash_20250124", "name": "bash"},
+	}
+	geminiTools := claudeTools2Gemini(tools)
+	require.Len(t, geminiTools, 2)
+	require.NotNil(t, geminiTools[0].GoogleSearch)
+
+	functions, ok := geminiTools[1].FunctionDeclarations.([]dto.FunctionRequest)
+	require.True(t, ok)
+	require.Len(t, functions, 2)
+	require.Equal(t, "get_weather", functions[0].Name)
+	require.Equal(t, "weather", functions[0].Description)
+	require.NotNil(t, functions[0].Parameters)
+	require.Equal(t, "now", functions[1].Name)
+	require.Nil(t, functions[1].Parameters, "object without properties is dropped")
+
+	require.Nil(t, claudeTools2Gemini(nil))
+}
+
+func TestClaudeToolChoice2Gemini(t *testing.T) {
+	tests := []struct {
+		name       string
+		toolChoice any
+		want       string
+	}{
+		{name: "unset", toolChoice: nil, want: `null`},
+		{name: "auto", toolChoice: map[string]any{"type": "auto"}, want: `{"functionCallingConfig":{"mode":"AUTO"}}`},
+		{name: "any", toolChoice: map[string]any{"type": "any"}, want: `{"functionCallingConfig":{"mode":"ANY"}}`},
+		{name: "tool", toolChoice: map[string]any{"type": "tool", "name": "get_weather"}, want: `{"functionCallingConfig":{"mode":"ANY","allowedFunctionNames":["get_weather"]}}`},
+		{name: "none", toolChoice: map[string]any{"type": "none"}, want: `{"functionCallingConfig":{"mode":"NONE"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requireJSON(t, tt.want, claudeToolChoice2Gemini(tt.toolChoice))
+		})
+	}
+}
+
+func TestAttachFunctionCallThoughtSignature(t *testing.T) {
+	call := &dto.FunctionCall{FunctionName: "f", Arguments: map[string]any{}}
+	tests := []struct {
+		name  string
+		parts []dto.GeminiPart
+		want  []string
+	}{
+		{
+			name:  "first function call gets the bypass signature",
+			parts: []dto.GeminiPart{{Text: "a"}, {FunctionCall: call}, {FunctionCall: call}},
+			want:  []string{"", thoughtSignatureBypassValue, ""},
+		},
+		{
+			name:  "existing signature is kept",
+			parts: []dto.GeminiPart{{Text: "a", Thought: true, ThoughtSignature: []byte(`"s1"`)}, {FunctionCall: call}},
+			want:  []string{"s1", ""},
+		},
+		{
+			name:  "no function call",
+			parts: []dto.GeminiPart{{Text: "a"}},
+			want:  []string{""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attachFunctionCallThoughtSignature(tt.parts)
+			got := make([]string, len(tt.parts))
+			for i, part := range tt.parts {
+				got[i] = dto.GeminiRawString(part.ThoughtSignature)
+			}
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestResponseGeminiChat2Claude(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Set(common.RequestIdKey, "test")
+	info := &relaycommon.RelayInfo{ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "gemini-2.5-pro"}}
+	usage := &dto.Usage{PromptTokens: 10, CompletionTokens: 5}
+	usage.PromptTokensDetails.CachedTokens = 4
+
+	tests := []struct {
+		name           string
+		parts          []dto.GeminiPart
+		finishReason   string
+		wantContent    string
+		wantStopReason string
+	}{
+		{
+			name: "adjacent thoughts are merged and text signatures become empty thinking",
+			parts: []dto.GeminiPart{
+				{Text: "a", Thought: true},
+				{Text: "b", Thought: true, ThoughtSignature: []byte(`"s1"`)},
+				{Text: "x", ThoughtSignature: []byte(`"s2"`)},
+				{Text: "y"},
+			},
+			finishReason:   "STOP",
+			wantContent:    `[{"type":"thinking","thinking":"ab","signature":"s1"},{"type":"thinking","thinking":"","signature":"s2"},{"type":"text","text":"xy"}]`,
+			wantStopReason: "end_turn",
+		},
+		{
+			name:           "function call ends with tool_use",
+			parts:          []dto.GeminiPart{{FunctionCall: &dto.FunctionCall{ID: "call_1", FunctionName: "f"}}},
+			finishReason:   "STOP",
+			wantContent:    `[{"type":"tool_use","id":"call_1","name":"f","input":{}}]`,
+			wantStopReason: "tool_use",
+		},
+		{
+			name:           "code execution becomes text",
+			parts:          []dto.GeminiPart{{ExecutableCode: &dto.GeminiPartExecutableCode{Language: "python", Code: "print(1)"}}, {CodeExecutionResult: &dto.GeminiPartCodeExecutionResult{Output: "1"}}},
+			finishReason:   "MAX_TOKENS",
+			wantContent:    "[{\"type\":\"text\",\"text\":\"```python\\nprint(1)\\n``````output\\n1\\n```\"}]",
+			wantStopReason: "max_tokens",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := &dto.GeminiChatResponse{Candidates: []dto.GeminiChatCandidate{{
+				Content:      dto.GeminiChatContent{Role: "model", Parts: tt.parts},
+				FinishReason: common.GetPointer(tt.finishReason),
+			}}}
+			claudeResponse := responseGeminiChat2Claude(c, response, usage, info)
+			requireJSON(t, tt.wantContent, claudeResponse.Content)
+			require.Equal(t, tt.wantStopReason, claudeResponse.StopReason)
+			require.Equal(t, "gemini-2.5-pro", claudeResponse.Model)
+			require.Equal(t, &dto.ClaudeUsage{InputTokens: 6, CacheReadInputTokens: 4, OutputTokens: 5}, claudeResponse.Usage)
+		})
+	}
+}
+
+func TestGeminiClaudeStream(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Set(common.RequestIdKey, "test")
+
+	stream := &geminiClaudeStream{c: c}
+	for _, part := range []dto.GeminiPart{
+		{Text: "a", Thought: true},
+		{Thought: true, ThoughtSignature: []byte(`"s1"`)},
+		{Text: "hi"},
+		{Text: " there"},
+		{FunctionCall: &dto.FunctionCall{ID: "call_1", FunctionName: "f", Arguments: map[string]any{"x": 1}}},
+	} {
+		stream.handlePart(part)
+	}
+	stream.finishReason = "STOP"
+	stream.finish(&dto.Usage{PromptTokens: 3, CompletionTokens: 2})
+
+	body := recorder.Body.String()
+	var events []string
+	for _, match := range regexp.MustCompile(`event: (\S+)`).FindAllStringSubmatch(body, -1) {
+		events = append(events, match[1])
+	}
+	require.Equal(t, []string{
+		"content_block_start", "content_block_delta", "content_block_delta", "content_block_stop",
+		"content_block_start", "content_block_delta", "content_block_delta", "content_block_stop",
+		"content_block_start", "content_block_delta", "content_block_stop",
+		"message_delta", "message_stop",
+	}, events)
+	require.Contains(t, body, `"signature":"s1"`)
+	require.Contains(t, body, `"partial_json":"{\"x\":1}"`)
+	require.Contains(t, body, `"stop_reason":"tool_use"`)
+	require.Equal(t, 3, stream.index)
+}
@@ -52,6 +52,13 @@ type Adaptor struct {
 }
 
 func (a *Adaptor) ConvertGeminiRequest(c *gin.Context, info *relaycommon.RelayInfo, request *dto.GeminiChatRequest) (any, error) {
+	if a.RequestMode == RequestModeClaude {
+		claudeReq, err := claude.RequestGemini2Claude(c, request, info)
+		if err != nil {
+			return nil, err
+		}
+		return a.ConvertClaudeRequest(c, info, claudeReq)
+	}
 	// Vertex AI does not support functionResponse.id; keep it stripped here for consistency.
 	if model_setting.GetGeminiSettings().RemoveFunctionResponseIdEnabled {
 		removeFunctionResponseID(request)
@@ -90,6 +97,17 @@ func removeFunctionResponseID(request *dto.GeminiChatRequest) {
 }
 
 func (a *Adaptor) ConvertClaudeRequest(c *gin.Context, info *relaycommon.RelayInfo, request *dto.ClaudeRequest) (any, error) {
+	if a.RequestMode == RequestModeGemini {
+		geminiRequest, err := gemini.RequestClaude2Gemini(c, request, info)
+		if err != nil {
+			return nil, err
+		}
+		if model_setting.GetGeminiSettings().RemoveFunctionResponseIdEnabled {
+			removeFunctionResponseID(geminiRequest)
+		}
+		c.Set("request_model", request.Model)
+		return geminiRequest, nil
+	}
 	if v, ok := claudeModelMap[info.UpstreamModelName]; ok {
 		c.Set("request_model", v)
 	} else {
@@ -99,6 +117,34 @@ func (a *Adaptor) ConvertClaudeRequest(c *gin.Context, info *relaycommon.RelayIn
 	return vertexClaudeReq, nil
 }
 
+// ConvertGeminiCountTokensRequest Vertex 的 countTokens 直接使用 contents、systemInstruction 等字段
+func (a *Adaptor) ConvertGeminiCountTokensRequest(c *gin.Context, info *relaycommon.RelayInfo, request *dto.GeminiChatRequest) (any, error) {
+	if a.RequestMode != RequestModeGemini {
+		return nil, errors.New("count tokens is only supported for gemini models")
+	}
+	return &dto.GeminiCountTokensRequest{
+		Contents:           request.Contents,
+		SystemInstructions: request.SystemInstructions,
+		Tools:              request.Tools,
+	}, nil
+}
+
+// ConvertClaudeCountTokensRequest Vertex 的 count-tokens 接口需要在请求体中指定 Vertex 模型 id，
+// 且只支持服务账号凭据
+func (a *Adaptor) ConvertClaudeCountTokensRequest(c *gin.Context, info *relaycommon.RelayInfo, request *dto.ClaudeRequest) (any, error) {
+	if a.RequestMode != RequestModeClaude {
+		return nil, errors.New("count tokens is only supported for claude models")
+	}
+	if info.ChannelOtherSettings.VertexKeyType == dto.VertexKeyTypeAPIKey {
+		return nil, errors.New("count tokens is not supported with api key")
+	}
+	countReq := dto.NewClaudeCountTokensRequest(request)
+	if v, ok := claudeModelMap[info.UpstreamModelName]; ok {
+		countReq.Model = v
+	}
+	return countReq, nil
+}
+
 func (a *Adaptor) ConvertAudioRequest(c *gin.Context, info *relaycommon.RelayInfo, request dto.AudioRequest) (io.Reader, error) {
 	//TODO implement me
 	return nil, errors.New("not implemented")
@@ -229,9 +275,14 @@ func (a *Adaptor) GetRequestURL(info *relaycommon.RelayInfo) (string, error) {
 
 		if strings.HasPrefix(info.UpstreamModelName, "imagen") {
 			suffix = "predict"
+		} else if info.RelayMode == constant.RelayModeGeminiCountTokens {
+			suffix = "countTokens"
 		}
 		return a.getRequestUrl(info, info.UpstreamModelName, suffix)
 	} else if a.RequestMode == RequestModeClaude {
+		if info.RelayMode == constant.RelayModeClaudeCountTokens {
+			return a.getRequestUrl(info, "count-tokens", "rawPredict")
+		}
 		if info.IsStream {
 			suffix = "streamRawPredict?alt=sse"
 		} else {
@@ -0,0 +1,95 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/relay/channel"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/relay/helper"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ClaudeCountTokensHelper 处理 /v1/messages/count_tokens，渠道支持时由上游计数，否则使用本地估算，不计费
+func ClaudeCountTokensHelper(c *gin.Context, info *relaycommon.RelayInfo) *types.NewAPIError {
+	info.InitChannelMeta(c)
+
+	claudeReq, ok := info.Request.(*dto.ClaudeRequest)
+	if !ok {
+		return types.NewErrorWithStatusCode(fmt.Errorf("invalid request type, expected *dto.ClaudeRequest, got %T", info.Request), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+
+	request, err := common.DeepCopy(claudeReq)
+	if err != nil {
+		return types.NewError(fmt.Errorf("failed to copy request to ClaudeRequest: %w", err), types.ErrorCodeInvalidRequest, types.ErrOptionWithSkipRetry())
+	}
+
+	err = helper.ModelMappedHelper(c, info, request)
+	if err != nil {
+		return types.NewError(err, types.ErrorCodeChannelModelMappedError, types.ErrOptionWithSkipRetry())
+	}
+
+	adaptor := GetAdaptor(info.ApiType)
+	if adaptor == nil {
+		return types.NewError(fmt.Errorf("invalid api type: %d", info.ApiType), types.ErrorCodeInvalidApiType, types.ErrOptionWithSkipRetry())
+	}
+	adaptor.Init(info)
+
+	inputTokens := -1
+	if counter, ok := adaptor.(channel.ClaudeTokenCounter); ok {
+		inputTokens, err = countClaudeTokensUpstream(c, info, adaptor, counter, request)
+		if err != nil {
+			logger.LogWarn(c, fmt.Sprintf("count tokens upstream failed, fallback to local estimate: %s", err.Error()))
+			inputTokens = -1
+		}
+	}
+	if inputTokens < 0 {
+		inputTokens = service.CountTokenMetaInput(request.GetTokenCountMeta(), info.OriginModelName)
+	}
+
+	c.JSON(http.StatusOK, dto.ClaudeCountTokensResponse{InputTokens: inputTokens})
+	return nil
+}
+
+func countClaudeTokensUpstream(c *gin.Context, info *relaycommon.RelayInfo, adaptor channel.Adaptor, counter channel.ClaudeTokenCounter, request *dto.ClaudeRequest) (int, error) {
+	convertedRequest, err := counter.ConvertClaudeCountTokensRequest(c, info, request)
+	if err != nil {
+		return 0, err
+	}
+	jsonData, err := common.Marshal(convertedRequest)
+	if err != nil {
+		return 0, err
+	}
+	if common.DebugEnabled {
+		println("requestBody: ", string(jsonData))
+	}
+
+	resp, err := adaptor.DoRequest(c, info, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return 0, err
+	}
+	httpResp, ok := resp.(*http.Response)
+	if !ok || httpResp == nil {
+		return 0, errors.New("invalid upstream response")
+	}
+	defer service.CloseResponseBodyGracefully(httpResp)
+
+	if httpResp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(httpResp.Body, 1024))
+		return 0, fmt.Errorf("status code %d: %s", httpResp.StatusCode, string(body))
+	}
+	var countResp dto.ClaudeCountTokensResponse
+	if err := common.DecodeJson(httpResp.Body, &countResp); err != nil {
+		return 0, err
+	}
+	return countResp.InputTokens, nil
+}
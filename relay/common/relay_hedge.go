@@ -0,0 +1,128 @@
+package common
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"sync"
+
+	"github.com/QuantumNous/new-api/dto"
+
+	"github.com/jinzhu/copier"
+)
+
+const (
+	HedgeStatusRunning   = "running"
+	HedgeStatusWon       = "won"
+	HedgeStatusCancelled = "cancelled"
+	HedgeStatusFailed    = "failed"
+)
+
+// HedgeAttempt 对冲请求中的一次转发，Ctx 被取消后上游请求随之中断
+type HedgeAttempt struct {
+	Ctx  context.Context
+	Lost func() bool // 另一次转发已先返回，本次转发的结果需要丢弃且不能计费
+}
+
+type HedgeAttemptLog struct {
+	ChannelId int    `json:"channel_id"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+}
+
+// HedgeInfo 记录对冲请求中每次转发的结果，由两次转发共享，最终写入消费日志
+type HedgeInfo struct {
+	mu       sync.Mutex
+	delayMs  int
+	attempts []HedgeAttemptLog
+}
+
+func NewHedgeInfo(delayMs int) *HedgeInfo {
+	return &HedgeInfo{delayMs: delayMs}
+}
+
+// AddAttempt 添加一次转发记录，返回其序号
+func (h *HedgeInfo) AddAttempt(channelId int) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.attempts = append(h.attempts, HedgeAttemptLog{ChannelId: channelId, Status: HedgeStatusRunning})
+	return len(h.attempts) - 1
+}
+
+func (h *HedgeInfo) SetStatus(index int, status string, errMsg string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if index < 0 || index >= len(h.attempts) {
+		return
+	}
+	h.attempts[index].Status = status
+	h.attempts[index].Error = errMsg
+}
+
+func (h *HedgeInfo) Snapshot() map[string]interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return map[string]interface{}{
+		"delay_ms": h.delayMs,
+		"attempts": slices.Clone(h.attempts),
+	}
+}
+
+// IsHedgeLost 对冲请求中输掉的一方不能写入响应和计费
+func (info *RelayInfo) IsHedgeLost() bool {
+	return info != nil && info.Hedge != nil && info.Hedge.Lost != nil && info.Hedge.Lost()
+}
+
+// CloneForHedge 为对冲请求复制一份 RelayInfo，两次转发会并发修改各自的副本。
+// StreamQuotaGuard 记录了已输出的 token 数，副本不共用，由调用方为副本重新创建
+func (info *RelayInfo) CloneForHedge() (*RelayInfo, error) {
+	clone := *info
+	clone.ChannelMeta = nil
+	clone.Hedge = nil
+	clone.StreamQuotaGuard = nil
+	clone.RequestConversionChain = slices.Clone(info.RequestConversionChain)
+	if info.Request != nil {
+		request, err := deepCopyRequest(info.Request)
+		if err != nil {
+			return nil, err
+		}
+		clone.Request = request
+	}
+	if info.ClaudeConvertInfo != nil {
+		claudeConvertInfo := *info.ClaudeConvertInfo
+		if claudeConvertInfo.Usage != nil {
+			usage := *claudeConvertInfo.Usage
+			claudeConvertInfo.Usage = &usage
+		}
+		clone.ClaudeConvertInfo = &claudeConvertInfo
+	}
+	if info.RerankerInfo != nil {
+		rerankerInfo := *info.RerankerInfo
+		clone.RerankerInfo = &rerankerInfo
+	}
+	if info.ResponsesUsageInfo != nil {
+		builtInTools := make(map[string]*BuildInToolInfo, len(info.ResponsesUsageInfo.BuiltInTools))
+		for name, tool := range info.ResponsesUsageInfo.BuiltInTools {
+			toolInfo := *tool
+			builtInTools[name] = &toolInfo
+		}
+		clone.ResponsesUsageInfo = &ResponsesUsageInfo{BuiltInTools: builtInTools}
+	}
+	if info.TaskRelayInfo != nil {
+		taskRelayInfo := *info.TaskRelayInfo
+		clone.TaskRelayInfo = &taskRelayInfo
+	}
+	return &clone, nil
+}
+
+func deepCopyRequest(request dto.Request) (dto.Request, error) {
+	src := reflect.ValueOf(request)
+	if src.Kind() != reflect.Pointer || src.IsNil() {
+		return request, nil
+	}
+	dst := reflect.New(src.Elem().Type())
+	if err := copier.CopyWithOption(dst.Interface(), request, copier.Option{DeepCopy: true, IgnoreEmpty: true}); err != nil {
+		return nil, err
+	}
+	return dst.Interface().(dto.Request), nil
+}
@@ -54,6 +54,14 @@ type ResponsesUsageInfo struct {
 	BuiltInTools map[string]*BuildInToolInfo
 }
 
+type BudgetInfo struct {
+	SubjectType string // user / token
+	SubjectId   int
+	Daily       int
+	Monthly     int
+	Window      string
+}
+
 type ChannelMeta struct {
 	ChannelType          int
 	ChannelId            int
@@ -80,6 +88,7 @@ type TokenCountMeta struct {
 }
 
 type RelayInfo struct {
+	RequestId         string
 	TokenId           int
 	TokenKey          string
 	TokenGroup        string
@@ -97,6 +106,7 @@ type RelayInfo struct {
 	UsePrice               bool
 	RelayMode              int
 	OriginModelName        string
+	VirtualModelName       string // 请求的虚拟模型，此时 OriginModelName 为链中实际使用的模型
 	RequestURLPath         string
 	ShouldIncludeUsage     bool
 	DisablePing            bool // 是否禁止向下游发送自定义 Ping
@@ -116,8 +126,24 @@ type RelayInfo struct {
 	FinalPreConsumedQuota  int  // 最终预消耗的配额
 	IsClaudeBetaQuery      bool // /v1/messages?beta=true
 	IsChannelTest          bool // channel test request
+	IsBatch                bool // 网关执行的 batch 中的请求，按 batch 倍率计费
 
 	PriceData types.PriceData
+	// StreamQuotaGuard 流式响应按已输出的内容追加预扣费，额度不足时返回错误，为 nil 时不检查
+	StreamQuotaGuard func(text string) *types.NewAPIError
+
+	// Hedge 对冲请求中的一次转发，非对冲请求为 nil
+	Hedge *HedgeAttempt
+
+	// ResponseCacheHit 命中响应缓存，按缓存计费倍率计费
+	ResponseCacheHit bool
+
+	// Budgets 设置了预算的用户与令牌，检查预算时写入，计费时据此累加预算计数；为 nil 时表示尚未读取
+	Budgets []BudgetInfo
+	// ResponsesTurnRequest 展开 previous_response_id 之前的请求，保存响应时只保存本轮的输入
+	ResponsesTurnRequest *dto.OpenAIResponsesRequest
+	// BudgetSpendAt 首次检查预算的时间，同一请求的预扣、返还与结算都计入该时间所在的分桶
+	BudgetSpendAt time.Time
 
 	Request dto.Request
 
@@ -401,7 +427,8 @@ func genBaseRelayInfo(c *gin.Context, request dto.Request) *RelayInfo {
 	// firstResponseTime = time.Now() - 1 second
 
 	info := &RelayInfo{
-		Request: request,
+		Request:   request,
+		RequestId: c.GetString(common.RequestIdKey),
 
 		UserId:     common.GetContextKeyInt(c, constant.ContextKeyUserId),
 		UsingGroup: common.GetContextKeyString(c, constant.ContextKeyUsingGroup),
@@ -409,7 +436,8 @@ func genBaseRelayInfo(c *gin.Context, request dto.Request) *RelayInfo {
 		UserQuota:  common.GetContextKeyInt(c, constant.ContextKeyUserQuota),
 		UserEmail:  common.GetContextKeyString(c, constant.ContextKeyUserEmail),
 
-		OriginModelName: common.GetContextKeyString(c, constant.ContextKeyOriginalModel),
+		OriginModelName:  common.GetContextKeyString(c, constant.ContextKeyOriginalModel),
+		VirtualModelName: common.GetContextKeyString(c, constant.ContextKeyVirtualModel),
 
 		TokenId:        common.GetContextKeyInt(c, constant.ContextKeyTokenId),
 		TokenKey:       common.GetContextKeyString(c, constant.ContextKeyTokenKey),
@@ -420,6 +448,7 @@ func genBaseRelayInfo(c *gin.Context, request dto.Request) *RelayInfo {
 		RelayMode:       relayconstant.Path2RelayMode(c.Request.URL.Path),
 		RequestURLPath:  c.Request.URL.String(),
 		IsStream:        isStream,
+		IsBatch:         common.GetContextKeyBool(c, constant.ContextKeyNativeBatch),
 
 		StartTime:         startTime,
 		FirstResponseTime: startTime.Add(-time.Second),
@@ -13,6 +13,7 @@ import (
 	"github.com/QuantumNous/new-api/dto"
 	"github.com/QuantumNous/new-api/logger"
 	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/pkg/tracing"
 	relaycommon "github.com/QuantumNous/new-api/relay/common"
 	relayconstant "github.com/QuantumNous/new-api/relay/constant"
 	"github.com/QuantumNous/new-api/relay/helper"
@@ -25,6 +26,7 @@ import (
 	"github.com/shopspring/decimal"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func TextHelper(c *gin.Context, info *relaycommon.RelayInfo) (newAPIError *types.NewAPIError) {
@@ -109,7 +111,9 @@ func TextHelper(c *gin.Context, info *relaycommon.RelayInfo) (newAPIError *types
 		}
 		requestBody = bytes.NewBuffer(body)
 	} else {
+		_, convertSpan := tracing.Start(c.Request.Context(), "adaptor.ConvertOpenAIRequest")
 		convertedRequest, err := adaptor.ConvertOpenAIRequest(c, info, request)
+		tracing.End(convertSpan, err)
 		if err != nil {
 			return types.NewError(err, types.ErrorCodeConvertRequestFailed, types.ErrOptionWithSkipRetry())
 		}
@@ -200,7 +204,11 @@ func TextHelper(c *gin.Context, info *relaycommon.RelayInfo) (newAPIError *types
 		}
 	}
 
+	_, responseSpan := tracing.Start(c.Request.Context(), "adaptor.DoResponse")
+
 	usage, newApiErr := adaptor.DoResponse(c, httpResp, info)
+
+	tracing.End(responseSpan, newApiErr)
 	if newApiErr != nil {
 		// reset status code 重置状态码
 		service.ResetStatusCode(newApiErr, statusCodeMappingStr)
@@ -219,6 +227,12 @@ func TextHelper(c *gin.Context, info *relaycommon.RelayInfo) (newAPIError *types
 }
 
 func postConsumeQuota(ctx *gin.Context, relayInfo *relaycommon.RelayInfo, usage *dto.Usage, extraContent ...string) {
+	// 对冲请求只对先返回的一方计费
+	if relayInfo.IsHedgeLost() {
+		return
+	}
+	_, span := tracing.Start(ctx.Request.Context(), "PostConsumeQuota", attribute.String("model", relayInfo.OriginModelName))
+	defer span.End()
 	if usage == nil {
 		usage = &dto.Usage{
 			PromptTokens:     relayInfo.GetEstimatePromptTokens(),
@@ -329,7 +343,15 @@ func postConsumeQuota(ctx *gin.Context, relayInfo *relaycommon.RelayInfo, usage
 
 	var audioInputQuota decimal.Decimal
 	var audioInputPrice float64
-	isClaudeUsageSemantic := relayInfo.ChannelType == constant.ChannelTypeAnthropic
+	// AWS 与 Vertex 上的 Claude 模型同样使用 Claude 响应格式，input_tokens 不包含缓存 tokens
+	isClaudeUsageSemantic := relayInfo.ChannelType == constant.ChannelTypeAnthropic ||
+		((relayInfo.ChannelType == constant.ChannelTypeAws || relayInfo.ChannelType == constant.ChannelTypeVertexAi) &&
+			strings.Contains(relayInfo.UpstreamModelName, "claude"))
+	affinityPromptTokens := promptTokens
+	if isClaudeUsageSemantic {
+		affinityPromptTokens += cacheTokens + cachedCreationTokens
+	}
+	service.RecordChannelAffinityUsage(ctx, affinityPromptTokens, cacheTokens)
 	if !relayInfo.PriceData.UsePrice {
 		baseTokens := dPromptTokens
 		// 减去 cached tokens
@@ -414,8 +436,16 @@ func postConsumeQuota(ctx *gin.Context, relayInfo *relaycommon.RelayInfo, usage
 		if !ratio.IsZero() && quota == 0 {
 			quota = 1
 		}
-		model.UpdateUserUsedQuotaAndRequestCount(relayInfo.UserId, quota)
-		model.UpdateChannelUsedQuota(relayInfo.ChannelId, quota)
+		// 命中响应缓存时没有请求上游，按缓存计费倍率收费
+		if relayInfo.ResponseCacheHit {
+			cacheBillingRatio := operation_setting.GetResponseCacheSetting().BillingRatio
+			quota = int(decimal.NewFromInt(int64(quota)).Mul(decimal.NewFromFloat(cacheBillingRatio)).Round(0).IntPart())
+			extraContent = append(extraContent, fmt.Sprintf("命中响应缓存，缓存计费倍率 %.2f", cacheBillingRatio))
+		}
+		model.UpdateUserUsedQuotaAndRequestCount(relayInfo.UserId, quota, service.RelayQuotaLedgerRef(relayInfo, quota))
+		if !relayInfo.ResponseCacheHit {
+			model.UpdateChannelUsedQuota(relayInfo.ChannelId, quota)
+		}
 	}
 
 	quotaDelta := quota - relayInfo.FinalPreConsumedQuota
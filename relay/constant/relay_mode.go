@@ -52,6 +52,16 @@ const (
 	RelayModeGemini
 
 	RelayModeResponsesCompact
+
+	RelayModeFiles
+
+	RelayModeBatch
+	RelayModeFineTuning
+
+	RelayModeClaudeCountTokens
+
+	RelayModeGeminiCountTokens
+	RelayModeGeminiCachedContents
 )
 
 func Path2RelayMode(path string) int {
@@ -86,6 +96,18 @@ func Path2RelayMode(path string) int {
 		relayMode = RelayModeRerank
 	} else if strings.HasPrefix(path, "/v1/realtime") {
 		relayMode = RelayModeRealtime
+	} else if strings.HasPrefix(path, "/v1/files") {
+		relayMode = RelayModeFiles
+	} else if strings.HasPrefix(path, "/v1/batches") {
+		relayMode = RelayModeBatch
+	} else if strings.HasPrefix(path, "/v1/fine_tuning") || strings.HasPrefix(path, "/v1/fine-tunes") {
+		relayMode = RelayModeFineTuning
+	} else if strings.HasPrefix(path, "/v1/messages/count_tokens") {
+		relayMode = RelayModeClaudeCountTokens
+	} else if (strings.HasPrefix(path, "/v1beta/models") || strings.HasPrefix(path, "/v1/models")) && strings.HasSuffix(path, ":countTokens") {
+		relayMode = RelayModeGeminiCountTokens
+	} else if strings.HasPrefix(path, "/v1beta/cachedContents") {
+		relayMode = RelayModeGeminiCachedContents
 	} else if strings.HasPrefix(path, "/v1beta/models") || strings.HasPrefix(path, "/v1/models") {
 		relayMode = RelayModeGemini
 	} else if strings.HasPrefix(path, "/mj") {
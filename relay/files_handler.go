@@ -0,0 +1,238 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FileUploadHelper 将文件上传到 Distribute 选中的渠道，并记录文件 ID 与渠道的映射
+func FileUploadHelper(c *gin.Context) *types.NewAPIError {
+	channelId := common.GetContextKeyInt(c, constant.ContextKeyChannelId)
+	channel, err := model.CacheGetChannel(channelId)
+	if err != nil {
+		return types.NewError(err, types.ErrorCodeGetChannelFailed, types.ErrOptionWithSkipRetry())
+	}
+	if !service.IsPlatformAPISupported(channel.Type) {
+		return types.NewErrorWithStatusCode(fmt.Errorf("channel type %d does not support files api", channel.Type), types.ErrorCodeInvalidApiType, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+	// 存储费用由后台任务延迟结算，上传时只校验用户余额
+	userQuota, err := model.GetUserQuota(common.GetContextKeyInt(c, constant.ContextKeyUserId), false)
+	if err != nil {
+		return types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry())
+	}
+	if userQuota <= 0 {
+		return types.NewErrorWithStatusCode(errors.New("user quota is not enough"), types.ErrorCodeInsufficientUserQuota, http.StatusForbidden, types.ErrOptionWithSkipRetry())
+	}
+
+	formData, err := common.ParseMultipartFormReusable(c)
+	if err != nil {
+		if common.IsRequestBodyTooLargeError(err) || errors.Is(err, common.ErrRequestBodyTooLarge) {
+			return types.NewErrorWithStatusCode(err, types.ErrorCodeReadRequestBodyFailed, http.StatusRequestEntityTooLarge, types.ErrOptionWithSkipRetry())
+		}
+		return types.NewErrorWithStatusCode(fmt.Errorf("error parsing multipart form: %w", err), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+	purpose := ""
+	if values := formData.Value["purpose"]; len(values) > 0 {
+		purpose = values[0]
+	}
+	if purpose == "" {
+		return types.NewErrorWithStatusCode(errors.New("purpose is required"), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+	fileHeaders := formData.File["file"]
+	if len(fileHeaders) == 0 {
+		return types.NewErrorWithStatusCode(errors.New("file is required"), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+	fileHeader := fileHeaders[0]
+
+	// 重新构建表单，model 字段只用于选择渠道，不透传给上游
+	var requestBody bytes.Buffer
+	writer := multipart.NewWriter(&requestBody)
+	for key, values := range formData.Value {
+		if key == "model" {
+			continue
+		}
+		for _, value := range values {
+			writer.WriteField(key, value)
+		}
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		return types.NewError(fmt.Errorf("error opening file: %w", err), types.ErrorCodeReadRequestBodyFailed, types.ErrOptionWithSkipRetry())
+	}
+	defer file.Close()
+	part, err := writer.CreateFormFile("file", fileHeader.Filename)
+	if err != nil {
+		return types.NewError(errors.New("create form file failed"), types.ErrorCodeConvertRequestFailed, types.ErrOptionWithSkipRetry())
+	}
+	if _, err := io.Copy(part, file); err != nil {
+		return types.NewError(errors.New("copy file failed"), types.ErrorCodeConvertRequestFailed, types.ErrOptionWithSkipRetry())
+	}
+	writer.Close()
+
+	key := common.GetContextKeyString(c, constant.ContextKeyChannelKey)
+	resp, err := service.DoPlatformRequest(c.Request.Context(), channel, key, http.MethodPost, "/v1/files", &requestBody, writer.FormDataContentType())
+	if err != nil {
+		return types.NewOpenAIError(err, types.ErrorCodeDoRequestFailed, http.StatusInternalServerError)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return service.RelayErrorHandler(c.Request.Context(), resp, false)
+	}
+	responseBody, err := io.ReadAll(resp.Body)
+	service.CloseResponseBodyGracefully(resp)
+	if err != nil {
+		return types.NewOpenAIError(err, types.ErrorCodeReadResponseBodyFailed, http.StatusInternalServerError)
+	}
+	var fileResponse dto.OpenAIFile
+	if err := common.Unmarshal(responseBody, &fileResponse); err != nil || fileResponse.Id == "" {
+		return types.NewOpenAIError(fmt.Errorf("invalid file response: %s", string(responseBody)), types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
+	}
+
+	group := common.GetContextKeyString(c, constant.ContextKeyUsingGroup)
+	if autoGroup := common.GetContextKeyString(c, constant.ContextKeyAutoGroup); autoGroup != "" {
+		group = autoGroup
+	}
+	now := common.GetTimestamp()
+	record := &model.File{
+		FileId:    fileResponse.Id,
+		UserId:    common.GetContextKeyInt(c, constant.ContextKeyUserId),
+		TokenId:   common.GetContextKeyInt(c, constant.ContextKeyTokenId),
+		ChannelId: channel.Id,
+		Group:     group,
+		Purpose:   common.GetStringIfEmpty(fileResponse.Purpose, purpose),
+		Filename:  common.GetStringIfEmpty(fileResponse.Filename, fileHeader.Filename),
+		Bytes:     fileResponse.Bytes,
+		Status:    model.FileStatusActive,
+		CreatedAt: fileResponse.CreatedAt,
+		ExpiresAt: fileResponse.ExpiresAt,
+		BilledAt:  now,
+	}
+	if record.Bytes == 0 {
+		record.Bytes = fileHeader.Size
+	}
+	if record.CreatedAt == 0 {
+		record.CreatedAt = now
+	}
+	if channel.ChannelInfo.IsMultiKey {
+		record.PrivateData.Key = key
+	}
+	if err := record.Insert(); err != nil {
+		logger.LogError(c, fmt.Sprintf("failed to save file %s of channel #%d: %s", fileResponse.Id, channel.Id, err.Error()))
+		return types.NewError(err, types.ErrorCodeUpdateDataError, types.ErrOptionWithSkipRetry())
+	}
+	service.IOCopyBytesGracefully(c, resp, responseBody)
+	return nil
+}
+
+// FileRetrieveHelper 透传文件信息查询，上游已不存在时同步删除本地记录
+func FileRetrieveHelper(c *gin.Context, file *model.File) *types.NewAPIError {
+	channel, key, newAPIError := service.GetFileChannelAndKey(file)
+	if newAPIError != nil {
+		return newAPIError
+	}
+	resp, err := service.DoPlatformRequest(c.Request.Context(), channel, key, http.MethodGet, "/v1/files/"+file.FileId, nil, "")
+	if err != nil {
+		return types.NewOpenAIError(err, types.ErrorCodeDoRequestFailed, http.StatusInternalServerError)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusNotFound {
+			settleDeletedFile(c, file)
+		}
+		return service.RelayErrorHandler(c.Request.Context(), resp, false)
+	}
+	responseBody, err := io.ReadAll(resp.Body)
+	service.CloseResponseBodyGracefully(resp)
+	if err != nil {
+		return types.NewOpenAIError(err, types.ErrorCodeReadResponseBodyFailed, http.StatusInternalServerError)
+	}
+	service.IOCopyBytesGracefully(c, resp, responseBody)
+	return nil
+}
+
+// FileContentHelper 流式透传文件内容
+func FileContentHelper(c *gin.Context, file *model.File) *types.NewAPIError {
+	channel, key, newAPIError := service.GetFileChannelAndKey(file)
+	if newAPIError != nil {
+		return newAPIError
+	}
+	resp, err := service.DoPlatformRequest(c.Request.Context(), channel, key, http.MethodGet, "/v1/files/"+file.FileId+"/content", nil, "")
+	if err != nil {
+		return types.NewOpenAIError(err, types.ErrorCodeDoRequestFailed, http.StatusInternalServerError)
+	}
+	defer service.CloseResponseBodyGracefully(resp)
+	if resp.StatusCode != http.StatusOK {
+		return service.RelayErrorHandler(c.Request.Context(), resp, false)
+	}
+	for k, v := range resp.Header {
+		c.Writer.Header().Set(k, v[0])
+	}
+	c.Writer.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(c.Writer, resp.Body); err != nil {
+		logger.LogError(c, fmt.Sprintf("failed to copy file content: %s", err.Error()))
+	}
+	return nil
+}
+
+// FileDeleteHelper 删除上游文件，并结算剩余的存储费用
+func FileDeleteHelper(c *gin.Context, file *model.File) *types.NewAPIError {
+	channel, key, newAPIError := service.GetFileChannelAndKey(file)
+	if newAPIError != nil {
+		return newAPIError
+	}
+	resp, err := service.DoPlatformRequest(c.Request.Context(), channel, key, http.MethodDelete, "/v1/files/"+file.FileId, nil, "")
+	if err != nil {
+		return types.NewOpenAIError(err, types.ErrorCodeDoRequestFailed, http.StatusInternalServerError)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusNotFound {
+			settleDeletedFile(c, file)
+		}
+		return service.RelayErrorHandler(c.Request.Context(), resp, false)
+	}
+	responseBody, err := io.ReadAll(resp.Body)
+	service.CloseResponseBodyGracefully(resp)
+	if err != nil {
+		return types.NewOpenAIError(err, types.ErrorCodeReadResponseBodyFailed, http.StatusInternalServerError)
+	}
+	settleDeletedFile(c, file)
+	service.IOCopyBytesGracefully(c, resp, responseBody)
+	return nil
+}
+
+func settleDeletedFile(c *gin.Context, file *model.File) {
+	quota, err := service.SettleFileStorage(file, common.GetTimestamp(), true)
+	if err != nil {
+		logger.LogError(c, fmt.Sprintf("failed to settle storage of file %s: %s", file.FileId, err.Error()))
+	}
+	if quota > 0 {
+		model.RecordConsumeLog(c, file.UserId, model.RecordConsumeLogParams{
+			ChannelId: file.ChannelId,
+			TokenId:   file.TokenId,
+			ModelName: "file-storage",
+			Quota:     quota,
+			Group:     file.Group,
+			Content:   fmt.Sprintf("文件存储费用：%s，扣除 %s", file.FileId, logger.LogQuota(quota)),
+			Other: map[string]interface{}{
+				"file_storage": true,
+				"files":        1,
+				"bytes":        file.Bytes,
+			},
+		})
+	}
+	if err := model.MarkFileDeleted(file.Id); err != nil {
+		logger.LogError(c, fmt.Sprintf("failed to mark file %s deleted: %s", file.FileId, err.Error()))
+	}
+}
@@ -0,0 +1,186 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// legacyFineTuneHyperparameters 旧版 /v1/fine-tunes 接口放在顶层的超参数，转换为新版 hyperparameters
+var legacyFineTuneHyperparameters = []string{"n_epochs", "batch_size", "learning_rate_multiplier"}
+
+// legacyFineTuneUnsupportedFields 新版接口已不再支持的旧版字段，直接丢弃
+var legacyFineTuneUnsupportedFields = []string{
+	"prompt_loss_weight",
+	"compute_classification_metrics",
+	"classification_n_classes",
+	"classification_positive_class",
+	"classification_betas",
+}
+
+func convertLegacyFineTuneRequest(request map[string]any) {
+	hyperparameters, _ := request["hyperparameters"].(map[string]any)
+	for _, field := range legacyFineTuneHyperparameters {
+		value, ok := request[field]
+		if !ok {
+			continue
+		}
+		if hyperparameters == nil {
+			hyperparameters = make(map[string]any)
+		}
+		if _, exist := hyperparameters[field]; !exist {
+			hyperparameters[field] = value
+		}
+		delete(request, field)
+	}
+	if hyperparameters != nil {
+		request["hyperparameters"] = hyperparameters
+	}
+	for _, field := range legacyFineTuneUnsupportedFields {
+		delete(request, field)
+	}
+}
+
+// FineTuningCreateHelper 创建微调任务，任务会在训练文件所在的渠道上执行
+func FineTuningCreateHelper(c *gin.Context) *types.NewAPIError {
+	requestBody, err := common.GetRequestBody(c)
+	if err != nil {
+		return types.NewErrorWithStatusCode(err, types.ErrorCodeReadRequestBodyFailed, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+	var request map[string]any
+	if err := common.Unmarshal(requestBody, &request); err != nil {
+		return types.NewErrorWithStatusCode(err, types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+	convertLegacyFineTuneRequest(request)
+	baseModel, _ := request["model"].(string)
+	trainingFileId, _ := request["training_file"].(string)
+	validationFileId, _ := request["validation_file"].(string)
+	if baseModel == "" {
+		return types.NewErrorWithStatusCode(errors.New("model is required"), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+	if trainingFileId == "" {
+		return types.NewErrorWithStatusCode(errors.New("training_file is required"), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+
+	userId := common.GetContextKeyInt(c, constant.ContextKeyUserId)
+	trainingFile, exist, err := model.GetUserFileByFileId(userId, trainingFileId)
+	if err != nil {
+		return types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry())
+	}
+	if !exist {
+		return types.NewErrorWithStatusCode(fmt.Errorf("training file %s not found", trainingFileId), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+	if validationFileId != "" {
+		validationFile, exist, err := model.GetUserFileByFileId(userId, validationFileId)
+		if err != nil {
+			return types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry())
+		}
+		if !exist {
+			return types.NewErrorWithStatusCode(fmt.Errorf("validation file %s not found", validationFileId), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+		}
+		if validationFile.ChannelId != trainingFile.ChannelId {
+			return types.NewErrorWithStatusCode(errors.New("training_file and validation_file must be uploaded to the same channel"), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+		}
+	}
+	// 微调为延迟计费，创建时只校验用户余额
+	userQuota, err := model.GetUserQuota(userId, false)
+	if err != nil {
+		return types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry())
+	}
+	if userQuota <= 0 {
+		return types.NewErrorWithStatusCode(errors.New("user quota is not enough"), types.ErrorCodeInsufficientUserQuota, http.StatusForbidden, types.ErrOptionWithSkipRetry())
+	}
+	channel, key, newAPIError := service.GetFileChannelAndKey(trainingFile)
+	if newAPIError != nil {
+		return newAPIError
+	}
+	if channel.Status != common.ChannelStatusEnabled {
+		return types.NewErrorWithStatusCode(fmt.Errorf("channel of training file %s is disabled", trainingFileId), types.ErrorCodeGetChannelFailed, http.StatusServiceUnavailable, types.ErrOptionWithSkipRetry())
+	}
+
+	upstreamBody, err := common.Marshal(request)
+	if err != nil {
+		return types.NewError(err, types.ErrorCodeJsonMarshalFailed, types.ErrOptionWithSkipRetry())
+	}
+	resp, err := service.DoPlatformRequest(c.Request.Context(), channel, key, http.MethodPost, "/v1/fine_tuning/jobs", bytes.NewReader(upstreamBody), "application/json")
+	if err != nil {
+		return types.NewOpenAIError(err, types.ErrorCodeDoRequestFailed, http.StatusInternalServerError)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return service.RelayErrorHandler(c.Request.Context(), resp, false)
+	}
+	responseBody, err := io.ReadAll(resp.Body)
+	service.CloseResponseBodyGracefully(resp)
+	if err != nil {
+		return types.NewOpenAIError(err, types.ErrorCodeReadResponseBodyFailed, http.StatusInternalServerError)
+	}
+	var job dto.FineTuningJob
+	if err := common.Unmarshal(responseBody, &job); err != nil || job.Id == "" {
+		return types.NewOpenAIError(fmt.Errorf("invalid fine-tuning job response: %s", string(responseBody)), types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
+	}
+
+	group := common.GetContextKeyString(c, constant.ContextKeyUsingGroup)
+	if group == "auto" {
+		group = trainingFile.Group
+	}
+	task := &model.Task{
+		TaskID:     job.Id,
+		Platform:   constant.TaskPlatformFineTuning,
+		Action:     constant.TaskActionFineTuning,
+		UserId:     userId,
+		Group:      group,
+		ChannelId:  channel.Id,
+		SubmitTime: common.GetTimestamp(),
+		Status:     model.TaskStatusSubmitted,
+		Progress:   "0%",
+		Properties: model.Properties{
+			OriginModelName: baseModel,
+		},
+		PrivateData: model.TaskPrivateData{
+			Key:     trainingFile.PrivateData.Key,
+			TokenId: common.GetContextKeyInt(c, constant.ContextKeyTokenId),
+		},
+		Data: responseBody,
+	}
+	if err := task.Insert(); err != nil {
+		logger.LogError(c, fmt.Sprintf("failed to save fine-tuning job %s of channel #%d: %s", job.Id, channel.Id, err.Error()))
+		return types.NewError(err, types.ErrorCodeUpdateDataError, types.ErrOptionWithSkipRetry())
+	}
+	service.IOCopyBytesGracefully(c, resp, responseBody)
+	return nil
+}
+
+// FineTuningRetrieveHelper 查询微调任务，未结束的任务会实时查询上游状态
+func FineTuningRetrieveHelper(c *gin.Context, task *model.Task) *types.NewAPIError {
+	if isTaskFinished(task) {
+		c.Data(http.StatusOK, "application/json", task.Data)
+		return nil
+	}
+	return relayPlatformTask(c, task, http.MethodGet, "/v1/fine_tuning/jobs/"+task.TaskID, true)
+}
+
+// FineTuningCancelHelper 取消微调任务
+func FineTuningCancelHelper(c *gin.Context, task *model.Task) *types.NewAPIError {
+	return relayPlatformTask(c, task, http.MethodPost, "/v1/fine_tuning/jobs/"+task.TaskID+"/cancel", true)
+}
+
+// FineTuningSubResourceHelper 转发 events / checkpoints 等只读子资源，保留分页参数
+func FineTuningSubResourceHelper(c *gin.Context, task *model.Task, resource string) *types.NewAPIError {
+	path := "/v1/fine_tuning/jobs/" + task.TaskID + "/" + resource
+	if c.Request.URL.RawQuery != "" {
+		path += "?" + c.Request.URL.RawQuery
+	}
+	return relayPlatformTask(c, task, http.MethodGet, path, false)
+}
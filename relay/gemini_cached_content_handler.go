@@ -0,0 +1,235 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/relay/helper"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GeminiCachedContentCreateHelper 在 Distribute 选中的渠道上创建上下文缓存，并记录缓存名称与渠道、key 的映射。
+// 创建时写入缓存的 token 按模型输入价格计费，先按本地估算预扣费，成功后按上游返回的 token 数结算
+func GeminiCachedContentCreateHelper(c *gin.Context) (newAPIError *types.NewAPIError) {
+	channelId := common.GetContextKeyInt(c, constant.ContextKeyChannelId)
+	channel, err := model.CacheGetChannel(channelId)
+	if err != nil {
+		return types.NewError(err, types.ErrorCodeGetChannelFailed, types.ErrOptionWithSkipRetry())
+	}
+	if !service.IsGeminiCachedContentSupported(channel.Type) {
+		return types.NewErrorWithStatusCode(fmt.Errorf("channel type %d does not support cachedContents api", channel.Type), types.ErrorCodeInvalidApiType, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+
+	var request map[string]any
+	if err := common.UnmarshalBodyReusable(c, &request); err != nil {
+		return types.NewErrorWithStatusCode(err, types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+	if common.Interface2String(request["model"]) == "" {
+		return types.NewErrorWithStatusCode(errors.New("model is required"), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+
+	info := relaycommon.GenRelayInfoGemini(c, nil)
+	info.InitChannelMeta(c)
+	if err := helper.ModelMappedHelper(c, info, nil); err != nil {
+		return types.NewError(err, types.ErrorCodeChannelModelMappedError, types.ErrOptionWithSkipRetry())
+	}
+	var geminiReq dto.GeminiChatRequest
+	if err := common.UnmarshalBodyReusable(c, &geminiReq); err != nil {
+		return types.NewErrorWithStatusCode(err, types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+	meta := geminiReq.GetTokenCountMeta()
+	meta.MaxTokens = 0
+	tokens := service.CountTokenMetaInput(meta, info.OriginModelName)
+	info.SetEstimatePromptTokens(tokens)
+	priceData, err := helper.ModelPriceHelper(c, info, tokens, meta)
+	if err != nil {
+		return types.NewError(err, types.ErrorCodeModelPriceError, types.ErrOptionWithSkipRetry())
+	}
+	if !priceData.FreeModel {
+		if newAPIError := service.PreConsumeQuota(c, priceData.QuotaToPreConsume, info); newAPIError != nil {
+			return newAPIError
+		}
+	}
+	defer func() {
+		if newAPIError != nil && info.FinalPreConsumedQuota != 0 {
+			service.ReturnPreConsumedQuota(c, info)
+		}
+	}()
+
+	request["model"] = "models/" + info.UpstreamModelName
+	requestBody, err := common.Marshal(request)
+	if err != nil {
+		return types.NewError(err, types.ErrorCodeConvertRequestFailed, types.ErrOptionWithSkipRetry())
+	}
+
+	key := common.GetContextKeyString(c, constant.ContextKeyChannelKey)
+	resp, err := service.DoGeminiCachedContentRequest(c.Request.Context(), channel, key, http.MethodPost, "/cachedContents", bytes.NewReader(requestBody))
+	if err != nil {
+		return types.NewOpenAIError(err, types.ErrorCodeDoRequestFailed, http.StatusInternalServerError)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return service.RelayErrorHandler(c.Request.Context(), resp, false)
+	}
+	responseBody, err := io.ReadAll(resp.Body)
+	service.CloseResponseBodyGracefully(resp)
+	if err != nil {
+		return types.NewOpenAIError(err, types.ErrorCodeReadResponseBodyFailed, http.StatusInternalServerError)
+	}
+	var cachedContent dto.GeminiCachedContent
+	if err := common.Unmarshal(responseBody, &cachedContent); err != nil || cachedContent.Name == "" {
+		return types.NewOpenAIError(fmt.Errorf("invalid cached content response: %s", string(responseBody)), types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
+	}
+
+	group := common.GetContextKeyString(c, constant.ContextKeyUsingGroup)
+	if autoGroup := common.GetContextKeyString(c, constant.ContextKeyAutoGroup); autoGroup != "" {
+		group = autoGroup
+	}
+	now := common.GetTimestamp()
+	record := &model.GeminiCachedContent{
+		Name:        cachedContent.Name,
+		UserId:      info.UserId,
+		TokenId:     info.TokenId,
+		ChannelId:   channel.Id,
+		Group:       group,
+		Model:       info.OriginModelName,
+		DisplayName: cachedContent.DisplayName,
+		Status:      model.GeminiCachedContentStatusActive,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		ExpiresAt:   service.ParseGeminiExpireTime(cachedContent.ExpireTime, now),
+		BilledAt:    now,
+	}
+	if cachedContent.UsageMetadata != nil {
+		record.TotalTokens = cachedContent.UsageMetadata.TotalTokenCount
+	}
+	if channel.ChannelInfo.IsMultiKey {
+		record.KeyIndex = common.GetContextKeyInt(c, constant.ContextKeyChannelMultiKeyIndex)
+	}
+	if err := record.Insert(); err != nil {
+		logger.LogError(c, fmt.Sprintf("failed to save cached content %s of channel #%d: %s", cachedContent.Name, channel.Id, err.Error()))
+		return types.NewError(err, types.ErrorCodeUpdateDataError, types.ErrOptionWithSkipRetry())
+	}
+	service.SetGeminiCachedContentRoute(record)
+
+	// 上游未返回 token 数时按本地估算结算
+	var usage *dto.Usage
+	if record.TotalTokens > 0 {
+		usage = &dto.Usage{PromptTokens: record.TotalTokens, TotalTokens: record.TotalTokens}
+	}
+	postConsumeQuota(c, info, usage, fmt.Sprintf("创建上下文缓存 %s", strings.TrimPrefix(cachedContent.Name, "cachedContents/")))
+
+	service.IOCopyBytesGracefully(c, resp, responseBody)
+	return nil
+}
+
+// GeminiCachedContentRetrieveHelper 透传缓存信息查询，上游已不存在时同步删除本地记录
+func GeminiCachedContentRetrieveHelper(c *gin.Context, cachedContent *model.GeminiCachedContent) *types.NewAPIError {
+	resp, responseBody, newAPIError := doGeminiCachedContentRequest(c, cachedContent, http.MethodGet, "/"+cachedContent.Name, nil)
+	if newAPIError != nil {
+		return newAPIError
+	}
+	service.IOCopyBytesGracefully(c, resp, responseBody)
+	return nil
+}
+
+// GeminiCachedContentUpdateHelper 透传 ttl / expireTime 更新，并同步本地记录的过期时间
+func GeminiCachedContentUpdateHelper(c *gin.Context, cachedContent *model.GeminiCachedContent) *types.NewAPIError {
+	requestBody, err := common.GetRequestBody(c)
+	if err != nil {
+		return types.NewErrorWithStatusCode(err, types.ErrorCodeReadRequestBodyFailed, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+	path := "/" + cachedContent.Name
+	if c.Request.URL.RawQuery != "" {
+		// updateMask 等参数通过查询字符串传递
+		path += "?" + c.Request.URL.RawQuery
+	}
+	resp, responseBody, newAPIError := doGeminiCachedContentRequest(c, cachedContent, http.MethodPatch, path, bytes.NewReader(requestBody))
+	if newAPIError != nil {
+		return newAPIError
+	}
+	var updated dto.GeminiCachedContent
+	if err := common.Unmarshal(responseBody, &updated); err == nil && updated.ExpireTime != "" {
+		now := common.GetTimestamp()
+		cachedContent.ExpiresAt = service.ParseGeminiExpireTime(updated.ExpireTime, now)
+		if err := model.UpdateGeminiCachedContentExpiresAt(cachedContent.Id, cachedContent.ExpiresAt, now); err != nil {
+			logger.LogError(c, fmt.Sprintf("failed to update cached content %s: %s", cachedContent.Name, err.Error()))
+		}
+		service.SetGeminiCachedContentRoute(cachedContent)
+	}
+	service.IOCopyBytesGracefully(c, resp, responseBody)
+	return nil
+}
+
+// GeminiCachedContentDeleteHelper 删除上游缓存，并结算剩余的存储费用
+func GeminiCachedContentDeleteHelper(c *gin.Context, cachedContent *model.GeminiCachedContent) *types.NewAPIError {
+	resp, responseBody, newAPIError := doGeminiCachedContentRequest(c, cachedContent, http.MethodDelete, "/"+cachedContent.Name, nil)
+	if newAPIError != nil {
+		return newAPIError
+	}
+	settleDeletedGeminiCachedContent(c, cachedContent)
+	service.IOCopyBytesGracefully(c, resp, responseBody)
+	return nil
+}
+
+// doGeminiCachedContentRequest 使用创建缓存时的渠道与 key 请求上游，上游返回 404 时视为缓存已被删除
+func doGeminiCachedContentRequest(c *gin.Context, cachedContent *model.GeminiCachedContent, method string, path string, body io.Reader) (*http.Response, []byte, *types.NewAPIError) {
+	channel, key, newAPIError := service.GetGeminiCachedContentChannelAndKey(cachedContent)
+	if newAPIError != nil {
+		return nil, nil, newAPIError
+	}
+	resp, err := service.DoGeminiCachedContentRequest(c.Request.Context(), channel, key, method, path, body)
+	if err != nil {
+		return nil, nil, types.NewOpenAIError(err, types.ErrorCodeDoRequestFailed, http.StatusInternalServerError)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusNotFound {
+			settleDeletedGeminiCachedContent(c, cachedContent)
+		}
+		return nil, nil, service.RelayErrorHandler(c.Request.Context(), resp, false)
+	}
+	responseBody, err := io.ReadAll(resp.Body)
+	service.CloseResponseBodyGracefully(resp)
+	if err != nil {
+		return nil, nil, types.NewOpenAIError(err, types.ErrorCodeReadResponseBodyFailed, http.StatusInternalServerError)
+	}
+	return resp, responseBody, nil
+}
+
+func settleDeletedGeminiCachedContent(c *gin.Context, cachedContent *model.GeminiCachedContent) {
+	quota, err := service.SettleGeminiCacheStorage(cachedContent, common.GetTimestamp(), true)
+	if err != nil {
+		logger.LogError(c, fmt.Sprintf("failed to settle storage of cached content %s: %s", cachedContent.Name, err.Error()))
+	}
+	if quota > 0 {
+		model.RecordConsumeLog(c, cachedContent.UserId, model.RecordConsumeLogParams{
+			ChannelId: cachedContent.ChannelId,
+			TokenId:   cachedContent.TokenId,
+			ModelName: "gemini-cache-storage",
+			Quota:     quota,
+			Group:     cachedContent.Group,
+			Content:   fmt.Sprintf("Gemini 上下文缓存存储费用：%s，扣除 %s", strings.TrimPrefix(cachedContent.Name, "cachedContents/"), logger.LogQuota(quota)),
+			Other: map[string]interface{}{
+				"gemini_cache_storage": true,
+				"caches":               1,
+				"tokens":               cachedContent.TotalTokens,
+			},
+		})
+	}
+	if err := model.MarkGeminiCachedContentDeleted(cachedContent.Id); err != nil {
+		logger.LogError(c, fmt.Sprintf("failed to mark cached content %s deleted: %s", cachedContent.Name, err.Error()))
+	}
+	service.DeleteGeminiCachedContentRoute(cachedContent.Name)
+}
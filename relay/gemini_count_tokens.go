@@ -0,0 +1,96 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/relay/channel"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/relay/helper"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GeminiCountTokensHelper 处理 Gemini countTokens，渠道支持时透传上游响应，否则使用本地估算，不计费
+func GeminiCountTokensHelper(c *gin.Context, info *relaycommon.RelayInfo) *types.NewAPIError {
+	info.InitChannelMeta(c)
+
+	geminiReq, ok := info.Request.(*dto.GeminiChatRequest)
+	if !ok {
+		return types.NewErrorWithStatusCode(fmt.Errorf("invalid request type, expected *dto.GeminiChatRequest, got %T", info.Request), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+
+	request, err := common.DeepCopy(geminiReq)
+	if err != nil {
+		return types.NewError(fmt.Errorf("failed to copy request to GeminiChatRequest: %w", err), types.ErrorCodeInvalidRequest, types.ErrOptionWithSkipRetry())
+	}
+
+	err = helper.ModelMappedHelper(c, info, request)
+	if err != nil {
+		return types.NewError(err, types.ErrorCodeChannelModelMappedError, types.ErrOptionWithSkipRetry())
+	}
+
+	adaptor := GetAdaptor(info.ApiType)
+	if adaptor == nil {
+		return types.NewError(fmt.Errorf("invalid api type: %d", info.ApiType), types.ErrorCodeInvalidApiType, types.ErrOptionWithSkipRetry())
+	}
+	adaptor.Init(info)
+
+	if counter, ok := adaptor.(channel.GeminiTokenCounter); ok {
+		resp, responseBody, err := countGeminiTokensUpstream(c, info, adaptor, counter, request)
+		if err == nil {
+			service.IOCopyBytesGracefully(c, resp, responseBody)
+			return nil
+		}
+		logger.LogWarn(c, fmt.Sprintf("count tokens upstream failed, fallback to local estimate: %s", err.Error()))
+	}
+
+	c.JSON(http.StatusOK, dto.GeminiCountTokensResponse{
+		TotalTokens: service.CountTokenMetaInput(request.GetTokenCountMeta(), info.OriginModelName),
+	})
+	return nil
+}
+
+func countGeminiTokensUpstream(c *gin.Context, info *relaycommon.RelayInfo, adaptor channel.Adaptor, counter channel.GeminiTokenCounter, request *dto.GeminiChatRequest) (*http.Response, []byte, error) {
+	convertedRequest, err := counter.ConvertGeminiCountTokensRequest(c, info, request)
+	if err != nil {
+		return nil, nil, err
+	}
+	jsonData, err := common.Marshal(convertedRequest)
+	if err != nil {
+		return nil, nil, err
+	}
+	logger.LogDebug(c, "Gemini count tokens request body: "+string(jsonData))
+
+	resp, err := adaptor.DoRequest(c, info, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, nil, err
+	}
+	httpResp, ok := resp.(*http.Response)
+	if !ok || httpResp == nil {
+		return nil, nil, errors.New("invalid upstream response")
+	}
+	defer service.CloseResponseBodyGracefully(httpResp)
+
+	if httpResp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(httpResp.Body, 1024))
+		return nil, nil, fmt.Errorf("status code %d: %s", httpResp.StatusCode, string(body))
+	}
+	responseBody, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	var countResp dto.GeminiCountTokensResponse
+	if err := common.Unmarshal(responseBody, &countResp); err != nil {
+		return nil, nil, err
+	}
+	return httpResp, responseBody, nil
+}
@@ -24,10 +24,10 @@ func HandleGroupRatio(ctx *gin.Context, relayInfo *relaycommon.RelayInfo) types.
 	}
 
 	// check auto group
-	autoGroup, exists := ctx.Get("auto_group")
-	if exists {
+	// 虚拟模型切换到下一个模型时会把 auto_group 置空
+	if autoGroup := ctx.GetString("auto_group"); autoGroup != "" {
 		logger.LogDebug(ctx, fmt.Sprintf("final group: %s", autoGroup))
-		relayInfo.UsingGroup = autoGroup.(string)
+		relayInfo.UsingGroup = autoGroup
 	}
 
 	// check user group special ratio
@@ -42,6 +42,17 @@ func HandleGroupRatio(ctx *gin.Context, relayInfo *relaycommon.RelayInfo) types.
 		groupRatioInfo.GroupRatio = ratio_setting.GetGroupRatio(relayInfo.UsingGroup)
 	}
 
+	// 网关执行的 batch 中的请求与上游 batch 一样按 batch 倍率计费
+	if relayInfo.IsBatch {
+		billingRatio := operation_setting.GetBatchSetting().BillingRatio
+		if billingRatio > 0 {
+			groupRatioInfo.GroupRatio *= billingRatio
+			if groupRatioInfo.HasSpecialRatio {
+				groupRatioInfo.GroupSpecialRatio *= billingRatio
+			}
+		}
+	}
+
 	return groupRatioInfo
 }
 
@@ -0,0 +1,133 @@
+package helper
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+// streamOutputTextPaths 上游流式响应中输出内容所在的位置，依次为 OpenAI、Claude 与 Gemini 格式
+var streamOutputTextPaths = []string{
+	"choices.#.delta.content",
+	"choices.#.delta.reasoning_content",
+	"choices.#.delta.reasoning",
+	"choices.#.delta.tool_calls.#.function.arguments",
+	"delta.text",
+	"delta.thinking",
+	"delta.partial_json",
+	"candidates.#.content.parts.#.text",
+	"delta",
+}
+
+func appendStreamOutputText(b *strings.Builder, result gjson.Result) {
+	if result.IsArray() {
+		result.ForEach(func(_, value gjson.Result) bool {
+			appendStreamOutputText(b, value)
+			return true
+		})
+		return
+	}
+	// Responses API 的 delta 为字符串，Claude 的 delta 为对象，由上面更具体的路径处理
+	if result.Type == gjson.String {
+		b.WriteString(result.Str)
+	}
+}
+
+// StreamOutputText 提取一个上游流式数据块中的输出内容，用于流式响应过程中估算已输出的 token 数
+func StreamOutputText(data string) string {
+	var b strings.Builder
+	for _, result := range gjson.GetMany(data, streamOutputTextPaths...) {
+		appendStreamOutputText(&b, result)
+	}
+	return b.String()
+}
+
+// streamCutOffWriter 流式响应被截断后丢弃适配器继续写出的内容，保证截断事件是客户端收到的最后一个事件
+type streamCutOffWriter struct {
+	gin.ResponseWriter
+}
+
+func (w *streamCutOffWriter) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (w *streamCutOffWriter) WriteString(s string) (int, error) {
+	return len(s), nil
+}
+
+// IsStreamStarted 是否已经开始向客户端发送流式响应，此时不能再返回 JSON 错误
+func IsStreamStarted(c *gin.Context) bool {
+	return c.Writer.Written() && strings.HasPrefix(c.Writer.Header().Get("Content-Type"), "text/event-stream")
+}
+
+// IsStreamErrorSent 是否已经向客户端发送过错误事件
+func IsStreamErrorSent(c *gin.Context) bool {
+	return common.GetContextKeyBool(c, constant.ContextKeyStreamErrorSent)
+}
+
+// MarkStreamErrorSent 记录已经以事件的形式发送了错误，请求按失败处理，幂等键不会保存该响应
+func MarkStreamErrorSent(c *gin.Context) {
+	common.SetContextKey(c, constant.ContextKeyStreamErrorSent, true)
+	common.SetContextKey(c, constant.ContextKeyRelayFailed, true)
+}
+
+// StreamErrorData 流式响应已经开始后按客户端请求的格式发送错误事件，OpenAI 格式随后发送 [DONE]
+func StreamErrorData(c *gin.Context, relayFormat types.RelayFormat, newAPIError *types.NewAPIError) {
+	MarkStreamErrorSent(c)
+	switch relayFormat {
+	case types.RelayFormatClaude:
+		_ = ClaudeData(c, dto.ClaudeResponse{
+			Type:  "error",
+			Error: newAPIError.ToClaudeError(),
+		})
+	case types.RelayFormatGemini:
+		_ = ObjectData(c, gin.H{"error": newAPIError.ToOpenAIError()})
+	case types.RelayFormatOpenAIResponses:
+		openaiError := newAPIError.ToOpenAIError()
+		data, _ := common.Marshal(gin.H{
+			"type":    "error",
+			"code":    openaiError.Code,
+			"message": openaiError.Message,
+		})
+		ResponseChunkData(c, dto.ResponsesStreamResponse{Type: "error"}, string(data))
+	default:
+		_ = ObjectData(c, gin.H{"error": newAPIError.ToOpenAIError()})
+		Done(c)
+	}
+}
+
+// StreamQuotaCutOff 额度不足时按客户端请求的格式结束流式响应：先发送表示输出被截断的结束原因，再发送错误事件
+func StreamQuotaCutOff(c *gin.Context, info *relaycommon.RelayInfo, newAPIError *types.NewAPIError) {
+	logger.LogWarn(c, fmt.Sprintf("stream cut off: %s", newAPIError.Error()))
+	switch info.RelayFormat {
+	case types.RelayFormatClaude:
+		stopReason := "max_tokens"
+		_ = ClaudeData(c, dto.ClaudeResponse{
+			Type:  "message_delta",
+			Delta: &dto.ClaudeMediaMessage{StopReason: &stopReason},
+		})
+	case types.RelayFormatGemini:
+		_ = ObjectData(c, gin.H{
+			"candidates": []gin.H{{"index": 0, "finishReason": "MAX_TOKENS", "content": gin.H{"role": "model", "parts": []gin.H{}}}},
+		})
+	case types.RelayFormatOpenAIResponses:
+		// Responses API 没有表示截断的事件，只发送错误事件
+	default:
+		_ = ObjectData(c, GenerateStopResponse(GetResponseID(c), time.Now().Unix(), info.UpstreamModelName, "length"))
+	}
+	StreamErrorData(c, info.RelayFormat, newAPIError)
+	if info.RelayFormat == types.RelayFormatClaude {
+		_ = ClaudeData(c, dto.ClaudeResponse{Type: "message_stop"})
+	}
+	c.Writer = &streamCutOffWriter{ResponseWriter: c.Writer}
+}
@@ -233,6 +233,15 @@ func StreamScannerHandler(c *gin.Context, resp *http.Response, info *relaycommon
 					if !success {
 						return
 					}
+					// 对冲请求中写入成功的一方即胜出的一方，由它追加预扣费
+					if info.StreamQuotaGuard != nil && !info.IsHedgeLost() {
+						if newAPIError := info.StreamQuotaGuard(StreamOutputText(data)); newAPIError != nil {
+							writeMutex.Lock()
+							StreamQuotaCutOff(c, info, newAPIError)
+							writeMutex.Unlock()
+							return
+						}
+					}
 				case <-time.After(10 * time.Second):
 					logger.LogError(c, "data handler timeout")
 					return
@@ -39,3 +39,26 @@ func OpenAIFinishReasonToClaudeStopReason(finishReason string) string {
 		return finishReason
 	}
 }
+
+// GeminiFinishReasonToClaudeStopReason 安全过滤等原因均视为拒绝回答，有工具调用时由调用方改为 tool_use
+func GeminiFinishReasonToClaudeStopReason(finishReason string) string {
+	switch strings.ToUpper(finishReason) {
+	case "", "STOP", "FINISH_REASON_UNSPECIFIED":
+		return "end_turn"
+	case "MAX_TOKENS":
+		return "max_tokens"
+	default:
+		return "refusal"
+	}
+}
+
+func ClaudeStopReasonToGeminiFinishReason(stopReason string) string {
+	switch strings.ToLower(stopReason) {
+	case "max_tokens":
+		return "MAX_TOKENS"
+	case "refusal":
+		return "SAFETY"
+	default:
+		return "STOP"
+	}
+}
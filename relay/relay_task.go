@@ -188,6 +188,10 @@ func RelayTaskSubmit(c *gin.Context, info *relaycommon.RelayInfo) (taskErr *dto.
 		taskErr = service.TaskErrorWrapperLocal(errors.New("user quota is not enough"), "quota_not_enough", http.StatusForbidden)
 		return
 	}
+	if budgetErr := service.CheckBudgets(info, quota); budgetErr != nil {
+		taskErr = service.TaskErrorWrapperLocal(budgetErr.Err, string(budgetErr.GetErrorCode()), budgetErr.StatusCode)
+		return
+	}
 
 	// build body
 	requestBody, err := adaptor.BuildRequestBody(c, info)
@@ -258,7 +262,7 @@ func RelayTaskSubmit(c *gin.Context, info *relaycommon.RelayInfo) (taskErr *dto.
 					Group:     info.UsingGroup,
 					Other:     other,
 				})
-				model.UpdateUserUsedQuotaAndRequestCount(info.UserId, quota)
+				model.UpdateUserUsedQuotaAndRequestCount(info.UserId, quota, service.RelayQuotaLedgerRef(info, quota))
 				model.UpdateChannelUsedQuota(info.ChannelId, quota)
 			}
 		}
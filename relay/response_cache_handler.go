@@ -0,0 +1,86 @@
+package relay
+
+import (
+	"net/http"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	relayconstant "github.com/QuantumNous/new-api/relay/constant"
+	"github.com/QuantumNous/new-api/relay/helper"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ResponseCacheHelper 使用缓存的响应回复客户端并按缓存计费倍率计费，流式请求由缓存的响应合成 SSE 数据
+func ResponseCacheHelper(c *gin.Context, info *relaycommon.RelayInfo, entry *service.ResponseCacheEntry) *types.NewAPIError {
+	// 命中缓存的请求没有选择渠道，日志中的渠道为 0
+	info.InitChannelMeta(c)
+	info.ResponseCacheHit = true
+	info.SetFirstResponseTime()
+
+	if info.IsStream && info.RelayMode == relayconstant.RelayModeChatCompletions {
+		var response dto.OpenAITextResponse
+		if err := common.UnmarshalJsonStr(entry.Body, &response); err != nil {
+			return types.NewError(err, types.ErrorCodeBadResponseBody, types.ErrOptionWithSkipRetry())
+		}
+		includeUsage := true
+		if request, ok := info.Request.(*dto.GeneralOpenAIRequest); ok && request.StreamOptions != nil {
+			includeUsage = request.StreamOptions.IncludeUsage
+		}
+		replayChatStream(c, &response, entry.Usage, includeUsage)
+	} else {
+		c.Data(http.StatusOK, "application/json", []byte(entry.Body))
+	}
+
+	usage := entry.Usage
+	postConsumeQuota(c, info, &usage)
+	return nil
+}
+
+func replayChatStream(c *gin.Context, response *dto.OpenAITextResponse, usage dto.Usage, includeUsage bool) {
+	created := common.GetTimestamp()
+	if value, ok := response.Created.(float64); ok {
+		created = int64(value)
+	}
+
+	helper.SetEventStreamHeaders(c)
+	for _, choice := range response.Choices {
+		delta := dto.ChatCompletionsStreamResponseChoiceDelta{Role: "assistant"}
+		delta.SetContentString(choice.Message.StringContent())
+		if choice.Message.ReasoningContent != "" {
+			delta.SetReasoningContent(choice.Message.ReasoningContent)
+		}
+		if len(choice.Message.ToolCalls) > 0 {
+			var toolCalls []dto.ToolCallResponse
+			if err := common.Unmarshal(choice.Message.ToolCalls, &toolCalls); err == nil {
+				for i := range toolCalls {
+					toolCalls[i].Index = common.GetPointer(i)
+				}
+				delta.ToolCalls = toolCalls
+			}
+		}
+		_ = helper.ObjectData(c, &dto.ChatCompletionsStreamResponse{
+			Id:      response.Id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   response.Model,
+			Choices: []dto.ChatCompletionsStreamResponseChoice{
+				{
+					Index: choice.Index,
+					Delta: delta,
+				},
+			},
+		})
+
+		stop := helper.GenerateStopResponse(response.Id, created, response.Model, choice.FinishReason)
+		stop.Choices[0].Index = choice.Index
+		_ = helper.ObjectData(c, stop)
+	}
+	if includeUsage {
+		_ = helper.ObjectData(c, helper.GenerateFinalUsageResponse(response.Id, created, response.Model, usage))
+	}
+	helper.Done(c)
+}
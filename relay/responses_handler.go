@@ -2,6 +2,7 @@ package relay
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,6 +11,7 @@ import (
 	"github.com/QuantumNous/new-api/common"
 	appconstant "github.com/QuantumNous/new-api/constant"
 	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/pkg/tracing"
 	relaycommon "github.com/QuantumNous/new-api/relay/common"
 	relayconstant "github.com/QuantumNous/new-api/relay/constant"
 	"github.com/QuantumNous/new-api/relay/helper"
@@ -70,6 +72,26 @@ func ResponsesHelper(c *gin.Context, info *relaycommon.RelayInfo) (newAPIError *
 		return types.NewError(fmt.Errorf("invalid api type: %d", info.ApiType), types.ErrorCodeInvalidApiType, types.ErrOptionWithSkipRetry())
 	}
 	adaptor.Init(info)
+
+	// 原生支持 Responses API 的渠道由上游保存会话，本地没有记录时原样转发
+	if request.PreviousResponseID != "" && !supportsNativeResponses(info.ApiType) {
+		return types.NewErrorWithStatusCode(fmt.Errorf("previous response with id '%s' not found", request.PreviousResponseID),
+			types.ErrorCodeInvalidRequest, http.StatusNotFound, types.ErrOptionWithSkipRetry())
+	}
+	turnRequest := info.ResponsesTurnRequest
+	if turnRequest == nil {
+		turnRequest = request
+	}
+
+	if !supportsNativeResponses(info.ApiType) {
+		usage, newAPIError := responsesViaChatCompletions(c, info, adaptor, request, turnRequest)
+		if newAPIError != nil {
+			return newAPIError
+		}
+		postConsumeQuota(c, info, usage)
+		return nil
+	}
+
 	var requestBody io.Reader
 	if model_setting.GetGlobalSettings().PassThroughRequestEnabled || info.ChannelSetting.PassThroughBodyEnabled {
 		body, err := common.GetRequestBody(c)
@@ -78,7 +100,9 @@ func ResponsesHelper(c *gin.Context, info *relaycommon.RelayInfo) (newAPIError *
 		}
 		requestBody = bytes.NewBuffer(body)
 	} else {
+		_, convertSpan := tracing.Start(c.Request.Context(), "adaptor.ConvertOpenAIResponsesRequest")
 		convertedRequest, err := adaptor.ConvertOpenAIResponsesRequest(c, info, *request)
+		tracing.End(convertSpan, err)
 		if err != nil {
 			return types.NewError(err, types.ErrorCodeConvertRequestFailed, types.ErrOptionWithSkipRetry())
 		}
@@ -127,7 +151,11 @@ func ResponsesHelper(c *gin.Context, info *relaycommon.RelayInfo) (newAPIError *
 		}
 	}
 
+	_, responseSpan := tracing.Start(c.Request.Context(), "adaptor.DoResponse")
+
 	usage, newAPIError := adaptor.DoResponse(c, httpResp, info)
+
+	tracing.End(responseSpan, newAPIError)
 	if newAPIError != nil {
 		// reset status code 重置状态码
 		service.ResetStatusCode(newAPIError, statusCodeMappingStr)
@@ -159,3 +187,47 @@ func ResponsesHelper(c *gin.Context, info *relaycommon.RelayInfo) (newAPIError *
 	}
 	return nil
 }
+
+// ExpandPreviousResponse 在估算 token 与预扣费之前把 previous_response_id 展开为完整的输入历史，
+// 使预扣费、TPM 与上下文长度筛选都按完整的输入计算。本地没有该响应时请求保持不变，由选中的渠道决定是否转发
+func ExpandPreviousResponse(info *relaycommon.RelayInfo) *types.NewAPIError {
+	switch req := info.Request.(type) {
+	case *dto.OpenAIResponsesRequest:
+		if req.PreviousResponseID == "" {
+			return nil
+		}
+		turnRequest := *req
+		found, newAPIError := expandPreviousResponse(info.UserId, req)
+		if newAPIError != nil {
+			return newAPIError
+		}
+		if found {
+			info.ResponsesTurnRequest = &turnRequest
+		}
+	case *dto.OpenAIResponsesCompactionRequest:
+		if req.PreviousResponseID == "" {
+			return nil
+		}
+		expanded := &dto.OpenAIResponsesRequest{Input: req.Input, PreviousResponseID: req.PreviousResponseID}
+		found, newAPIError := expandPreviousResponse(info.UserId, expanded)
+		if newAPIError != nil {
+			return newAPIError
+		}
+		if found {
+			req.Input = expanded.Input
+			req.PreviousResponseID = ""
+		}
+	}
+	return nil
+}
+
+func expandPreviousResponse(userId int, request *dto.OpenAIResponsesRequest) (bool, *types.NewAPIError) {
+	found, err := service.ExpandPreviousResponse(userId, request)
+	if errors.Is(err, service.ErrStoredResponseUnavailable) {
+		return false, types.NewErrorWithStatusCode(err, types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+	if err != nil {
+		return false, types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry())
+	}
+	return found, nil
+}
@@ -0,0 +1,323 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/pkg/tracing"
+	"github.com/QuantumNous/new-api/relay/channel"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	relayconstant "github.com/QuantumNous/new-api/relay/constant"
+	"github.com/QuantumNous/new-api/relay/helper"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/service/openaicompat"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+// supportsNativeResponses 渠道适配器是否原生支持 /v1/responses，不支持的渠道通过对话接口转换
+func supportsNativeResponses(apiType int) bool {
+	switch apiType {
+	case constant.APITypeOpenAI, constant.APITypeOpenRouter, constant.APITypeXinference,
+		constant.APITypeCodex, constant.APITypeVolcEngine, constant.APITypeCloudflare:
+		return true
+	}
+	return false
+}
+
+// responsesViaChatWriter 把适配器写出的对话格式响应转换为 Responses API 格式。
+// 流式响应逐个 chunk 转换为事件，非流式响应缓存完整响应体，在 finish 时转换后写出
+type responsesViaChatWriter struct {
+	gin.ResponseWriter
+	c          *gin.Context
+	converter  *openaicompat.ChatToResponsesStreamConverter
+	responseID string
+	response   *dto.OpenAIResponsesResponse // finish 后的完整响应
+	decided    bool
+	stream     bool
+	failed     bool // 已发送 response.failed，之后的 chunk 不再转换
+	buffer     bytes.Buffer
+}
+
+func newResponsesViaChatWriter(c *gin.Context, info *relaycommon.RelayInfo) *responsesViaChatWriter {
+	responseID := helper.GetResponsesID(c)
+	return &responsesViaChatWriter{
+		ResponseWriter: c.Writer,
+		c:              c,
+		converter:      openaicompat.NewChatToResponsesStreamConverter(responseID, info.OriginModelName),
+		responseID:     responseID,
+	}
+}
+
+func (w *responsesViaChatWriter) isStream() bool {
+	if !w.decided {
+		w.decided = true
+		w.stream = strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream")
+	}
+	return w.stream
+}
+
+func (w *responsesViaChatWriter) Write(data []byte) (int, error) {
+	w.buffer.Write(data)
+	if w.isStream() {
+		if err := w.processLines(); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+func (w *responsesViaChatWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *responsesViaChatWriter) Flush() {
+	// 非流式响应在转换完成前不能提前发送响应头
+	if w.isStream() {
+		w.ResponseWriter.Flush()
+	}
+}
+
+func (w *responsesViaChatWriter) processLines() error {
+	for {
+		line, err := w.buffer.ReadBytes('\n')
+		if err != nil {
+			// 不完整的行留到下次写入
+			w.buffer.Write(line)
+			return nil
+		}
+		line = bytes.TrimSpace(line)
+		if bytes.HasPrefix(line, []byte(":")) {
+			// 保留心跳
+			if _, err := w.ResponseWriter.Write(append(line, '\n', '\n')); err != nil {
+				return err
+			}
+			continue
+		}
+		if !bytes.HasPrefix(line, []byte("data:")) {
+			continue
+		}
+		payload := bytes.TrimSpace(line[len("data:"):])
+		if len(payload) == 0 || string(payload) == "[DONE]" || w.failed {
+			continue
+		}
+		// 上游在流式输出中途返回的错误（包括额度不足时的截断）转换为 response.failed
+		if errResult := gjson.GetBytes(payload, "error"); errResult.Exists() && errResult.Type != gjson.Null {
+			if err := w.fail(parseStreamError(errResult)); err != nil {
+				return err
+			}
+			continue
+		}
+		var chunk dto.ChatCompletionsStreamResponse
+		if err := common.Unmarshal(payload, &chunk); err != nil {
+			continue
+		}
+		if err := w.writeEvents(w.converter.ConvertChunk(&chunk)); err != nil {
+			return err
+		}
+	}
+}
+
+func (w *responsesViaChatWriter) writeEvents(events []dto.ResponsesStreamResponse) error {
+	for _, event := range events {
+		data, err := common.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w.ResponseWriter, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseStreamError(errResult gjson.Result) types.OpenAIError {
+	var openaiError types.OpenAIError
+	if errResult.IsObject() {
+		_ = common.UnmarshalJsonStr(errResult.Raw, &openaiError)
+	}
+	if openaiError.Message == "" {
+		openaiError.Message = errResult.String()
+	}
+	return openaiError
+}
+
+// fail 发送 response.failed 事件，流式输出已经开始后出错时不能再返回 JSON 错误
+func (w *responsesViaChatWriter) fail(openaiError types.OpenAIError) error {
+	if w.failed {
+		return nil
+	}
+	w.failed = true
+	helper.MarkStreamErrorSent(w.c)
+	events := w.converter.Fail(openaiError, nil)
+	if err := w.writeEvents(events); err != nil {
+		return err
+	}
+	w.ResponseWriter.Flush()
+	return nil
+}
+
+// finish 写出剩余的响应，usage 使用适配器返回的用量，与计费保持一致
+func (w *responsesViaChatWriter) finish(usage *dto.Usage) *types.NewAPIError {
+	if w.isStream() {
+		w.buffer.WriteString("\n")
+		if err := w.processLines(); err != nil {
+			return types.NewOpenAIError(err, types.ErrorCodeBadResponse, http.StatusInternalServerError)
+		}
+		if w.failed {
+			return nil
+		}
+		events := w.converter.Finish(usage)
+		w.response = events[len(events)-1].Response
+		if err := w.writeEvents(events); err != nil {
+			return types.NewOpenAIError(err, types.ErrorCodeBadResponse, http.StatusInternalServerError)
+		}
+		w.ResponseWriter.Flush()
+		return nil
+	}
+
+	var chatResp dto.OpenAITextResponse
+	if err := common.Unmarshal(w.buffer.Bytes(), &chatResp); err != nil {
+		return types.NewOpenAIError(err, types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
+	}
+	if usage != nil {
+		chatResp.Usage = *usage
+	}
+	responsesResp, err := openaicompat.ChatCompletionsResponseToResponsesResponse(&chatResp, w.responseID)
+	if err != nil {
+		return types.NewOpenAIError(err, types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
+	}
+	w.response = responsesResp
+	data, err := common.Marshal(responsesResp)
+	if err != nil {
+		return types.NewOpenAIError(err, types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.ResponseWriter.Write(data); err != nil {
+		return types.NewOpenAIError(err, types.ErrorCodeBadResponse, http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// responsesViaChatCompletions 把 Responses API 请求转换为对话请求发给不支持 Responses API 的渠道，
+// 再把对话响应转换回 Responses API 格式。turnRequest 为展开 previous_response_id 之前的请求，用于保存响应
+func responsesViaChatCompletions(c *gin.Context, info *relaycommon.RelayInfo, adaptor channel.Adaptor, request *dto.OpenAIResponsesRequest, turnRequest *dto.OpenAIResponsesRequest) (*dto.Usage, *types.NewAPIError) {
+	chatReq, err := openaicompat.ResponsesRequestToChatCompletionsRequest(request)
+	if err != nil {
+		return nil, types.NewErrorWithStatusCode(err, types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+	if !info.SupportStreamOptions {
+		chatReq.StreamOptions = nil
+	}
+	applySystemPromptIfNeeded(c, info, chatReq)
+	info.AppendRequestConversion(types.RelayFormatOpenAI)
+
+	savedRelayFormat := info.RelayFormat
+	savedRelayMode := info.RelayMode
+	savedRequestURLPath := info.RequestURLPath
+	savedShouldIncludeUsage := info.ShouldIncludeUsage
+	defer func() {
+		info.RelayFormat = savedRelayFormat
+		info.RelayMode = savedRelayMode
+		info.RequestURLPath = savedRequestURLPath
+		info.ShouldIncludeUsage = savedShouldIncludeUsage
+	}()
+
+	info.RelayFormat = types.RelayFormatOpenAI
+	info.RelayMode = relayconstant.RelayModeChatCompletions
+	info.RequestURLPath = "/v1/chat/completions"
+	info.ShouldIncludeUsage = true
+
+	_, convertSpan := tracing.Start(c.Request.Context(), "adaptor.ConvertOpenAIRequest")
+
+	convertedRequest, err := adaptor.ConvertOpenAIRequest(c, info, chatReq)
+
+	tracing.End(convertSpan, err)
+	if err != nil {
+		return nil, types.NewError(err, types.ErrorCodeConvertRequestFailed, types.ErrOptionWithSkipRetry())
+	}
+	relaycommon.AppendRequestConversionFromRequest(info, convertedRequest)
+
+	jsonData, err := common.Marshal(convertedRequest)
+	if err != nil {
+		return nil, types.NewError(err, types.ErrorCodeConvertRequestFailed, types.ErrOptionWithSkipRetry())
+	}
+
+	jsonData, err = relaycommon.RemoveDisabledFields(jsonData, info.ChannelOtherSettings)
+	if err != nil {
+		return nil, types.NewError(err, types.ErrorCodeConvertRequestFailed, types.ErrOptionWithSkipRetry())
+	}
+
+	if len(info.ParamOverride) > 0 {
+		jsonData, err = relaycommon.ApplyParamOverride(jsonData, info.ParamOverride, relaycommon.BuildParamOverrideContext(info))
+		if err != nil {
+			return nil, types.NewError(err, types.ErrorCodeChannelParamOverrideInvalid, types.ErrOptionWithSkipRetry())
+		}
+	}
+
+	if common.DebugEnabled {
+		println("requestBody: ", string(jsonData))
+	}
+
+	var httpResp *http.Response
+	resp, err := adaptor.DoRequest(c, info, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, types.NewOpenAIError(err, types.ErrorCodeDoRequestFailed, http.StatusInternalServerError)
+	}
+
+	statusCodeMappingStr := c.GetString("status_code_mapping")
+
+	if resp != nil {
+		httpResp = resp.(*http.Response)
+		if httpResp.StatusCode != http.StatusOK {
+			newAPIError := service.RelayErrorHandler(c.Request.Context(), httpResp, false)
+			service.ResetStatusCode(newAPIError, statusCodeMappingStr)
+			return nil, newAPIError
+		}
+	}
+
+	originWriter := c.Writer
+	writer := newResponsesViaChatWriter(c, info)
+	c.Writer = writer
+	defer func() {
+		c.Writer = originWriter
+	}()
+
+	_, responseSpan := tracing.Start(c.Request.Context(), "adaptor.DoResponse")
+
+	usage, newAPIError := adaptor.DoResponse(c, httpResp, info)
+
+	tracing.End(responseSpan, newAPIError)
+	if newAPIError != nil {
+		service.ResetStatusCode(newAPIError, statusCodeMappingStr)
+		if writer.isStream() && writer.Written() {
+			// 流式输出已经开始，错误以 response.failed 事件发送，不能再重试其他渠道
+			if err := writer.fail(newAPIError.ToOpenAIError()); err != nil {
+				logger.LogError(c, "send response.failed failed: "+err.Error())
+			}
+			return nil, types.NewErrorWithStatusCode(newAPIError.Err, newAPIError.GetErrorCode(), newAPIError.StatusCode, types.ErrOptionWithSkipRetry())
+		}
+		return nil, newAPIError
+	}
+
+	usageDto, _ := usage.(*dto.Usage)
+	if newAPIError = writer.finish(usageDto); newAPIError != nil {
+		return nil, newAPIError
+	}
+	if err := service.StoreResponsesResponse(info.UserId, turnRequest, writer.response); err != nil {
+		logger.LogWarn(c, fmt.Sprintf("response not stored: %s", err.Error()))
+	}
+	if usageDto == nil {
+		usageDto = &dto.Usage{}
+	}
+	return usageDto, nil
+}
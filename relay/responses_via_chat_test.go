@@ -0,0 +1,50 @@
+package relay
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/relay/helper"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponsesViaChatQuotaCutOff(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/responses", nil)
+	c.Set(common.RequestIdKey, "test")
+
+	// 转换期间适配器按对话格式输出
+	info := &relaycommon.RelayInfo{RelayFormat: types.RelayFormatOpenAI, OriginModelName: "gpt-4o", ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "gpt-4o"}}
+	writer := newResponsesViaChatWriter(c, info)
+	c.Writer = writer
+	helper.SetEventStreamHeaders(c)
+
+	content := "hello"
+	_ = helper.ObjectData(c, dto.ChatCompletionsStreamResponse{
+		Choices: []dto.ChatCompletionsStreamResponseChoice{{Delta: dto.ChatCompletionsStreamResponseChoiceDelta{Content: &content}}},
+	})
+	quotaErr := types.NewErrorWithStatusCode(errors.New("用户额度不足"), types.ErrorCodeInsufficientUserQuota, http.StatusForbidden)
+	helper.StreamQuotaCutOff(c, info, quotaErr)
+	require.Nil(t, writer.finish(nil))
+
+	body := recorder.Body.String()
+	require.Contains(t, body, "event: response.failed")
+	require.NotContains(t, body, "event: response.completed")
+	require.Contains(t, body, "用户额度不足")
+	require.Contains(t, body, string(types.ErrorCodeInsufficientUserQuota))
+	require.Equal(t, 1, strings.Count(body, "event: response.failed"))
+	require.True(t, common.GetContextKeyBool(c, constant.ContextKeyRelayFailed))
+	require.True(t, helper.IsStreamErrorSent(c))
+}
@@ -224,6 +224,14 @@ func SetApiRouter(router *gin.Engine) {
 		logRoute.GET("/self", middleware.UserAuth(), controller.GetUserLogs)
 		logRoute.GET("/self/search", middleware.UserAuth(), controller.SearchUserLogs)
 
+		quotaLedgerRoute := apiRouter.Group("/quota_ledger")
+		quotaLedgerRoute.Use(middleware.AdminAuth())
+		{
+			quotaLedgerRoute.GET("/", controller.GetQuotaLedgers)
+			quotaLedgerRoute.GET("/reconciliation", controller.GetQuotaLedgerReconciliation)
+			quotaLedgerRoute.POST("/reconciliation", controller.ReconcileQuotaLedger)
+		}
+
 		dataRoute := apiRouter.Group("/data")
 		dataRoute.GET("/", middleware.AdminAuth(), controller.GetAllQuotaDates)
 		dataRoute.GET("/self", middleware.UserAuth(), controller.GetUserQuotaDates)
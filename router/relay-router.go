@@ -1,6 +1,8 @@
 package router
 
 import (
+	"strings"
+
 	"github.com/QuantumNous/new-api/constant"
 	"github.com/QuantumNous/new-api/controller"
 	"github.com/QuantumNous/new-api/middleware"
@@ -63,6 +65,8 @@ func SetRelayRouter(router *gin.Engine) {
 	}
 	relayV1Router := router.Group("/v1")
 	relayV1Router.Use(middleware.TokenAuth())
+	relayV1Router.Use(middleware.Idempotency())
+	relayV1Router.Use(middleware.TokenRateLimit())
 	relayV1Router.Use(middleware.ModelRequestRateLimit())
 	{
 		// WebSocket 路由（统一到 Relay）
@@ -72,6 +76,47 @@ func SetRelayRouter(router *gin.Engine) {
 			controller.Relay(c, types.RelayFormatOpenAIRealtime)
 		})
 	}
+	{
+		// files 路由：上传时选择渠道，其余操作按文件映射回上传渠道
+		filesRouter := relayV1Router.Group("/files")
+		filesRouter.POST("", middleware.Distribute(), controller.RelayFileUpload)
+		filesRouter.GET("", controller.RelayFileList)
+		filesRouter.GET("/:id", controller.RelayFileRetrieve)
+		filesRouter.DELETE("/:id", controller.RelayFileDelete)
+		filesRouter.GET("/:id/content", controller.RelayFileContent)
+	}
+	{
+		// batches 路由：batch 在输入文件所在渠道上执行
+		batchesRouter := relayV1Router.Group("/batches")
+		batchesRouter.POST("", controller.RelayBatchCreate)
+		batchesRouter.GET("", controller.RelayBatchList)
+		batchesRouter.GET("/:id", controller.RelayBatchRetrieve)
+		batchesRouter.POST("/:id/cancel", controller.RelayBatchCancel)
+	}
+	{
+		// fine-tuning 路由：任务在训练文件所在渠道上执行，旧版 /fine-tunes 转换为新版接口
+		fineTuningRouter := relayV1Router.Group("/fine_tuning/jobs")
+		fineTuningRouter.POST("", controller.RelayFineTuningCreate)
+		fineTuningRouter.GET("", controller.RelayFineTuningList)
+		fineTuningRouter.GET("/:id", controller.RelayFineTuningRetrieve)
+		fineTuningRouter.POST("/:id/cancel", controller.RelayFineTuningCancel)
+		fineTuningRouter.GET("/:id/events", controller.RelayFineTuningEvents)
+		fineTuningRouter.GET("/:id/checkpoints", controller.RelayFineTuningCheckpoints)
+
+		legacyFineTunesRouter := relayV1Router.Group("/fine-tunes")
+		legacyFineTunesRouter.POST("", controller.RelayFineTuningCreate)
+		legacyFineTunesRouter.GET("", controller.RelayFineTuningList)
+		legacyFineTunesRouter.GET("/:id", controller.RelayFineTuningRetrieve)
+		legacyFineTunesRouter.POST("/:id/cancel", controller.RelayFineTuningCancel)
+		legacyFineTunesRouter.GET("/:id/events", controller.RelayFineTuningEvents)
+	}
+	{
+		// responses 查询路由：由本地响应存储提供，不经过渠道
+		responsesRouter := relayV1Router.Group("/responses")
+		responsesRouter.GET("/:id", controller.RelayResponseRetrieve)
+		responsesRouter.DELETE("/:id", controller.RelayResponseDelete)
+		responsesRouter.GET("/:id/input_items", controller.RelayResponseInputItems)
+	}
 	{
 		//http router
 		httpRouter := relayV1Router.Group("")
@@ -81,6 +126,7 @@ func SetRelayRouter(router *gin.Engine) {
 		httpRouter.POST("/messages", func(c *gin.Context) {
 			controller.Relay(c, types.RelayFormatClaude)
 		})
+		httpRouter.POST("/messages/count_tokens", controller.RelayClaudeCountTokens)
 
 		// chat related routes
 		httpRouter.POST("/completions", func(c *gin.Context) {
@@ -135,6 +181,10 @@ func SetRelayRouter(router *gin.Engine) {
 			controller.Relay(c, types.RelayFormatGemini)
 		})
 		httpRouter.POST("/models/*path", func(c *gin.Context) {
+			if strings.HasSuffix(c.Request.URL.Path, ":countTokens") {
+				controller.RelayGeminiCountTokens(c)
+				return
+			}
 			controller.Relay(c, types.RelayFormatGemini)
 		})
 
@@ -145,16 +195,6 @@ func SetRelayRouter(router *gin.Engine) {
 
 		// not implemented
 		httpRouter.POST("/images/variations", controller.RelayNotImplemented)
-		httpRouter.GET("/files", controller.RelayNotImplemented)
-		httpRouter.POST("/files", controller.RelayNotImplemented)
-		httpRouter.DELETE("/files/:id", controller.RelayNotImplemented)
-		httpRouter.GET("/files/:id", controller.RelayNotImplemented)
-		httpRouter.GET("/files/:id/content", controller.RelayNotImplemented)
-		httpRouter.POST("/fine-tunes", controller.RelayNotImplemented)
-		httpRouter.GET("/fine-tunes", controller.RelayNotImplemented)
-		httpRouter.GET("/fine-tunes/:id", controller.RelayNotImplemented)
-		httpRouter.POST("/fine-tunes/:id/cancel", controller.RelayNotImplemented)
-		httpRouter.GET("/fine-tunes/:id/events", controller.RelayNotImplemented)
 		httpRouter.DELETE("/models/:model", controller.RelayNotImplemented)
 	}
 
@@ -166,7 +206,7 @@ func SetRelayRouter(router *gin.Engine) {
 	//relayMjRouter.Use()
 
 	relaySunoRouter := router.Group("/suno")
-	relaySunoRouter.Use(middleware.TokenAuth(), middleware.Distribute())
+	relaySunoRouter.Use(middleware.TokenAuth(), middleware.Idempotency(), middleware.TokenRateLimit(), middleware.Distribute())
 	{
 		relaySunoRouter.POST("/submit/:action", controller.RelayTask)
 		relaySunoRouter.POST("/fetch", controller.RelayTask)
@@ -175,19 +215,38 @@ func SetRelayRouter(router *gin.Engine) {
 
 	relayGeminiRouter := router.Group("/v1beta")
 	relayGeminiRouter.Use(middleware.TokenAuth())
+	relayGeminiRouter.Use(middleware.Idempotency())
+	relayGeminiRouter.Use(middleware.TokenRateLimit())
 	relayGeminiRouter.Use(middleware.ModelRequestRateLimit())
 	relayGeminiRouter.Use(middleware.Distribute())
 	{
 		// Gemini API 路径格式: /v1beta/models/{model_name}:{action}
 		relayGeminiRouter.POST("/models/*path", func(c *gin.Context) {
+			if strings.HasSuffix(c.Request.URL.Path, ":countTokens") {
+				controller.RelayGeminiCountTokens(c)
+				return
+			}
 			controller.Relay(c, types.RelayFormatGemini)
 		})
 	}
+	{
+		// Gemini 上下文缓存路由：创建时选择渠道，其余操作根据映射路由回创建缓存的渠道
+		geminiCachedContentsRouter := router.Group("/v1beta/cachedContents")
+		geminiCachedContentsRouter.Use(middleware.TokenAuth())
+		geminiCachedContentsRouter.Use(middleware.Idempotency())
+		geminiCachedContentsRouter.Use(middleware.TokenRateLimit())
+		geminiCachedContentsRouter.Use(middleware.ModelRequestRateLimit())
+		geminiCachedContentsRouter.POST("", middleware.Distribute(), controller.RelayGeminiCachedContentCreate)
+		geminiCachedContentsRouter.GET("", controller.RelayGeminiCachedContentList)
+		geminiCachedContentsRouter.GET("/:id", controller.RelayGeminiCachedContentRetrieve)
+		geminiCachedContentsRouter.PATCH("/:id", controller.RelayGeminiCachedContentUpdate)
+		geminiCachedContentsRouter.DELETE("/:id", controller.RelayGeminiCachedContentDelete)
+	}
 }
 
 func registerMjRouterGroup(relayMjRouter *gin.RouterGroup) {
 	relayMjRouter.GET("/image/:id", relay.RelayMidjourneyImage)
-	relayMjRouter.Use(middleware.TokenAuth(), middleware.Distribute())
+	relayMjRouter.Use(middleware.TokenAuth(), middleware.Idempotency(), middleware.TokenRateLimit(), middleware.Distribute())
 	{
 		relayMjRouter.POST("/submit/action", controller.RelayMidjourney)
 		relayMjRouter.POST("/submit/shorten", controller.RelayMidjourney)
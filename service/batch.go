@@ -0,0 +1,584 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+	"github.com/QuantumNous/new-api/setting/ratio_setting"
+
+	"github.com/bytedance/gopkg/util/gopool"
+)
+
+// batch 输入 / 输出文件单行最大长度
+const batchMaxLineSize = 64 << 20
+
+// SupportedBatchEndpoints batch 支持的接口
+var SupportedBatchEndpoints = []string{
+	"/v1/chat/completions",
+	"/v1/completions",
+	"/v1/embeddings",
+	"/v1/responses",
+}
+
+var batchModelDateSuffix = regexp.MustCompile(`-\d{4}-\d{2}-\d{2}$`)
+
+// IsNativeBatchChannel 渠道是否需要由网关逐行执行 batch，OpenAI / Azure 以外的渠道没有 batch 接口
+func IsNativeBatchChannel(channel *model.Channel) bool {
+	if channel.GetOtherSettings().BatchNativeFallback {
+		return true
+	}
+	return channel.Type != constant.ChannelTypeOpenAI && channel.Type != constant.ChannelTypeAzure
+}
+
+func newBatchScanner(reader io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), batchMaxLineSize)
+	return scanner
+}
+
+// BatchModelUsage batch 输出文件中单个模型的用量汇总
+type BatchModelUsage struct {
+	ModelName        string
+	Requests         int
+	PromptTokens     int
+	CompletionTokens int
+	CachedTokens     int
+	ModelRatio       float64
+	ModelPrice       float64
+	Quota            int
+}
+
+// resolveBatchBillingModel 上游返回的模型名通常带日期后缀，找不到价格时尝试去掉后缀
+func resolveBatchBillingModel(name string) string {
+	if _, _, exist := ratio_setting.GetModelRatioOrPrice(name); exist {
+		return name
+	}
+	trimmed := batchModelDateSuffix.ReplaceAllString(name, "")
+	if _, _, exist := ratio_setting.GetModelRatioOrPrice(trimmed); exist {
+		return trimmed
+	}
+	return name
+}
+
+// CalcBatchOutputQuota 解析 batch 输出文件中每一行的 usage，按模型汇总计算额度
+func CalcBatchOutputQuota(reader io.Reader, group string) (map[string]*BatchModelUsage, error) {
+	type responseBody struct {
+		Model string     `json:"model"`
+		Usage *dto.Usage `json:"usage"`
+	}
+	groupRatio := ratio_setting.GetGroupRatio(group)
+	billingRatio := operation_setting.GetBatchSetting().BillingRatio
+	if billingRatio <= 0 {
+		billingRatio = 1
+	}
+	usages := make(map[string]*BatchModelUsage)
+	quotas := make(map[string]float64)
+	scanner := newBatchScanner(reader)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var outputLine dto.BatchOutputLine
+		if err := common.Unmarshal(line, &outputLine); err != nil {
+			return nil, fmt.Errorf("invalid batch output line: %w", err)
+		}
+		if outputLine.Response == nil || outputLine.Response.StatusCode != http.StatusOK {
+			continue
+		}
+		var body responseBody
+		if err := common.Unmarshal(outputLine.Response.Body, &body); err != nil || body.Usage == nil {
+			continue
+		}
+		promptTokens := body.Usage.PromptTokens
+		completionTokens := body.Usage.CompletionTokens
+		cachedTokens := body.Usage.PromptTokensDetails.CachedTokens
+		if promptTokens == 0 && completionTokens == 0 {
+			// responses 接口
+			promptTokens = body.Usage.InputTokens
+			completionTokens = body.Usage.OutputTokens
+			if body.Usage.InputTokensDetails != nil {
+				cachedTokens = body.Usage.InputTokensDetails.CachedTokens
+			}
+		}
+		modelName := resolveBatchBillingModel(body.Model)
+		usage, ok := usages[modelName]
+		if !ok {
+			usage = &BatchModelUsage{ModelName: modelName}
+			usages[modelName] = usage
+		}
+		usage.Requests++
+		usage.PromptTokens += promptTokens
+		usage.CompletionTokens += completionTokens
+		usage.CachedTokens += cachedTokens
+
+		if price, usePrice := ratio_setting.GetModelPrice(modelName, false); usePrice {
+			usage.ModelPrice = price
+			quotas[modelName] += price * common.QuotaPerUnit * groupRatio * billingRatio
+			continue
+		}
+		modelRatio, _, _ := ratio_setting.GetModelRatio(modelName)
+		completionRatio := ratio_setting.GetCompletionRatio(modelName)
+		cacheRatio, _ := ratio_setting.GetCacheRatio(modelName)
+		usage.ModelRatio = modelRatio
+		tokens := float64(promptTokens-cachedTokens) + float64(cachedTokens)*cacheRatio + float64(completionTokens)*completionRatio
+		quotas[modelName] += tokens * modelRatio * groupRatio * billingRatio
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for modelName, quota := range quotas {
+		usages[modelName].Quota = int(quota)
+	}
+	return usages, nil
+}
+
+// SumBatchQuota 各模型额度之和，即 batch 应扣除的总额度
+func SumBatchQuota(usages map[string]*BatchModelUsage) int {
+	total := 0
+	for _, usage := range usages {
+		total += usage.Quota
+	}
+	return total
+}
+
+// SettleBatchQuota 扣除 batch 的额度并按模型记录消费日志。调用方须先以 UpdateWithStatus 保存结束状态，
+// 保存成功后才能调用，否则重复轮询会重复扣费
+func SettleBatchQuota(task *model.Task, batchId string, usages map[string]*BatchModelUsage) {
+	total := SumBatchQuota(usages)
+	if total <= 0 {
+		return
+	}
+	ledgerRef := model.QuotaLedgerRef{Source: model.QuotaLedgerSourceConsume, RefId: batchId}
+	if err := model.DecreaseUserQuota(task.UserId, total, ledgerRef); err != nil {
+		common.SysLog(fmt.Sprintf("batch %s decrease user quota failed: %s", batchId, err.Error()))
+		return
+	}
+	token := getBillingToken(task.PrivateData.TokenId)
+	if token != nil && !token.UnlimitedQuota {
+		if err := model.DecreaseTokenQuota(token.Id, token.Key, total, ledgerRef); err != nil {
+			common.SysLog(fmt.Sprintf("batch %s decrease token quota failed: %s", batchId, err.Error()))
+		}
+	}
+	RecordBackgroundBudgetSpend(task.UserId, token, total)
+	model.UpdateUserUsedQuotaAndRequestCount(task.UserId, total, ledgerRef)
+	model.UpdateChannelUsedQuota(task.ChannelId, total)
+	billingRatio := operation_setting.GetBatchSetting().BillingRatio
+	for _, usage := range usages {
+		if usage.Quota <= 0 {
+			continue
+		}
+		model.RecordBackgroundConsumeLog(task.UserId, model.RecordConsumeLogParams{
+			ChannelId:        task.ChannelId,
+			TokenId:          task.PrivateData.TokenId,
+			ModelName:        usage.ModelName,
+			PromptTokens:     usage.PromptTokens,
+			CompletionTokens: usage.CompletionTokens,
+			Quota:            usage.Quota,
+			Group:            task.Group,
+			Content:          fmt.Sprintf("Batch %s 结算：%d 个请求，扣除 %s", batchId, usage.Requests, logger.LogQuota(usage.Quota)),
+			Other: map[string]interface{}{
+				"batch_id":      batchId,
+				"requests":      usage.Requests,
+				"cache_tokens":  usage.CachedTokens,
+				"model_ratio":   usage.ModelRatio,
+				"model_price":   usage.ModelPrice,
+				"group_ratio":   ratio_setting.GetGroupRatio(task.Group),
+				"billing_ratio": billingRatio,
+			},
+		})
+	}
+}
+
+var nativeBatchRunning sync.Map
+
+// IsNativeBatchRunning 网关执行的 batch 是否正在本节点运行
+func IsNativeBatchRunning(taskId string) bool {
+	_, ok := nativeBatchRunning.Load(taskId)
+	return ok
+}
+
+// NativeBatchRelayFunc 在进程内执行 batch 中的一行请求，返回响应状态码、请求 ID 与响应体
+type NativeBatchRelayFunc func(ctx context.Context, tokenKey string, method string, path string, body []byte) (statusCode int, requestId string, responseBody []byte)
+
+// StartNativeBatch 在后台逐行执行 batch，每一行都会作为普通请求经过网关计费
+func StartNativeBatch(task *model.Task, relayLine NativeBatchRelayFunc) {
+	if _, loaded := nativeBatchRunning.LoadOrStore(task.TaskID, struct{}{}); loaded {
+		return
+	}
+	gopool.Go(func() {
+		defer nativeBatchRunning.Delete(task.TaskID)
+		runNativeBatch(task, relayLine)
+	})
+}
+
+func failNativeBatch(task *model.Task, batch *dto.OpenAIBatch, reason string) {
+	now := common.GetTimestamp()
+	batch.Status = dto.BatchStatusFailed
+	batch.FailedAt = now
+	batch.Errors = &dto.OpenAIBatchErrors{
+		Object: "list",
+		Data:   []dto.OpenAIBatchError{{Code: "native_batch_failed", Message: reason}},
+	}
+	task.SetData(batch)
+	task.Status = model.TaskStatusFailure
+	task.Progress = "100%"
+	task.FailReason = reason
+	task.FinishTime = now
+	if err := task.Update(); err != nil {
+		common.SysLog(fmt.Sprintf("native batch %s update failed: %s", task.TaskID, err.Error()))
+	}
+}
+
+// FailInterruptedNativeBatch 节点重启后无法继续执行的 batch 直接标记失败，已执行的请求已经单独计费
+func FailInterruptedNativeBatch(task *model.Task) {
+	var batch dto.OpenAIBatch
+	_ = task.GetData(&batch)
+	failNativeBatch(task, &batch, "batch interrupted by server restart")
+}
+
+// nativeBatchOutput 执行结果按完成顺序写入临时文件，输出行通过 custom_id 与输入对应
+type nativeBatchOutput struct {
+	mu        sync.Mutex
+	output    *os.File
+	errors    *os.File
+	completed atomic.Int64
+	failed    atomic.Int64
+}
+
+func newNativeBatchOutput() (*nativeBatchOutput, error) {
+	output, err := os.CreateTemp("", "batch-output-*.jsonl")
+	if err != nil {
+		return nil, err
+	}
+	errorFile, err := os.CreateTemp("", "batch-error-*.jsonl")
+	if err != nil {
+		removeTempFile(output)
+		return nil, err
+	}
+	return &nativeBatchOutput{output: output, errors: errorFile}, nil
+}
+
+func (o *nativeBatchOutput) write(line []byte, failed bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	file := o.output
+	if failed {
+		file = o.errors
+		o.failed.Add(1)
+	} else {
+		o.completed.Add(1)
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		common.SysLog(fmt.Sprintf("write native batch result failed: %s", err.Error()))
+	}
+}
+
+func (o *nativeBatchOutput) close() {
+	removeTempFile(o.output)
+	removeTempFile(o.errors)
+}
+
+func removeTempFile(file *os.File) {
+	file.Close()
+	_ = os.Remove(file.Name())
+}
+
+// uploadNativeBatchResult 上传结果文件，文件为空时返回空的文件 ID
+func uploadNativeBatchResult(ctx context.Context, task *model.Task, channel *model.Channel, key string, filename string, file *os.File) (string, error) {
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil || size == 0 {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	uploaded, err := UploadFileToChannel(ctx, channel, key, filename, "batch", file, size, task.UserId, task.PrivateData.TokenId, task.Group)
+	if err != nil {
+		return "", err
+	}
+	return uploaded.FileId, nil
+}
+
+// downloadNativeBatchInput 逐行校验输入文件并保存到临时文件，返回请求数量，校验失败时返回的错误可直接展示给用户
+func downloadNativeBatchInput(ctx context.Context, batch *dto.OpenAIBatch, channel *model.Channel, key string, fileId string) (*os.File, int, error) {
+	resp, err := DoPlatformRequest(ctx, channel, key, http.MethodGet, "/v1/files/"+fileId+"/content", nil, "")
+	if err != nil {
+		return nil, 0, fmt.Errorf("download input file failed: %s", err.Error())
+	}
+	defer CloseResponseBodyGracefully(resp)
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("download input file failed, status code %d", resp.StatusCode)
+	}
+	input, err := os.CreateTemp("", "batch-input-*.jsonl")
+	if err != nil {
+		return nil, 0, fmt.Errorf("create input file failed: %s", err.Error())
+	}
+	writer := bufio.NewWriter(input)
+	total := 0
+	lineNo := 0
+	scanner := newBatchScanner(resp.Body)
+	for scanner.Scan() {
+		lineNo++
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+		var line dto.BatchInputLine
+		if err := common.Unmarshal(raw, &line); err != nil {
+			removeTempFile(input)
+			return nil, 0, fmt.Errorf("invalid json at line %d", lineNo)
+		}
+		if line.Url != batch.Endpoint {
+			removeTempFile(input)
+			return nil, 0, fmt.Errorf("url of line %d does not match batch endpoint %s", lineNo, batch.Endpoint)
+		}
+		writer.Write(raw)
+		writer.WriteByte('\n')
+		total++
+	}
+	if err := scanner.Err(); err != nil {
+		removeTempFile(input)
+		return nil, 0, fmt.Errorf("read input file failed: %s", err.Error())
+	}
+	if err := writer.Flush(); err != nil {
+		removeTempFile(input)
+		return nil, 0, fmt.Errorf("save input file failed: %s", err.Error())
+	}
+	if _, err := input.Seek(0, io.SeekStart); err != nil {
+		removeTempFile(input)
+		return nil, 0, fmt.Errorf("save input file failed: %s", err.Error())
+	}
+	return input, total, nil
+}
+
+func runNativeBatch(task *model.Task, relayLine NativeBatchRelayFunc) {
+	ctx := context.Background()
+	// 排队期间可能已被取消
+	latest, exist, err := model.GetByTaskId(task.UserId, task.TaskID)
+	if err != nil || !exist || latest.Status == model.TaskStatusFailure || latest.Status == model.TaskStatusSuccess {
+		return
+	}
+	task = latest
+	var batch dto.OpenAIBatch
+	if err := task.GetData(&batch); err != nil {
+		failNativeBatch(task, &batch, "invalid batch data")
+		return
+	}
+	inputFile, exist, err := model.GetUserFileByFileId(task.UserId, batch.InputFileId)
+	if err != nil || !exist {
+		failNativeBatch(task, &batch, fmt.Sprintf("input file %s not found", batch.InputFileId))
+		return
+	}
+	fileChannel, fileKey, newAPIError := GetFileChannelAndKey(inputFile)
+	if newAPIError != nil {
+		failNativeBatch(task, &batch, newAPIError.Error())
+		return
+	}
+	token, err := model.GetTokenById(task.PrivateData.TokenId)
+	if err != nil {
+		failNativeBatch(task, &batch, "token of batch not found")
+		return
+	}
+
+	input, total, err := downloadNativeBatchInput(ctx, &batch, fileChannel, fileKey, inputFile.FileId)
+	if err != nil {
+		failNativeBatch(task, &batch, err.Error())
+		return
+	}
+	defer removeTempFile(input)
+	results, err := newNativeBatchOutput()
+	if err != nil {
+		failNativeBatch(task, &batch, fmt.Sprintf("create output file failed: %s", err.Error()))
+		return
+	}
+	defer results.close()
+
+	now := common.GetTimestamp()
+	batch.Status = dto.BatchStatusInProgress
+	batch.InProgressAt = now
+	batch.RequestCounts = dto.OpenAIBatchRequestCounts{Total: total}
+	task.SetData(batch)
+	task.Status = model.TaskStatusInProgress
+	task.StartTime = now
+	if err := task.Update(); err != nil {
+		common.SysLog(fmt.Sprintf("native batch %s update failed: %s", task.TaskID, err.Error()))
+	}
+
+	concurrency := operation_setting.GetBatchSetting().NativeConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	var (
+		cancelled atomic.Bool
+		wg        sync.WaitGroup
+		sem       = make(chan struct{}, concurrency)
+	)
+	stopProgress := make(chan struct{})
+	progressDone := make(chan struct{})
+	go func() {
+		defer close(progressDone)
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopProgress:
+				return
+			case <-ticker.C:
+				if updateNativeBatchProgress(task, int(results.completed.Load()), int(results.failed.Load())) {
+					cancelled.Store(true)
+				}
+			}
+		}
+	}()
+
+	scanner := newBatchScanner(input)
+	for scanner.Scan() {
+		if cancelled.Load() {
+			break
+		}
+		var line dto.BatchInputLine
+		if err := common.Unmarshal(scanner.Bytes(), &line); err != nil {
+			continue
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results.write(executeNativeBatchLine(ctx, relayLine, token.Key, &line))
+		}()
+	}
+	wg.Wait()
+	close(stopProgress)
+	<-progressDone
+	if err := scanner.Err(); err != nil {
+		failNativeBatch(task, &batch, fmt.Sprintf("read input file failed: %s", err.Error()))
+		return
+	}
+	completed, failed := int(results.completed.Load()), int(results.failed.Load())
+	if updateNativeBatchProgress(task, completed, failed) {
+		cancelled.Store(true)
+	}
+
+	batch.Status = dto.BatchStatusFinalizing
+	batch.FinalizingAt = common.GetTimestamp()
+	batch.RequestCounts.Completed = completed
+	batch.RequestCounts.Failed = failed
+	batch.OutputFileId, err = uploadNativeBatchResult(ctx, task, fileChannel, fileKey, batch.Id+"_output.jsonl", results.output)
+	if err != nil {
+		failNativeBatch(task, &batch, fmt.Sprintf("upload output file failed: %s", err.Error()))
+		return
+	}
+	batch.ErrorFileId, err = uploadNativeBatchResult(ctx, task, fileChannel, fileKey, batch.Id+"_error.jsonl", results.errors)
+	if err != nil {
+		failNativeBatch(task, &batch, fmt.Sprintf("upload error file failed: %s", err.Error()))
+		return
+	}
+
+	now = common.GetTimestamp()
+	if cancelled.Load() {
+		batch.Status = dto.BatchStatusCancelled
+		batch.CancelledAt = now
+		task.Status = model.TaskStatusFailure
+		task.FailReason = "cancelled"
+	} else {
+		batch.Status = dto.BatchStatusCompleted
+		batch.CompletedAt = now
+		task.Status = model.TaskStatusSuccess
+	}
+	task.SetData(batch)
+	task.Progress = "100%"
+	task.FinishTime = now
+	if err := task.Update(); err != nil {
+		common.SysLog(fmt.Sprintf("native batch %s update failed: %s", task.TaskID, err.Error()))
+	}
+}
+
+// updateNativeBatchProgress 保存执行进度，返回用户是否已取消该 batch。
+// 只在任务未被并发修改时写入，读取后被取消则重新读取，不会覆盖取消状态
+func updateNativeBatchProgress(task *model.Task, completed int, failed int) bool {
+	for attempt := 0; attempt < 3; attempt++ {
+		latest, exist, err := model.GetByTaskId(task.UserId, task.TaskID)
+		if err != nil || !exist {
+			return false
+		}
+		var batch dto.OpenAIBatch
+		if err := latest.GetData(&batch); err != nil {
+			return false
+		}
+		if batch.Status == dto.BatchStatusCancelling {
+			return true
+		}
+		if latest.Status != model.TaskStatusInProgress {
+			return false
+		}
+		batch.RequestCounts.Completed = completed
+		batch.RequestCounts.Failed = failed
+		latest.SetData(batch)
+		if batch.RequestCounts.Total > 0 {
+			latest.Progress = fmt.Sprintf("%d%%", (completed+failed)*99/batch.RequestCounts.Total)
+		}
+		updated, err := latest.UpdateProgressIfUnchanged()
+		if err != nil {
+			common.SysLog(fmt.Sprintf("native batch %s update progress failed: %s", task.TaskID, err.Error()))
+			return false
+		}
+		if updated {
+			return false
+		}
+	}
+	return false
+}
+
+func executeNativeBatchLine(ctx context.Context, relayLine NativeBatchRelayFunc, tokenKey string, line *dto.BatchInputLine) ([]byte, bool) {
+	outputLine := dto.BatchOutputLine{
+		Id:       "batch_req_" + common.GetRandomString(24),
+		CustomId: line.CustomId,
+	}
+	buildResult := func(failed bool) ([]byte, bool) {
+		data, _ := common.Marshal(outputLine)
+		return data, failed
+	}
+
+	// batch 中的请求不支持流式输出
+	var body map[string]any
+	if err := common.Unmarshal(line.Body, &body); err != nil {
+		outputLine.Error = &dto.OpenAIBatchError{Code: "invalid_request", Message: "invalid request body"}
+		return buildResult(true)
+	}
+	delete(body, "stream")
+	delete(body, "stream_options")
+	requestBody, _ := common.Marshal(body)
+
+	method := strings.ToUpper(common.GetStringIfEmpty(line.Method, http.MethodPost))
+	statusCode, requestId, responseBody := relayLine(ctx, tokenKey, method, line.Url, requestBody)
+	if !json.Valid(responseBody) {
+		responseBody, _ = common.Marshal(string(responseBody))
+	}
+	outputLine.Response = &dto.BatchOutputResponse{
+		StatusCode: statusCode,
+		RequestId:  requestId,
+		Body:       responseBody,
+	}
+	return buildResult(statusCode != http.StatusOK)
+}
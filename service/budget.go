@@ -0,0 +1,181 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/bytedance/gopkg/util/gopool"
+)
+
+func budgetSubjectName(subjectType string) string {
+	if subjectType == model.BudgetSubjectToken {
+		return "令牌"
+	}
+	return "用户"
+}
+
+// loadBudgets 读取用户与令牌的预算，只返回设置了预算的对象。token 为 nil 时只读取用户预算；
+// 没有任何预算时返回空切片而不是 nil，表示已经读取过
+func loadBudgets(userId int, token *model.Token) ([]relaycommon.BudgetInfo, error) {
+	budgets := make([]relaycommon.BudgetInfo, 0)
+	user, err := model.GetUserCache(userId)
+	if err != nil {
+		return nil, err
+	}
+	if user.DailyBudget > 0 || user.MonthlyBudget > 0 {
+		budgets = append(budgets, relaycommon.BudgetInfo{
+			SubjectType: model.BudgetSubjectUser,
+			SubjectId:   userId,
+			Daily:       user.DailyBudget,
+			Monthly:     user.MonthlyBudget,
+			Window:      user.BudgetWindow,
+		})
+	}
+	if token != nil && (token.DailyBudget > 0 || token.MonthlyBudget > 0) {
+		budgets = append(budgets, relaycommon.BudgetInfo{
+			SubjectType: model.BudgetSubjectToken,
+			SubjectId:   token.Id,
+			Daily:       token.DailyBudget,
+			Monthly:     token.MonthlyBudget,
+			Window:      token.BudgetWindow,
+		})
+	}
+	return budgets, nil
+}
+
+// loadRelayBudgets 读取本次请求的用户与令牌预算并记录计入的分桶时间，已经读取过时直接返回
+func loadRelayBudgets(relayInfo *relaycommon.RelayInfo) error {
+	if relayInfo.Budgets != nil {
+		return nil
+	}
+	var token *model.Token
+	if !relayInfo.IsPlayground && relayInfo.TokenKey != "" {
+		var err error
+		token, err = model.GetTokenByKey(relayInfo.TokenKey, false)
+		if err != nil {
+			return err
+		}
+	}
+	budgets, err := loadBudgets(relayInfo.UserId, token)
+	if err != nil {
+		return err
+	}
+	relayInfo.Budgets = budgets
+	if relayInfo.BudgetSpendAt.IsZero() {
+		relayInfo.BudgetSpendAt = time.Now()
+	}
+	return nil
+}
+
+// CheckBudgets 检查本次扣费后是否会超出用户或令牌的每日、每月预算
+func CheckBudgets(relayInfo *relaycommon.RelayInfo, quota int) *types.NewAPIError {
+	if err := loadRelayBudgets(relayInfo); err != nil {
+		return types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry())
+	}
+	for _, budget := range relayInfo.Budgets {
+		usage, err := model.GetBudgetUsage(budget.SubjectType, budget.SubjectId, budget.Window)
+		if err != nil {
+			return types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry())
+		}
+		if budget.Daily > 0 && usage.Daily+quota > budget.Daily {
+			return types.NewErrorWithStatusCode(fmt.Errorf("%s每日预算不足, 已使用: %s, 每日预算: %s", budgetSubjectName(budget.SubjectType), logger.FormatQuota(usage.Daily), logger.FormatQuota(budget.Daily)),
+				types.ErrorCodeBudgetExceeded, http.StatusTooManyRequests, types.ErrOptionWithSkipRetry(), types.ErrOptionWithNoRecordErrorLog())
+		}
+		if budget.Monthly > 0 && usage.Monthly+quota > budget.Monthly {
+			return types.NewErrorWithStatusCode(fmt.Errorf("%s每月预算不足, 已使用: %s, 每月预算: %s", budgetSubjectName(budget.SubjectType), logger.FormatQuota(usage.Monthly), logger.FormatQuota(budget.Monthly)),
+				types.ErrorCodeBudgetExceeded, http.StatusTooManyRequests, types.ErrOptionWithSkipRetry(), types.ErrOptionWithNoRecordErrorLog())
+		}
+	}
+	return nil
+}
+
+// recordBudgetSpend 累加预算计数，quota 为负数时表示返还预扣费。没有检查过预算的计费路径在此读取预算
+func recordBudgetSpend(relayInfo *relaycommon.RelayInfo, quota int) {
+	if quota == 0 {
+		return
+	}
+	if err := loadRelayBudgets(relayInfo); err != nil {
+		common.SysError(fmt.Sprintf("failed to load budgets of user %d: %s", relayInfo.UserId, err.Error()))
+		return
+	}
+	increaseBudgetSpend(relayInfo.Budgets, quota, relayInfo.BudgetSpendAt)
+	if quota > 0 {
+		checkAndSendBudgetNotify(relayInfo.Budgets, quota, relayInfo.UserId, relayInfo.UserEmail, relayInfo.UserSetting)
+	}
+}
+
+// RecordBackgroundBudgetSpend 累加后台结算（batch、微调、存储）的预算计数。这些费用在结算时才确定，
+// 只能计入预算而无法提前拦截，token 为 nil 时只计入用户预算
+func RecordBackgroundBudgetSpend(userId int, token *model.Token, quota int) {
+	if quota <= 0 {
+		return
+	}
+	budgets, err := loadBudgets(userId, token)
+	if err != nil {
+		common.SysError(fmt.Sprintf("failed to load budgets of user %d: %s", userId, err.Error()))
+		return
+	}
+	if len(budgets) == 0 {
+		return
+	}
+	increaseBudgetSpend(budgets, quota, time.Now())
+	user, err := model.GetUserCache(userId)
+	if err != nil {
+		return
+	}
+	checkAndSendBudgetNotify(budgets, quota, userId, user.Email, user.GetSetting())
+}
+
+func increaseBudgetSpend(budgets []relaycommon.BudgetInfo, quota int, at time.Time) {
+	for _, budget := range budgets {
+		if err := model.IncreaseBudgetSpend(budget.SubjectType, budget.SubjectId, quota, at); err != nil {
+			common.SysError(fmt.Sprintf("failed to increase budget spend: %s %d, err=%v", budget.SubjectType, budget.SubjectId, err))
+		}
+	}
+}
+
+// checkAndSendBudgetNotify 本次消费使预算使用量越过提醒阈值时通知用户
+func checkAndSendBudgetNotify(budgets []relaycommon.BudgetInfo, quota int, userId int, userEmail string, userSetting dto.UserSetting) {
+	percent := operation_setting.GetQuotaSetting().BudgetNotifyPercent
+	if percent <= 0 || len(budgets) == 0 {
+		return
+	}
+	gopool.Go(func() {
+		for _, budget := range budgets {
+			usage, err := model.GetBudgetUsage(budget.SubjectType, budget.SubjectId, budget.Window)
+			if err != nil {
+				common.SysError(fmt.Sprintf("failed to get budget usage: %s %d, err=%v", budget.SubjectType, budget.SubjectId, err))
+				continue
+			}
+			for _, window := range []struct {
+				name   string
+				used   int
+				budget int
+			}{{"每日", usage.Daily, budget.Daily}, {"每月", usage.Monthly, budget.Monthly}} {
+				if window.budget <= 0 {
+					continue
+				}
+				threshold := window.budget * percent / 100
+				if window.used < threshold || window.used-quota >= threshold {
+					continue
+				}
+				prompt := fmt.Sprintf("您的%s%s预算已使用 %d%%", budgetSubjectName(budget.SubjectType), window.name, window.used*100/window.budget)
+				content := "{{value}}，已使用 {{value}}，预算 {{value}}"
+				values := []interface{}{prompt, logger.FormatQuota(window.used), logger.FormatQuota(window.budget)}
+				err := NotifyUser(userId, userEmail, userSetting, dto.NewNotify(dto.NotifyTypeBudgetWarning, prompt, content, values))
+				if err != nil {
+					common.SysError(fmt.Sprintf("failed to send budget notify to user %d: %s", userId, err.Error()))
+				}
+			}
+		}
+	})
+}
@@ -9,6 +9,8 @@ import (
 	"time"
 
 	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/model"
 	"github.com/QuantumNous/new-api/pkg/cachex"
 	"github.com/QuantumNous/new-api/setting/operation_setting"
 	"github.com/gin-gonic/gin"
@@ -21,6 +23,7 @@ const (
 	ginKeyChannelAffinityTTLSeconds = "channel_affinity_ttl_seconds"
 	ginKeyChannelAffinityMeta       = "channel_affinity_meta"
 	ginKeyChannelAffinityLogInfo    = "channel_affinity_log_info"
+	ginKeyChannelAffinityPreferred  = "channel_affinity_preferred"
 
 	channelAffinityCacheNamespace = "new-api:channel_affinity:v1"
 )
@@ -30,6 +33,9 @@ var (
 	channelAffinityCache     *cachex.HybridCache[int]
 
 	channelAffinityRegexCache sync.Map // map[string]*regexp.Regexp
+
+	channelAffinityUsageLock  sync.Mutex
+	channelAffinityUsageStats = make(map[string]*ChannelAffinityUsageStats)
 )
 
 type channelAffinityMeta struct {
@@ -46,12 +52,30 @@ type channelAffinityMeta struct {
 }
 
 type ChannelAffinityCacheStats struct {
-	Enabled       bool           `json:"enabled"`
-	Total         int            `json:"total"`
-	Unknown       int            `json:"unknown"`
-	ByRuleName    map[string]int `json:"by_rule_name"`
-	CacheCapacity int            `json:"cache_capacity"`
-	CacheAlgo     string         `json:"cache_algo"`
+	Enabled       bool                                 `json:"enabled"`
+	Total         int                                  `json:"total"`
+	Unknown       int                                  `json:"unknown"`
+	ByRuleName    map[string]int                       `json:"by_rule_name"`
+	CacheCapacity int                                  `json:"cache_capacity"`
+	CacheAlgo     string                               `json:"cache_algo"`
+	UsageByRule   map[string]ChannelAffinityUsageStats `json:"usage_by_rule"`
+}
+
+// ChannelAffinityUsageStats 规则匹配的请求的输入与上游提示缓存命中情况，用于判断亲和是否带来了缓存收益，
+// 统计保存在本实例内存中，重启后清零
+type ChannelAffinityUsageStats struct {
+	Requests        int64 `json:"requests"`          // 匹配规则的请求数
+	AffinityHits    int64 `json:"affinity_hits"`     // 使用了亲和渠道的请求数
+	PromptTokens    int64 `json:"prompt_tokens"`     // 输入 token 数，包含缓存读写
+	CacheTokens     int64 `json:"cache_tokens"`      // 命中上游提示缓存的 token 数
+	HitPromptTokens int64 `json:"hit_prompt_tokens"` // 使用了亲和渠道的请求的输入 token 数
+	HitCacheTokens  int64 `json:"hit_cache_tokens"`  // 使用了亲和渠道的请求命中缓存的 token 数
+}
+
+// channelAffinityPreferred 缓存中记录的亲和渠道与 key 序号，key 序号为 -1 表示未记录
+type channelAffinityPreferred struct {
+	ChannelID int
+	KeyIndex  int
 }
 
 func getChannelAffinityCache() *cachex.HybridCache[int] {
@@ -158,6 +182,45 @@ func GetChannelAffinityCacheStats() ChannelAffinityCacheStats {
 		ByRuleName:    byRuleName,
 		CacheCapacity: mainCap,
 		CacheAlgo:     mainAlgo,
+		UsageByRule:   getChannelAffinityUsageStats(),
+	}
+}
+
+func getChannelAffinityUsageStats() map[string]ChannelAffinityUsageStats {
+	channelAffinityUsageLock.Lock()
+	defer channelAffinityUsageLock.Unlock()
+	usage := make(map[string]ChannelAffinityUsageStats, len(channelAffinityUsageStats))
+	for name, stats := range channelAffinityUsageStats {
+		usage[name] = *stats
+	}
+	return usage
+}
+
+// RecordChannelAffinityUsage 按规则累计请求的输入 token 与命中上游提示缓存的 token，promptTokens 需包含缓存读写
+func RecordChannelAffinityUsage(c *gin.Context, promptTokens int, cacheTokens int) {
+	if c == nil || promptTokens <= 0 {
+		return
+	}
+	meta, ok := getChannelAffinityMeta(c)
+	if !ok || meta.RuleName == "" {
+		return
+	}
+	_, hit := c.Get(ginKeyChannelAffinityLogInfo)
+
+	channelAffinityUsageLock.Lock()
+	defer channelAffinityUsageLock.Unlock()
+	stats, ok := channelAffinityUsageStats[meta.RuleName]
+	if !ok {
+		stats = &ChannelAffinityUsageStats{}
+		channelAffinityUsageStats[meta.RuleName] = stats
+	}
+	stats.Requests++
+	stats.PromptTokens += int64(promptTokens)
+	stats.CacheTokens += int64(cacheTokens)
+	if hit {
+		stats.AffinityHits++
+		stats.HitPromptTokens += int64(promptTokens)
+		stats.HitCacheTokens += int64(cacheTokens)
 	}
 }
 
@@ -252,7 +315,7 @@ func matchAnyIncludeFold(patterns []string, s string) bool {
 	return false
 }
 
-func extractChannelAffinityValue(c *gin.Context, src operation_setting.ChannelAffinityKeySource) string {
+func extractChannelAffinityValue(c *gin.Context, src operation_setting.ChannelAffinityKeySource, modelName string) string {
 	switch src.Type {
 	case "context_int":
 		if src.Key == "" {
@@ -286,6 +349,8 @@ func extractChannelAffinityValue(c *gin.Context, src operation_setting.ChannelAf
 		default:
 			return strings.TrimSpace(res.Raw)
 		}
+	case channelAffinityKeySourcePromptPrefixHash:
+		return extractPromptPrefixHash(c, modelName, src.PrefixMessages)
 	default:
 		return ""
 	}
@@ -376,7 +441,7 @@ func GetPreferredChannelByAffinity(c *gin.Context, modelName string, usingGroup
 		var affinityValue string
 		var usedSource operation_setting.ChannelAffinityKeySource
 		for _, src := range rule.KeySources {
-			affinityValue = extractChannelAffinityValue(c, src)
+			affinityValue = extractChannelAffinityValue(c, src, modelName)
 			if affinityValue != "" {
 				usedSource = src
 				break
@@ -409,12 +474,14 @@ func GetPreferredChannelByAffinity(c *gin.Context, modelName string, usingGroup
 		})
 
 		cache := getChannelAffinityCache()
-		channelID, found, err := cache.Get(cacheKeySuffix)
+		value, found, err := cache.Get(cacheKeySuffix)
 		if err != nil {
 			common.SysError(fmt.Sprintf("channel affinity cache get failed: key=%s, err=%v", cacheKeyFull, err))
 			return 0, false
 		}
 		if found {
+			channelID, keyIndex := decodeChannelAffinityValue(value)
+			c.Set(ginKeyChannelAffinityPreferred, channelAffinityPreferred{ChannelID: channelID, KeyIndex: keyIndex})
 			return channelID, true
 		}
 		return 0, false
@@ -422,6 +489,39 @@ func GetPreferredChannelByAffinity(c *gin.Context, modelName string, usingGroup
 	return 0, false
 }
 
+// 缓存值的低 32 位为渠道 ID，高位为多 key 渠道的 key 序号 + 1；旧版本写入的值只有渠道 ID
+func encodeChannelAffinityValue(channelID int, keyIndex int) int {
+	if keyIndex < 0 {
+		return channelID
+	}
+	return int(int64(keyIndex+1)<<32 | int64(channelID))
+}
+
+func decodeChannelAffinityValue(value int) (channelID int, keyIndex int) {
+	v := int64(value)
+	return int(v & 0xFFFFFFFF), int(v>>32) - 1
+}
+
+// GetChannelAffinityKeyIndex 本次请求使用了亲和渠道且缓存中记录的 key 仍可用时返回其序号，
+// 多 key 渠道继续使用同一个 key，上游按 key（账号）隔离的提示缓存才能命中
+func GetChannelAffinityKeyIndex(c *gin.Context, channel *model.Channel) (int, bool) {
+	if c == nil || channel == nil {
+		return 0, false
+	}
+	if _, used := c.Get(ginKeyChannelAffinityLogInfo); !used {
+		return 0, false
+	}
+	anyPreferred, ok := c.Get(ginKeyChannelAffinityPreferred)
+	if !ok {
+		return 0, false
+	}
+	preferred, ok := anyPreferred.(channelAffinityPreferred)
+	if !ok || preferred.ChannelID != channel.Id || preferred.KeyIndex < 0 || !channel.IsKeyUsable(preferred.KeyIndex) {
+		return 0, false
+	}
+	return preferred.KeyIndex, true
+}
+
 func MarkChannelAffinityUsed(c *gin.Context, selectedGroup string, channelID int) {
 	if c == nil || channelID <= 0 {
 		return
@@ -470,6 +570,11 @@ func RecordChannelAffinity(c *gin.Context, channelID int) {
 			channelID = successChannelID
 		}
 	}
+	// 上下文中的 key 序号属于最终成功的渠道
+	keyIndex := -1
+	if c != nil && channelID == c.GetInt("channel_id") && common.GetContextKeyBool(c, constant.ContextKeyChannelIsMultiKey) {
+		keyIndex = common.GetContextKeyInt(c, constant.ContextKeyChannelMultiKeyIndex)
+	}
 	cacheKey, ttlSeconds, ok := getChannelAffinityContext(c)
 	if !ok {
 		return
@@ -481,7 +586,7 @@ func RecordChannelAffinity(c *gin.Context, channelID int) {
 		ttlSeconds = 3600
 	}
 	cache := getChannelAffinityCache()
-	if err := cache.SetWithTTL(cacheKey, channelID, time.Duration(ttlSeconds)*time.Second); err != nil {
+	if err := cache.SetWithTTL(cacheKey, encodeChannelAffinityValue(channelID, keyIndex), time.Duration(ttlSeconds)*time.Second); err != nil {
 		common.SysError(fmt.Sprintf("channel affinity cache set failed: key=%s, err=%v", cacheKey, err))
 	}
 }
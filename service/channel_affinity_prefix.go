@@ -0,0 +1,59 @@
+package service
+
+import (
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+const channelAffinityKeySourcePromptPrefixHash = "prompt_prefix_hash"
+
+var (
+	// 请求中属于稳定前缀的系统提示与工具字段，覆盖 OpenAI Chat / Responses、Claude 与 Gemini 格式
+	promptPrefixStableFields = []string{"system", "instructions", "systemInstruction", "system_instruction", "tools"}
+	// 按顺序排列的消息字段，取第一个存在的数组
+	promptPrefixMessageFields = []string{"messages", "contents", "input"}
+)
+
+// extractPromptPrefixHash 对请求的稳定前缀（模型、系统提示、工具与前 prefixMessages 条消息）取哈希，
+// 前缀相同的请求路由到同一渠道与 key，上游的提示缓存才能命中。
+// 消息开头的 system / developer 消息视为系统提示，不计入 prefixMessages
+func extractPromptPrefixHash(c *gin.Context, modelName string, prefixMessages int) string {
+	body, err := common.GetRequestBody(c)
+	if err != nil || len(body) == 0 || !gjson.ValidBytes(body) {
+		return ""
+	}
+	parts := make([]string, 0, len(promptPrefixStableFields)+1)
+	for _, field := range promptPrefixStableFields {
+		if res := gjson.GetBytes(body, field); res.Exists() {
+			parts = append(parts, field+"="+res.Raw)
+		}
+	}
+	for _, field := range promptPrefixMessageFields {
+		res := gjson.GetBytes(body, field)
+		if !res.IsArray() {
+			continue
+		}
+		counted := 0
+		res.ForEach(func(_, message gjson.Result) bool {
+			role := message.Get("role").String()
+			if counted == 0 && (role == "system" || role == "developer") {
+				parts = append(parts, field+"="+message.Raw)
+				return true
+			}
+			if counted >= prefixMessages {
+				return false
+			}
+			parts = append(parts, field+"="+message.Raw)
+			counted++
+			return true
+		})
+		break
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return common.Sha1([]byte(modelName + "\n" + strings.Join(parts, "\n")))
+}
@@ -0,0 +1,33 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryParamRestartRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		retry     int
+		resetNext bool
+	}{
+		{name: "retries exhausted", retry: 3},
+		{name: "auto group switch pending", retry: 0, resetNext: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			param := &RetryParam{}
+			param.SetRetry(tt.retry)
+			if tt.resetNext {
+				param.ResetRetryNextTry()
+			}
+			param.RestartRetry()
+			// 循环在切换后执行一次 IncreaseRetry
+			param.IncreaseRetry()
+			require.Equal(t, 0, param.GetRetry())
+			param.IncreaseRetry()
+			require.Equal(t, 1, param.GetRetry())
+		})
+	}
+}
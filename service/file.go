@@ -0,0 +1,133 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/types"
+)
+
+// GetFileChannelAndKey 返回文件所在渠道以及上传时使用的 key，渠道被禁用时仍然可以访问已上传的文件
+func GetFileChannelAndKey(file *model.File) (*model.Channel, string, *types.NewAPIError) {
+	channel, err := model.GetChannelById(file.ChannelId, true)
+	if err != nil {
+		return nil, "", types.NewError(fmt.Errorf("channel #%d of file %s not found", file.ChannelId, file.FileId), types.ErrorCodeGetChannelFailed, types.ErrOptionWithSkipRetry())
+	}
+	if file.PrivateData.Key != "" {
+		return channel, file.PrivateData.Key, nil
+	}
+	key, _, newAPIError := channel.GetNextEnabledKey()
+	if newAPIError != nil {
+		return nil, "", newAPIError
+	}
+	return channel, key, nil
+}
+
+// RegisterUpstreamFile 将上游生成的文件（如 batch 输出文件）登记到文件映射表，使用户可以通过 /v1/files 访问
+func RegisterUpstreamFile(ctx context.Context, channel *model.Channel, key string, fileId string, userId int, tokenId int, group string) (*model.File, error) {
+	if fileId == "" {
+		return nil, nil
+	}
+	file, exist, err := model.GetFileByFileId(fileId)
+	if err != nil {
+		return nil, err
+	}
+	if exist {
+		return file, nil
+	}
+	resp, err := DoPlatformRequest(ctx, channel, key, http.MethodGet, "/v1/files/"+fileId, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	responseBody, err := io.ReadAll(resp.Body)
+	CloseResponseBodyGracefully(resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("retrieve file %s failed, status code %d: %s", fileId, resp.StatusCode, string(responseBody))
+	}
+	var fileResponse dto.OpenAIFile
+	if err := common.Unmarshal(responseBody, &fileResponse); err != nil {
+		return nil, err
+	}
+	file = newUpstreamFileRecord(channel, key, &fileResponse, userId, tokenId, group)
+	if err := file.Insert(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// UploadFileToChannel 以 multipart 形式向渠道上传文件，并登记到文件映射表
+func UploadFileToChannel(ctx context.Context, channel *model.Channel, key string, filename string, purpose string, content io.Reader, size int64, userId int, tokenId int, group string) (*model.File, error) {
+	// 边读边写入 multipart 请求体，不在内存中保存整个文件
+	bodyReader, bodyWriter := io.Pipe()
+	writer := multipart.NewWriter(bodyWriter)
+	go func() {
+		writer.WriteField("purpose", purpose)
+		part, err := writer.CreateFormFile("file", filename)
+		if err == nil {
+			_, err = io.Copy(part, content)
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		bodyWriter.CloseWithError(err)
+	}()
+	resp, err := DoPlatformRequest(ctx, channel, key, http.MethodPost, "/v1/files", bodyReader, writer.FormDataContentType())
+	bodyReader.Close()
+	if err != nil {
+		return nil, err
+	}
+	responseBody, err := io.ReadAll(resp.Body)
+	CloseResponseBodyGracefully(resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upload file failed, status code %d: %s", resp.StatusCode, string(responseBody))
+	}
+	var fileResponse dto.OpenAIFile
+	if err := common.Unmarshal(responseBody, &fileResponse); err != nil || fileResponse.Id == "" {
+		return nil, fmt.Errorf("invalid file response: %s", string(responseBody))
+	}
+	if fileResponse.Bytes == 0 {
+		fileResponse.Bytes = size
+	}
+	file := newUpstreamFileRecord(channel, key, &fileResponse, userId, tokenId, group)
+	if err := file.Insert(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func newUpstreamFileRecord(channel *model.Channel, key string, fileResponse *dto.OpenAIFile, userId int, tokenId int, group string) *model.File {
+	now := common.GetTimestamp()
+	file := &model.File{
+		FileId:    fileResponse.Id,
+		UserId:    userId,
+		TokenId:   tokenId,
+		ChannelId: channel.Id,
+		Group:     group,
+		Purpose:   fileResponse.Purpose,
+		Filename:  fileResponse.Filename,
+		Bytes:     fileResponse.Bytes,
+		Status:    model.FileStatusActive,
+		CreatedAt: fileResponse.CreatedAt,
+		ExpiresAt: fileResponse.ExpiresAt,
+		BilledAt:  now,
+	}
+	if file.CreatedAt == 0 {
+		file.CreatedAt = now
+	}
+	if channel.ChannelInfo.IsMultiKey {
+		file.PrivateData.Key = key
+	}
+	return file
+}
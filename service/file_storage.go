@@ -0,0 +1,108 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/setting/ratio_setting"
+)
+
+const fileStorageBillingBatchSize = 500
+
+// getFileStorageChannel 渠道被禁用后文件仍然存在于上游，因此需要回退到数据库查询
+func getFileStorageChannel(channelId int) (*model.Channel, error) {
+	channel, err := model.CacheGetChannel(channelId)
+	if err == nil {
+		return channel, nil
+	}
+	return model.GetChannelById(channelId, true)
+}
+
+// CalcFileStorageQuota 计算文件在 [from, until) 区间内的存储费用，price 单位为 美元 / GB / 天
+func CalcFileStorageQuota(bytes int64, from int64, until int64, price float64, groupRatio float64) int {
+	return calcStorageQuota(bytes, 1<<30, from, until, 86400, price, groupRatio)
+}
+
+// SettleFileStorage 结算文件自上次结算以来的存储费用，返回本次扣除的额度。
+// force 为 false 时，不足 1 额度的区间会累积到下次结算，避免小文件永远不计费
+func SettleFileStorage(file *model.File, until int64, force bool) (int, error) {
+	if until <= file.BilledAt {
+		return 0, nil
+	}
+	channel, err := getFileStorageChannel(file.ChannelId)
+	if err != nil {
+		return 0, err
+	}
+	price := channel.GetOtherSettings().FileStoragePrice
+	quota := CalcFileStorageQuota(file.Bytes, file.BilledAt, until, price, ratio_setting.GetGroupRatio(file.Group))
+	if price > 0 && quota <= 0 && !force {
+		return 0, nil
+	}
+	ok, err := model.UpdateFileBilling(file.Id, file.BilledAt, until, quota)
+	if err != nil || !ok {
+		// 已被其他节点或请求结算
+		return 0, err
+	}
+	file.BilledAt = until
+	file.Quota += quota
+	if quota <= 0 {
+		return 0, nil
+	}
+	if err := chargeStorageQuota(file.UserId, file.TokenId, file.ChannelId, quota, file.FileId); err != nil {
+		return 0, err
+	}
+	return quota, nil
+}
+
+// SettleAllFileStorage 结算所有未删除文件的存储费用，同一用户合并记录一条消费日志
+func SettleAllFileStorage() {
+	now := common.GetTimestamp()
+	bills := make(storageBills)
+	lastId := 0
+	for {
+		files, err := model.GetActiveFilesAfterId(lastId, fileStorageBillingBatchSize)
+		if err != nil {
+			common.SysLog(fmt.Sprintf("failed to get files for storage billing: %s", err.Error()))
+			break
+		}
+		if len(files) == 0 {
+			break
+		}
+		for _, file := range files {
+			lastId = file.Id
+			until := now
+			expired := file.ExpiresAt > 0 && file.ExpiresAt <= now
+			if expired {
+				until = file.ExpiresAt
+			}
+			quota, err := SettleFileStorage(file, until, expired)
+			if err != nil {
+				common.SysLog(fmt.Sprintf("failed to settle storage of file %s: %s", file.FileId, err.Error()))
+				continue
+			}
+			if expired {
+				// 上游已自动删除过期文件
+				if err := model.MarkFileDeleted(file.Id); err != nil {
+					common.SysLog(fmt.Sprintf("failed to mark expired file %s deleted: %s", file.FileId, err.Error()))
+				}
+			}
+			if quota <= 0 {
+				continue
+			}
+			bills.add(file.UserId, file.ChannelId, file.TokenId, file.Group, quota, file.Bytes)
+		}
+		if len(files) < fileStorageBillingBatchSize {
+			break
+		}
+	}
+	bills.record("file-storage", func(bill *storageBill) (string, map[string]interface{}) {
+		return fmt.Sprintf("文件存储费用：%d 个文件，共 %.2f MB，扣除 %s", bill.count, float64(bill.size)/(1<<20), logger.LogQuota(bill.quota)),
+			map[string]interface{}{
+				"file_storage": true,
+				"files":        bill.count,
+				"bytes":        bill.size,
+			}
+	})
+}
@@ -0,0 +1,191 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/pkg/cachex"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+	"github.com/QuantumNous/new-api/setting/ratio_setting"
+
+	"github.com/gin-gonic/gin"
+	"github.com/samber/hot"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	fineTunedModelCacheNamespace = "new-api:fine_tuned_model:v1"
+
+	fineTunedModelCacheTTL = 10 * time.Minute
+	// 不是由网关训练的模型缓存时间较短，其他节点刚登记的微调模型能尽快生效
+	fineTunedModelMissingCacheTTL = time.Minute
+)
+
+var (
+	fineTunedModelCacheOnce sync.Once
+	fineTunedModelCache     *cachex.HybridCache[fineTunedModelOwner]
+)
+
+// fineTunedModelOwner 微调模型的归属，Exist 为 false 表示模型不是由网关训练产生的
+type fineTunedModelOwner struct {
+	Exist  bool   `json:"exist"`
+	UserId int    `json:"user_id"`
+	Group  string `json:"group"`
+}
+
+func getFineTunedModelCache() *cachex.HybridCache[fineTunedModelOwner] {
+	fineTunedModelCacheOnce.Do(func() {
+		fineTunedModelCache = cachex.NewHybridCache[fineTunedModelOwner](cachex.HybridCacheConfig[fineTunedModelOwner]{
+			Namespace: cachex.Namespace(fineTunedModelCacheNamespace),
+			Redis:     common.RDB,
+			RedisEnabled: func() bool {
+				return common.RedisEnabled && common.RDB != nil
+			},
+			RedisCodec: cachex.JSONCodec[fineTunedModelOwner]{},
+			Memory: func() *hot.HotCache[string, fineTunedModelOwner] {
+				return hot.NewHotCache[string, fineTunedModelOwner](hot.LRU, 10_000).
+					WithTTL(fineTunedModelCacheTTL).
+					WithJanitor().
+					Build()
+			},
+		})
+	})
+	return fineTunedModelCache
+}
+
+// getFineTunedModelOwner 与渠道、令牌一样先查缓存，每个请求都会经过 Distribute，不能每次查询数据库
+func getFineTunedModelOwner(modelName string) (fineTunedModelOwner, error) {
+	cache := getFineTunedModelCache()
+	if owner, found, err := cache.Get(modelName); err == nil && found {
+		return owner, nil
+	}
+	fineTunedModel, exist, err := model.GetFineTunedModel(modelName)
+	if err != nil {
+		return fineTunedModelOwner{}, err
+	}
+	owner := fineTunedModelOwner{Exist: exist}
+	ttl := fineTunedModelMissingCacheTTL
+	if exist {
+		owner.UserId = fineTunedModel.UserId
+		owner.Group = fineTunedModel.Group
+		ttl = fineTunedModelCacheTTL
+	}
+	_ = cache.SetWithTTL(modelName, owner, ttl)
+	return owner, nil
+}
+
+// CalcFineTuningQuota 训练费用 = 训练 token 数 × 基础模型倍率 × 训练倍率 × 分组倍率
+func CalcFineTuningQuota(baseModel string, trainedTokens int, group string) (int, float64) {
+	if trainedTokens <= 0 {
+		return 0, 0
+	}
+	modelRatio, _, _ := ratio_setting.GetModelRatio(resolveBatchBillingModel(baseModel))
+	quota := decimal.NewFromInt(int64(trainedTokens)).
+		Mul(decimal.NewFromFloat(modelRatio)).
+		Mul(decimal.NewFromFloat(operation_setting.GetFineTuningSetting().TrainingRatio)).
+		Mul(decimal.NewFromFloat(ratio_setting.GetGroupRatio(group)))
+	return int(quota.IntPart()), modelRatio
+}
+
+// SettleFineTuningQuota 按训练 token 数扣费。调用方须先以 UpdateWithStatus 保存结束状态，保存成功后才能调用，
+// 否则重复轮询会重复扣费
+func SettleFineTuningQuota(task *model.Task, job *dto.FineTuningJob) {
+	quota, modelRatio := CalcFineTuningQuota(job.Model, job.TrainedTokens, task.Group)
+	if quota <= 0 {
+		return
+	}
+	ledgerRef := model.QuotaLedgerRef{Source: model.QuotaLedgerSourceConsume, RefId: job.Id}
+	if err := model.DecreaseUserQuota(task.UserId, quota, ledgerRef); err != nil {
+		common.SysLog(fmt.Sprintf("fine-tuning job %s decrease user quota failed: %s", job.Id, err.Error()))
+		return
+	}
+	token := getBillingToken(task.PrivateData.TokenId)
+	if token != nil && !token.UnlimitedQuota {
+		if err := model.DecreaseTokenQuota(token.Id, token.Key, quota, ledgerRef); err != nil {
+			common.SysLog(fmt.Sprintf("fine-tuning job %s decrease token quota failed: %s", job.Id, err.Error()))
+		}
+	}
+	RecordBackgroundBudgetSpend(task.UserId, token, quota)
+	model.UpdateUserUsedQuotaAndRequestCount(task.UserId, quota, ledgerRef)
+	model.UpdateChannelUsedQuota(task.ChannelId, quota)
+	model.RecordBackgroundConsumeLog(task.UserId, model.RecordConsumeLogParams{
+		ChannelId:    task.ChannelId,
+		TokenId:      task.PrivateData.TokenId,
+		ModelName:    job.Model,
+		PromptTokens: job.TrainedTokens,
+		Quota:        quota,
+		Group:        task.Group,
+		Content:      fmt.Sprintf("微调任务 %s 结算：训练 %d tokens，扣除 %s", job.Id, job.TrainedTokens, logger.LogQuota(quota)),
+		Other: map[string]interface{}{
+			"fine_tuning_job_id": job.Id,
+			"fine_tuned_model":   job.FineTunedModel,
+			"model_ratio":        modelRatio,
+			"training_ratio":     operation_setting.GetFineTuningSetting().TrainingRatio,
+			"group_ratio":        ratio_setting.GetGroupRatio(task.Group),
+		},
+	})
+}
+
+// RegisterFineTunedModel 记录微调模型的归属，并把模型加入训练所用渠道的模型列表
+func RegisterFineTunedModel(task *model.Task, job *dto.FineTuningJob) error {
+	if job.FineTunedModel == "" {
+		return nil
+	}
+	userGroup, err := model.GetUserGroup(task.UserId, false)
+	if err != nil {
+		return err
+	}
+	fineTunedModel := &model.FineTunedModel{
+		ModelName: job.FineTunedModel,
+		BaseModel: job.Model,
+		UserId:    task.UserId,
+		Group:     userGroup,
+		ChannelId: task.ChannelId,
+		JobId:     job.Id,
+		CreatedAt: common.GetTimestamp(),
+	}
+	if err := fineTunedModel.Insert(); err != nil {
+		return err
+	}
+	_ = getFineTunedModelCache().SetWithTTL(job.FineTunedModel, fineTunedModelOwner{
+		Exist:  true,
+		UserId: fineTunedModel.UserId,
+		Group:  fineTunedModel.Group,
+	}, fineTunedModelCacheTTL)
+	channel, err := model.GetChannelById(task.ChannelId, true)
+	if err != nil {
+		return err
+	}
+	if err := channel.AppendModel(job.FineTunedModel); err != nil {
+		return err
+	}
+	model.InitChannelCache()
+	return nil
+}
+
+// CanUseFineTunedModel 微调模型只允许训练它的用户使用，开启分组共享后同分组用户也可使用。
+// 不是由网关训练产生的微调模型不做限制
+func CanUseFineTunedModel(c *gin.Context, modelName string) bool {
+	if !model.IsFineTunedModelName(modelName) {
+		return true
+	}
+	owner, err := getFineTunedModelOwner(modelName)
+	if err != nil {
+		logger.LogError(c, fmt.Sprintf("get fine-tuned model %s failed: %s", modelName, err.Error()))
+		return false
+	}
+	if !owner.Exist {
+		return true
+	}
+	if owner.UserId == common.GetContextKeyInt(c, constant.ContextKeyUserId) {
+		return true
+	}
+	return operation_setting.GetFineTuningSetting().ShareWithGroup &&
+		owner.Group == common.GetContextKeyString(c, constant.ContextKeyUserGroup)
+}
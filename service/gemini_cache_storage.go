@@ -0,0 +1,95 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+	"github.com/QuantumNous/new-api/setting/ratio_setting"
+)
+
+const geminiCacheStorageBillingBatchSize = 500
+
+// CalcGeminiCacheStorageQuota 计算缓存在 [from, until) 区间内的存储费用，price 单位为 美元 / 百万 token / 小时
+func CalcGeminiCacheStorageQuota(tokens int, from int64, until int64, price float64, groupRatio float64) int {
+	return calcStorageQuota(int64(tokens), 1_000_000, from, until, 3600, price, groupRatio)
+}
+
+// SettleGeminiCacheStorage 结算缓存自上次结算以来的存储费用，返回本次扣除的额度。
+// force 为 false 时，不足 1 额度的区间会累积到下次结算
+func SettleGeminiCacheStorage(cachedContent *model.GeminiCachedContent, until int64, force bool) (int, error) {
+	if cachedContent.ExpiresAt > 0 && until > cachedContent.ExpiresAt {
+		until = cachedContent.ExpiresAt
+	}
+	if until <= cachedContent.BilledAt {
+		return 0, nil
+	}
+	price := operation_setting.GetGeminiCacheStoragePrice(cachedContent.Model)
+	quota := CalcGeminiCacheStorageQuota(cachedContent.TotalTokens, cachedContent.BilledAt, until, price, ratio_setting.GetGroupRatio(cachedContent.Group))
+	if price > 0 && quota <= 0 && !force {
+		return 0, nil
+	}
+	ok, err := model.UpdateGeminiCachedContentBilling(cachedContent.Id, cachedContent.BilledAt, until, quota)
+	if err != nil || !ok {
+		// 已被其他节点或请求结算
+		return 0, err
+	}
+	cachedContent.BilledAt = until
+	cachedContent.Quota += quota
+	if quota <= 0 {
+		return 0, nil
+	}
+	if err := chargeStorageQuota(cachedContent.UserId, cachedContent.TokenId, cachedContent.ChannelId, quota, cachedContent.Name); err != nil {
+		return 0, err
+	}
+	return quota, nil
+}
+
+// SettleAllGeminiCacheStorage 结算所有未删除缓存的存储费用，同一用户合并记录一条消费日志，已过期的缓存结算到过期时间后标记删除
+func SettleAllGeminiCacheStorage() {
+	now := common.GetTimestamp()
+	bills := make(storageBills)
+	lastId := 0
+	for {
+		cachedContents, err := model.GetActiveGeminiCachedContentsAfterId(lastId, geminiCacheStorageBillingBatchSize)
+		if err != nil {
+			common.SysLog(fmt.Sprintf("failed to get gemini cached contents for storage billing: %s", err.Error()))
+			break
+		}
+		if len(cachedContents) == 0 {
+			break
+		}
+		for _, cachedContent := range cachedContents {
+			lastId = cachedContent.Id
+			expired := cachedContent.ExpiresAt > 0 && cachedContent.ExpiresAt <= now
+			quota, err := SettleGeminiCacheStorage(cachedContent, now, expired)
+			if err != nil {
+				common.SysLog(fmt.Sprintf("failed to settle storage of gemini cached content %s: %s", cachedContent.Name, err.Error()))
+				continue
+			}
+			if expired {
+				// 上游已自动删除过期缓存
+				if err := model.MarkGeminiCachedContentDeleted(cachedContent.Id); err != nil {
+					common.SysLog(fmt.Sprintf("failed to mark expired gemini cached content %s deleted: %s", cachedContent.Name, err.Error()))
+				}
+			}
+			if quota <= 0 {
+				continue
+			}
+			bills.add(cachedContent.UserId, cachedContent.ChannelId, cachedContent.TokenId, cachedContent.Group, quota, int64(cachedContent.TotalTokens))
+		}
+		if len(cachedContents) < geminiCacheStorageBillingBatchSize {
+			break
+		}
+	}
+	bills.record("gemini-cache-storage", func(bill *storageBill) (string, map[string]interface{}) {
+		return fmt.Sprintf("Gemini 上下文缓存存储费用：%d 个缓存，共 %d tokens，扣除 %s", bill.count, bill.size, logger.LogQuota(bill.quota)),
+			map[string]interface{}{
+				"gemini_cache_storage": true,
+				"caches":               bill.count,
+				"tokens":               bill.size,
+			}
+	})
+}
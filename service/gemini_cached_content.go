@@ -0,0 +1,182 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/pkg/cachex"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/samber/hot"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	geminiCachedContentCacheNamespace = "new-api:gemini_cached_content:v1"
+
+	// Gemini 未指定 ttl 与 expireTime 时缓存默认保留 1 小时
+	geminiCachedContentDefaultTTL = time.Hour
+)
+
+var (
+	geminiCachedContentCacheOnce sync.Once
+	geminiCachedContentCache     *cachex.HybridCache[GeminiCachedContentRoute]
+)
+
+// GeminiCachedContentRoute 缓存名称到渠道的映射，与渠道亲和性一样保存在 Redis 或内存中，过期时间与缓存一致
+type GeminiCachedContentRoute struct {
+	UserId    int    `json:"user_id"`
+	ChannelId int    `json:"channel_id"`
+	KeyIndex  int    `json:"key_index"`
+	Group     string `json:"group"`
+}
+
+func getGeminiCachedContentCache() *cachex.HybridCache[GeminiCachedContentRoute] {
+	geminiCachedContentCacheOnce.Do(func() {
+		geminiCachedContentCache = cachex.NewHybridCache[GeminiCachedContentRoute](cachex.HybridCacheConfig[GeminiCachedContentRoute]{
+			Namespace: cachex.Namespace(geminiCachedContentCacheNamespace),
+			Redis:     common.RDB,
+			RedisEnabled: func() bool {
+				return common.RedisEnabled && common.RDB != nil
+			},
+			RedisCodec: cachex.JSONCodec[GeminiCachedContentRoute]{},
+			Memory: func() *hot.HotCache[string, GeminiCachedContentRoute] {
+				return hot.NewHotCache[string, GeminiCachedContentRoute](hot.LRU, 100_000).
+					WithTTL(geminiCachedContentDefaultTTL).
+					WithJanitor().
+					Build()
+			},
+		})
+	})
+	return geminiCachedContentCache
+}
+
+// IsGeminiCachedContentSupported 仅 Gemini 渠道支持 cachedContents 接口，Vertex AI 的缓存接口路径不同
+func IsGeminiCachedContentSupported(channelType int) bool {
+	return channelType == constant.ChannelTypeGemini
+}
+
+// GetGeminiCachedContentName 读取请求中引用的缓存名称，countTokens 请求位于 generateContentRequest 中
+func GetGeminiCachedContentName(c *gin.Context) string {
+	body, err := common.GetRequestBody(c)
+	if err != nil || len(body) == 0 {
+		return ""
+	}
+	result := gjson.GetManyBytes(body, "cachedContent", "generateContentRequest.cachedContent")
+	for _, r := range result {
+		if name := strings.TrimSpace(r.String()); name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+func SetGeminiCachedContentRoute(cachedContent *model.GeminiCachedContent) {
+	ttl := time.Duration(cachedContent.ExpiresAt-common.GetTimestamp()) * time.Second
+	if ttl <= 0 {
+		return
+	}
+	route := GeminiCachedContentRoute{
+		UserId:    cachedContent.UserId,
+		ChannelId: cachedContent.ChannelId,
+		KeyIndex:  cachedContent.KeyIndex,
+		Group:     cachedContent.Group,
+	}
+	if err := getGeminiCachedContentCache().SetWithTTL(cachedContent.Name, route, ttl); err != nil {
+		common.SysError(fmt.Sprintf("gemini cached content route set failed: name=%s, err=%v", cachedContent.Name, err))
+	}
+}
+
+// GetGeminiCachedContentRoute 优先查询映射缓存，未命中时回退到数据库（如重启后的内存缓存）
+func GetGeminiCachedContentRoute(name string) (GeminiCachedContentRoute, bool) {
+	route, found, err := getGeminiCachedContentCache().Get(name)
+	if err != nil {
+		common.SysError(fmt.Sprintf("gemini cached content route get failed: name=%s, err=%v", name, err))
+	}
+	if found {
+		return route, true
+	}
+	cachedContent, exist, err := model.GetActiveGeminiCachedContentByName(name)
+	if err != nil || !exist || cachedContent.ExpiresAt <= common.GetTimestamp() {
+		return GeminiCachedContentRoute{}, false
+	}
+	SetGeminiCachedContentRoute(cachedContent)
+	return GeminiCachedContentRoute{
+		UserId:    cachedContent.UserId,
+		ChannelId: cachedContent.ChannelId,
+		KeyIndex:  cachedContent.KeyIndex,
+		Group:     cachedContent.Group,
+	}, true
+}
+
+func DeleteGeminiCachedContentRoute(name string) {
+	if _, err := getGeminiCachedContentCache().DeleteMany([]string{name}); err != nil {
+		common.SysError(fmt.Sprintf("gemini cached content route delete failed: name=%s, err=%v", name, err))
+	}
+}
+
+// GetChannelKeyByIndex 多 key 渠道按索引取 key，索引失效时（如 key 被修改）回退到轮询选择
+func GetChannelKeyByIndex(channel *model.Channel, index int) (string, int, *types.NewAPIError) {
+	if channel.ChannelInfo.IsMultiKey {
+		keys := channel.GetKeys()
+		if index >= 0 && index < len(keys) {
+			return keys[index], index, nil
+		}
+	}
+	return channel.GetNextEnabledKey()
+}
+
+func GetGeminiCachedContentChannelAndKey(cachedContent *model.GeminiCachedContent) (*model.Channel, string, *types.NewAPIError) {
+	channel, err := model.GetChannelById(cachedContent.ChannelId, true)
+	if err != nil {
+		return nil, "", types.NewError(fmt.Errorf("channel #%d of cached content %s not found", cachedContent.ChannelId, cachedContent.Name), types.ErrorCodeGetChannelFailed, types.ErrOptionWithSkipRetry())
+	}
+	key, _, newAPIError := GetChannelKeyByIndex(channel, cachedContent.KeyIndex)
+	if newAPIError != nil {
+		return nil, "", newAPIError
+	}
+	return channel, key, nil
+}
+
+// DoGeminiCachedContentRequest 使用指定渠道与 key 请求上游 cachedContents 接口，path 形如 /cachedContents/{id}，调用方负责关闭响应体
+func DoGeminiCachedContentRequest(ctx context.Context, channel *model.Channel, key string, method string, path string, body io.Reader) (*http.Response, error) {
+	if !IsGeminiCachedContentSupported(channel.Type) {
+		return nil, fmt.Errorf("channel type %d does not support cachedContents api", channel.Type)
+	}
+	baseURL := channel.GetBaseURL()
+	if baseURL == "" {
+		baseURL = constant.ChannelBaseURLs[channel.Type]
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(baseURL, "/")+"/v1beta"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("x-goog-api-key", key)
+	client, err := GetHttpClientWithProxy(channel.GetSetting().Proxy)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req)
+}
+
+// ParseGeminiExpireTime 解析上游返回的 expireTime，缺失时按默认保留时间计算
+func ParseGeminiExpireTime(expireTime string, now int64) int64 {
+	if expireTime != "" {
+		if t, err := time.Parse(time.RFC3339Nano, expireTime); err == nil {
+			return t.Unix()
+		}
+	}
+	return now + int64(geminiCachedContentDefaultTTL.Seconds())
+}
@@ -0,0 +1,179 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/pkg/cachex"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+
+	"github.com/samber/hot"
+)
+
+const (
+	idempotencyCacheNamespace = "new-api:idempotency:v1"
+
+	IdempotencyStateProcessing = "processing"
+	IdempotencyStateCompleted  = "completed"
+
+	idempotencyPollInterval = 200 * time.Millisecond
+)
+
+var (
+	idempotencyCacheOnce sync.Once
+	idempotencyCache     *cachex.HybridCache[IdempotencyEntry]
+
+	ErrIdempotencyKeyInProgress = errors.New("a request with the same Idempotency-Key is still in progress")
+)
+
+// IdempotencyEntry Idempotency-Key 对应的请求状态，完成后保存写给客户端的原始响应，流式响应保存完整的 SSE 数据
+type IdempotencyEntry struct {
+	State       string `json:"state"`
+	RequestHash string `json:"request_hash"`
+	StatusCode  int    `json:"status_code,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+	BodyOmitted bool   `json:"body_omitted,omitempty"` // 响应超过保存上限，只记录请求已完成
+	CreatedAt   int64  `json:"created_at"`
+}
+
+func getIdempotencyCache() *cachex.HybridCache[IdempotencyEntry] {
+	idempotencyCacheOnce.Do(func() {
+		setting := operation_setting.GetIdempotencySetting()
+		capacity := setting.MaxEntries
+		if capacity <= 0 {
+			capacity = 10_000
+		}
+		ttl := setting.TTLSeconds
+		if ttl <= 0 {
+			ttl = 86400
+		}
+		idempotencyCache = cachex.NewHybridCache[IdempotencyEntry](cachex.HybridCacheConfig[IdempotencyEntry]{
+			Namespace: cachex.Namespace(idempotencyCacheNamespace),
+			Redis:     common.RDB,
+			RedisEnabled: func() bool {
+				return common.RedisEnabled && common.RDB != nil
+			},
+			RedisCodec: cachex.JSONCodec[IdempotencyEntry]{},
+			Memory: func() *hot.HotCache[string, IdempotencyEntry] {
+				return hot.NewHotCache[string, IdempotencyEntry](hot.LRU, capacity).
+					WithTTL(time.Duration(ttl) * time.Second).
+					WithJanitor().
+					Build()
+			},
+		})
+	})
+	return idempotencyCache
+}
+
+// GetIdempotencyScope Idempotency-Key 按令牌隔离
+func GetIdempotencyScope(tokenId int, key string) string {
+	return fmt.Sprintf("%d:%s", tokenId, key)
+}
+
+// AcquireIdempotencyKey 尝试占用 key，成功时返回 true，调用方处理完请求后必须调用 CompleteIdempotencyKey 或 ReleaseIdempotencyKey。
+// key 已被占用时等待原请求完成并返回其记录；请求内容不同时直接返回记录，由调用方判断
+func AcquireIdempotencyKey(ctx context.Context, scope string, requestHash string) (*IdempotencyEntry, bool, error) {
+	setting := operation_setting.GetIdempotencySetting()
+	lockTimeout := getIdempotencyLockTimeout()
+	waitTimeout := time.Duration(setting.WaitTimeoutSeconds) * time.Second
+	if waitTimeout <= 0 {
+		waitTimeout = 5 * time.Minute
+	}
+	deadline := time.Now().Add(waitTimeout)
+
+	processing := IdempotencyEntry{
+		State:       IdempotencyStateProcessing,
+		RequestHash: requestHash,
+		CreatedAt:   common.GetTimestamp(),
+	}
+	for {
+		acquired, err := getIdempotencyCache().SetNXWithTTL(scope, processing, lockTimeout)
+		if err != nil {
+			return nil, false, err
+		}
+		if acquired {
+			return nil, true, nil
+		}
+		entry, found, err := getIdempotencyCache().Get(scope)
+		if err != nil {
+			return nil, false, err
+		}
+		// 原请求失败释放了 key 时重新尝试占用
+		if found && (entry.State == IdempotencyStateCompleted || entry.RequestHash != requestHash) {
+			return &entry, false, nil
+		}
+		if found && time.Now().After(deadline) {
+			return nil, false, ErrIdempotencyKeyInProgress
+		}
+		select {
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		case <-time.After(idempotencyPollInterval):
+		}
+	}
+}
+
+func getIdempotencyLockTimeout() time.Duration {
+	lockTimeout := time.Duration(operation_setting.GetIdempotencySetting().LockTimeoutSeconds) * time.Second
+	if lockTimeout <= 0 {
+		lockTimeout = 10 * time.Minute
+	}
+	return lockTimeout
+}
+
+// KeepIdempotencyKey 请求处理期间定期延长处理中标记的有效期，避免长时间的流式请求在完成前标记过期。
+// 返回的函数停止延长并等待正在进行的续期结束，必须在 CompleteIdempotencyKey 或 ReleaseIdempotencyKey 之前调用
+func KeepIdempotencyKey(scope string, requestHash string) (stop func()) {
+	lockTimeout := getIdempotencyLockTimeout()
+	processing := IdempotencyEntry{
+		State:       IdempotencyStateProcessing,
+		RequestHash: requestHash,
+		CreatedAt:   common.GetTimestamp(),
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(lockTimeout / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := getIdempotencyCache().SetWithTTL(scope, processing, lockTimeout); err != nil {
+					common.SysError(fmt.Sprintf("idempotency key extend failed: scope=%s, err=%v", scope, err))
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+		})
+	}
+}
+
+// CompleteIdempotencyKey 保存已完成请求的响应，TTL 内的重复请求直接返回该响应
+func CompleteIdempotencyKey(scope string, entry IdempotencyEntry) error {
+	ttl := operation_setting.GetIdempotencySetting().TTLSeconds
+	if ttl <= 0 {
+		ttl = 86400
+	}
+	entry.State = IdempotencyStateCompleted
+	return getIdempotencyCache().SetWithTTL(scope, entry, time.Duration(ttl)*time.Second)
+}
+
+// ReleaseIdempotencyKey 请求失败时释放 key，允许客户端使用相同的 key 重试
+func ReleaseIdempotencyKey(scope string) {
+	if _, err := getIdempotencyCache().DeleteMany([]string{scope}); err != nil {
+		common.SysError(fmt.Sprintf("idempotency key release failed: scope=%s, err=%v", scope, err))
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/QuantumNous/new-api/constant"
 	"github.com/QuantumNous/new-api/dto"
 	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
 	"github.com/QuantumNous/new-api/types"
 
 	"github.com/gin-gonic/gin"
@@ -49,6 +50,18 @@ func GenerateTextOtherInfo(ctx *gin.Context, relayInfo *relaycommon.RelayInfo, m
 		other["is_model_mapped"] = true
 		other["upstream_model_name"] = relayInfo.UpstreamModelName
 	}
+	if relayInfo.VirtualModelName != "" {
+		other["virtual_model"] = relayInfo.VirtualModelName
+	}
+
+	if hedgeInfo, ok := common.GetContextKeyType[*relaycommon.HedgeInfo](ctx, constant.ContextKeyHedgeInfo); ok && hedgeInfo != nil {
+		other["hedge"] = hedgeInfo.Snapshot()
+	}
+
+	if relayInfo.ResponseCacheHit {
+		other["response_cache"] = true
+		other["response_cache_billing_ratio"] = operation_setting.GetResponseCacheSetting().BillingRatio
+	}
 
 	isSystemPromptOverwritten := common.GetContextKeyBool(ctx, constant.ContextKeySystemPromptOverride)
 	if isSystemPromptOverwritten {
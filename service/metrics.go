@@ -0,0 +1,41 @@
+package service
+
+import (
+	"strconv"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/pkg/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// multiKeyCollector 在抓取时统计多 key 渠道的 key 状态
+type multiKeyCollector struct {
+	keys *prometheus.Desc
+}
+
+func (c *multiKeyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.keys
+}
+
+func (c *multiKeyCollector) Collect(ch chan<- prometheus.Metric) {
+	states, err := model.GetMultiKeyChannelStates()
+	if err != nil {
+		common.SysError("failed to collect multi-key channel metrics: " + err.Error())
+		return
+	}
+	for _, state := range states {
+		channelId := strconv.Itoa(state.ChannelId)
+		channelType := strconv.Itoa(state.ChannelType)
+		ch <- prometheus.MustNewConstMetric(c.keys, prometheus.GaugeValue, float64(state.Enabled), channelId, channelType, "enabled")
+		ch <- prometheus.MustNewConstMetric(c.keys, prometheus.GaugeValue, float64(state.Disabled), channelId, channelType, "disabled")
+		ch <- prometheus.MustNewConstMetric(c.keys, prometheus.GaugeValue, float64(state.BreakerOpen), channelId, channelType, "breaker_open")
+	}
+}
+
+func init() {
+	metrics.Register(&multiKeyCollector{
+		keys: metrics.NewDesc("channel", "multi_key_keys", "Keys of multi-key channels by state.", []string{"channel_id", "channel_type", "state"}),
+	})
+}
@@ -0,0 +1,172 @@
+package service
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 估算删除消息能节省的 token 数时每个媒体文件按此计算，宁可少算，删除后会重新估算
+const middleOutMediaTokens = 85
+
+// middleOutUnit 可以整体删除的一段消息 [start, end)，工具调用与对应的结果在同一段中
+type middleOutUnit struct {
+	start  int
+	end    int
+	tokens int
+}
+
+func middleOutMessageTokens(meta *types.TokenCountMeta, modelName string) int {
+	tokens := 3
+	if meta.TokenType == types.TokenTypeTextNumber {
+		tokens += utf8.RuneCountInString(meta.CombineText)
+	} else {
+		tokens += CountTextToken(meta.CombineText, modelName)
+	}
+	return tokens + len(meta.Files)*middleOutMediaTokens
+}
+
+// pairMiddleOutUnits Claude 与 Gemini 的消息按 user / assistant 交替，成对删除 assistant 与其后的 user 消息才能保持交替，
+// 工具调用的结果也在其后的 user 消息中。第一条与最后一条消息不删除
+func pairMiddleOutUnits(roles []string, assistantRole string, messageTokens func(i int) int) []middleOutUnit {
+	units := make([]middleOutUnit, 0)
+	for i := 1; i+1 <= len(roles)-2; {
+		if roles[i] == assistantRole && roles[i+1] == "user" {
+			units = append(units, middleOutUnit{start: i, end: i + 2, tokens: messageTokens(i) + messageTokens(i+1)})
+			i += 2
+		} else {
+			i++
+		}
+	}
+	return units
+}
+
+// openAIMiddleOutUnits 开头的 system 消息不删除，其余消息按轮分段，tool 消息与前面的 assistant 消息在同一段。
+// 第一段与最后一段不删除
+func openAIMiddleOutUnits(messages []dto.Message, messageTokens func(i int) int) []middleOutUnit {
+	start := 0
+	for start < len(messages) && (messages[start].Role == "system" || messages[start].Role == "developer") {
+		start++
+	}
+	units := make([]middleOutUnit, 0)
+	for i := start; i < len(messages); i++ {
+		if messages[i].Role == "tool" && len(units) > 0 {
+			units[len(units)-1].end = i + 1
+			units[len(units)-1].tokens += messageTokens(i)
+			continue
+		}
+		units = append(units, middleOutUnit{start: i, end: i + 1, tokens: messageTokens(i)})
+	}
+	if len(units) <= 2 {
+		return nil
+	}
+	return units[1 : len(units)-1]
+}
+
+// selectMiddleOutRemovals 从中间开始向两侧依次选择要删除的段，直到节省的 token 数不少于 excess，返回每条消息是否删除
+func selectMiddleOutRemovals(count int, units []middleOutUnit, excess int) ([]bool, int) {
+	removed := make([]bool, count)
+	removedCount := 0
+	remaining := make([]middleOutUnit, len(units))
+	copy(remaining, units)
+	for excess > 0 && len(remaining) > 0 {
+		i := len(remaining) / 2
+		unit := remaining[i]
+		remaining = append(remaining[:i], remaining[i+1:]...)
+		for j := unit.start; j < unit.end; j++ {
+			removed[j] = true
+			removedCount++
+		}
+		excess -= unit.tokens
+	}
+	return removed, removedCount
+}
+
+func keepMiddleOutMessages[T any](messages []T, removed []bool) []T {
+	kept := make([]T, 0, len(messages))
+	for i, message := range messages {
+		if !removed[i] {
+			kept = append(kept, message)
+		}
+	}
+	return kept
+}
+
+// middleOutRequest 删除请求中间的消息，返回删除的消息数
+func middleOutRequest(request dto.Request, excess int, modelName string) int {
+	switch r := request.(type) {
+	case *dto.GeneralOpenAIRequest:
+		units := openAIMiddleOutUnits(r.Messages, func(i int) int {
+			single := &dto.GeneralOpenAIRequest{Messages: []dto.Message{r.Messages[i]}}
+			return middleOutMessageTokens(single.GetTokenCountMeta(), modelName)
+		})
+		removed, count := selectMiddleOutRemovals(len(r.Messages), units, excess)
+		r.Messages = keepMiddleOutMessages(r.Messages, removed)
+		return count
+	case *dto.ClaudeRequest:
+		roles := make([]string, len(r.Messages))
+		for i, message := range r.Messages {
+			roles[i] = message.Role
+		}
+		units := pairMiddleOutUnits(roles, "assistant", func(i int) int {
+			single := &dto.ClaudeRequest{Messages: []dto.ClaudeMessage{r.Messages[i]}}
+			return middleOutMessageTokens(single.GetTokenCountMeta(), modelName)
+		})
+		removed, count := selectMiddleOutRemovals(len(r.Messages), units, excess)
+		r.Messages = keepMiddleOutMessages(r.Messages, removed)
+		return count
+	case *dto.GeminiChatRequest:
+		roles := make([]string, len(r.Contents))
+		for i, content := range r.Contents {
+			roles[i] = content.Role
+		}
+		units := pairMiddleOutUnits(roles, "model", func(i int) int {
+			single := &dto.GeminiChatRequest{Contents: []dto.GeminiChatContent{r.Contents[i]}}
+			return middleOutMessageTokens(single.GetTokenCountMeta(), modelName)
+		})
+		removed, count := selectMiddleOutRemovals(len(r.Contents), units, excess)
+		r.Contents = keepMiddleOutMessages(r.Contents, removed)
+		return count
+	}
+	return 0
+}
+
+// ApplyMiddleOut 令牌开启 middle-out 且提示超出所选渠道模型的上下文长度时，从中间开始删除消息直到能够容纳，类似 OpenRouter 的 middle-out。
+// 开头的 system 消息、第一轮与最后一轮对话始终保留，工具调用与对应的结果一起删除。支持 OpenAI Chat、Claude 与 Gemini 格式，
+// 返回删除后重新估算的提示 token 数与 meta；渠道开启透传时上游收到的仍是原始请求
+func ApplyMiddleOut(c *gin.Context, info *relaycommon.RelayInfo, request dto.Request, tokens int, meta *types.TokenCountMeta) (int, *types.TokenCountMeta, *types.NewAPIError) {
+	if !common.GetContextKeyBool(c, constant.ContextKeyTokenMiddleOut) || tokens <= 0 || meta == nil {
+		return tokens, meta, nil
+	}
+	channel, err := model.CacheGetChannel(common.GetContextKeyInt(c, constant.ContextKeyChannelId))
+	if err != nil {
+		return tokens, meta, nil
+	}
+	limit, ok := model.GetChannelContextLimit(channel, info.OriginModelName)
+	if !ok || limit.Fits(model.ContextRequirement{PromptTokens: tokens, MaxTokens: meta.MaxTokens}) {
+		return tokens, meta, nil
+	}
+
+	excess := tokens + limit.OutputReserve(meta.MaxTokens) - limit.ContextWindow
+	removed := middleOutRequest(request, excess, info.OriginModelName)
+	if removed == 0 {
+		logger.LogWarn(c, fmt.Sprintf("middle-out: 提示 token 数 %d 超出模型 %s 的上下文长度 %d，但没有可以删除的消息", tokens, info.OriginModelName, limit.ContextWindow))
+		return tokens, meta, nil
+	}
+	newMeta := request.GetTokenCountMeta()
+	newTokens, err := EstimateRequestToken(c, newMeta, info)
+	if err != nil {
+		return tokens, meta, types.NewError(err, types.ErrorCodeCountTokenFailed)
+	}
+	logger.LogInfo(c, fmt.Sprintf("middle-out: 删除 %d 条消息，提示 token 数 %d -> %d，模型 %s 上下文长度 %d", removed, tokens, newTokens, info.OriginModelName, limit.ContextWindow))
+	return newTokens, newMeta, nil
+}
@@ -0,0 +1,127 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/QuantumNous/new-api/dto"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenAIMiddleOutUnits(t *testing.T) {
+	toolCall := dto.Message{Role: "assistant"}
+	toolCall.SetToolCalls([]dto.ToolCallRequest{{ID: "call_1", Type: "function", Function: dto.FunctionRequest{Name: "f"}}})
+
+	tests := []struct {
+		name     string
+		messages []dto.Message
+		want     []middleOutUnit
+	}{
+		{
+			name:     "leading system and first and last rounds are kept",
+			messages: []dto.Message{{Role: "system"}, {Role: "user"}, {Role: "assistant"}, {Role: "user"}, {Role: "assistant"}, {Role: "user"}},
+			want:     []middleOutUnit{{start: 2, end: 3, tokens: 10}, {start: 3, end: 4, tokens: 10}, {start: 4, end: 5, tokens: 10}},
+		},
+		{
+			name:     "tool results stay with the assistant message",
+			messages: []dto.Message{{Role: "developer"}, {Role: "user"}, toolCall, {Role: "tool"}, {Role: "tool"}, {Role: "assistant"}, {Role: "user"}},
+			want:     []middleOutUnit{{start: 2, end: 5, tokens: 30}, {start: 5, end: 6, tokens: 10}},
+		},
+		{
+			name:     "two rounds have nothing to remove",
+			messages: []dto.Message{{Role: "system"}, {Role: "user"}, {Role: "assistant"}},
+		},
+		{
+			name: "empty",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			units := openAIMiddleOutUnits(tt.messages, func(i int) int { return 10 })
+			require.Equal(t, tt.want, units)
+		})
+	}
+}
+
+func TestPairMiddleOutUnits(t *testing.T) {
+	tests := []struct {
+		name          string
+		roles         []string
+		assistantRole string
+		want          []middleOutUnit
+	}{
+		{
+			name:          "claude alternating messages",
+			roles:         []string{"user", "assistant", "user", "assistant", "user", "assistant", "user"},
+			assistantRole: "assistant",
+			want:          []middleOutUnit{{start: 1, end: 3, tokens: 5}, {start: 3, end: 5, tokens: 9}},
+		},
+		{
+			name:          "gemini pairs skip consecutive user contents",
+			roles:         []string{"user", "user", "model", "user", "model", "user"},
+			assistantRole: "model",
+			want:          []middleOutUnit{{start: 2, end: 4, tokens: 7}},
+		},
+		{
+			name:          "last message is never removed",
+			roles:         []string{"user", "assistant", "user"},
+			assistantRole: "assistant",
+			want:          []middleOutUnit{},
+		},
+		{
+			name:          "single message",
+			roles:         []string{"user"},
+			assistantRole: "assistant",
+			want:          []middleOutUnit{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			units := pairMiddleOutUnits(tt.roles, tt.assistantRole, func(i int) int { return i + 1 })
+			require.Equal(t, tt.want, units)
+		})
+	}
+}
+
+func TestSelectMiddleOutRemovals(t *testing.T) {
+	units := []middleOutUnit{{start: 1, end: 2, tokens: 10}, {start: 2, end: 4, tokens: 20}, {start: 4, end: 5, tokens: 10}}
+	tests := []struct {
+		name        string
+		excess      int
+		wantRemoved []bool
+		wantCount   int
+	}{
+		{
+			name:        "no excess",
+			excess:      0,
+			wantRemoved: []bool{false, false, false, false, false, false},
+		},
+		{
+			name:        "middle unit first",
+			excess:      5,
+			wantRemoved: []bool{false, false, true, true, false, false},
+			wantCount:   2,
+		},
+		{
+			name:        "expands outwards until enough is saved",
+			excess:      25,
+			wantRemoved: []bool{false, false, true, true, true, false},
+			wantCount:   3,
+		},
+		{
+			name:        "stops when every unit is removed",
+			excess:      100,
+			wantRemoved: []bool{false, true, true, true, true, false},
+			wantCount:   4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			removed, count := selectMiddleOutRemovals(6, units, tt.excess)
+			require.Equal(t, tt.wantRemoved, removed)
+			require.Equal(t, tt.wantCount, count)
+			require.Len(t, units, 3, "input units are not modified")
+			require.Equal(t, middleOutUnit{start: 2, end: 4, tokens: 20}, units[1])
+		})
+	}
+}
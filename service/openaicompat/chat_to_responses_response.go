@@ -0,0 +1,373 @@
+package openaicompat
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/types"
+)
+
+const (
+	responsesItemMessage      = "message"
+	responsesItemReasoning    = "reasoning"
+	responsesItemFunctionCall = "function_call"
+)
+
+func chatCreatedToInt(created any) int {
+	switch v := created.(type) {
+	case float64:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	}
+	return int(common.GetTimestamp())
+}
+
+// ChatUsageToResponsesUsage 把对话接口的 usage 转换为 Responses API 的 usage 字段
+func ChatUsageToResponsesUsage(usage *dto.Usage) *dto.Usage {
+	if usage == nil {
+		return nil
+	}
+	out := *usage
+	out.InputTokens = usage.PromptTokens
+	out.OutputTokens = usage.CompletionTokens
+	if out.TotalTokens == 0 {
+		out.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	}
+	out.InputTokensDetails = &dto.InputTokenDetails{
+		CachedTokens: usage.PromptTokensDetails.CachedTokens,
+		ImageTokens:  usage.PromptTokensDetails.ImageTokens,
+		AudioTokens:  usage.PromptTokensDetails.AudioTokens,
+	}
+	return &out
+}
+
+func newResponsesResponse(id string, model string, createdAt int, status string) *dto.OpenAIResponsesResponse {
+	return &dto.OpenAIResponsesResponse{
+		ID:        id,
+		Object:    "response",
+		CreatedAt: createdAt,
+		Status:    status,
+		Model:     model,
+		Output:    []dto.ResponsesOutput{},
+	}
+}
+
+func applyResponsesFinishReason(resp *dto.OpenAIResponsesResponse, finishReason string) {
+	if finishReason == "length" {
+		resp.Status = "incomplete"
+		resp.IncompleteDetails = &dto.IncompleteDetails{Reasoning: "max_output_tokens"}
+	}
+}
+
+// ChatCompletionsResponseToResponsesResponse 把非流式对话响应转换为 Responses API 响应，只转换第一个 choice
+func ChatCompletionsResponseToResponsesResponse(resp *dto.OpenAITextResponse, id string) (*dto.OpenAIResponsesResponse, error) {
+	if resp == nil {
+		return nil, errors.New("response is nil")
+	}
+
+	out := newResponsesResponse(id, resp.Model, chatCreatedToInt(resp.Created), "completed")
+	if len(resp.Choices) > 0 {
+		choice := resp.Choices[0]
+		reasoning := choice.Message.ReasoningContent
+		if reasoning == "" {
+			reasoning = choice.Message.Reasoning
+		}
+		if reasoning != "" {
+			out.Output = append(out.Output, dto.ResponsesOutput{
+				Type:    responsesItemReasoning,
+				ID:      "rs_" + common.GetUUID(),
+				Summary: []dto.ResponsesOutputContent{{Type: "summary_text", Text: reasoning}},
+			})
+		}
+		if text := choice.Message.StringContent(); text != "" {
+			out.Output = append(out.Output, dto.ResponsesOutput{
+				Type:    responsesItemMessage,
+				ID:      "msg_" + common.GetUUID(),
+				Status:  "completed",
+				Role:    "assistant",
+				Content: []dto.ResponsesOutputContent{{Type: "output_text", Text: text, Annotations: []interface{}{}}},
+			})
+		}
+		for _, toolCall := range choice.Message.ParseToolCalls() {
+			out.Output = append(out.Output, dto.ResponsesOutput{
+				Type:      responsesItemFunctionCall,
+				ID:        "fc_" + common.GetUUID(),
+				Status:    "completed",
+				CallId:    toolCall.ID,
+				Name:      toolCall.Function.Name,
+				Arguments: toolCall.Function.Arguments,
+			})
+		}
+		applyResponsesFinishReason(out, choice.FinishReason)
+	}
+	out.Usage = ChatUsageToResponsesUsage(&resp.Usage)
+	return out, nil
+}
+
+type responsesStreamItem struct {
+	output    dto.ResponsesOutput
+	index     int
+	toolIndex int
+	text      strings.Builder
+}
+
+// ChatToResponsesStreamConverter 把对话接口的流式 chunk 逐个转换为 Responses API 的流式事件。
+// 同一时间只有一个输出条目处于打开状态，内容类型变化时关闭当前条目并打开新条目
+type ChatToResponsesStreamConverter struct {
+	id           string
+	model        string
+	createdAt    int
+	started      bool
+	current      *responsesStreamItem
+	output       []dto.ResponsesOutput
+	finishReason string
+}
+
+func NewChatToResponsesStreamConverter(id string, model string) *ChatToResponsesStreamConverter {
+	return &ChatToResponsesStreamConverter{
+		id:        id,
+		model:     model,
+		createdAt: int(common.GetTimestamp()),
+	}
+}
+
+func (s *ChatToResponsesStreamConverter) response(status string) *dto.OpenAIResponsesResponse {
+	resp := newResponsesResponse(s.id, s.model, s.createdAt, status)
+	resp.Output = append(resp.Output, s.output...)
+	return resp
+}
+
+func (s *ChatToResponsesStreamConverter) start() []dto.ResponsesStreamResponse {
+	if s.started {
+		return nil
+	}
+	s.started = true
+	return []dto.ResponsesStreamResponse{
+		{Type: "response.created", Response: s.response("in_progress")},
+		{Type: "response.in_progress", Response: s.response("in_progress")},
+	}
+}
+
+func (s *ChatToResponsesStreamConverter) open(itemType string, toolIndex int, toolCall *dto.ToolCallResponse) []dto.ResponsesStreamResponse {
+	events := s.close()
+	item := &responsesStreamItem{
+		index:     len(s.output),
+		toolIndex: toolIndex,
+		output:    dto.ResponsesOutput{Type: itemType},
+	}
+	switch itemType {
+	case responsesItemMessage:
+		item.output.ID = "msg_" + common.GetUUID()
+		item.output.Status = "in_progress"
+		item.output.Role = "assistant"
+		item.output.Content = []dto.ResponsesOutputContent{}
+	case responsesItemReasoning:
+		item.output.ID = "rs_" + common.GetUUID()
+	case responsesItemFunctionCall:
+		item.output.ID = "fc_" + common.GetUUID()
+		item.output.Status = "in_progress"
+		item.output.CallId = toolCall.ID
+		item.output.Name = toolCall.Function.Name
+	}
+	s.current = item
+	// 占位，关闭时替换为完整条目，保证 output_index 与最终 output 一致
+	s.output = append(s.output, item.output)
+
+	added := item.output
+	events = append(events, dto.ResponsesStreamResponse{
+		Type:        dto.ResponsesOutputTypeItemAdded,
+		OutputIndex: common.GetPointer(item.index),
+		Item:        &added,
+	})
+	switch itemType {
+	case responsesItemMessage:
+		events = append(events, dto.ResponsesStreamResponse{
+			Type:         "response.content_part.added",
+			ItemID:       item.output.ID,
+			OutputIndex:  common.GetPointer(item.index),
+			ContentIndex: common.GetPointer(0),
+			Part:         &dto.ResponsesOutputContent{Type: "output_text", Annotations: []interface{}{}},
+		})
+	case responsesItemReasoning:
+		events = append(events, dto.ResponsesStreamResponse{
+			Type:         "response.reasoning_summary_part.added",
+			ItemID:       item.output.ID,
+			OutputIndex:  common.GetPointer(item.index),
+			SummaryIndex: common.GetPointer(0),
+			Part:         &dto.ResponsesOutputContent{Type: "summary_text"},
+		})
+	}
+	return events
+}
+
+func (s *ChatToResponsesStreamConverter) delta(delta string) []dto.ResponsesStreamResponse {
+	item := s.current
+	item.text.WriteString(delta)
+	event := dto.ResponsesStreamResponse{
+		ItemID:      item.output.ID,
+		OutputIndex: common.GetPointer(item.index),
+		Delta:       delta,
+	}
+	switch item.output.Type {
+	case responsesItemMessage:
+		event.Type = "response.output_text.delta"
+		event.ContentIndex = common.GetPointer(0)
+	case responsesItemReasoning:
+		event.Type = "response.reasoning_summary_text.delta"
+		event.SummaryIndex = common.GetPointer(0)
+	case responsesItemFunctionCall:
+		event.Type = "response.function_call_arguments.delta"
+	}
+	return []dto.ResponsesStreamResponse{event}
+}
+
+func (s *ChatToResponsesStreamConverter) close() []dto.ResponsesStreamResponse {
+	item := s.current
+	if item == nil {
+		return nil
+	}
+	s.current = nil
+
+	text := item.text.String()
+	var events []dto.ResponsesStreamResponse
+	switch item.output.Type {
+	case responsesItemMessage:
+		part := dto.ResponsesOutputContent{Type: "output_text", Text: text, Annotations: []interface{}{}}
+		item.output.Status = "completed"
+		item.output.Content = []dto.ResponsesOutputContent{part}
+		events = append(events,
+			dto.ResponsesStreamResponse{
+				Type:         "response.output_text.done",
+				ItemID:       item.output.ID,
+				OutputIndex:  common.GetPointer(item.index),
+				ContentIndex: common.GetPointer(0),
+				Text:         text,
+			},
+			dto.ResponsesStreamResponse{
+				Type:         "response.content_part.done",
+				ItemID:       item.output.ID,
+				OutputIndex:  common.GetPointer(item.index),
+				ContentIndex: common.GetPointer(0),
+				Part:         &part,
+			},
+		)
+	case responsesItemReasoning:
+		part := dto.ResponsesOutputContent{Type: "summary_text", Text: text}
+		item.output.Summary = []dto.ResponsesOutputContent{part}
+		events = append(events,
+			dto.ResponsesStreamResponse{
+				Type:         "response.reasoning_summary_text.done",
+				ItemID:       item.output.ID,
+				OutputIndex:  common.GetPointer(item.index),
+				SummaryIndex: common.GetPointer(0),
+				Text:         text,
+			},
+			dto.ResponsesStreamResponse{
+				Type:         "response.reasoning_summary_part.done",
+				ItemID:       item.output.ID,
+				OutputIndex:  common.GetPointer(item.index),
+				SummaryIndex: common.GetPointer(0),
+				Part:         &part,
+			},
+		)
+	case responsesItemFunctionCall:
+		item.output.Status = "completed"
+		item.output.Arguments = text
+		events = append(events, dto.ResponsesStreamResponse{
+			Type:        "response.function_call_arguments.done",
+			ItemID:      item.output.ID,
+			OutputIndex: common.GetPointer(item.index),
+			Arguments:   text,
+		})
+	}
+	s.output[item.index] = item.output
+	done := item.output
+	events = append(events, dto.ResponsesStreamResponse{
+		Type:        dto.ResponsesOutputTypeItemDone,
+		OutputIndex: common.GetPointer(item.index),
+		Item:        &done,
+	})
+	return events
+}
+
+// ConvertChunk 转换一个对话流式 chunk，只处理第一个 choice
+func (s *ChatToResponsesStreamConverter) ConvertChunk(chunk *dto.ChatCompletionsStreamResponse) []dto.ResponsesStreamResponse {
+	if chunk.Model != "" {
+		s.model = chunk.Model
+	}
+	events := s.start()
+	for _, choice := range chunk.Choices {
+		if choice.Index != 0 {
+			continue
+		}
+		if reasoning := choice.Delta.GetReasoningContent(); reasoning != "" {
+			if s.current == nil || s.current.output.Type != responsesItemReasoning {
+				events = append(events, s.open(responsesItemReasoning, 0, nil)...)
+			}
+			events = append(events, s.delta(reasoning)...)
+		}
+		if content := choice.Delta.GetContentString(); content != "" {
+			if s.current == nil || s.current.output.Type != responsesItemMessage {
+				events = append(events, s.open(responsesItemMessage, 0, nil)...)
+			}
+			events = append(events, s.delta(content)...)
+		}
+		for i := range choice.Delta.ToolCalls {
+			toolCall := &choice.Delta.ToolCalls[i]
+			toolIndex := 0
+			if toolCall.Index != nil {
+				toolIndex = *toolCall.Index
+			}
+			isNewCall := s.current == nil || s.current.output.Type != responsesItemFunctionCall ||
+				s.current.toolIndex != toolIndex || (toolCall.ID != "" && toolCall.ID != s.current.output.CallId)
+			if isNewCall {
+				events = append(events, s.open(responsesItemFunctionCall, toolIndex, toolCall)...)
+			} else if toolCall.Function.Name != "" && s.current.output.Name == "" {
+				s.current.output.Name = toolCall.Function.Name
+			}
+			if toolCall.Function.Arguments != "" {
+				events = append(events, s.delta(toolCall.Function.Arguments)...)
+			}
+		}
+		if choice.FinishReason != nil && *choice.FinishReason != "" {
+			s.finishReason = *choice.FinishReason
+		}
+	}
+	return events
+}
+
+// Finish 关闭仍处于打开状态的条目并生成 response.completed 事件
+func (s *ChatToResponsesStreamConverter) Finish(usage *dto.Usage) []dto.ResponsesStreamResponse {
+	events := s.start()
+	events = append(events, s.close()...)
+	resp := s.response("completed")
+	applyResponsesFinishReason(resp, s.finishReason)
+	resp.Usage = ChatUsageToResponsesUsage(usage)
+	eventType := "response.completed"
+	if resp.Status == "incomplete" {
+		eventType = "response.incomplete"
+	}
+	return append(events, dto.ResponsesStreamResponse{Type: eventType, Response: resp})
+}
+
+// Fail 上游在流式输出中途出错时关闭仍处于打开状态的条目并生成 response.failed 事件，error 中携带上游的错误
+func (s *ChatToResponsesStreamConverter) Fail(openaiError types.OpenAIError, usage *dto.Usage) []dto.ResponsesStreamResponse {
+	events := s.start()
+	events = append(events, s.close()...)
+	resp := s.response("failed")
+	code := openaiError.Code
+	if code == nil || code == "" {
+		code = "server_error"
+	}
+	resp.Error = map[string]any{
+		"code":    code,
+		"message": openaiError.Message,
+	}
+	resp.Usage = ChatUsageToResponsesUsage(usage)
+	return append(events, dto.ResponsesStreamResponse{Type: "response.failed", Response: resp})
+}
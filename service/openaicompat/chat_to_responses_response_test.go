@@ -0,0 +1,268 @@
+package openaicompat
+
+import (
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChatCompletionsResponseToResponsesResponse(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus string
+		wantTypes  []string
+		check      func(t *testing.T, resp *dto.OpenAIResponsesResponse)
+	}{
+		{
+			name:       "text",
+			body:       `{"model":"gpt-4o","created":1700000000,"choices":[{"index":0,"message":{"role":"assistant","content":"hello"},"finish_reason":"stop"}],"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5,"prompt_tokens_details":{"cached_tokens":1}}}`,
+			wantStatus: "completed",
+			wantTypes:  []string{responsesItemMessage},
+			check: func(t *testing.T, resp *dto.OpenAIResponsesResponse) {
+				require.Equal(t, 1700000000, resp.CreatedAt)
+				require.Equal(t, "hello", resp.Output[0].Content[0].Text)
+				require.Equal(t, 3, resp.Usage.InputTokens)
+				require.Equal(t, 2, resp.Usage.OutputTokens)
+				require.Equal(t, 1, resp.Usage.InputTokensDetails.CachedTokens)
+			},
+		},
+		{
+			name:       "reasoning text and tool call",
+			body:       `{"model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","reasoning_content":"think","content":"ok","tool_calls":[{"id":"call_1","type":"function","function":{"name":"lookup","arguments":"{}"}}]},"finish_reason":"tool_calls"}]}`,
+			wantStatus: "completed",
+			wantTypes:  []string{responsesItemReasoning, responsesItemMessage, responsesItemFunctionCall},
+			check: func(t *testing.T, resp *dto.OpenAIResponsesResponse) {
+				require.Equal(t, "think", resp.Output[0].Summary[0].Text)
+				require.Equal(t, "call_1", resp.Output[2].CallId)
+				require.Equal(t, "lookup", resp.Output[2].Name)
+				require.Equal(t, "{}", resp.Output[2].Arguments)
+			},
+		},
+		{
+			name:       "length finish reason is incomplete",
+			body:       `{"model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"trunc"},"finish_reason":"length"}]}`,
+			wantStatus: "incomplete",
+			wantTypes:  []string{responsesItemMessage},
+			check: func(t *testing.T, resp *dto.OpenAIResponsesResponse) {
+				require.NotNil(t, resp.IncompleteDetails)
+				require.Equal(t, "max_output_tokens", resp.IncompleteDetails.Reasoning)
+			},
+		},
+		{
+			name:       "no choices",
+			body:       `{"model":"gpt-4o","choices":[]}`,
+			wantStatus: "completed",
+			wantTypes:  nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var chatResp dto.OpenAITextResponse
+			require.NoError(t, common.Unmarshal([]byte(tt.body), &chatResp))
+			resp, err := ChatCompletionsResponseToResponsesResponse(&chatResp, "resp_1")
+			require.NoError(t, err)
+			require.Equal(t, "resp_1", resp.ID)
+			require.Equal(t, "gpt-4o", resp.Model)
+			require.Equal(t, tt.wantStatus, resp.Status)
+			var outputTypes []string
+			for _, output := range resp.Output {
+				outputTypes = append(outputTypes, output.Type)
+			}
+			require.Equal(t, tt.wantTypes, outputTypes)
+			if tt.check != nil {
+				tt.check(t, resp)
+			}
+		})
+	}
+
+	_, err := ChatCompletionsResponseToResponsesResponse(nil, "resp_1")
+	require.Error(t, err)
+}
+
+// convertChatStream 依次转换流式 chunk，返回全部事件
+func convertChatStream(t *testing.T, converter *ChatToResponsesStreamConverter, chunks []string) []dto.ResponsesStreamResponse {
+	var events []dto.ResponsesStreamResponse
+	for _, data := range chunks {
+		var chunk dto.ChatCompletionsStreamResponse
+		require.NoError(t, common.Unmarshal([]byte(data), &chunk))
+		events = append(events, converter.ConvertChunk(&chunk)...)
+	}
+	return events
+}
+
+func streamEventTypes(events []dto.ResponsesStreamResponse) []string {
+	eventTypes := make([]string, 0, len(events))
+	for _, event := range events {
+		eventTypes = append(eventTypes, event.Type)
+	}
+	return eventTypes
+}
+
+func TestChatToResponsesStreamConverter(t *testing.T) {
+	tests := []struct {
+		name       string
+		chunks     []string
+		wantEvents []string
+		wantStatus string
+		wantOutput []string
+	}{
+		{
+			name: "text",
+			chunks: []string{
+				`{"model":"gpt-4o","choices":[{"index":0,"delta":{"role":"assistant","content":"he"}}]}`,
+				`{"choices":[{"index":0,"delta":{"content":"llo"},"finish_reason":"stop"}]}`,
+			},
+			wantEvents: []string{
+				"response.created", "response.in_progress",
+				dto.ResponsesOutputTypeItemAdded, "response.content_part.added",
+				"response.output_text.delta", "response.output_text.delta",
+				"response.output_text.done", "response.content_part.done", dto.ResponsesOutputTypeItemDone,
+				"response.completed",
+			},
+			wantStatus: "completed",
+			wantOutput: []string{"hello"},
+		},
+		{
+			name: "reasoning then text",
+			chunks: []string{
+				`{"choices":[{"index":0,"delta":{"reasoning_content":"hmm"}}]}`,
+				`{"choices":[{"index":0,"delta":{"content":"ok"},"finish_reason":"stop"}]}`,
+			},
+			wantEvents: []string{
+				"response.created", "response.in_progress",
+				dto.ResponsesOutputTypeItemAdded, "response.reasoning_summary_part.added", "response.reasoning_summary_text.delta",
+				"response.reasoning_summary_text.done", "response.reasoning_summary_part.done", dto.ResponsesOutputTypeItemDone,
+				dto.ResponsesOutputTypeItemAdded, "response.content_part.added", "response.output_text.delta",
+				"response.output_text.done", "response.content_part.done", dto.ResponsesOutputTypeItemDone,
+				"response.completed",
+			},
+			wantStatus: "completed",
+			wantOutput: []string{"hmm", "ok"},
+		},
+		{
+			name: "two tool calls",
+			chunks: []string{
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"a","arguments":"{\"x\""}}]}}]}`,
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":":1}"}}]}}]}`,
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":1,"id":"call_2","type":"function","function":{"name":"b","arguments":"{}"}}]},"finish_reason":"tool_calls"}]}`,
+			},
+			wantEvents: []string{
+				"response.created", "response.in_progress",
+				dto.ResponsesOutputTypeItemAdded, "response.function_call_arguments.delta", "response.function_call_arguments.delta",
+				"response.function_call_arguments.done", dto.ResponsesOutputTypeItemDone,
+				dto.ResponsesOutputTypeItemAdded, "response.function_call_arguments.delta",
+				"response.function_call_arguments.done", dto.ResponsesOutputTypeItemDone,
+				"response.completed",
+			},
+			wantStatus: "completed",
+			wantOutput: []string{`{"x":1}`, "{}"},
+		},
+		{
+			name: "length finish reason",
+			chunks: []string{
+				`{"choices":[{"index":0,"delta":{"content":"tr"},"finish_reason":"length"}]}`,
+			},
+			wantEvents: []string{
+				"response.created", "response.in_progress",
+				dto.ResponsesOutputTypeItemAdded, "response.content_part.added", "response.output_text.delta",
+				"response.output_text.done", "response.content_part.done", dto.ResponsesOutputTypeItemDone,
+				"response.incomplete",
+			},
+			wantStatus: "incomplete",
+			wantOutput: []string{"tr"},
+		},
+		{
+			name:   "empty stream",
+			chunks: nil,
+			wantEvents: []string{
+				"response.created", "response.in_progress", "response.completed",
+			},
+			wantStatus: "completed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			converter := NewChatToResponsesStreamConverter("resp_1", "gpt-4o")
+			events := convertChatStream(t, converter, tt.chunks)
+			events = append(events, converter.Finish(&dto.Usage{PromptTokens: 1, CompletionTokens: 2})...)
+			require.Equal(t, tt.wantEvents, streamEventTypes(events))
+
+			final := events[len(events)-1].Response
+			require.NotNil(t, final)
+			require.Equal(t, "resp_1", final.ID)
+			require.Equal(t, tt.wantStatus, final.Status)
+			require.Equal(t, 3, final.Usage.TotalTokens)
+			var outputs []string
+			for _, output := range final.Output {
+				switch output.Type {
+				case responsesItemMessage:
+					outputs = append(outputs, output.Content[0].Text)
+				case responsesItemReasoning:
+					outputs = append(outputs, output.Summary[0].Text)
+				case responsesItemFunctionCall:
+					outputs = append(outputs, output.Arguments)
+				}
+			}
+			require.Equal(t, tt.wantOutput, outputs)
+
+			// 条目的 output_index 与最终 output 中的位置一致
+			for _, event := range events {
+				if event.Type == dto.ResponsesOutputTypeItemDone {
+					require.Equal(t, final.Output[*event.OutputIndex].ID, event.Item.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestChatToResponsesStreamConverterFail(t *testing.T) {
+	tests := []struct {
+		name       string
+		chunks     []string
+		err        types.OpenAIError
+		wantEvents []string
+		wantCode   any
+	}{
+		{
+			name: "error after text",
+			chunks: []string{
+				`{"choices":[{"index":0,"delta":{"content":"par"}}]}`,
+			},
+			err: types.OpenAIError{Message: "upstream broke", Code: "upstream_error"},
+			wantEvents: []string{
+				"response.created", "response.in_progress",
+				dto.ResponsesOutputTypeItemAdded, "response.content_part.added", "response.output_text.delta",
+				"response.output_text.done", "response.content_part.done", dto.ResponsesOutputTypeItemDone,
+				"response.failed",
+			},
+			wantCode: "upstream_error",
+		},
+		{
+			name:       "error before any chunk",
+			err:        types.OpenAIError{Message: "quota exhausted"},
+			wantEvents: []string{"response.created", "response.in_progress", "response.failed"},
+			wantCode:   "server_error",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			converter := NewChatToResponsesStreamConverter("resp_1", "gpt-4o")
+			events := convertChatStream(t, converter, tt.chunks)
+			events = append(events, converter.Fail(tt.err, nil)...)
+			require.Equal(t, tt.wantEvents, streamEventTypes(events))
+
+			final := events[len(events)-1].Response
+			require.Equal(t, "failed", final.Status)
+			errData, err := common.Marshal(final.Error)
+			require.NoError(t, err)
+			expected, err := common.Marshal(map[string]any{"code": tt.wantCode, "message": tt.err.Message})
+			require.NoError(t, err)
+			require.JSONEq(t, string(expected), string(errData))
+		})
+	}
+}
@@ -0,0 +1,270 @@
+package openaicompat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+)
+
+// ResponsesRequestToChatCompletionsRequest 把 /v1/responses 请求转换为对话请求，用于不支持 Responses API 的渠道
+func ResponsesRequestToChatCompletionsRequest(req *dto.OpenAIResponsesRequest) (*dto.GeneralOpenAIRequest, error) {
+	if req == nil {
+		return nil, errors.New("request is nil")
+	}
+	if req.Model == "" {
+		return nil, errors.New("model is required")
+	}
+	if req.PreviousResponseID != "" {
+		return nil, errors.New("previous_response_id is not supported in chat completions compatibility mode")
+	}
+
+	messages := make([]dto.Message, 0)
+	if len(req.Instructions) > 0 {
+		var instructions string
+		if err := common.Unmarshal(req.Instructions, &instructions); err == nil && strings.TrimSpace(instructions) != "" {
+			messages = append(messages, dto.Message{Role: "system", Content: instructions})
+		}
+	}
+
+	inputMessages, err := responsesInputToChatMessages(req.Input)
+	if err != nil {
+		return nil, err
+	}
+	messages = append(messages, inputMessages...)
+
+	out := &dto.GeneralOpenAIRequest{
+		Model:       req.Model,
+		Messages:    messages,
+		Stream:      req.Stream,
+		MaxTokens:   req.MaxOutputTokens,
+		Temperature: req.Temperature,
+		User:        req.User,
+	}
+	if req.Stream {
+		out.StreamOptions = &dto.StreamOptions{IncludeUsage: true}
+	}
+	if req.TopP != nil {
+		out.TopP = *req.TopP
+	}
+	if req.Reasoning != nil && req.Reasoning.Effort != "" {
+		out.ReasoningEffort = req.Reasoning.Effort
+	}
+	if len(req.ParallelToolCalls) > 0 {
+		var parallel bool
+		if err := common.Unmarshal(req.ParallelToolCalls, &parallel); err == nil {
+			out.ParallelTooCalls = common.GetPointer(parallel)
+		}
+	}
+
+	if len(req.Tools) > 0 {
+		var tools []map[string]any
+		if err := common.Unmarshal(req.Tools, &tools); err != nil {
+			return nil, fmt.Errorf("invalid tools: %w", err)
+		}
+		for _, tool := range tools {
+			// 内置工具（web_search、file_search 等）只有 Responses API 支持，对话接口无法提供
+			if common.Interface2String(tool["type"]) != "function" {
+				continue
+			}
+			out.Tools = append(out.Tools, dto.ToolCallRequest{
+				Type: "function",
+				Function: dto.FunctionRequest{
+					Name:        common.Interface2String(tool["name"]),
+					Description: common.Interface2String(tool["description"]),
+					Parameters:  tool["parameters"],
+				},
+			})
+		}
+	}
+
+	if len(req.ToolChoice) > 0 {
+		var toolChoice any
+		if err := common.Unmarshal(req.ToolChoice, &toolChoice); err == nil {
+			switch v := toolChoice.(type) {
+			case string:
+				out.ToolChoice = v
+			case map[string]any:
+				// Responses: {"type":"function","name":"..."}
+				// Chat: {"type":"function","function":{"name":"..."}}
+				if common.Interface2String(v["type"]) == "function" && common.Interface2String(v["name"]) != "" {
+					out.ToolChoice = map[string]any{
+						"type":     "function",
+						"function": map[string]any{"name": v["name"]},
+					}
+				} else {
+					out.ToolChoice = v
+				}
+			}
+		}
+	}
+
+	if len(req.Text) > 0 {
+		var text struct {
+			Format map[string]any `json:"format"`
+		}
+		if err := common.Unmarshal(req.Text, &text); err == nil && text.Format != nil {
+			switch formatType := common.Interface2String(text.Format["type"]); formatType {
+			case "json_schema":
+				schema := dto.FormatJsonSchema{
+					Description: common.Interface2String(text.Format["description"]),
+					Name:        common.Interface2String(text.Format["name"]),
+					Schema:      text.Format["schema"],
+				}
+				if strict, ok := text.Format["strict"]; ok {
+					schema.Strict, _ = common.Marshal(strict)
+				}
+				schemaRaw, err := common.Marshal(schema)
+				if err != nil {
+					return nil, err
+				}
+				out.ResponseFormat = &dto.ResponseFormat{Type: formatType, JsonSchema: schemaRaw}
+			case "json_object":
+				out.ResponseFormat = &dto.ResponseFormat{Type: formatType}
+			}
+		}
+	}
+
+	return out, nil
+}
+
+func responsesInputToChatMessages(input json.RawMessage) ([]dto.Message, error) {
+	if len(input) == 0 {
+		return nil, nil
+	}
+	if common.GetJsonType(input) == "string" {
+		var text string
+		if err := common.Unmarshal(input, &text); err != nil {
+			return nil, err
+		}
+		return []dto.Message{{Role: "user", Content: text}}, nil
+	}
+
+	var items []map[string]any
+	if err := common.Unmarshal(input, &items); err != nil {
+		return nil, fmt.Errorf("invalid input: %w", err)
+	}
+
+	messages := make([]dto.Message, 0, len(items))
+	// 连续的 function_call 合并为同一条 assistant 消息的 tool_calls
+	var pendingToolCalls []dto.ToolCallRequest
+	flushToolCalls := func() {
+		if len(pendingToolCalls) == 0 {
+			return
+		}
+		last := len(messages) - 1
+		if last >= 0 && messages[last].Role == "assistant" && len(messages[last].ToolCalls) == 0 {
+			messages[last].SetToolCalls(pendingToolCalls)
+		} else {
+			message := dto.Message{Role: "assistant", Content: ""}
+			message.SetToolCalls(pendingToolCalls)
+			messages = append(messages, message)
+		}
+		pendingToolCalls = nil
+	}
+
+	for _, item := range items {
+		itemType := common.Interface2String(item["type"])
+		switch itemType {
+		case "function_call":
+			callID := common.Interface2String(item["call_id"])
+			if callID == "" {
+				callID = common.Interface2String(item["id"])
+			}
+			pendingToolCalls = append(pendingToolCalls, dto.ToolCallRequest{
+				ID:   callID,
+				Type: "function",
+				Function: dto.FunctionRequest{
+					Name:      common.Interface2String(item["name"]),
+					Arguments: common.Interface2String(item["arguments"]),
+				},
+			})
+			continue
+		case "function_call_output":
+			flushToolCalls()
+			output, ok := item["output"].(string)
+			if !ok {
+				data, _ := common.Marshal(item["output"])
+				output = string(data)
+			}
+			messages = append(messages, dto.Message{
+				Role:       "tool",
+				Content:    output,
+				ToolCallId: common.Interface2String(item["call_id"]),
+			})
+			continue
+		case "", "message":
+		default:
+			// reasoning 等条目无法在对话接口中回放
+			continue
+		}
+
+		flushToolCalls()
+		role := common.Interface2String(item["role"])
+		if role == "" {
+			continue
+		}
+		if role == "developer" {
+			role = "system"
+		}
+		message := dto.Message{Role: role}
+		switch content := item["content"].(type) {
+		case string:
+			message.Content = content
+		case []any:
+			message.SetMediaContent(responsesContentToMediaContent(content))
+		default:
+			message.Content = ""
+		}
+		messages = append(messages, message)
+	}
+	flushToolCalls()
+	return messages, nil
+}
+
+func responsesContentToMediaContent(parts []any) []dto.MediaContent {
+	contents := make([]dto.MediaContent, 0, len(parts))
+	for _, p := range parts {
+		part, ok := p.(map[string]any)
+		if !ok {
+			continue
+		}
+		switch common.Interface2String(part["type"]) {
+		case "input_text", "output_text", "text":
+			contents = append(contents, dto.MediaContent{
+				Type: dto.ContentTypeText,
+				Text: common.Interface2String(part["text"]),
+			})
+		case "input_image":
+			imageURL := common.Interface2String(part["image_url"])
+			if imageURL == "" {
+				continue
+			}
+			contents = append(contents, dto.MediaContent{
+				Type: dto.ContentTypeImageURL,
+				ImageUrl: &dto.MessageImageUrl{
+					Url:    imageURL,
+					Detail: common.Interface2String(part["detail"]),
+				},
+			})
+		case "input_file":
+			contents = append(contents, dto.MediaContent{
+				Type: dto.ContentTypeFile,
+				File: &dto.MessageFile{
+					FileName: common.Interface2String(part["filename"]),
+					FileData: common.Interface2String(part["file_data"]),
+					FileId:   common.Interface2String(part["file_id"]),
+				},
+			})
+		case "input_audio":
+			contents = append(contents, dto.MediaContent{
+				Type:       dto.ContentTypeInputAudio,
+				InputAudio: part["input_audio"],
+			})
+		}
+	}
+	return contents
+}
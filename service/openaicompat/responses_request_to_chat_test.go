@@ -0,0 +1,199 @@
+package openaicompat
+
+import (
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponsesRequestToChatCompletionsRequestErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		req  *dto.OpenAIResponsesRequest
+	}{
+		{name: "nil request", req: nil},
+		{name: "missing model", req: &dto.OpenAIResponsesRequest{Input: []byte(`"hi"`)}},
+		{name: "previous response id", req: &dto.OpenAIResponsesRequest{Model: "gpt-4o", PreviousResponseID: "resp_1"}},
+		{name: "invalid input", req: &dto.OpenAIResponsesRequest{Model: "gpt-4o", Input: []byte(`{"role":"user"}`)}},
+		{name: "invalid tools", req: &dto.OpenAIResponsesRequest{Model: "gpt-4o", Tools: []byte(`{"type":"function"}`)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ResponsesRequestToChatCompletionsRequest(tt.req)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestResponsesRequestToChatCompletionsRequestMessages(t *testing.T) {
+	type wantMessage struct {
+		role       string
+		content    string
+		toolCallId string
+		toolCalls  []string // name(arguments)
+	}
+	tests := []struct {
+		name         string
+		instructions string
+		input        string
+		want         []wantMessage
+	}{
+		{
+			name:  "string input",
+			input: `"hello"`,
+			want:  []wantMessage{{role: "user", content: "hello"}},
+		},
+		{
+			name:         "instructions become system message",
+			instructions: `"be brief"`,
+			input:        `"hello"`,
+			want:         []wantMessage{{role: "system", content: "be brief"}, {role: "user", content: "hello"}},
+		},
+		{
+			name:         "blank instructions are dropped",
+			instructions: `"  "`,
+			input:        `"hello"`,
+			want:         []wantMessage{{role: "user", content: "hello"}},
+		},
+		{
+			name:  "developer role maps to system and content parts are joined",
+			input: `[{"role":"developer","content":"rules"},{"type":"message","role":"user","content":[{"type":"input_text","text":"a"},{"type":"input_text","text":"b"}]}]`,
+			want:  []wantMessage{{role: "system", content: "rules"}, {role: "user", content: "ab"}},
+		},
+		{
+			name: "consecutive function calls merge into one assistant message",
+			input: `[{"role":"user","content":"weather?"},
+				{"type":"function_call","call_id":"call_1","name":"get_weather","arguments":"{\"city\":\"a\"}"},
+				{"type":"function_call","id":"call_2","name":"get_weather","arguments":"{\"city\":\"b\"}"},
+				{"type":"function_call_output","call_id":"call_1","output":"sunny"},
+				{"type":"function_call_output","call_id":"call_2","output":{"temp":20}}]`,
+			want: []wantMessage{
+				{role: "user", content: "weather?"},
+				{role: "assistant", toolCalls: []string{`call_1:get_weather({"city":"a"})`, `call_2:get_weather({"city":"b"})`}},
+				{role: "tool", content: "sunny", toolCallId: "call_1"},
+				{role: "tool", content: `{"temp":20}`, toolCallId: "call_2"},
+			},
+		},
+		{
+			name: "function call attaches to preceding assistant text",
+			input: `[{"role":"assistant","content":"let me check"},
+				{"type":"function_call","call_id":"call_1","name":"lookup","arguments":"{}"}]`,
+			want: []wantMessage{
+				{role: "assistant", content: "let me check", toolCalls: []string{`call_1:lookup({})`}},
+			},
+		},
+		{
+			name:  "reasoning items are skipped",
+			input: `[{"type":"reasoning","summary":[]},{"role":"user","content":"hi"}]`,
+			want:  []wantMessage{{role: "user", content: "hi"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &dto.OpenAIResponsesRequest{Model: "gpt-4o", Input: []byte(tt.input)}
+			if tt.instructions != "" {
+				req.Instructions = []byte(tt.instructions)
+			}
+			out, err := ResponsesRequestToChatCompletionsRequest(req)
+			require.NoError(t, err)
+			require.Len(t, out.Messages, len(tt.want))
+			for i, want := range tt.want {
+				message := out.Messages[i]
+				require.Equal(t, want.role, message.Role)
+				require.Equal(t, want.content, messageText(&message))
+				require.Equal(t, want.toolCallId, message.ToolCallId)
+				var toolCalls []string
+				for _, toolCall := range message.ParseToolCalls() {
+					toolCalls = append(toolCalls, toolCall.ID+":"+toolCall.Function.Name+"("+toolCall.Function.Arguments+")")
+				}
+				require.Equal(t, want.toolCalls, toolCalls)
+			}
+		})
+	}
+}
+
+// messageText 拼接消息中的文本，多段内容以 []dto.MediaContent 保存，StringContent 无法读取
+func messageText(message *dto.Message) string {
+	if text, ok := message.Content.(string); ok {
+		return text
+	}
+	var text string
+	for _, content := range message.ParseContent() {
+		if content.Type == dto.ContentTypeText {
+			text += content.Text
+		}
+	}
+	return text
+}
+
+func TestResponsesRequestToChatCompletionsRequestMediaContent(t *testing.T) {
+	req := &dto.OpenAIResponsesRequest{
+		Model: "gpt-4o",
+		Input: []byte(`[{"role":"user","content":[
+			{"type":"input_text","text":"describe"},
+			{"type":"input_image","image_url":"https://example.com/a.png","detail":"low"},
+			{"type":"input_image"},
+			{"type":"input_file","filename":"a.pdf","file_id":"file_1"}]}]`),
+	}
+	out, err := ResponsesRequestToChatCompletionsRequest(req)
+	require.NoError(t, err)
+	require.Len(t, out.Messages, 1)
+
+	contents := out.Messages[0].ParseContent()
+	require.Len(t, contents, 3)
+	require.Equal(t, dto.ContentTypeText, contents[0].Type)
+	require.Equal(t, "describe", contents[0].Text)
+	require.Equal(t, dto.ContentTypeImageURL, contents[1].Type)
+	image := contents[1].GetImageMedia()
+	require.NotNil(t, image)
+	require.Equal(t, "https://example.com/a.png", image.Url)
+	require.Equal(t, "low", image.Detail)
+	require.Equal(t, dto.ContentTypeFile, contents[2].Type)
+}
+
+func TestResponsesRequestToChatCompletionsRequestOptions(t *testing.T) {
+	topP := 0.5
+	temperature := 0.2
+	req := &dto.OpenAIResponsesRequest{
+		Model:             "gpt-4o",
+		Input:             []byte(`"hi"`),
+		Stream:            true,
+		MaxOutputTokens:   128,
+		Temperature:       &temperature,
+		TopP:              &topP,
+		Reasoning:         &dto.Reasoning{Effort: "low"},
+		ParallelToolCalls: []byte(`false`),
+		Tools: []byte(`[
+			{"type":"function","name":"lookup","description":"find","parameters":{"type":"object"}},
+			{"type":"web_search"}]`),
+		ToolChoice: []byte(`{"type":"function","name":"lookup"}`),
+		Text:       []byte(`{"format":{"type":"json_schema","name":"answer","schema":{"type":"object"},"strict":true}}`),
+	}
+	out, err := ResponsesRequestToChatCompletionsRequest(req)
+	require.NoError(t, err)
+
+	require.True(t, out.Stream)
+	require.NotNil(t, out.StreamOptions)
+	require.True(t, out.StreamOptions.IncludeUsage)
+	require.Equal(t, uint(128), out.MaxTokens)
+	require.Equal(t, &temperature, out.Temperature)
+	require.Equal(t, 0.5, out.TopP)
+	require.Equal(t, "low", out.ReasoningEffort)
+	require.NotNil(t, out.ParallelTooCalls)
+	require.False(t, *out.ParallelTooCalls)
+
+	require.Len(t, out.Tools, 1)
+	require.Equal(t, "lookup", out.Tools[0].Function.Name)
+	require.Equal(t, "find", out.Tools[0].Function.Description)
+
+	toolChoice, err := common.Marshal(out.ToolChoice)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"type":"function","function":{"name":"lookup"}}`, string(toolChoice))
+
+	require.NotNil(t, out.ResponseFormat)
+	require.Equal(t, "json_schema", out.ResponseFormat.Type)
+	require.JSONEq(t, `{"name":"answer","schema":{"type":"object"},"strict":true}`, string(out.ResponseFormat.JsonSchema))
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/model"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+)
+
+// IsPlatformAPISupported 判断渠道是否支持 OpenAI 平台类接口（files 等），仅 OpenAI 兼容渠道支持
+func IsPlatformAPISupported(channelType int) bool {
+	if channelType == constant.ChannelTypeCustom {
+		return false
+	}
+	apiType, _ := common.ChannelType2APIType(channelType)
+	return apiType == constant.APITypeOpenAI
+}
+
+// GetPlatformRequestURL 拼接平台类接口的上游地址，path 形如 /v1/files/{file_id}
+func GetPlatformRequestURL(channel *model.Channel, path string) string {
+	baseURL := channel.GetBaseURL()
+	if baseURL == "" {
+		baseURL = constant.ChannelBaseURLs[channel.Type]
+	}
+	if channel.Type == constant.ChannelTypeAzure {
+		apiVersion := channel.Other
+		if apiVersion == "" {
+			apiVersion = constant.AzureDefaultAPIVersion
+		}
+		requestURL := "/openai" + strings.TrimPrefix(path, "/v1")
+		if strings.Contains(requestURL, "?") {
+			requestURL += "&api-version=" + apiVersion
+		} else {
+			requestURL += "?api-version=" + apiVersion
+		}
+		return relaycommon.GetFullRequestURL(baseURL, requestURL, channel.Type)
+	}
+	return relaycommon.GetFullRequestURL(baseURL, path, channel.Type)
+}
+
+// DoPlatformRequest 使用指定渠道与 key 请求上游平台类接口，调用方负责关闭响应体
+func DoPlatformRequest(ctx context.Context, channel *model.Channel, key string, method string, path string, body io.Reader, contentType string) (*http.Response, error) {
+	if !IsPlatformAPISupported(channel.Type) {
+		return nil, fmt.Errorf("channel type %d does not support this api", channel.Type)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, GetPlatformRequestURL(channel, path), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if channel.Type == constant.ChannelTypeAzure {
+		req.Header.Set("api-key", key)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	if channel.Type == constant.ChannelTypeOpenAI && channel.OpenAIOrganization != nil && *channel.OpenAIOrganization != "" {
+		req.Header.Set("OpenAI-Organization", *channel.OpenAIOrganization)
+	}
+	client, err := GetHttpClientWithProxy(channel.GetSetting().Proxy)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req)
+}
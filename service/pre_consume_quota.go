@@ -7,11 +7,13 @@ import (
 	"github.com/QuantumNous/new-api/common"
 	"github.com/QuantumNous/new-api/logger"
 	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/pkg/tracing"
 	relaycommon "github.com/QuantumNous/new-api/relay/common"
 	"github.com/QuantumNous/new-api/types"
 
 	"github.com/bytedance/gopkg/util/gopool"
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func ReturnPreConsumedQuota(c *gin.Context, relayInfo *relaycommon.RelayInfo) {
@@ -30,7 +32,11 @@ func ReturnPreConsumedQuota(c *gin.Context, relayInfo *relaycommon.RelayInfo) {
 
 // PreConsumeQuota checks if the user has enough quota to pre-consume.
 // It returns the pre-consumed quota if successful, or an error if not.
-func PreConsumeQuota(c *gin.Context, preConsumedQuota int, relayInfo *relaycommon.RelayInfo) *types.NewAPIError {
+func PreConsumeQuota(c *gin.Context, preConsumedQuota int, relayInfo *relaycommon.RelayInfo) (newAPIError *types.NewAPIError) {
+	_, span := tracing.Start(c.Request.Context(), "service.PreConsumeQuota", attribute.Int("quota", preConsumedQuota))
+	defer func() {
+		tracing.End(span, newAPIError)
+	}()
 	userQuota, err := model.GetUserQuota(relayInfo.UserId, false)
 	if err != nil {
 		return types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry())
@@ -42,6 +48,11 @@ func PreConsumeQuota(c *gin.Context, preConsumedQuota int, relayInfo *relaycommo
 		return types.NewErrorWithStatusCode(fmt.Errorf("预扣费额度失败, 用户剩余额度: %s, 需要预扣费额度: %s", logger.FormatQuota(userQuota), logger.FormatQuota(preConsumedQuota)), types.ErrorCodeInsufficientUserQuota, http.StatusForbidden, types.ErrOptionWithSkipRetry(), types.ErrOptionWithNoRecordErrorLog())
 	}
 
+	// 预算按预估额度检查，信任额度时同样生效
+	if budgetErr := CheckBudgets(relayInfo, preConsumedQuota); budgetErr != nil {
+		return budgetErr
+	}
+
 	trustQuota := common.GetTrustQuota()
 
 	relayInfo.UserQuota = userQuota
@@ -68,12 +79,52 @@ func PreConsumeQuota(c *gin.Context, preConsumedQuota int, relayInfo *relaycommo
 		if err != nil {
 			return types.NewErrorWithStatusCode(err, types.ErrorCodePreConsumeTokenQuotaFailed, http.StatusForbidden, types.ErrOptionWithSkipRetry(), types.ErrOptionWithNoRecordErrorLog())
 		}
-		err = model.DecreaseUserQuota(relayInfo.UserId, preConsumedQuota)
+		err = model.DecreaseUserQuota(relayInfo.UserId, preConsumedQuota, RelayQuotaLedgerRef(relayInfo, preConsumedQuota))
 		if err != nil {
 			return types.NewError(err, types.ErrorCodeUpdateDataError, types.ErrOptionWithSkipRetry())
 		}
+		recordBudgetSpend(relayInfo, preConsumedQuota)
 		logger.LogInfo(c, fmt.Sprintf("用户 %d 预扣费 %s, 预扣费后剩余额度: %s", relayInfo.UserId, logger.FormatQuota(preConsumedQuota), logger.FormatQuota(userQuota-preConsumedQuota)))
 	}
 	relayInfo.FinalPreConsumedQuota = preConsumedQuota
 	return nil
 }
+
+// TopUpPreConsumedQuota 已预扣费额度低于 quota 时追加预扣差额，用于请求中途切换到更贵的模型
+func TopUpPreConsumedQuota(c *gin.Context, quota int, relayInfo *relaycommon.RelayInfo) *types.NewAPIError {
+	delta := quota - relayInfo.FinalPreConsumedQuota
+	if delta <= 0 {
+		return nil
+	}
+	newAPIError := addPreConsumedQuota(relayInfo, delta, func(userQuota int) error {
+		return fmt.Errorf("预扣费额度失败, 用户剩余额度: %s, 需要追加预扣费额度: %s", logger.FormatQuota(userQuota), logger.FormatQuota(delta))
+	})
+	if newAPIError != nil {
+		return newAPIError
+	}
+	logger.LogInfo(c, fmt.Sprintf("用户 %d 追加预扣费 %s, 共预扣费 %s", relayInfo.UserId, logger.FormatQuota(delta), logger.FormatQuota(relayInfo.FinalPreConsumedQuota)))
+	return nil
+}
+
+// addPreConsumedQuota 在已预扣费额度之上追加预扣 delta，用户额度不足时返回 insufficient 生成的错误
+func addPreConsumedQuota(relayInfo *relaycommon.RelayInfo, delta int, insufficient func(userQuota int) error) *types.NewAPIError {
+	userQuota, err := model.GetUserQuota(relayInfo.UserId, false)
+	if err != nil {
+		return types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry())
+	}
+	if userQuota < delta {
+		return types.NewErrorWithStatusCode(insufficient(userQuota), types.ErrorCodeInsufficientUserQuota, http.StatusForbidden, types.ErrOptionWithSkipRetry(), types.ErrOptionWithNoRecordErrorLog())
+	}
+	if budgetErr := CheckBudgets(relayInfo, delta); budgetErr != nil {
+		return budgetErr
+	}
+	if err := PreConsumeTokenQuota(relayInfo, delta); err != nil {
+		return types.NewErrorWithStatusCode(err, types.ErrorCodePreConsumeTokenQuotaFailed, http.StatusForbidden, types.ErrOptionWithSkipRetry(), types.ErrOptionWithNoRecordErrorLog())
+	}
+	if err := model.DecreaseUserQuota(relayInfo.UserId, delta, RelayQuotaLedgerRef(relayInfo, delta)); err != nil {
+		return types.NewError(err, types.ErrorCodeUpdateDataError, types.ErrOptionWithSkipRetry())
+	}
+	recordBudgetSpend(relayInfo, delta)
+	relayInfo.FinalPreConsumedQuota += delta
+	return nil
+}
@@ -0,0 +1,245 @@
+package service
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 排队中的请求检查渠道是否恢复的间隔，渠道的限流状态与在途请求数只在本节点内存中，因此需要轮询
+const relayQueuePollInterval = 200 * time.Millisecond
+
+type relayQueueWaiter struct {
+	priority int
+	seq      uint64
+	index    int
+}
+
+// relayQueueHeap 优先级高的在前，优先级相同时先到先得
+type relayQueueHeap []*relayQueueWaiter
+
+func (h relayQueueHeap) Len() int { return len(h) }
+
+func (h relayQueueHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h relayQueueHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *relayQueueHeap) Push(x any) {
+	waiter := x.(*relayQueueWaiter)
+	waiter.index = len(*h)
+	*h = append(*h, waiter)
+}
+
+func (h *relayQueueHeap) Pop() any {
+	old := *h
+	n := len(old)
+	waiter := old[n-1]
+	old[n-1] = nil
+	waiter.index = -1
+	*h = old[:n-1]
+	return waiter
+}
+
+// relayQueue 分组下某个模型的等待队列，只保存在本节点内存中
+type relayQueue struct {
+	group   string
+	model   string
+	mu      sync.Mutex
+	waiters relayQueueHeap
+	changed chan struct{} // 队首变化时关闭并替换，唤醒等待中的请求
+
+	totalQueued   int64
+	totalTimeouts int64
+	totalWait     time.Duration
+	maxWait       time.Duration
+}
+
+var (
+	relayQueues   sync.Map // group + "\x00" + model -> *relayQueue
+	relayQueueSeq atomic.Uint64
+)
+
+func getRelayQueue(group string, modelName string) *relayQueue {
+	key := group + "\x00" + modelName
+	if queue, ok := relayQueues.Load(key); ok {
+		return queue.(*relayQueue)
+	}
+	queue, _ := relayQueues.LoadOrStore(key, &relayQueue{group: group, model: modelName, changed: make(chan struct{})})
+	return queue.(*relayQueue)
+}
+
+func (q *relayQueue) push(priority int, maxSize int) (*relayQueueWaiter, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if maxSize > 0 && q.waiters.Len() >= maxSize {
+		return nil, false
+	}
+	waiter := &relayQueueWaiter{priority: priority, seq: relayQueueSeq.Add(1)}
+	heap.Push(&q.waiters, waiter)
+	q.totalQueued++
+	return waiter, true
+}
+
+// head 返回当前请求是否位于队首，以及队首变化时会被关闭的通道
+func (q *relayQueue) head(waiter *relayQueueWaiter) (bool, <-chan struct{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.waiters.Len() > 0 && q.waiters[0] == waiter, q.changed
+}
+
+func (q *relayQueue) remove(waiter *relayQueueWaiter, wait time.Duration, timeout bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if waiter.index >= 0 {
+		heap.Remove(&q.waiters, waiter.index)
+	}
+	q.totalWait += wait
+	if wait > q.maxWait {
+		q.maxWait = wait
+	}
+	if timeout {
+		q.totalTimeouts++
+	}
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// RelayQueueStat 等待队列统计，用于性能监控
+type RelayQueueStat struct {
+	Group         string  `json:"group"`
+	Model         string  `json:"model"`
+	Depth         int     `json:"depth"`          // 当前排队请求数
+	TotalQueued   int64   `json:"total_queued"`   // 累计排队请求数
+	TotalTimeouts int64   `json:"total_timeouts"` // 累计等待超时数
+	AvgWaitMs     float64 `json:"avg_wait_ms"`
+	MaxWaitMs     int64   `json:"max_wait_ms"`
+}
+
+// GetRelayQueueStats 获取本节点所有等待队列的统计信息
+func GetRelayQueueStats() []RelayQueueStat {
+	stats := make([]RelayQueueStat, 0)
+	relayQueues.Range(func(_, value any) bool {
+		queue := value.(*relayQueue)
+		queue.mu.Lock()
+		stat := RelayQueueStat{
+			Group:         queue.group,
+			Model:         queue.model,
+			Depth:         queue.waiters.Len(),
+			TotalQueued:   queue.totalQueued,
+			TotalTimeouts: queue.totalTimeouts,
+			MaxWaitMs:     queue.maxWait.Milliseconds(),
+		}
+		if finished := queue.totalQueued - int64(queue.waiters.Len()); finished > 0 {
+			stat.AvgWaitMs = float64(queue.totalWait.Milliseconds()) / float64(finished)
+		}
+		queue.mu.Unlock()
+		stats = append(stats, stat)
+		return true
+	})
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Group != stats[j].Group {
+			return stats[i].Group < stats[j].Group
+		}
+		return stats[i].Model < stats[j].Model
+	})
+	return stats
+}
+
+func relayQueueError(c *gin.Context, code types.ErrorCode, message string, retryAfter time.Duration) *types.NewAPIError {
+	if retryAfter > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+	return types.NewErrorWithStatusCode(errors.New(message), code, http.StatusTooManyRequests, types.ErrOptionWithSkipRetry())
+}
+
+// WaitRelayQueue 分组下该模型的渠道全部被上游限流或达到最大并发数时排队等待，直到有渠道恢复或超过最长等待时间。
+// 排队顺序按用户分组的优先级，keepAlive 不为空时每隔 keepAliveInterval 调用一次，用于流式请求发送 SSE ping。
+// 渠道列表在开始排队前读取一次，未开启内存缓存时从数据库查询
+func WaitRelayQueue(c *gin.Context, group string, modelName string, keepAliveInterval time.Duration, keepAlive func() error) *types.NewAPIError {
+	setting := operation_setting.GetRelayQueueSetting()
+	if !setting.Enabled {
+		return nil
+	}
+	maxWait := time.Duration(setting.MaxWaitSeconds) * time.Second
+	if maxWait <= 0 {
+		return nil
+	}
+	channels, err := model.GetModelChannels(group, modelName)
+	if err != nil {
+		logger.LogError(c, fmt.Sprintf("获取分组 %s 下模型 %s 的渠道失败: %s", group, modelName, err.Error()))
+		return nil
+	}
+	if !model.IsModelChannelsSaturated(channels) {
+		return nil
+	}
+	queue := getRelayQueue(group, modelName)
+	userGroup := common.GetContextKeyString(c, constant.ContextKeyUserGroup)
+	waiter, ok := queue.push(operation_setting.GetRelayQueuePriority(userGroup), setting.MaxQueueSize)
+	if !ok {
+		return relayQueueError(c, types.ErrorCodeRelayQueueFull, fmt.Sprintf("分组 %s 下模型 %s 的渠道均被上游限流或已达到最大并发数，且排队请求数已达上限", group, modelName), maxWait)
+	}
+	logger.LogInfo(c, fmt.Sprintf("分组 %s 下模型 %s 的渠道均被上游限流或已达到最大并发数，开始排队", group, modelName))
+
+	start := time.Now()
+	timeout := false
+	defer func() {
+		queue.remove(waiter, time.Since(start), timeout)
+	}()
+
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	poll := time.NewTicker(relayQueuePollInterval)
+	defer poll.Stop()
+	var keepAliveC <-chan time.Time
+	if keepAlive != nil && keepAliveInterval > 0 {
+		keepAliveTicker := time.NewTicker(keepAliveInterval)
+		defer keepAliveTicker.Stop()
+		keepAliveC = keepAliveTicker.C
+	}
+
+	for {
+		isHead, changed := queue.head(waiter)
+		if isHead && !model.IsModelChannelsSaturated(channels) {
+			logger.LogInfo(c, fmt.Sprintf("排队结束，等待 %s", time.Since(start).Round(time.Millisecond)))
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-poll.C:
+		case <-keepAliveC:
+			if err := keepAlive(); err != nil {
+				return types.NewErrorWithStatusCode(err, types.ErrorCodeRelayQueueTimeout, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+			}
+		case <-timer.C:
+			timeout = true
+			return relayQueueError(c, types.ErrorCodeRelayQueueTimeout, fmt.Sprintf("分组 %s 下模型 %s 的渠道均被上游限流或已达到最大并发数，排队 %d 秒后仍无可用渠道", group, modelName, setting.MaxWaitSeconds), 0)
+		case <-c.Request.Context().Done():
+			return types.NewErrorWithStatusCode(c.Request.Context().Err(), types.ErrorCodeRelayQueueTimeout, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+		}
+	}
+}
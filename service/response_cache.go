@@ -0,0 +1,283 @@
+package service
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/pkg/cachex"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	relayconstant "github.com/QuantumNous/new-api/relay/constant"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+	"github.com/gin-gonic/gin"
+	"github.com/samber/hot"
+	"github.com/tidwall/gjson"
+)
+
+const responseCacheNamespace = "new-api:response_cache:v1"
+
+var (
+	responseCacheOnce sync.Once
+	responseCache     *cachex.HybridCache[ResponseCacheEntry]
+)
+
+// ResponseCacheEntry 缓存的响应。流式请求的响应会先合并为非流式响应再缓存，命中时按需合成 SSE 数据
+type ResponseCacheEntry struct {
+	Body  string    `json:"body"`
+	Usage dto.Usage `json:"usage"`
+	Group string    `json:"group,omitempty"` // 写入缓存时实际使用的分组
+}
+
+func getResponseCache() *cachex.HybridCache[ResponseCacheEntry] {
+	responseCacheOnce.Do(func() {
+		setting := operation_setting.GetResponseCacheSetting()
+		capacity := setting.MaxEntries
+		if capacity <= 0 {
+			capacity = 10_000
+		}
+		ttl := setting.TTLSeconds
+		if ttl <= 0 {
+			ttl = 3600
+		}
+		responseCache = cachex.NewHybridCache[ResponseCacheEntry](cachex.HybridCacheConfig[ResponseCacheEntry]{
+			Namespace: cachex.Namespace(responseCacheNamespace),
+			Redis:     common.RDB,
+			RedisEnabled: func() bool {
+				return common.RedisEnabled && common.RDB != nil
+			},
+			RedisCodec: cachex.JSONCodec[ResponseCacheEntry]{},
+			Memory: func() *hot.HotCache[string, ResponseCacheEntry] {
+				// janitor 需要默认 TTL，写入时仍按配置的 TTL 设置
+				return hot.NewHotCache[string, ResponseCacheEntry](hot.LRU, capacity).
+					WithTTL(time.Duration(ttl) * time.Second).
+					WithJanitor().
+					Build()
+			},
+		})
+	})
+	return responseCache
+}
+
+// GetResponseCacheKey 由规范化后的请求体、模型与分组生成缓存 key，请求不可缓存时返回 false。
+// 只缓存 embedding 请求与 temperature 为 0 的对话请求，客户端可以通过 Cache-Control: no-cache 跳过缓存
+func GetResponseCacheKey(c *gin.Context, modelName string, group string) (string, bool) {
+	if !operation_setting.IsResponseCacheModel(modelName) {
+		return "", false
+	}
+	cacheControl := c.GetHeader("Cache-Control")
+	if strings.Contains(cacheControl, "no-cache") || strings.Contains(cacheControl, "no-store") {
+		return "", false
+	}
+	body, err := common.GetRequestBody(c)
+	if err != nil {
+		return "", false
+	}
+	switch relayconstant.Path2RelayMode(c.Request.URL.Path) {
+	case relayconstant.RelayModeEmbeddings:
+	case relayconstant.RelayModeChatCompletions:
+		temperature := gjson.GetBytes(body, "temperature")
+		if temperature.Type != gjson.Number || temperature.Float() != 0 || gjson.GetBytes(body, "n").Int() > 1 {
+			return "", false
+		}
+	default:
+		return "", false
+	}
+
+	var normalized map[string]any
+	if err := common.Unmarshal(body, &normalized); err != nil {
+		return "", false
+	}
+	// 流式与非流式请求共用缓存，user 字段不影响响应内容
+	delete(normalized, "stream")
+	delete(normalized, "stream_options")
+	delete(normalized, "user")
+	// map 序列化时 key 有序，字段顺序与空白不同的请求会得到相同的 hash
+	normalizedBody, err := common.Marshal(normalized)
+	if err != nil {
+		return "", false
+	}
+	hash := hex.EncodeToString(common.Sha256Raw(normalizedBody))
+	return fmt.Sprintf("%s:%s:%s", group, modelName, hash), true
+}
+
+// LookupResponseCache 在选择渠道之前查询响应缓存，缓存 key 与命中的响应保存在上下文中，转发成功后使用同一个 key 写入缓存。
+// 命中时不选择渠道，auto 分组按写入缓存时实际使用的分组计费
+func LookupResponseCache(c *gin.Context, modelName string, group string) bool {
+	key, ok := GetResponseCacheKey(c, modelName, group)
+	if !ok {
+		return false
+	}
+	common.SetContextKey(c, constant.ContextKeyResponseCacheKey, key)
+	entry, ok := GetResponseCache(key)
+	if !ok {
+		return false
+	}
+	if group == "auto" && entry.Group != "" {
+		common.SetContextKey(c, constant.ContextKeyAutoGroup, entry.Group)
+	}
+	common.SetContextKey(c, constant.ContextKeyResponseCacheEntry, entry)
+	return true
+}
+
+func GetResponseCache(key string) (*ResponseCacheEntry, bool) {
+	entry, found, err := getResponseCache().Get(key)
+	if err != nil {
+		common.SysError(fmt.Sprintf("response cache get failed: key=%s, err=%v", key, err))
+		return nil, false
+	}
+	if !found {
+		return nil, false
+	}
+	return &entry, true
+}
+
+// StoreResponseCache 缓存上游返回的响应，body 为写给客户端的原始数据
+func StoreResponseCache(key string, info *relaycommon.RelayInfo, body []byte) error {
+	var entry ResponseCacheEntry
+	if info.IsStream {
+		response, err := aggregateChatStream(body)
+		if err != nil {
+			return err
+		}
+		if response.Usage.TotalTokens == 0 {
+			// 客户端没有要求返回 usage 时流中没有用量信息，按本地计数估算
+			text := ""
+			for _, choice := range response.Choices {
+				text += choice.Message.ReasoningContent + choice.Message.StringContent()
+			}
+			response.Usage.PromptTokens = info.GetEstimatePromptTokens()
+			response.Usage.CompletionTokens = CountTextToken(text, info.OriginModelName)
+			response.Usage.TotalTokens = response.Usage.PromptTokens + response.Usage.CompletionTokens
+		}
+		data, err := common.Marshal(response)
+		if err != nil {
+			return err
+		}
+		entry = ResponseCacheEntry{Body: string(data), Usage: response.Usage, Group: info.UsingGroup}
+	} else {
+		var response dto.SimpleResponse
+		if err := common.Unmarshal(body, &response); err != nil {
+			return err
+		}
+		if response.Error != nil {
+			return errors.New("response contains error")
+		}
+		entry = ResponseCacheEntry{Body: string(body), Usage: response.Usage, Group: info.UsingGroup}
+	}
+	// 没有用量信息的响应无法在命中时计费
+	if entry.Usage.TotalTokens == 0 {
+		return errors.New("response has no usage")
+	}
+
+	ttl := operation_setting.GetResponseCacheSetting().TTLSeconds
+	if ttl <= 0 {
+		ttl = 3600
+	}
+	return getResponseCache().SetWithTTL(key, entry, time.Duration(ttl)*time.Second)
+}
+
+type streamChoiceState struct {
+	content      strings.Builder
+	reasoning    strings.Builder
+	toolCalls    []dto.ToolCallResponse
+	finishReason string
+}
+
+// aggregateChatStream 把对话请求的 SSE 响应合并为非流式响应
+func aggregateChatStream(data []byte) (*dto.OpenAITextResponse, error) {
+	response := &dto.OpenAITextResponse{Object: "chat.completion"}
+	states := make(map[int]*streamChoiceState)
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if !bytes.HasPrefix(line, []byte("data:")) {
+			continue
+		}
+		payload := bytes.TrimSpace(line[len("data:"):])
+		if len(payload) == 0 || string(payload) == "[DONE]" {
+			continue
+		}
+		var chunk dto.ChatCompletionsStreamResponse
+		if err := common.Unmarshal(payload, &chunk); err != nil {
+			return nil, err
+		}
+		if response.Id == "" {
+			response.Id = chunk.Id
+			response.Model = chunk.Model
+			response.Created = chunk.Created
+		}
+		if chunk.Usage != nil {
+			response.Usage = *chunk.Usage
+		}
+		for _, choice := range chunk.Choices {
+			state, ok := states[choice.Index]
+			if !ok {
+				state = &streamChoiceState{}
+				states[choice.Index] = state
+			}
+			state.content.WriteString(choice.Delta.GetContentString())
+			state.reasoning.WriteString(choice.Delta.GetReasoningContent())
+			for _, toolCall := range choice.Delta.ToolCalls {
+				index := len(state.toolCalls) - 1
+				if toolCall.Index != nil {
+					index = *toolCall.Index
+				} else if toolCall.ID != "" {
+					index = len(state.toolCalls)
+				}
+				if index < 0 {
+					index = 0
+				}
+				for len(state.toolCalls) <= index {
+					state.toolCalls = append(state.toolCalls, dto.ToolCallResponse{})
+				}
+				merged := &state.toolCalls[index]
+				if toolCall.ID != "" {
+					merged.ID = toolCall.ID
+				}
+				if toolCall.Type != nil {
+					merged.Type = toolCall.Type
+				}
+				if toolCall.Function.Name != "" {
+					merged.Function.Name = toolCall.Function.Name
+				}
+				merged.Function.Arguments += toolCall.Function.Arguments
+			}
+			if choice.FinishReason != nil && *choice.FinishReason != "" {
+				state.finishReason = *choice.FinishReason
+			}
+		}
+	}
+	if response.Id == "" && len(states) == 0 {
+		return nil, errors.New("empty stream response")
+	}
+
+	indexes := make([]int, 0, len(states))
+	for index := range states {
+		indexes = append(indexes, index)
+	}
+	slices.Sort(indexes)
+	for _, index := range indexes {
+		state := states[index]
+		message := dto.Message{
+			Role:             "assistant",
+			Content:          state.content.String(),
+			ReasoningContent: state.reasoning.String(),
+		}
+		if len(state.toolCalls) > 0 {
+			message.SetToolCalls(state.toolCalls)
+		}
+		response.Choices = append(response.Choices, dto.OpenAITextResponseChoice{
+			Index:        index,
+			Message:      message,
+			FinishReason: state.finishReason,
+		})
+	}
+	return response, nil
+}
@@ -0,0 +1,177 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func sseData(chunks ...string) []byte {
+	var b strings.Builder
+	for _, chunk := range chunks {
+		b.WriteString("data: ")
+		b.WriteString(chunk)
+		b.WriteString("\n\n")
+	}
+	return []byte(b.String())
+}
+
+func TestAggregateChatStream(t *testing.T) {
+	type wantChoice struct {
+		content      string
+		reasoning    string
+		finishReason string
+		toolCalls    []string // id:name(arguments)
+	}
+	tests := []struct {
+		name        string
+		data        []byte
+		wantErr     bool
+		wantId      string
+		wantTokens  int
+		wantChoices []wantChoice
+	}{
+		{
+			name: "text with usage",
+			data: sseData(
+				`{"id":"chatcmpl-1","model":"gpt-4o","created":1700000000,"choices":[{"index":0,"delta":{"role":"assistant","content":"Hel"}}]}`,
+				`{"id":"chatcmpl-1","choices":[{"index":0,"delta":{"content":"lo"},"finish_reason":"stop"}]}`,
+				`{"id":"chatcmpl-1","choices":[],"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`,
+				`[DONE]`,
+			),
+			wantId:      "chatcmpl-1",
+			wantTokens:  5,
+			wantChoices: []wantChoice{{content: "Hello", finishReason: "stop"}},
+		},
+		{
+			name: "reasoning and multiple choices",
+			data: sseData(
+				`{"id":"chatcmpl-2","choices":[{"index":1,"delta":{"content":"B"}},{"index":0,"delta":{"reasoning_content":"think"}}]}`,
+				`{"id":"chatcmpl-2","choices":[{"index":0,"delta":{"content":"A"},"finish_reason":"stop"},{"index":1,"delta":{},"finish_reason":"length"}]}`,
+			),
+			wantId: "chatcmpl-2",
+			wantChoices: []wantChoice{
+				{content: "A", reasoning: "think", finishReason: "stop"},
+				{content: "B", finishReason: "length"},
+			},
+		},
+		{
+			name: "tool call arguments are merged by index",
+			data: sseData(
+				`{"id":"chatcmpl-3","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"a","arguments":"{\"x\""}}]}}]}`,
+				`{"id":"chatcmpl-3","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":":1}"}}]}}]}`,
+				`{"id":"chatcmpl-3","choices":[{"index":0,"delta":{"tool_calls":[{"index":1,"id":"call_2","type":"function","function":{"name":"b","arguments":"{}"}}]},"finish_reason":"tool_calls"}]}`,
+			),
+			wantId: "chatcmpl-3",
+			wantChoices: []wantChoice{{
+				finishReason: "tool_calls",
+				toolCalls:    []string{`call_1:a({"x":1})`, `call_2:b({})`},
+			}},
+		},
+		{
+			name: "tool calls without index follow their id",
+			data: sseData(
+				`{"id":"chatcmpl-4","choices":[{"index":0,"delta":{"tool_calls":[{"id":"call_1","type":"function","function":{"name":"a","arguments":"{"}}]}}]}`,
+				`{"id":"chatcmpl-4","choices":[{"index":0,"delta":{"tool_calls":[{"function":{"arguments":"}"}}]}}]}`,
+				`{"id":"chatcmpl-4","choices":[{"index":0,"delta":{"tool_calls":[{"id":"call_2","type":"function","function":{"name":"b","arguments":"[]"}}]}}]}`,
+			),
+			wantId: "chatcmpl-4",
+			wantChoices: []wantChoice{{
+				toolCalls: []string{`call_1:a({})`, `call_2:b([])`},
+			}},
+		},
+		{
+			name:    "empty stream",
+			data:    sseData(`[DONE]`),
+			wantErr: true,
+		},
+		{
+			name:    "invalid chunk",
+			data:    sseData(`{"id":`),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := aggregateChatStream(tt.data)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantId, response.Id)
+			require.Equal(t, "chat.completion", response.Object)
+			require.Equal(t, tt.wantTokens, response.Usage.TotalTokens)
+			require.Len(t, response.Choices, len(tt.wantChoices))
+			for i, want := range tt.wantChoices {
+				choice := response.Choices[i]
+				require.Equal(t, i, choice.Index)
+				require.Equal(t, "assistant", choice.Message.Role)
+				require.Equal(t, want.content, choice.Message.StringContent())
+				require.Equal(t, want.reasoning, choice.Message.ReasoningContent)
+				require.Equal(t, want.finishReason, choice.FinishReason)
+				var toolCalls []string
+				for _, toolCall := range choice.Message.ParseToolCalls() {
+					toolCalls = append(toolCalls, toolCall.ID+":"+toolCall.Function.Name+"("+toolCall.Function.Arguments+")")
+				}
+				require.Equal(t, want.toolCalls, toolCalls)
+			}
+		})
+	}
+}
+
+func TestGetResponseCacheKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setting := operation_setting.GetResponseCacheSetting()
+	enabled := setting.Enabled
+	setting.Enabled = true
+	t.Cleanup(func() { setting.Enabled = enabled })
+
+	newContext := func(path, body, cacheControl string) *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		c.Request.Header.Set("Content-Type", "application/json")
+		if cacheControl != "" {
+			c.Request.Header.Set("Cache-Control", cacheControl)
+		}
+		return c
+	}
+	key := func(path, body, cacheControl string) (string, bool) {
+		return GetResponseCacheKey(newContext(path, body, cacheControl), "gpt-4o", "default")
+	}
+
+	base, ok := key("/v1/chat/completions", `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hi"}]}`, "")
+	require.True(t, ok)
+	require.True(t, strings.HasPrefix(base, "default:gpt-4o:"))
+
+	same, ok := key("/v1/chat/completions", `{"messages":[{"role":"user","content":"hi"}], "stream":true,"user":"u1","temperature":0,"model":"gpt-4o"}`, "")
+	require.True(t, ok)
+	require.Equal(t, base, same, "stream, user and field order do not change the key")
+
+	tests := []struct {
+		name         string
+		path         string
+		body         string
+		cacheControl string
+		want         bool
+	}{
+		{name: "embeddings", path: "/v1/embeddings", body: `{"model":"gpt-4o","input":"hi"}`, want: true},
+		{name: "temperature not set", path: "/v1/chat/completions", body: `{"model":"gpt-4o"}`},
+		{name: "temperature above 0", path: "/v1/chat/completions", body: `{"model":"gpt-4o","temperature":0.5}`},
+		{name: "multiple choices", path: "/v1/chat/completions", body: `{"model":"gpt-4o","temperature":0,"n":2}`},
+		{name: "no-cache", path: "/v1/embeddings", body: `{"model":"gpt-4o","input":"hi"}`, cacheControl: "no-cache"},
+		{name: "not cacheable endpoint", path: "/v1/responses", body: `{"model":"gpt-4o","temperature":0}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ok := key(tt.path, tt.body, tt.cacheControl)
+			require.Equal(t, tt.want, ok)
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+)
+
+// normalizeResponsesInput 把 input 统一为条目数组，字符串 input 视为一条用户消息
+func normalizeResponsesInput(input json.RawMessage) ([]json.RawMessage, error) {
+	if len(input) == 0 {
+		return nil, nil
+	}
+	if common.GetJsonType(input) == "string" {
+		var text string
+		if err := common.Unmarshal(input, &text); err != nil {
+			return nil, err
+		}
+		item, err := common.Marshal(map[string]any{
+			"type":    "message",
+			"role":    "user",
+			"content": text,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return []json.RawMessage{item}, nil
+	}
+	var items []json.RawMessage
+	if err := common.Unmarshal(input, &items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// 沿 previous_response_id 回溯的最大轮数，防止异常数据导致无限回溯
+const responseStoreMaxChainDepth = 1000
+
+// ErrStoredResponseUnavailable 引用的响应或其历史无法使用（已过期或超过大小限制），需要返回给客户端
+var ErrStoredResponseUnavailable = errors.New("stored response unavailable")
+
+// storedResponseChain 从 stored 沿 PreviousResponseId 回溯，按时间顺序返回整条会话的记录
+func storedResponseChain(userId int, stored *model.StoredResponse) ([]*model.StoredResponse, error) {
+	chain := []*model.StoredResponse{stored}
+	for current := stored; ; {
+		if current.Oversized {
+			return nil, fmt.Errorf("%w: response '%s' exceeds the response store size limit and was not stored", ErrStoredResponseUnavailable, current.ResponseId)
+		}
+		if current.PreviousResponseId == "" {
+			break
+		}
+		if len(chain) >= responseStoreMaxChainDepth {
+			return nil, fmt.Errorf("%w: conversation of response '%s' exceeds %d turns", ErrStoredResponseUnavailable, stored.ResponseId, responseStoreMaxChainDepth)
+		}
+		previous, exist, err := model.GetStoredResponse(userId, current.PreviousResponseId)
+		if err != nil {
+			return nil, err
+		}
+		if !exist {
+			return nil, fmt.Errorf("%w: previous response '%s' in the conversation has expired", ErrStoredResponseUnavailable, current.PreviousResponseId)
+		}
+		chain = append(chain, previous)
+		current = previous
+	}
+	slices.Reverse(chain)
+	return chain, nil
+}
+
+// StoredResponseInputItems 返回响应的完整输入条目：之前各轮的输入与输出，加上本轮的输入
+func StoredResponseInputItems(userId int, stored *model.StoredResponse) ([]json.RawMessage, error) {
+	chain, err := storedResponseChain(userId, stored)
+	if err != nil {
+		return nil, err
+	}
+	var items []json.RawMessage
+	for i, record := range chain {
+		var input []json.RawMessage
+		if err := common.UnmarshalJsonStr(record.Input, &input); err != nil {
+			return nil, err
+		}
+		items = append(items, input...)
+		if i == len(chain)-1 {
+			break
+		}
+		var output []json.RawMessage
+		if err := common.UnmarshalJsonStr(record.Output, &output); err != nil {
+			return nil, err
+		}
+		items = append(items, output...)
+	}
+	return items, nil
+}
+
+// ExpandPreviousResponse 把 previous_response_id 展开为完整的输入历史：之前各轮的输入与输出、本轮的输入。
+// 本地没有该响应时返回 false，请求保持不变；会话中的记录已过期或超过大小限制时返回 ErrStoredResponseUnavailable
+func ExpandPreviousResponse(userId int, request *dto.OpenAIResponsesRequest) (bool, error) {
+	stored, exist, err := model.GetStoredResponse(userId, request.PreviousResponseID)
+	if err != nil || !exist {
+		return false, err
+	}
+	history, err := StoredResponseInputItems(userId, stored)
+	if err != nil {
+		return false, err
+	}
+	var output []json.RawMessage
+	if err := common.UnmarshalJsonStr(stored.Output, &output); err != nil {
+		return false, err
+	}
+	current, err := normalizeResponsesInput(request.Input)
+	if err != nil {
+		return false, err
+	}
+	history = append(history, output...)
+	history = append(history, current...)
+	input, err := common.Marshal(history)
+	if err != nil {
+		return false, err
+	}
+	request.Input = input
+	request.PreviousResponseID = ""
+	return true, nil
+}
+
+// StoreResponsesResponse 保存响应供后续请求引用。request 为客户端的原始请求（未展开 previous_response_id），
+// 只保存本轮的输入并记录上一轮的 id，避免每轮重复保存完整历史
+func StoreResponsesResponse(userId int, request *dto.OpenAIResponsesRequest, response *dto.OpenAIResponsesResponse) error {
+	setting := operation_setting.GetResponseStoreSetting()
+	if !setting.Enabled || response == nil || response.ID == "" {
+		return nil
+	}
+	// 客户端显式传入 store: false 时不保存
+	if len(request.Store) > 0 {
+		var store bool
+		if err := common.Unmarshal(request.Store, &store); err == nil && !store {
+			return nil
+		}
+	}
+
+	items, err := normalizeResponsesInput(request.Input)
+	if err != nil {
+		return err
+	}
+	if items == nil {
+		items = []json.RawMessage{}
+	}
+	input, err := common.Marshal(items)
+	if err != nil {
+		return err
+	}
+	output, err := common.Marshal(response.Output)
+	if err != nil {
+		return err
+	}
+	body, err := common.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	ttl := setting.TTLSeconds
+	if ttl <= 0 {
+		ttl = 30 * 24 * 3600
+	}
+	stored := &model.StoredResponse{
+		ResponseId:         response.ID,
+		PreviousResponseId: request.PreviousResponseID,
+		UserId:             userId,
+		Model:              response.Model,
+		Input:              string(input),
+		Output:             string(output),
+		Response:           string(body),
+	}
+	// 超过大小限制时只保存元数据，之后引用该响应时返回明确的错误，而不是找不到
+	if setting.MaxBodyBytes > 0 && len(input)+len(output)+len(body) > setting.MaxBodyBytes {
+		stored.Input = "[]"
+		stored.Output = "[]"
+		stored.Response = ""
+		stored.Oversized = true
+	}
+	return model.SaveStoredResponse(stored, time.Duration(ttl)*time.Second)
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+
+	"github.com/stretchr/testify/require"
+)
+
+func setupResponseStoreTestDB(t *testing.T) {
+	t.Helper()
+	setupTestDB(t, &model.StoredResponse{})
+	setting := operation_setting.GetResponseStoreSetting()
+	origSetting := *setting
+	setting.Enabled = true
+	t.Cleanup(func() {
+		*setting = origSetting
+	})
+}
+
+// storeTurn 保存一轮对话，输出为一条 assistant 文本
+func storeTurn(t *testing.T, id string, previousId string, input string, reply string) {
+	t.Helper()
+	request := &dto.OpenAIResponsesRequest{Model: "gpt-4o", PreviousResponseID: previousId, Input: []byte(input)}
+	response := &dto.OpenAIResponsesResponse{
+		ID:    id,
+		Model: "gpt-4o",
+		Output: []dto.ResponsesOutput{{
+			Type:    "message",
+			Role:    "assistant",
+			Content: []dto.ResponsesOutputContent{{Type: "output_text", Text: reply}},
+		}},
+	}
+	require.NoError(t, StoreResponsesResponse(1, request, response))
+}
+
+func TestExpandPreviousResponse_WalksChain(t *testing.T) {
+	setupResponseStoreTestDB(t)
+	storeTurn(t, "resp_1", "", `"q1"`, "a1")
+	storeTurn(t, "resp_2", "resp_1", `[{"role":"user","content":"q2"}]`, "a2")
+
+	// 每轮只保存本轮的输入
+	stored, exist, err := model.GetStoredResponse(1, "resp_2")
+	require.NoError(t, err)
+	require.True(t, exist)
+	require.Equal(t, "resp_1", stored.PreviousResponseId)
+	require.JSONEq(t, `[{"role":"user","content":"q2"}]`, stored.Input)
+
+	request := &dto.OpenAIResponsesRequest{Model: "gpt-4o", PreviousResponseID: "resp_2", Input: []byte(`"q3"`)}
+	found, err := ExpandPreviousResponse(1, request)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Empty(t, request.PreviousResponseID)
+
+	var items []map[string]any
+	require.NoError(t, common.Unmarshal(request.Input, &items))
+	var texts []string
+	for _, item := range items {
+		switch content := item["content"].(type) {
+		case string:
+			texts = append(texts, content)
+		case []any:
+			texts = append(texts, common.Interface2String(content[0].(map[string]any)["text"]))
+		}
+	}
+	require.Equal(t, []string{"q1", "a1", "q2", "a2", "q3"}, texts)
+
+	// 其他用户无法引用
+	found, err = ExpandPreviousResponse(2, &dto.OpenAIResponsesRequest{PreviousResponseID: "resp_2"})
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
+func TestExpandPreviousResponse_Unavailable(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(t *testing.T)
+	}{
+		{
+			name: "expired ancestor",
+			prepare: func(t *testing.T) {
+				storeTurn(t, "resp_1", "", `"q1"`, "a1")
+				storeTurn(t, "resp_2", "resp_1", `"q2"`, "a2")
+				require.NoError(t, model.DB.Model(&model.StoredResponse{}).Where("response_id = ?", "resp_1").
+					Update("expires_at", common.GetTimestamp()-1).Error)
+			},
+		},
+		{
+			name: "oversized response",
+			prepare: func(t *testing.T) {
+				operation_setting.GetResponseStoreSetting().MaxBodyBytes = 1024
+				storeTurn(t, "resp_2", "", `"q1"`, strings.Repeat("a", 2048))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupResponseStoreTestDB(t)
+			tt.prepare(t)
+			request := &dto.OpenAIResponsesRequest{Model: "gpt-4o", PreviousResponseID: "resp_2", Input: []byte(`"q3"`)}
+			found, err := ExpandPreviousResponse(1, request)
+			require.ErrorIs(t, err, ErrStoredResponseUnavailable)
+			require.False(t, found)
+			require.Equal(t, "resp_2", request.PreviousResponseID)
+		})
+	}
+}
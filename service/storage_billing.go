@@ -0,0 +1,95 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/model"
+
+	"github.com/shopspring/decimal"
+)
+
+// 上游文件与 Gemini 上下文缓存都按存储量与存储时长计费，由后台任务定期结算
+
+// calcStorageQuota 计算存储费用：amount 按 unit 折算，[from, until) 按 period 秒折算，price 单位为 美元 / unit / period
+func calcStorageQuota(amount int64, unit int64, from int64, until int64, period int64, price float64, groupRatio float64) int {
+	if price <= 0 || amount <= 0 || until <= from {
+		return 0
+	}
+	quota := decimal.NewFromInt(amount).Div(decimal.NewFromInt(unit)).
+		Mul(decimal.NewFromInt(until - from).Div(decimal.NewFromInt(period))).
+		Mul(decimal.NewFromFloat(price)).
+		Mul(decimal.NewFromFloat(common.QuotaPerUnit)).
+		Mul(decimal.NewFromFloat(groupRatio))
+	return int(quota.IntPart())
+}
+
+// getBillingToken 读取后台结算的费用所属的令牌，令牌已删除或读取失败时返回 nil
+func getBillingToken(tokenId int) *model.Token {
+	if tokenId <= 0 {
+		return nil
+	}
+	token, err := model.GetTokenById(tokenId)
+	if err != nil {
+		common.SysLog(fmt.Sprintf("failed to get token %d for background billing: %s", tokenId, err.Error()))
+		return nil
+	}
+	return token
+}
+
+// chargeStorageQuota 扣除存储费用。存储费用不是一次请求，只累加已用额度，不增加请求次数；
+// 费用同时计入创建该对象的令牌与预算，令牌已删除时只扣除用户额度
+func chargeStorageQuota(userId int, tokenId int, channelId int, quota int, refId string) error {
+	ledgerRef := model.QuotaLedgerRef{Source: model.QuotaLedgerSourceConsume, RefId: refId}
+	if err := model.DecreaseUserQuota(userId, quota, ledgerRef); err != nil {
+		return err
+	}
+	model.UpdateUserUsedQuota(userId, quota, ledgerRef)
+	token := getBillingToken(tokenId)
+	if token != nil {
+		if err := model.DecreaseTokenQuota(token.Id, token.Key, quota, ledgerRef); err != nil {
+			common.SysLog(fmt.Sprintf("failed to decrease quota of token %d for storage billing: %s", tokenId, err.Error()))
+		}
+	}
+	RecordBackgroundBudgetSpend(userId, token, quota)
+	model.UpdateChannelUsedQuota(channelId, quota)
+	return nil
+}
+
+type storageBill struct {
+	quota     int
+	count     int
+	size      int64
+	channelId int
+	tokenId   int
+	group     string
+}
+
+// storageBills 一次结算中每个用户的存储费用，同一用户合并记录一条消费日志
+type storageBills map[int]*storageBill
+
+func (b storageBills) add(userId int, channelId int, tokenId int, group string, quota int, size int64) {
+	bill, ok := b[userId]
+	if !ok {
+		bill = &storageBill{channelId: channelId, tokenId: tokenId, group: group}
+		b[userId] = bill
+	}
+	bill.quota += quota
+	bill.count++
+	bill.size += size
+}
+
+func (b storageBills) record(modelName string, describe func(bill *storageBill) (string, map[string]interface{})) {
+	for userId, bill := range b {
+		content, other := describe(bill)
+		model.RecordBackgroundConsumeLog(userId, model.RecordConsumeLogParams{
+			ChannelId: bill.channelId,
+			TokenId:   bill.tokenId,
+			ModelName: modelName,
+			Quota:     bill.quota,
+			Group:     bill.group,
+			Content:   content,
+			Other:     other,
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NewStreamQuotaGuard 创建流式响应的额度检查，每输出 StreamTopUpTokens 个 token 按已输出的用量追加预扣费，
+// 预扣额度始终覆盖到下一个检查点。用户、令牌额度或预算不足时返回错误，由调用方中断响应。
+// 按次计费与免费模型不需要检查，返回 nil
+func NewStreamQuotaGuard(c *gin.Context, relayInfo *relaycommon.RelayInfo) func(text string) *types.NewAPIError {
+	interval := operation_setting.GetQuotaSetting().StreamTopUpTokens
+	if interval <= 0 || !relayInfo.IsStream || relayInfo.PriceData.UsePrice || relayInfo.PriceData.FreeModel {
+		return nil
+	}
+	outputTokens := 0
+	nextCheck := interval
+	return func(text string) *types.NewAPIError {
+		if text == "" {
+			return nil
+		}
+		outputTokens += EstimateTokenByModel(relayInfo.OriginModelName, text)
+		if outputTokens < nextCheck {
+			return nil
+		}
+		nextCheck = outputTokens + interval
+		priceData := relayInfo.PriceData
+		ratio := priceData.ModelRatio * priceData.GroupRatioInfo.GroupRatio
+		quota := int((float64(relayInfo.GetEstimatePromptTokens()) + float64(nextCheck)*priceData.CompletionRatio) * ratio)
+		delta := quota - relayInfo.FinalPreConsumedQuota
+		if delta <= 0 {
+			return nil
+		}
+		return topUpStreamQuota(c, relayInfo, delta, outputTokens)
+	}
+}
+
+// RealtimeQuotaGuard 实时会话的额度检查。实时会话在每次响应完成时结算，响应过程中每输出 StreamTopUpTokens 个 token
+// 按尚未结算的用量追加预扣费，追加的额度在结算时抵扣
+type RealtimeQuotaGuard struct {
+	mu              sync.Mutex
+	c               *gin.Context
+	relayInfo       *relaycommon.RelayInfo
+	interval        int
+	uncheckedTokens int
+	reserved        int
+}
+
+// NewRealtimeQuotaGuard 按次计费与免费模型不需要检查，返回 nil
+func NewRealtimeQuotaGuard(c *gin.Context, relayInfo *relaycommon.RelayInfo) *RealtimeQuotaGuard {
+	interval := operation_setting.GetQuotaSetting().StreamTopUpTokens
+	if interval <= 0 || relayInfo.PriceData.UsePrice || relayInfo.PriceData.FreeModel {
+		return nil
+	}
+	return &RealtimeQuotaGuard{c: c, relayInfo: relayInfo, interval: interval}
+}
+
+// Check 记录新输出的 token，到达检查点时按 usage 追加预扣费，额度不足时返回错误
+func (g *RealtimeQuotaGuard) Check(outputTokens int, usage *dto.RealtimeUsage) *types.NewAPIError {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.uncheckedTokens += outputTokens
+	if g.uncheckedTokens < g.interval {
+		return nil
+	}
+	g.uncheckedTokens = 0
+	delta := calculateWssQuota(g.c, g.relayInfo, usage) - g.reserved
+	if delta <= 0 {
+		return nil
+	}
+	if newAPIError := topUpStreamQuota(g.c, g.relayInfo, delta, usage.OutputTokens); newAPIError != nil {
+		return newAPIError
+	}
+	g.reserved += delta
+	return nil
+}
+
+// Settle 结算一次用量并抵扣已追加预扣的额度，结算失败时已预扣的额度保留
+func (g *RealtimeQuotaGuard) Settle(c *gin.Context, relayInfo *relaycommon.RelayInfo, usage *dto.RealtimeUsage) error {
+	if g == nil {
+		return PreWssConsumeQuota(c, relayInfo, usage, 0)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := PreWssConsumeQuota(c, relayInfo, usage, g.reserved); err != nil {
+		return err
+	}
+	relayInfo.FinalPreConsumedQuota -= g.reserved
+	g.reserved = 0
+	g.uncheckedTokens = 0
+	return nil
+}
+
+func topUpStreamQuota(c *gin.Context, relayInfo *relaycommon.RelayInfo, delta int, outputTokens int) *types.NewAPIError {
+	newAPIError := addPreConsumedQuota(relayInfo, delta, func(userQuota int) error {
+		return fmt.Errorf("用户额度不足, 已输出 %d tokens, 剩余额度: %s, 需要追加预扣费额度: %s", outputTokens, logger.FormatQuota(userQuota), logger.FormatQuota(delta))
+	})
+	if newAPIError != nil {
+		return newAPIError
+	}
+	logger.LogInfo(c, fmt.Sprintf("用户 %d 流式响应已输出 %d tokens, 追加预扣费 %s", relayInfo.UserId, outputTokens, logger.FormatQuota(delta)))
+	return nil
+}
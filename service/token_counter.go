@@ -415,6 +415,24 @@ func CountTokenInput(input any, model string) int {
 	return CountTokenInput(fmt.Sprintf("%v", input), model)
 }
 
+// CountTokenMetaInput 本地估算请求的输入 token 数，用于渠道不支持 count_tokens / countTokens 时，媒体按固定值估算
+func CountTokenMetaInput(meta *types.TokenCountMeta, model string) int {
+	tkm := CountTokenInput(meta.CombineText, model)
+	for _, file := range meta.Files {
+		switch file.FileType {
+		case types.FileTypeImage:
+			tkm += 520
+		case types.FileTypeAudio:
+			tkm += 256
+		case types.FileTypeVideo:
+			tkm += 4096 * 2
+		default:
+			tkm += 4096
+		}
+	}
+	return tkm
+}
+
 func CountAudioTokenInput(audioBase64 string, audioFormat string) (int, error) {
 	if audioBase64 == "" {
 		return 0, nil
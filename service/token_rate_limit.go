@@ -0,0 +1,147 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/common/limiter"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 令牌并发名额的过期时间，请求运行期间定期续期，进程异常退出时未释放的名额最多保留这么久
+const tokenConcurrencyTTL = 30 * time.Minute
+
+var tokenMemoryLimiter = limiter.NewMemoryLimiter()
+
+// takeTokenBucket 按每分钟 limit 的速率从令牌桶中扣除 requested，返回剩余数量与回满所需时间。
+// 令牌桶按秒补充，容量与请求数放大 60 倍以支持小于每秒 1 个的速率
+func takeTokenBucket(ctx context.Context, key string, limit int, requested int) (bool, int64, time.Duration, error) {
+	opts := []limiter.Option{
+		limiter.WithCapacity(int64(limit) * 60),
+		limiter.WithRate(int64(limit)),
+		limiter.WithRequested(int64(requested) * 60),
+	}
+	var (
+		allowed   bool
+		remaining int64
+		err       error
+	)
+	if common.RedisEnabled {
+		allowed, remaining, err = limiter.New(context.Background(), common.RDB).Take(ctx, key, opts...)
+		if err != nil {
+			return false, 0, 0, err
+		}
+	} else {
+		allowed, remaining = tokenMemoryLimiter.Take(key, opts...)
+	}
+	reset := time.Duration(int64(limit)*60-remaining) * time.Second / time.Duration(limit)
+	return allowed, remaining / 60, reset, nil
+}
+
+func setRateLimitHeaders(c *gin.Context, kind string, limit int, remaining int64, reset time.Duration) {
+	c.Header("x-ratelimit-limit-"+kind, strconv.Itoa(limit))
+	c.Header("x-ratelimit-remaining-"+kind, strconv.FormatInt(remaining, 10))
+	c.Header("x-ratelimit-reset-"+kind, reset.String())
+}
+
+func rateLimitExceededError(c *gin.Context, message string, retryAfter time.Duration) *types.NewAPIError {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	return types.NewErrorWithStatusCode(fmt.Errorf("%s", message), types.ErrorCodeRateLimitExceeded, http.StatusTooManyRequests, types.ErrOptionWithSkipRetry())
+}
+
+// CheckTokenRpmLimit 检查令牌每分钟请求数限制，并返回 x-ratelimit-*-requests 响应头
+func CheckTokenRpmLimit(c *gin.Context) *types.NewAPIError {
+	limit := common.GetContextKeyInt(c, constant.ContextKeyTokenRpmLimit)
+	if limit <= 0 {
+		return nil
+	}
+	tokenId := common.GetContextKeyInt(c, constant.ContextKeyTokenId)
+	allowed, remaining, reset, err := takeTokenBucket(c.Request.Context(), fmt.Sprintf("tokenRateLimit:rpm:%d", tokenId), limit, 1)
+	if err != nil {
+		return types.NewErrorWithStatusCode(err, types.ErrorCodeRateLimitExceeded, http.StatusInternalServerError, types.ErrOptionWithSkipRetry())
+	}
+	setRateLimitHeaders(c, "requests", limit, remaining, reset)
+	if !allowed {
+		return rateLimitExceededError(c, fmt.Sprintf("该令牌已达到请求速率限制：每分钟最多 %d 次请求", limit), time.Minute/time.Duration(limit))
+	}
+	return nil
+}
+
+// CheckTokenTpmLimit 按预估的输入 token 数检查令牌每分钟 token 数限制，并返回 x-ratelimit-*-tokens 响应头
+func CheckTokenTpmLimit(c *gin.Context, tokens int) *types.NewAPIError {
+	limit := common.GetContextKeyInt(c, constant.ContextKeyTokenTpmLimit)
+	if limit <= 0 {
+		return nil
+	}
+	if tokens > limit {
+		return types.NewErrorWithStatusCode(fmt.Errorf("请求预估 %d tokens，超过该令牌每分钟 %d tokens 的限制", tokens, limit), types.ErrorCodeRateLimitExceeded, http.StatusTooManyRequests, types.ErrOptionWithSkipRetry())
+	}
+	tokenId := common.GetContextKeyInt(c, constant.ContextKeyTokenId)
+	allowed, remaining, reset, err := takeTokenBucket(c.Request.Context(), fmt.Sprintf("tokenRateLimit:tpm:%d", tokenId), limit, max(tokens, 1))
+	if err != nil {
+		return types.NewErrorWithStatusCode(err, types.ErrorCodeRateLimitExceeded, http.StatusInternalServerError, types.ErrOptionWithSkipRetry())
+	}
+	setRateLimitHeaders(c, "tokens", limit, remaining, reset)
+	if !allowed {
+		retryAfter := time.Duration(int64(tokens)-remaining) * time.Minute / time.Duration(limit)
+		return rateLimitExceededError(c, fmt.Sprintf("该令牌已达到 token 速率限制：每分钟最多 %d tokens", limit), retryAfter)
+	}
+	return nil
+}
+
+// AcquireTokenConcurrency 占用令牌的一个并发名额，请求结束后必须调用返回的 release 释放
+func AcquireTokenConcurrency(c *gin.Context) (func(), *types.NewAPIError) {
+	limit := common.GetContextKeyInt(c, constant.ContextKeyTokenConcurrencyLimit)
+	if limit <= 0 {
+		return func() {}, nil
+	}
+	key := fmt.Sprintf("tokenConcurrency:%d", common.GetContextKeyInt(c, constant.ContextKeyTokenId))
+	if !common.RedisEnabled {
+		if ok, _ := tokenMemoryLimiter.Acquire(key, int64(limit)); !ok {
+			return nil, rateLimitExceededError(c, fmt.Sprintf("该令牌已达到并发请求数限制：最多同时处理 %d 个请求", limit), time.Second)
+		}
+		return func() { tokenMemoryLimiter.Release(key) }, nil
+	}
+
+	rl := limiter.New(context.Background(), common.RDB)
+	ok, _, member, err := rl.Acquire(c.Request.Context(), key, int64(limit), tokenConcurrencyTTL)
+	if err != nil {
+		return nil, types.NewErrorWithStatusCode(err, types.ErrorCodeRateLimitExceeded, http.StatusInternalServerError, types.ErrOptionWithSkipRetry())
+	}
+	if !ok {
+		return nil, rateLimitExceededError(c, fmt.Sprintf("该令牌已达到并发请求数限制：最多同时处理 %d 个请求", limit), time.Second)
+	}
+	// 请求运行期间定期续期名额，避免长时间的流式请求在结束前名额过期导致并发数超出限制
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(tokenConcurrencyTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// 续期与请求结束并发进行，不能再使用请求的 gin.Context
+				if err := rl.Refresh(context.Background(), key, member, tokenConcurrencyTTL); err != nil {
+					common.SysError(fmt.Sprintf("token concurrency refresh failed: key=%s, err=%v", key, err))
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		// 请求可能已被客户端取消，释放时不能使用请求的 context
+		if err := rl.Release(context.Background(), key, member); err != nil {
+			logger.LogError(c, fmt.Sprintf("token concurrency release failed: %s", err.Error()))
+		}
+	}, nil
+}
@@ -0,0 +1,63 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UseVirtualModelTarget 切换到虚拟模型链中的第 index 个模型，返回该模型及其使用的分组。
+// 不同模型的渠道池互不相关，因此同时清除 auto 分组已选择的分组与重试进度
+func UseVirtualModelTarget(c *gin.Context, index int) (operation_setting.VirtualModelTarget, string, bool) {
+	chain, ok := operation_setting.GetVirtualModelChain(common.GetContextKeyString(c, constant.ContextKeyVirtualModel))
+	if !ok || index < 0 || index >= len(chain) {
+		return operation_setting.VirtualModelTarget{}, "", false
+	}
+	target := chain[index]
+	group := target.Group
+	if group == "" {
+		group = common.GetContextKeyString(c, constant.ContextKeyVirtualModelGroup)
+	}
+	common.SetContextKey(c, constant.ContextKeyVirtualModelIndex, index)
+	common.SetContextKey(c, constant.ContextKeyUsingGroup, group)
+	common.SetContextKey(c, constant.ContextKeyAutoGroup, "")
+	common.SetContextKey(c, constant.ContextKeyAutoGroupIndex, 0)
+	common.SetContextKey(c, constant.ContextKeyAutoGroupRetryIndex, 0)
+	return target, group, true
+}
+
+// HasNextVirtualModelTarget 当前请求是虚拟模型，且链中还有未尝试的模型
+func HasNextVirtualModelTarget(c *gin.Context) bool {
+	chain, ok := operation_setting.GetVirtualModelChain(common.GetContextKeyString(c, constant.ContextKeyVirtualModel))
+	if !ok {
+		return false
+	}
+	return common.GetContextKeyInt(c, constant.ContextKeyVirtualModelIndex)+1 < len(chain)
+}
+
+// SelectVirtualModelChannel 按顺序为虚拟模型链中的模型选择渠道，返回第一个有可用渠道的模型
+func SelectVirtualModelChannel(c *gin.Context, virtualModel string, requestGroup string) (*model.Channel, string, error) {
+	common.SetContextKey(c, constant.ContextKeyVirtualModel, virtualModel)
+	common.SetContextKey(c, constant.ContextKeyVirtualModelGroup, requestGroup)
+	for i := 0; ; i++ {
+		target, group, ok := UseVirtualModelTarget(c, i)
+		if !ok {
+			break
+		}
+		channel, _, err := CacheGetRandomSatisfiedChannel(&RetryParam{
+			Ctx:        c,
+			ModelName:  target.Model,
+			TokenGroup: group,
+			Retry:      common.GetPointer(0),
+		})
+		if err == nil && channel != nil {
+			return channel, target.Model, nil
+		}
+	}
+	return nil, "", fmt.Errorf("虚拟模型 %s 链中的模型均无可用渠道", virtualModel)
+}
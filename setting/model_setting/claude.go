@@ -2,6 +2,7 @@ package model_setting
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/QuantumNous/new-api/setting/config"
 )
@@ -18,6 +19,7 @@ type ClaudeSettings struct {
 	DefaultMaxTokens                      map[string]int                 `json:"default_max_tokens"`
 	ThinkingAdapterEnabled                bool                           `json:"thinking_adapter_enabled"`
 	ThinkingAdapterBudgetTokensPercentage float64                        `json:"thinking_adapter_budget_tokens_percentage"`
+	AutoCacheControlModels                []string                       `json:"auto_cache_control_models"` // OpenAI 格式请求转换为 Claude 时自动插入 cache_control 断点的模型
 }
 
 // 默认配置
@@ -28,6 +30,7 @@ var defaultClaudeSettings = ClaudeSettings{
 		"default": 8192,
 	},
 	ThinkingAdapterBudgetTokensPercentage: 0.8,
+	AutoCacheControlModels:                []string{},
 }
 
 // 全局实例
@@ -73,3 +76,17 @@ func (c *ClaudeSettings) GetDefaultMaxTokens(model string) int {
 	}
 	return c.DefaultMaxTokens["default"]
 }
+
+// IsAutoCacheControlModel 判断模型是否配置为自动插入 cache_control 断点
+func (c *ClaudeSettings) IsAutoCacheControlModel(model string) bool {
+	target := strings.TrimSpace(model)
+	if target == "" {
+		return false
+	}
+	for _, entry := range c.AutoCacheControlModels {
+		if strings.TrimSpace(entry) == target {
+			return true
+		}
+	}
+	return false
+}
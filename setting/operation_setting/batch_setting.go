@@ -0,0 +1,27 @@
+package operation_setting
+
+import "github.com/QuantumNous/new-api/setting/config"
+
+// BatchSetting 批处理接口（/v1/batches）配置
+type BatchSetting struct {
+	BillingRatio          float64 `json:"billing_ratio"`           // 上游 batch 结算时的价格倍率，OpenAI batch 默认五折
+	NativeFallbackEnabled bool    `json:"native_fallback_enabled"` // 渠道不支持 batch 接口时由网关逐行转发执行
+	NativeConcurrency     int     `json:"native_concurrency"`      // 网关执行 batch 时的并发数
+}
+
+// 默认配置
+var batchSetting = BatchSetting{
+	BillingRatio:          0.5,
+	NativeFallbackEnabled: false,
+	NativeConcurrency:     4,
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("batch_setting", &batchSetting)
+}
+
+// GetBatchSetting 获取批处理接口配置
+func GetBatchSetting() *BatchSetting {
+	return &batchSetting
+}
@@ -3,9 +3,11 @@ package operation_setting
 import "github.com/QuantumNous/new-api/setting/config"
 
 type ChannelAffinityKeySource struct {
-	Type string `json:"type"` // context_int, context_string, gjson
+	Type string `json:"type"` // context_int, context_string, gjson, prompt_prefix_hash
 	Key  string `json:"key,omitempty"`
 	Path string `json:"path,omitempty"`
+	// prompt_prefix_hash: 除系统提示与工具外参与哈希的前 N 条消息，0 表示只使用系统提示与工具
+	PrefixMessages int `json:"prefix_messages,omitempty"`
 }
 
 type ChannelAffinityRule struct {
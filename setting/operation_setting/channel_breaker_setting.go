@@ -0,0 +1,32 @@
+package operation_setting
+
+import "github.com/QuantumNous/new-api/setting/config"
+
+// ChannelBreakerSetting 渠道与多 key 熔断配置，熔断状态只保存在内存中，不会修改数据库中的渠道状态
+type ChannelBreakerSetting struct {
+	Enabled                  bool `json:"enabled"`
+	FailureThreshold         int  `json:"failure_threshold"`           // 连续失败多少次后熔断
+	CooldownSeconds          int  `json:"cooldown_seconds"`            // 熔断后多久进入半开状态
+	MaxCooldownSeconds       int  `json:"max_cooldown_seconds"`        // 半开探测失败后冷却时间翻倍的上限
+	HalfOpenMaxProbes        int  `json:"half_open_max_probes"`        // 半开状态下同时进行的探测请求数上限
+	HalfOpenSuccessThreshold int  `json:"half_open_success_threshold"` // 半开状态下连续成功多少次后恢复
+}
+
+// 默认配置
+var channelBreakerSetting = ChannelBreakerSetting{
+	Enabled:                  false,
+	FailureThreshold:         5,
+	CooldownSeconds:          30,
+	MaxCooldownSeconds:       600,
+	HalfOpenMaxProbes:        1,
+	HalfOpenSuccessThreshold: 3,
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("channel_breaker_setting", &channelBreakerSetting)
+}
+
+func GetChannelBreakerSetting() *ChannelBreakerSetting {
+	return &channelBreakerSetting
+}
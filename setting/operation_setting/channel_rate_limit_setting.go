@@ -0,0 +1,29 @@
+package operation_setting
+
+import "github.com/QuantumNous/new-api/setting/config"
+
+// ChannelRateLimitSetting 根据上游返回的限流响应头（x-ratelimit-*、anthropic-ratelimit-*、retry-after）
+// 调整渠道与多 key 的选择顺序，限流状态只保存在内存中
+type ChannelRateLimitSetting struct {
+	Enabled                  bool    `json:"enabled"`
+	NearExhaustionRatio      float64 `json:"near_exhaustion_ratio"`       // 剩余额度低于上限的该比例时降低优先级
+	DefaultRetryAfterSeconds int     `json:"default_retry_after_seconds"` // 上游返回 429 但没有 retry-after 时的暂停时间
+	MaxRetryAfterSeconds     int     `json:"max_retry_after_seconds"`     // 暂停时间上限，避免异常的 retry-after 长期屏蔽 key
+}
+
+// 默认配置
+var channelRateLimitSetting = ChannelRateLimitSetting{
+	Enabled:                  true,
+	NearExhaustionRatio:      0.05,
+	DefaultRetryAfterSeconds: 10,
+	MaxRetryAfterSeconds:     600,
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("channel_rate_limit_setting", &channelRateLimitSetting)
+}
+
+func GetChannelRateLimitSetting() *ChannelRateLimitSetting {
+	return &channelRateLimitSetting
+}
@@ -0,0 +1,55 @@
+package operation_setting
+
+import "github.com/QuantumNous/new-api/setting/config"
+
+const (
+	ChannelSelectStrategyWeightedRandom = "weighted_random" // 按权重随机（默认）
+	ChannelSelectStrategyLeastLatency   = "least_latency"   // 实际转发延迟的 EWMA 最低
+	ChannelSelectStrategyLeastInflight  = "least_inflight"  // 当前在途请求最少
+	ChannelSelectStrategyErrorAware     = "error_aware"     // 按错误率降低权重后随机
+)
+
+// ChannelSelectSetting 同一优先级内的渠道选择策略，模型级配置优先于分组级配置
+type ChannelSelectSetting struct {
+	DefaultStrategy string            `json:"default_strategy"`
+	GroupStrategies map[string]string `json:"group_strategies"` // 分组 -> 策略
+	ModelStrategies map[string]string `json:"model_strategies"` // 模型 -> 策略
+	EWMAAlpha       float64           `json:"ewma_alpha"`       // 延迟与错误率 EWMA 的平滑系数，越大越看重最近的请求
+	ExploreRatio    float64           `json:"explore_ratio"`    // least_latency 下按权重随机探索的比例，避免慢渠道恢复后永远拿不到流量
+	MinWeightRatio  float64           `json:"min_weight_ratio"` // error_aware 下权重的最低保留比例
+	StatsTTLSeconds int               `json:"stats_ttl_seconds"`
+}
+
+// 默认配置
+var channelSelectSetting = ChannelSelectSetting{
+	DefaultStrategy: ChannelSelectStrategyWeightedRandom,
+	GroupStrategies: map[string]string{},
+	ModelStrategies: map[string]string{},
+	EWMAAlpha:       0.2,
+	ExploreRatio:    0.05,
+	MinWeightRatio:  0.05,
+	StatsTTLSeconds: 600,
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("channel_select_setting", &channelSelectSetting)
+}
+
+func GetChannelSelectSetting() *ChannelSelectSetting {
+	return &channelSelectSetting
+}
+
+// GetChannelSelectStrategy 获取分组与模型对应的渠道选择策略
+func GetChannelSelectStrategy(group string, model string) string {
+	if strategy, ok := channelSelectSetting.ModelStrategies[model]; ok && strategy != "" {
+		return strategy
+	}
+	if strategy, ok := channelSelectSetting.GroupStrategies[group]; ok && strategy != "" {
+		return strategy
+	}
+	if channelSelectSetting.DefaultStrategy == "" {
+		return ChannelSelectStrategyWeightedRandom
+	}
+	return channelSelectSetting.DefaultStrategy
+}
@@ -0,0 +1,25 @@
+package operation_setting
+
+import "github.com/QuantumNous/new-api/setting/config"
+
+// FileSetting 文件接口（/v1/files）配置
+type FileSetting struct {
+	DefaultModel           string `json:"default_model"`            // 上传时未指定 model 字段，用于选择渠道的模型
+	StorageBillingInterval int    `json:"storage_billing_interval"` // 存储计费结算间隔（分钟）
+}
+
+// 默认配置
+var fileSetting = FileSetting{
+	DefaultModel:           "gpt-4o-mini",
+	StorageBillingInterval: 60,
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("file_setting", &fileSetting)
+}
+
+// GetFileSetting 获取文件接口配置
+func GetFileSetting() *FileSetting {
+	return &fileSetting
+}
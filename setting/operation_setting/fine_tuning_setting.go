@@ -0,0 +1,25 @@
+package operation_setting
+
+import "github.com/QuantumNous/new-api/setting/config"
+
+// FineTuningSetting 微调接口（/v1/fine_tuning/jobs）配置
+type FineTuningSetting struct {
+	TrainingRatio  float64 `json:"training_ratio"`   // 训练 token 相对基础模型输入价格的倍率
+	ShareWithGroup bool    `json:"share_with_group"` // 微调模型是否允许同分组的其他用户使用
+}
+
+// 默认配置
+var fineTuningSetting = FineTuningSetting{
+	TrainingRatio:  1,
+	ShareWithGroup: false,
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("fine_tuning_setting", &fineTuningSetting)
+}
+
+// GetFineTuningSetting 获取微调接口配置
+func GetFineTuningSetting() *FineTuningSetting {
+	return &fineTuningSetting
+}
@@ -0,0 +1,47 @@
+package operation_setting
+
+import (
+	"strings"
+
+	"github.com/QuantumNous/new-api/setting/config"
+)
+
+// GeminiCacheSetting Gemini 上下文缓存（cachedContents）配置
+type GeminiCacheSetting struct {
+	StoragePrices          map[string]float64 `json:"storage_prices"`           // 按模型前缀配置的存储价格（美元 / 百万 token / 小时）
+	DefaultStoragePrice    float64            `json:"default_storage_price"`    // 未匹配到模型前缀时的存储价格，为 0 时不计费
+	StorageBillingInterval int                `json:"storage_billing_interval"` // 存储计费结算间隔（分钟）
+}
+
+// 默认配置
+var geminiCacheSetting = GeminiCacheSetting{
+	StoragePrices: map[string]float64{
+		"gemini-2.5-pro":   4.50,
+		"gemini-2.5-flash": 1.00,
+		"gemini-2.0-flash": 1.00,
+	},
+	DefaultStoragePrice:    1.00,
+	StorageBillingInterval: 60,
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("gemini_cache_setting", &geminiCacheSetting)
+}
+
+func GetGeminiCacheSetting() *GeminiCacheSetting {
+	return &geminiCacheSetting
+}
+
+// GetGeminiCacheStoragePrice 按最长前缀匹配模型的缓存存储价格
+func GetGeminiCacheStoragePrice(modelName string) float64 {
+	price := geminiCacheSetting.DefaultStoragePrice
+	matched := ""
+	for prefix, p := range geminiCacheSetting.StoragePrices {
+		if strings.HasPrefix(modelName, prefix) && len(prefix) > len(matched) {
+			matched = prefix
+			price = p
+		}
+	}
+	return price
+}
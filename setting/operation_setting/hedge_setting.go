@@ -0,0 +1,38 @@
+package operation_setting
+
+import (
+	"slices"
+
+	"github.com/QuantumNous/new-api/setting/config"
+)
+
+// HedgeSetting 对冲请求配置：首个渠道在 DelayMs 内没有返回首字节时，向另一个渠道发送相同请求，取先返回者
+type HedgeSetting struct {
+	Enabled bool     `json:"enabled"`
+	DelayMs int      `json:"delay_ms"` // 首个渠道等待多久没有响应后发起对冲请求
+	Models  []string `json:"models"`   // 默认开启对冲的模型，令牌也可以单独开启
+}
+
+// 默认配置
+var hedgeSetting = HedgeSetting{
+	Enabled: false,
+	DelayMs: 2000,
+	Models:  []string{},
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("hedge_setting", &hedgeSetting)
+}
+
+func GetHedgeSetting() *HedgeSetting {
+	return &hedgeSetting
+}
+
+// ShouldHedge 令牌开启了对冲或模型在对冲列表中时返回 true
+func ShouldHedge(tokenHedging bool, modelName string) bool {
+	if !hedgeSetting.Enabled || hedgeSetting.DelayMs <= 0 {
+		return false
+	}
+	return tokenHedging || slices.Contains(hedgeSetting.Models, modelName)
+}
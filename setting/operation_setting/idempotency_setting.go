@@ -0,0 +1,32 @@
+package operation_setting
+
+import "github.com/QuantumNous/new-api/setting/config"
+
+// IdempotencySetting 中继接口 Idempotency-Key 配置：同一令牌下相同 key 的重复请求等待原请求完成后直接返回原响应，不再重复计费
+type IdempotencySetting struct {
+	Enabled            bool `json:"enabled"`
+	TTLSeconds         int  `json:"ttl_seconds"`          // 已完成请求的响应保留时间
+	LockTimeoutSeconds int  `json:"lock_timeout_seconds"` // 处理中标记的有效期，防止节点异常退出后 key 永久不可用
+	WaitTimeoutSeconds int  `json:"wait_timeout_seconds"` // 重复请求等待原请求完成的最长时间
+	MaxEntries         int  `json:"max_entries"`          // 未启用 Redis 时内存缓存的最大条数
+	MaxBodyBytes       int  `json:"max_body_bytes"`       // 超过该大小的响应不保存，重复请求返回 409
+}
+
+// 默认配置
+var idempotencySetting = IdempotencySetting{
+	Enabled:            true,
+	TTLSeconds:         86400,
+	LockTimeoutSeconds: 600,
+	WaitTimeoutSeconds: 300,
+	MaxEntries:         10_000,
+	MaxBodyBytes:       4 << 20,
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("idempotency_setting", &idempotencySetting)
+}
+
+func GetIdempotencySetting() *IdempotencySetting {
+	return &idempotencySetting
+}
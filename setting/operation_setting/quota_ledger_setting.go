@@ -0,0 +1,24 @@
+package operation_setting
+
+import "github.com/QuantumNous/new-api/setting/config"
+
+// QuotaLedgerSetting 额度账本对账设置，账本本身始终记录，对账任务只在主节点运行
+type QuotaLedgerSetting struct {
+	ReconcileEnabled         bool `json:"reconcile_enabled"`
+	ReconcileIntervalMinutes int  `json:"reconcile_interval_minutes"`
+}
+
+// 默认配置
+var quotaLedgerSetting = QuotaLedgerSetting{
+	ReconcileEnabled:         true,
+	ReconcileIntervalMinutes: 60,
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("quota_ledger_setting", &quotaLedgerSetting)
+}
+
+func GetQuotaLedgerSetting() *QuotaLedgerSetting {
+	return &quotaLedgerSetting
+}
@@ -4,11 +4,15 @@ import "github.com/QuantumNous/new-api/setting/config"
 
 type QuotaSetting struct {
 	EnableFreeModelPreConsume bool `json:"enable_free_model_pre_consume"` // 是否对免费模型启用预消耗
+	BudgetNotifyPercent       int  `json:"budget_notify_percent"`         // 预算使用达到该百分比时通知用户，0 表示不通知
+	StreamTopUpTokens         int  `json:"stream_top_up_tokens"`          // 流式响应每输出多少 token 追加一次预扣费，额度不足时中断响应，0 表示不追加
 }
 
 // 默认配置
 var quotaSetting = QuotaSetting{
 	EnableFreeModelPreConsume: true,
+	BudgetNotifyPercent:       80,
+	StreamTopUpTokens:         1000,
 }
 
 func init() {
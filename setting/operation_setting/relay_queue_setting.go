@@ -0,0 +1,33 @@
+package operation_setting
+
+import "github.com/QuantumNous/new-api/setting/config"
+
+// RelayQueueSetting 分组下某个模型的渠道全部被上游限流或达到最大并发数时，请求在本节点排队等待而不是直接失败
+type RelayQueueSetting struct {
+	Enabled        bool           `json:"enabled"`
+	MaxQueueSize   int            `json:"max_queue_size"`   // 每个分组与模型的最大排队请求数，超出后直接返回 429
+	MaxWaitSeconds int            `json:"max_wait_seconds"` // 单个请求的最长排队时间
+	GroupPriority  map[string]int `json:"group_priority"`   // 用户分组 -> 排队优先级，数值越大越先处理，未配置的分组为 0
+}
+
+// 默认配置
+var relayQueueSetting = RelayQueueSetting{
+	Enabled:        false,
+	MaxQueueSize:   100,
+	MaxWaitSeconds: 30,
+	GroupPriority:  map[string]int{},
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("relay_queue_setting", &relayQueueSetting)
+}
+
+func GetRelayQueueSetting() *RelayQueueSetting {
+	return &relayQueueSetting
+}
+
+// GetRelayQueuePriority 获取用户分组的排队优先级
+func GetRelayQueuePriority(userGroup string) int {
+	return relayQueueSetting.GroupPriority[userGroup]
+}
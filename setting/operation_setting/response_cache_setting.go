@@ -0,0 +1,44 @@
+package operation_setting
+
+import (
+	"slices"
+
+	"github.com/QuantumNous/new-api/setting/config"
+)
+
+// ResponseCacheSetting 响应缓存配置：相同的 embedding 请求与 temperature 为 0 的对话请求直接返回缓存的响应
+type ResponseCacheSetting struct {
+	Enabled      bool     `json:"enabled"`
+	TTLSeconds   int      `json:"ttl_seconds"`
+	MaxEntries   int      `json:"max_entries"`    // 未启用 Redis 时内存缓存的最大条数
+	MaxBodyBytes int      `json:"max_body_bytes"` // 超过该大小的响应不缓存
+	BillingRatio float64  `json:"billing_ratio"`  // 命中缓存时的计费倍率，0 为免费
+	Models       []string `json:"models"`         // 允许缓存的模型，为空时不限制
+}
+
+// 默认配置
+var responseCacheSetting = ResponseCacheSetting{
+	Enabled:      false,
+	TTLSeconds:   3600,
+	MaxEntries:   10_000,
+	MaxBodyBytes: 1 << 20,
+	BillingRatio: 0.1,
+	Models:       []string{},
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("response_cache_setting", &responseCacheSetting)
+}
+
+func GetResponseCacheSetting() *ResponseCacheSetting {
+	return &responseCacheSetting
+}
+
+// IsResponseCacheModel 模型是否允许使用响应缓存
+func IsResponseCacheModel(modelName string) bool {
+	if !responseCacheSetting.Enabled {
+		return false
+	}
+	return len(responseCacheSetting.Models) == 0 || slices.Contains(responseCacheSetting.Models, modelName)
+}
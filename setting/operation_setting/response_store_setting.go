@@ -0,0 +1,27 @@
+package operation_setting
+
+import "github.com/QuantumNous/new-api/setting/config"
+
+// ResponseStoreSetting 响应存储配置：保存经对话接口转换的 /v1/responses 响应，
+// 供 previous_response_id 在本地展开为完整上下文，以及 GET/DELETE /v1/responses/:id 查询
+type ResponseStoreSetting struct {
+	Enabled      bool `json:"enabled"`
+	TTLSeconds   int  `json:"ttl_seconds"`
+	MaxBodyBytes int  `json:"max_body_bytes"` // 单轮记录（本轮输入、输出与响应）超过该大小时只保存元数据，引用时返回错误
+}
+
+// 默认配置
+var responseStoreSetting = ResponseStoreSetting{
+	Enabled:      false,
+	TTLSeconds:   30 * 24 * 3600,
+	MaxBodyBytes: 4 << 20,
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("response_store_setting", &responseStoreSetting)
+}
+
+func GetResponseStoreSetting() *ResponseStoreSetting {
+	return &responseStoreSetting
+}
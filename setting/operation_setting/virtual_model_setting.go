@@ -0,0 +1,61 @@
+package operation_setting
+
+import (
+	"sort"
+
+	"github.com/QuantumNous/new-api/setting/config"
+)
+
+// VirtualModelTarget 虚拟模型链中的一个真实模型
+type VirtualModelTarget struct {
+	Model string `json:"model"`
+	Group string `json:"group,omitempty"` // 使用的分组，为空时使用请求本身的分组
+}
+
+// VirtualModelSetting 虚拟模型设置，请求虚拟模型时依次尝试链中的真实模型，前一个模型的渠道全部失败后切换到下一个
+type VirtualModelSetting struct {
+	Enabled bool                            `json:"enabled"`
+	Models  map[string][]VirtualModelTarget `json:"models"` // 虚拟模型名称 -> 按顺序尝试的真实模型
+}
+
+// 默认配置
+var virtualModelSetting = VirtualModelSetting{
+	Enabled: false,
+	Models:  map[string][]VirtualModelTarget{},
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("virtual_model_setting", &virtualModelSetting)
+}
+
+func GetVirtualModelSetting() *VirtualModelSetting {
+	return &virtualModelSetting
+}
+
+// GetVirtualModelChain 获取虚拟模型对应的真实模型链，未启用或不是虚拟模型时返回 false
+func GetVirtualModelChain(name string) ([]VirtualModelTarget, bool) {
+	if !virtualModelSetting.Enabled {
+		return nil, false
+	}
+	chain, ok := virtualModelSetting.Models[name]
+	if !ok || len(chain) == 0 {
+		return nil, false
+	}
+	return chain, true
+}
+
+// GetVirtualModelNames 获取所有已配置的虚拟模型名称
+func GetVirtualModelNames() []string {
+	if !virtualModelSetting.Enabled {
+		return nil
+	}
+	names := make([]string, 0, len(virtualModelSetting.Models))
+	for name, chain := range virtualModelSetting.Models {
+		if len(chain) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
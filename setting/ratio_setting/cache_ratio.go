@@ -58,6 +58,10 @@ var defaultCacheRatio = map[string]float64{
 	"claude-sonnet-4-5-20250929-thinking": 0.1,
 	"claude-opus-4-5-20251101":            0.1,
 	"claude-opus-4-5-20251101-thinking":   0.1,
+	"gemini-2.5-pro":                      0.1,
+	"gemini-2.5-flash":                    0.1,
+	"gemini-2.5-flash-lite":               0.1,
+	"gemini-2.0-flash":                    0.25,
 }
 
 var defaultCreateCacheRatio = map[string]float64{
@@ -424,6 +424,11 @@ func GetModelPrice(name string, printErr bool) (float64, bool) {
 
 	price, ok := modelPriceMap[name]
 	if !ok {
+		if baseModel, isFineTuned := getFineTunedBaseModel(name); isFineTuned {
+			if basePrice, ok := modelPriceMap[FormatMatchingModelName(baseModel)]; ok {
+				return basePrice, true
+			}
+		}
 		if printErr {
 			common.SysError("model price not found: " + name)
 		}
@@ -465,6 +470,11 @@ func GetModelRatio(name string) (float64, bool, string) {
 			}
 			//return 0, true, name
 		}
+		if baseModel, isFineTuned := getFineTunedBaseModel(name); isFineTuned {
+			if baseRatio, ok := modelRatioMap[FormatMatchingModelName(baseModel)]; ok {
+				return baseRatio, true, name
+			}
+		}
 		return 37.5, operation_setting.SelfUseModeEnabled, name
 	}
 	return ratio, true, name
@@ -532,6 +542,13 @@ func GetCompletionRatio(name string) float64 {
 
 	name = FormatMatchingModelName(name)
 
+	if baseModel, isFineTuned := getFineTunedBaseModel(name); isFineTuned {
+		if ratio, ok := CompletionRatio[name]; ok {
+			return ratio
+		}
+		name = FormatMatchingModelName(baseModel)
+	}
+
 	if strings.Contains(name, "/") {
 		if ratio, ok := CompletionRatio[name]; ok {
 			return ratio
@@ -834,6 +851,19 @@ func GetCompletionRatioCopy() map[string]float64 {
 	return copyMap
 }
 
+// getFineTunedBaseModel 从 OpenAI 微调模型名中取出基础模型，未单独配置价格的微调模型按基础模型计费
+// ft:gpt-4o-mini-2024-07-18:org::abc123 -> gpt-4o-mini-2024-07-18
+func getFineTunedBaseModel(name string) (string, bool) {
+	if !strings.HasPrefix(name, "ft:") {
+		return "", false
+	}
+	parts := strings.Split(name, ":")
+	if len(parts) < 2 || parts[1] == "" {
+		return "", false
+	}
+	return parts[1], true
+}
+
 // 转换模型名，减少渠道必须配置各种带参数模型
 func FormatMatchingModelName(name string) string {
 
@@ -77,6 +77,7 @@ const (
 	ErrorCodeAwsInvokeError         ErrorCode = "aws_invoke_error"
 	ErrorCodeModelNotFound          ErrorCode = "model_not_found"
 	ErrorCodePromptBlocked          ErrorCode = "prompt_blocked"
+	ErrorCodeContextLengthExceeded  ErrorCode = "context_length_exceeded"
 
 	// sql error
 	ErrorCodeQueryDataError  ErrorCode = "query_data_error"
@@ -85,6 +86,12 @@ const (
 	// quota error
 	ErrorCodeInsufficientUserQuota      ErrorCode = "insufficient_user_quota"
 	ErrorCodePreConsumeTokenQuotaFailed ErrorCode = "pre_consume_token_quota_failed"
+	ErrorCodeBudgetExceeded             ErrorCode = "budget_exceeded"
+
+	// rate limit error
+	ErrorCodeRateLimitExceeded ErrorCode = "rate_limit_exceeded"
+	ErrorCodeRelayQueueFull    ErrorCode = "relay_queue_full"
+	ErrorCodeRelayQueueTimeout ErrorCode = "relay_queue_timeout"
 )
 
 type NewAPIError struct {
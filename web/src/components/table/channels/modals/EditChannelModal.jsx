@@ -170,6 +170,10 @@ const EditChannelModal = (props) => {
     allow_service_tier: false,
     disable_store: false, // false = 允许透传（默认开启）
     allow_safety_identifier: false,
+    // 仅 Claude / AWS / Vertex: 自动插入 cache_control 断点
+    claude_auto_cache_control: false,
+    // 本节点最大并发数，0 为不限制
+    max_concurrency: 0,
   };
   const [batch, setBatch] = useState(false);
   const [multiToSingle, setMultiToSingle] = useState(false);
@@ -633,6 +637,9 @@ const EditChannelModal = (props) => {
           data.disable_store = parsedSettings.disable_store || false;
           data.allow_safety_identifier =
             parsedSettings.allow_safety_identifier || false;
+          data.claude_auto_cache_control =
+            parsedSettings.claude_auto_cache_control || false;
+          data.max_concurrency = parsedSettings.max_concurrency || 0;
         } catch (error) {
           console.error('解析其他设置失败:', error);
           data.azure_responses_version = '';
@@ -643,6 +650,8 @@ const EditChannelModal = (props) => {
           data.allow_service_tier = false;
           data.disable_store = false;
           data.allow_safety_identifier = false;
+          data.claude_auto_cache_control = false;
+          data.max_concurrency = 0;
         }
       } else {
         // 兼容历史数据：老渠道没有 settings 时，默认按 json 展示
@@ -652,6 +661,8 @@ const EditChannelModal = (props) => {
         data.allow_service_tier = false;
         data.disable_store = false;
         data.allow_safety_identifier = false;
+        data.claude_auto_cache_control = false;
+        data.max_concurrency = 0;
       }
 
       if (
@@ -1396,6 +1407,19 @@ const EditChannelModal = (props) => {
       }
     }
 
+    // type === 14 (Claude)、33 (AWS)、41 (Vertex): 保存自动插入 cache_control 设置
+    if ([14, 33, 41].includes(localInputs.type)) {
+      settings.claude_auto_cache_control =
+        localInputs.claude_auto_cache_control === true;
+    }
+
+    // 所有渠道: 保存最大并发数，为 0 时不写入
+    if (localInputs.max_concurrency > 0) {
+      settings.max_concurrency = localInputs.max_concurrency;
+    } else {
+      delete settings.max_concurrency;
+    }
+
     localInputs.settings = JSON.stringify(settings);
 
     // 清理不需要发送到后端的字段
@@ -1414,6 +1438,8 @@ const EditChannelModal = (props) => {
     delete localInputs.allow_service_tier;
     delete localInputs.disable_store;
     delete localInputs.allow_safety_identifier;
+    delete localInputs.claude_auto_cache_control;
+    delete localInputs.max_concurrency;
 
     let res;
     localInputs.auto_ban = localInputs.auto_ban ? 1 : 0;
@@ -3003,6 +3029,21 @@ const EditChannelModal = (props) => {
                       </Col>
                     </Row>
 
+                    <Form.InputNumber
+                      field='max_concurrency'
+                      label={t('最大并发数')}
+                      placeholder={t('0 为不限制')}
+                      min={0}
+                      precision={0}
+                      onNumberChange={(value) =>
+                        handleInputChange('max_concurrency', value || 0)
+                      }
+                      extraText={t(
+                        '本节点同时转发到该渠道的最大请求数，达到上限后优先选择其他渠道，全部达到上限时按排队设置等待',
+                      )}
+                      style={{ width: '100%' }}
+                    />
+
                     <Form.Switch
                       field='auto_ban'
                       label={t('是否自动禁用')}
@@ -3250,6 +3291,31 @@ const EditChannelModal = (props) => {
                         />
                       </>
                     )}
+
+                    {/* 提示缓存 - Claude / AWS / Vertex 渠道 */}
+                    {[14, 33, 41].includes(inputs.type) && (
+                      <>
+                        <div className='mt-4 mb-2 text-sm font-medium text-gray-700'>
+                          {t('提示缓存')}
+                        </div>
+
+                        <Form.Switch
+                          field='claude_auto_cache_control'
+                          label={t('自动插入 cache_control')}
+                          checkedText={t('开')}
+                          uncheckedText={t('关')}
+                          onChange={(value) =>
+                            handleChannelOtherSettingsChange(
+                              'claude_auto_cache_control',
+                              value,
+                            )
+                          }
+                          extraText={t(
+                            'OpenAI 格式请求转换为 Claude 时，自动在工具定义、系统提示与最后一条用户消息上插入缓存断点，缓存的读写按缓存倍率计费',
+                          )}
+                        />
+                      </>
+                    )}
                   </Card>
                 </div>
 
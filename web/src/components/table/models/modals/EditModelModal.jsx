@@ -122,6 +122,8 @@ const EditModelModal = (props) => {
     vendor_icon: '',
     endpoints: '',
     name_rule: props.editingModel?.model_name ? 0 : undefined, // 通过未配置模型过来的固定为精确匹配
+    context_window: 0,
+    max_output_tokens: 0,
     status: true,
     sync_official: true,
   });
@@ -330,6 +332,25 @@ const EditModelModal = (props) => {
                     />
                   </Col>
 
+                  <Col span={12}>
+                    <Form.InputNumber
+                      field='context_window'
+                      label={t('上下文长度')}
+                      min={0}
+                      extraText={t('0 表示未知，配置后会跳过无法容纳请求的渠道')}
+                      style={{ width: '100%' }}
+                    />
+                  </Col>
+                  <Col span={12}>
+                    <Form.InputNumber
+                      field='max_output_tokens'
+                      label={t('最大输出 Token')}
+                      min={0}
+                      extraText={t('0 表示未知')}
+                      style={{ width: '100%' }}
+                    />
+                  </Col>
+
                   <Col span={24}>
                     <Form.Input
                       field='icon'
@@ -74,6 +74,14 @@ const EditTokenModal = (props) => {
     allow_ips: '',
     group: '',
     cross_group_retry: false,
+    hedging: false,
+    middle_out: false,
+    daily_budget: 0,
+    monthly_budget: 0,
+    budget_window: 'calendar',
+    rpm_limit: 0,
+    tpm_limit: 0,
+    concurrency_limit: 0,
     tokenCount: 1,
   });
 
@@ -388,6 +396,26 @@ const EditTokenModal = (props) => {
                       )}
                     />
                   </Col>
+                  <Col span={24}>
+                    <Form.Switch
+                      field='hedging'
+                      label={t('对冲请求')}
+                      size='default'
+                      extraText={t(
+                        '开启后，首个渠道响应过慢时会同时请求另一个渠道，使用先返回的结果，仅对先返回的请求计费',
+                      )}
+                    />
+                  </Col>
+                  <Col span={24}>
+                    <Form.Switch
+                      field='middle_out'
+                      label={t('Middle-out 截断')}
+                      size='default'
+                      extraText={t(
+                        '开启后，提示超出模型上下文长度时从中间删除历史消息，保留系统提示、第一轮与最后一轮对话',
+                      )}
+                    />
+                  </Col>
                   <Col xs={24} sm={24} md={24} lg={10} xl={10}>
                     <Form.DatePicker
                       field='expired_time'
@@ -516,6 +544,36 @@ const EditTokenModal = (props) => {
                       )}
                     />
                   </Col>
+                  <Col xs={24} sm={24} md={12} lg={12} xl={12}>
+                    <Form.InputNumber
+                      field='daily_budget'
+                      label={t('每日预算')}
+                      min={0}
+                      style={{ width: '100%' }}
+                      extraText={renderQuotaWithPrompt(values.daily_budget || 0)}
+                    />
+                  </Col>
+                  <Col xs={24} sm={24} md={12} lg={12} xl={12}>
+                    <Form.InputNumber
+                      field='monthly_budget'
+                      label={t('每月预算')}
+                      min={0}
+                      style={{ width: '100%' }}
+                      extraText={renderQuotaWithPrompt(values.monthly_budget || 0)}
+                    />
+                  </Col>
+                  <Col span={24}>
+                    <Form.Select
+                      field='budget_window'
+                      label={t('预算周期')}
+                      style={{ width: '100%' }}
+                      optionList={[
+                        { value: 'calendar', label: t('自然日 / 自然月') },
+                        { value: 'rolling', label: t('最近 24 小时 / 最近 30 天') },
+                      ]}
+                      extraText={t('预算为 0 表示不限制，超出预算后令牌在当前周期内无法继续使用')}
+                    />
+                  </Col>
                 </Row>
               </Card>
 
@@ -566,6 +624,35 @@ const EditTokenModal = (props) => {
                       style={{ width: '100%' }}
                     />
                   </Col>
+                  <Col xs={24} sm={24} md={8} lg={8} xl={8}>
+                    <Form.InputNumber
+                      field='rpm_limit'
+                      label={t('每分钟请求数')}
+                      min={0}
+                      style={{ width: '100%' }}
+                    />
+                  </Col>
+                  <Col xs={24} sm={24} md={8} lg={8} xl={8}>
+                    <Form.InputNumber
+                      field='tpm_limit'
+                      label={t('每分钟 Token 数')}
+                      min={0}
+                      style={{ width: '100%' }}
+                    />
+                  </Col>
+                  <Col xs={24} sm={24} md={8} lg={8} xl={8}>
+                    <Form.InputNumber
+                      field='concurrency_limit'
+                      label={t('最大并发数')}
+                      min={0}
+                      style={{ width: '100%' }}
+                    />
+                  </Col>
+                  <Col span={24}>
+                    <Text type='tertiary' size='small'>
+                      {t('速率限制为 0 表示不限制，每分钟 Token 数按请求的预估输入 Token 计算')}
+                    </Text>
+                  </Col>
                 </Row>
               </Card>
             </div>
@@ -79,6 +79,9 @@ const EditUserModal = (props) => {
     quota: 0,
     group: 'default',
     remark: '',
+    daily_budget: 0,
+    monthly_budget: 0,
+    budget_window: 'calendar',
   });
 
   const fetchGroups = async () => {
@@ -306,6 +309,39 @@ const EditUserModal = (props) => {
                           />
                         </Form.Slot>
                       </Col>
+
+                      <Col span={12}>
+                        <Form.InputNumber
+                          field='daily_budget'
+                          label={t('每日预算')}
+                          min={0}
+                          extraText={renderQuotaWithPrompt(values.daily_budget || 0)}
+                          style={{ width: '100%' }}
+                        />
+                      </Col>
+
+                      <Col span={12}>
+                        <Form.InputNumber
+                          field='monthly_budget'
+                          label={t('每月预算')}
+                          min={0}
+                          extraText={renderQuotaWithPrompt(values.monthly_budget || 0)}
+                          style={{ width: '100%' }}
+                        />
+                      </Col>
+
+                      <Col span={24}>
+                        <Form.Select
+                          field='budget_window'
+                          label={t('预算周期')}
+                          optionList={[
+                            { value: 'calendar', label: t('自然日 / 自然月') },
+                            { value: 'rolling', label: t('最近 24 小时 / 最近 30 天') },
+                          ]}
+                          extraText={t('预算为 0 表示不限制，超出预算后用户在当前周期内无法继续使用')}
+                          style={{ width: '100%' }}
+                        />
+                      </Col>
                     </Row>
                   </Card>
                 )}
@@ -419,6 +419,12 @@ export const useLogsData = () => {
             value: other.upstream_model_name,
           });
         }
+        if (other?.virtual_model) {
+          expandDataLocal.push({
+            key: t('虚拟模型'),
+            value: other.virtual_model,
+          });
+        }
 
         const isViolationFeeLog =
           other?.violation_fee === true ||
@@ -46,6 +46,11 @@ const CLAUDE_DEFAULT_MAX_TOKENS = {
   'claude-3-7-sonnet-20250219-thinking': 8192,
 };
 
+const CLAUDE_AUTO_CACHE_CONTROL_MODELS = [
+  'claude-sonnet-4-20250514',
+  'claude-opus-4-1-20250805',
+];
+
 export default function SettingClaudeModel(props) {
   const { t } = useTranslation();
 
@@ -55,6 +60,7 @@ export default function SettingClaudeModel(props) {
     'claude.thinking_adapter_enabled': true,
     'claude.default_max_tokens': '',
     'claude.thinking_adapter_budget_tokens_percentage': 0.8,
+    'claude.auto_cache_control_models': '[]',
   });
   const refForm = useRef();
   const [inputsRow, setInputsRow] = useState(inputs);
@@ -172,6 +178,37 @@ export default function SettingClaudeModel(props) {
                 />
               </Col>
             </Row>
+            <Row>
+              <Col xs={24} sm={12} md={8} lg={8} xl={8}>
+                <Form.TextArea
+                  label={t('自动插入 cache_control 的模型')}
+                  field={'claude.auto_cache_control_models'}
+                  placeholder={
+                    t('为一个 JSON 文本，例如：') +
+                    '\n' +
+                    JSON.stringify(CLAUDE_AUTO_CACHE_CONTROL_MODELS, null, 2)
+                  }
+                  extraText={t(
+                    'OpenAI 格式请求转换为 Claude 时，这些模型会自动插入缓存断点，也可以在渠道中按渠道开启',
+                  )}
+                  autosize={{ minRows: 6, maxRows: 12 }}
+                  trigger='blur'
+                  stopValidateWithError
+                  rules={[
+                    {
+                      validator: (rule, value) => verifyJSON(value),
+                      message: t('不是合法的 JSON 字符串'),
+                    },
+                  ]}
+                  onChange={(value) =>
+                    setInputs({
+                      ...inputs,
+                      'claude.auto_cache_control_models': value,
+                    })
+                  }
+                />
+              </Col>
+            </Row>
             <Row>
               <Col span={16}>
                 <Form.Switch
@@ -26,6 +26,7 @@ import {
   Divider,
   Form,
   Input,
+  InputNumber,
   Modal,
   Row,
   Select,
@@ -63,6 +64,7 @@ const KEY_SOURCE_TYPES = [
   { label: 'context_int', value: 'context_int' },
   { label: 'context_string', value: 'context_string' },
   { label: 'gjson', value: 'gjson' },
+  { label: 'prompt_prefix_hash', value: 'prompt_prefix_hash' },
 ];
 
 const RULE_TEMPLATES = {
@@ -153,9 +155,19 @@ const normalizeKeySource = (src) => {
   const type = (src?.type || '').trim();
   const key = (src?.key || '').trim();
   const path = (src?.path || '').trim();
+  if (type === 'prompt_prefix_hash') {
+    const prefixMessages = Math.max(0, Number(src?.prefix_messages || 0));
+    return { type, key, path, prefix_messages: prefixMessages };
+  }
   return { type, key, path };
 };
 
+const formatKeySourceDetail = (src) => {
+  if (src.type === 'gjson') return src.path;
+  if (src.type === 'prompt_prefix_hash') return src.prefix_messages;
+  return src.key;
+};
+
 const makeUniqueName = (existingNames, baseName) => {
   const base = (baseName || '').trim() || 'rule';
   if (!existingNames.has(base)) return base;
@@ -190,6 +202,7 @@ export default function SettingsChannelAffinity(props) {
     total: 0,
     unknown: 0,
     by_rule_name: {},
+    usage_by_rule: {},
     cache_capacity: 0,
     cache_algo: '',
   });
@@ -427,7 +440,7 @@ export default function SettingsChannelAffinity(props) {
         if (xs.length === 0) return '-';
         return xs.slice(0, 3).map((src, idx) => {
           const s = normalizeKeySource(src);
-          const detail = s.type === 'gjson' ? s.path : s.key;
+          const detail = formatKeySourceDetail(s);
           return (
             <Tag key={`${s.type}-${idx}`} style={{ marginRight: 4 }}>
               {s.type}:{detail}
@@ -452,6 +465,35 @@ export default function SettingsChannelAffinity(props) {
         return <Text>{n}</Text>;
       },
     },
+    {
+      title: t('提示缓存命中'),
+      render: (_, record) => {
+        const name = (record?.name || '').trim();
+        const usage = cacheStats?.usage_by_rule?.[name];
+        if (!name || !usage || !usage.requests) {
+          return <Text type='tertiary'>-</Text>;
+        }
+        const percent = (cached, prompt) =>
+          prompt > 0 ? `${((cached / prompt) * 100).toFixed(1)}%` : '-';
+        return (
+          <Text
+            title={t(
+              '亲和命中 {{hits}}/{{requests}} 次请求；亲和命中时缓存命中率 {{hitRate}}',
+              {
+                hits: usage.affinity_hits,
+                requests: usage.requests,
+                hitRate: percent(
+                  usage.hit_cache_tokens,
+                  usage.hit_prompt_tokens,
+                ),
+              },
+            )}
+          >
+            {percent(usage.cache_tokens, usage.prompt_tokens)}
+          </Text>
+        );
+      },
+    },
     {
       title: t('作用域'),
       render: (_, record) => {
@@ -507,6 +549,8 @@ export default function SettingsChannelAffinity(props) {
         if (!x.key) return { ok: false, message: 'Key 不能为空' };
       } else if (x.type === 'gjson') {
         if (!x.path) return { ok: false, message: 'Path 不能为空' };
+      } else if (x.type === 'prompt_prefix_hash') {
+        // 只使用系统提示与工具时 prefix_messages 可以为 0
       } else {
         return { ok: false, message: 'Key 来源类型不合法' };
       }
@@ -1054,6 +1098,9 @@ export default function SettingsChannelAffinity(props) {
           <Text type='tertiary' size='small'>
             {t(
               'context_int/context_string 从请求上下文读取；gjson 从入口请求的 JSON body 按 gjson path 读取。',
+            )}{' '}
+            {t(
+              'prompt_prefix_hash 对系统提示、工具与前 N 条消息取哈希，前缀相同的请求使用同一渠道与 Key，N 为 0 时只使用系统提示与工具。',
             )}
           </Text>
           <div style={{ marginTop: 8, marginBottom: 8 }}>
@@ -1092,6 +1139,22 @@ export default function SettingsChannelAffinity(props) {
                     editingRule?.key_sources?.[idx],
                   );
                   const isGjson = src.type === 'gjson';
+                  if (src.type === 'prompt_prefix_hash') {
+                    return (
+                      <InputNumber
+                        min={0}
+                        style={{ width: '100%' }}
+                        prefix={t('前 N 条消息')}
+                        aria-label={t('前 N 条消息')}
+                        value={src.prefix_messages}
+                        onChange={(value) =>
+                          updateKeySource(idx, {
+                            prefix_messages: Number(value || 0),
+                          })
+                        }
+                      />
+                    );
+                  }
                   return (
                     <Input
                       placeholder={
@@ -373,6 +373,23 @@ export default function SettingsPerformance(props) {
                   />
                 </Col>
               </Row>
+
+              {/* 渠道限流排队统计 */}
+              {stats.relay_queue_stats?.length > 0 && (
+                <Row gutter={16} style={{ marginTop: 16 }}>
+                  <Col span={24}>
+                    <div style={{ padding: 16, background: 'var(--semi-color-fill-0)', borderRadius: 8 }}>
+                      <Text strong style={{ marginBottom: 8, display: 'block' }}>{t('渠道限流排队')}</Text>
+                      <Descriptions
+                        data={stats.relay_queue_stats.map((queue) => ({
+                          key: `${queue.group} / ${queue.model}`,
+                          value: `${t('排队中')}: ${queue.depth} · ${t('累计排队')}: ${queue.total_queued} · ${t('等待超时')}: ${queue.total_timeouts} · ${t('平均等待')}: ${queue.avg_wait_ms.toFixed(0)} ms · ${t('最长等待')}: ${queue.max_wait_ms} ms`,
+                        }))}
+                      />
+                    </div>
+                  </Col>
+                </Row>
+              )}
             </>
           )}
         </Form.Section>